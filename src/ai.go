@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Language model providers `notes summarize` and `notes enrich` can send
+// blocks to.
+const (
+	// AIProviderOllama talks to Ollama's /api/chat, by default on
+	// localhost, so notes never leave the machine.
+	AIProviderOllama = "ollama"
+
+	// AIProviderOpenAI talks to /chat/completions of the OpenAI API or any
+	// server compatible with it (llama.cpp, vLLM, LM Studio, OpenRouter).
+	AIProviderOpenAI = "openai"
+)
+
+var aiProviders = map[string]func(*AIConfig) Provider{
+	AIProviderOllama: newOllamaProvider,
+	AIProviderOpenAI: newOpenAIProvider,
+}
+
+const (
+	defaultOllamaURL = "http://localhost:11434"
+	defaultOpenAIURL = "https://api.openai.com/v1"
+
+	// DefaultAIAPIKeyEnv is the environment variable an OpenAI-compatible
+	// provider reads its API key from unless configured otherwise.
+	DefaultAIAPIKeyEnv = "OPENAI_API_KEY"
+
+	defaultAITimeout = 2 * time.Minute
+
+	// DefaultAIMaxInputChars bounds how much block content is sent in one
+	// request, keeping it within the context window of small local models.
+	DefaultAIMaxInputChars = 24000
+)
+
+// AIConfig selects the language model, e.g.
+// {"provider": "ollama", "model": "llama3.1"}. URL defaults per provider and
+// APIKeyEnv names the environment variable holding the API key, so the key
+// isn't stored in the repository.
+type AIConfig struct {
+	Provider      string `json:"provider"`
+	Model         string `json:"model"`
+	URL           string `json:"url,omitempty"`
+	APIKeyEnv     string `json:"api_key_env,omitempty"`
+	Timeout       string `json:"timeout,omitempty"`
+	MaxInputChars int    `json:"max_input_chars,omitempty"`
+
+	// Audience is the visibility level of the blocks that may be sent,
+	// shared by default so #private blocks stay local.
+	Audience string `json:"audience,omitempty"`
+
+	// EnrichOnAdd asks the model for a title and tags for each untagged
+	// block `notes add` adds, for review with `notes enrich --list`.
+	EnrichOnAdd bool `json:"enrich_on_add,omitempty"`
+}
+
+func (c *AIConfig) validate() error {
+	if _, ok := aiProviders[c.Provider]; !ok {
+		return fmt.Errorf("provider: unknown provider %q (available: %s)", c.Provider, strings.Join(sortedKeys(aiProviders), ", "))
+	}
+	if c.Model == "" {
+		return fmt.Errorf("model: required")
+	}
+	if c.Timeout != "" {
+		if _, err := time.ParseDuration(c.Timeout); err != nil {
+			return fmt.Errorf("timeout: %w", err)
+		}
+	}
+	if c.MaxInputChars < 0 {
+		return fmt.Errorf("max_input_chars: must not be negative")
+	}
+	if c.Audience != "" && !isVisibilityLevel(c.Audience) {
+		return fmt.Errorf("audience: unknown level %q (available: %s)", c.Audience, strings.Join(visibilityLevels, ", "))
+	}
+	return nil
+}
+
+func (c *AIConfig) timeout() time.Duration {
+	if timeout, err := time.ParseDuration(c.Timeout); err == nil && c.Timeout != "" {
+		return timeout
+	}
+	return defaultAITimeout
+}
+
+func (c *AIConfig) maxInputChars() int {
+	if c.MaxInputChars == 0 {
+		return DefaultAIMaxInputChars
+	}
+	return c.MaxInputChars
+}
+
+func (c *AIConfig) audience() string {
+	if c.Audience == "" {
+		return VisibilityShared
+	}
+	return c.Audience
+}
+
+// Provider is a language model answering a chat of system instructions and
+// one user message.
+type Provider interface {
+	Complete(ctx context.Context, system, user string) (string, error)
+}
+
+// NewProvider returns the provider c selects.
+func NewProvider(c *AIConfig) (Provider, error) {
+	if c == nil {
+		return nil, fmt.Errorf("no language model configured; set \"ai\" in %s", filepath.Join(ConfigDirName, ConfigFileName))
+	}
+	return aiProviders[c.Provider](c), nil
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+func chatMessages(system, user string) []chatMessage {
+	return []chatMessage{{Role: "system", Content: system}, {Role: "user", Content: user}}
+}
+
+// postJSON sends request to url and decodes the JSON response into
+// response, reporting the body of error responses.
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, request, response any) error {
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(encoded))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("failed to parse response from %s: %w", url, err)
+	}
+	return nil
+}
+
+type ollamaProvider struct {
+	url    string
+	model  string
+	client *http.Client
+}
+
+func newOllamaProvider(c *AIConfig) Provider {
+	url := c.URL
+	if url == "" {
+		url = defaultOllamaURL
+	}
+	return &ollamaProvider{url: strings.TrimSuffix(url, "/"), model: c.Model, client: &http.Client{Timeout: c.timeout()}}
+}
+
+func (p *ollamaProvider) Complete(ctx context.Context, system, user string) (string, error) {
+	request := map[string]any{"model": p.model, "messages": chatMessages(system, user), "stream": false}
+	var response struct {
+		Message chatMessage `json:"message"`
+	}
+	if err := postJSON(ctx, p.client, p.url+"/api/chat", nil, request, &response); err != nil {
+		return "", err
+	}
+	return response.Message.Content, nil
+}
+
+type openAIProvider struct {
+	url    string
+	model  string
+	apiKey string
+	client *http.Client
+}
+
+func newOpenAIProvider(c *AIConfig) Provider {
+	url := c.URL
+	if url == "" {
+		url = defaultOpenAIURL
+	}
+	keyEnv := c.APIKeyEnv
+	if keyEnv == "" {
+		keyEnv = DefaultAIAPIKeyEnv
+	}
+	return &openAIProvider{
+		url:    strings.TrimSuffix(url, "/"),
+		model:  c.Model,
+		apiKey: os.Getenv(keyEnv),
+		client: &http.Client{Timeout: c.timeout()},
+	}
+}
+
+func (p *openAIProvider) Complete(ctx context.Context, system, user string) (string, error) {
+	// Local OpenAI-compatible servers usually don't want a key
+	headers := map[string]string{}
+	if p.apiKey != "" {
+		headers["Authorization"] = "Bearer " + p.apiKey
+	}
+	request := map[string]any{"model": p.model, "messages": chatMessages(system, user)}
+	var response struct {
+		Choices []struct {
+			Message chatMessage `json:"message"`
+		} `json:"choices"`
+	}
+	if err := postJSON(ctx, p.client, p.url+"/chat/completions", headers, request, &response); err != nil {
+		return "", err
+	}
+	if len(response.Choices) == 0 {
+		return "", fmt.Errorf("%s returned no choices", p.url)
+	}
+	return response.Choices[0].Message.Content, nil
+}
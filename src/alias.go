@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// aliasNamePattern matches the names aliases may be given.
+var aliasNamePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
+
+// expandAlias replaces an alias in os.Args[1] with the command it stands
+// for, followed by any further arguments. Built-in commands can't be
+// aliased, so they are never looked up.
+func expandAlias() {
+	command := os.Args[1]
+	if _, builtin := completionCommands[command]; builtin || command == "__complete" {
+		return
+	}
+	userConfig, err := LoadUserConfig()
+	if err != nil {
+		return // reported as an unknown command
+	}
+	if expansion, ok := userConfig.Aliases[command]; ok {
+		debugf("expanding alias %s to %s", command, formatAlias(expansion))
+		os.Args = append(append([]string{os.Args[0]}, expansion...), os.Args[2:]...)
+	}
+}
+
+// formatAlias joins an alias's words, quoting those that need it.
+func formatAlias(words []string) string {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		if word == "" || strings.ContainsAny(word, " \t\"'") {
+			word = strconv.Quote(word)
+		}
+		quoted[i] = word
+	}
+	return strings.Join(quoted, " ")
+}
+
+// saveUserAliases writes aliases to the user config, keeping its other
+// settings.
+func saveUserAliases(aliases map[string][]string) error {
+	configPath, err := userConfigPath()
+	if err != nil {
+		return err
+	}
+
+	settings := make(map[string]json.RawMessage)
+	content, err := os.ReadFile(configPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read user config %s: %w", configPath, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, &settings); err != nil {
+			return fmt.Errorf("failed to parse user config %s: %w", configPath, err)
+		}
+	}
+
+	delete(settings, "aliases")
+	if len(aliases) > 0 {
+		encoded, err := json.Marshal(aliases)
+		if err != nil {
+			return fmt.Errorf("failed to encode aliases: %w", err)
+		}
+		settings["aliases"] = encoded
+	}
+
+	encoded, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode user config: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(configPath), err)
+	}
+	if err := os.WriteFile(configPath, append(encoded, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write user config %s: %w", configPath, err)
+	}
+	return nil
+}
+
+func handleAlias() {
+	usage := func() {
+		fmt.Println("Usage: notes alias [list]")
+		fmt.Println("       notes alias add <name> <command> [args...]")
+		fmt.Println("       notes alias rm <name>")
+		os.Exit(1)
+	}
+
+	userConfig, err := LoadUserConfig()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	aliases := userConfig.Aliases
+	if aliases == nil {
+		aliases = make(map[string][]string)
+	}
+
+	// Arguments are taken as they are, since those of an alias being added
+	// are flags of its command rather than of this one
+	args := os.Args[2:]
+	subcommand := "list"
+	if len(args) > 0 {
+		subcommand, args = args[0], args[1:]
+	}
+
+	switch subcommand {
+	case "list":
+		if len(aliases) == 0 {
+			fmt.Println("No aliases defined. Add one with: notes alias add <name> <command> [args...]")
+			return
+		}
+		for _, name := range sortedKeys(aliases) {
+			fmt.Printf("%-12s %s\n", name, formatAlias(aliases[name]))
+		}
+
+	case "add":
+		if len(args) < 2 {
+			fmt.Println("Error: alias add requires a name and a command")
+			usage()
+		}
+		name, expansion := args[0], args[1:]
+		if !aliasNamePattern.MatchString(name) {
+			fmt.Printf("Error: %q is not a valid alias name (use letters, digits, - and _)\n", name)
+			os.Exit(1)
+		}
+		if _, builtin := completionCommands[name]; builtin {
+			fmt.Printf("Error: %s is a built-in command\n", name)
+			os.Exit(1)
+		}
+		if _, builtin := completionCommands[expansion[0]]; !builtin {
+			fmt.Printf("Error: an alias must start with a built-in command, not %q\n", expansion[0])
+			os.Exit(1)
+		}
+
+		previous, replaced := aliases[name]
+		aliases[name] = expansion
+		if err := saveUserAliases(aliases); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if replaced {
+			fmt.Printf("Replaced alias %s (was: %s)\n", name, formatAlias(previous))
+		}
+		fmt.Printf("notes %s now runs: notes %s\n", name, formatAlias(expansion))
+
+	case "rm":
+		if len(args) != 1 {
+			fmt.Println("Error: alias rm requires an alias name")
+			usage()
+		}
+		if _, ok := aliases[args[0]]; !ok {
+			fmt.Printf("Error: no alias named %s\n", args[0])
+			os.Exit(1)
+		}
+		delete(aliases, args[0])
+		if err := saveUserAliases(aliases); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Removed alias %s\n", args[0])
+
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// appendContent adds text to the end of content, or its start with top.
+func appendContent(content, text string, top bool) string {
+	if top {
+		return text + "\n" + content
+	}
+	return content + "\n" + text
+}
+
+func handleAppend() {
+	fs := flag.NewFlagSet("append", flag.ExitOnError)
+	top := fs.Bool("top", false, "prepend the text instead of appending it")
+	args := parseArgs(fs, os.Args[2:])
+
+	if len(args) == 0 {
+		fmt.Println("Error: append command requires a block ID or hash and text")
+		fmt.Println("Usage: notes append [--top] <id> \"text\"   (or text on stdin, or -)")
+		os.Exit(1)
+	}
+
+	block, err := db.LookupBlock(args[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	text := strings.Join(args[1:], " ")
+	if len(args) == 1 || text == "-" {
+		if text, err = readStdin(); err != nil {
+			log.Fatalf("Failed to read from stdin: %v", err)
+		}
+	}
+	text = normalizeWhitespace(text)
+	if text == "" {
+		fmt.Println("Error: text cannot be empty")
+		os.Exit(1)
+	}
+	// A blank line would split the block when its file is read back
+	if len(ParseBlocksFromMarkdown(text)) > 1 {
+		fmt.Println("Error: text contains blank lines, which would split the block")
+		os.Exit(1)
+	}
+
+	applyEdits([]BlockEdit{{Hash: block.ContentHash, Content: appendContent(block.Content, text, *top)}})
+	if *top {
+		fmt.Printf("Prepended to block %d\n", block.ID)
+	} else {
+		fmt.Printf("Appended to block %d\n", block.ID)
+	}
+}
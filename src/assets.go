@@ -0,0 +1,251 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// untrackedAsset is a file in the assets directory without an attachments
+// row, such as one copied there by hand.
+type untrackedAsset struct {
+	AssetPath string
+	Linked    bool // whether any block, or one that can be restored, links to it
+}
+
+// untrackedAssets returns the files in the assets directory that have no
+// attachments row, sorted by name.
+func untrackedAssets(db *Database, repoDir string) ([]untrackedAsset, error) {
+	entries, err := os.ReadDir(filepath.Join(repoDir, AssetsDirName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list assets: %w", err)
+	}
+
+	attachments, err := db.GetAttachments()
+	if err != nil {
+		return nil, err
+	}
+	tracked := make(map[string]bool)
+	for _, attachment := range attachments {
+		tracked[attachment.AssetPath] = true
+	}
+	blocks, err := db.GetAllBlocks()
+	if err != nil {
+		return nil, err
+	}
+	restorable, err := restorableContent(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var untracked []untrackedAsset
+	for _, entry := range entries {
+		assetPath := path.Join(AssetsDirName, entry.Name())
+		if !entry.IsDir() && !tracked[assetPath] {
+			linked := referenceCount(blocks, assetPath) > 0 || linksAsset(restorable, assetPath)
+			untracked = append(untracked, untrackedAsset{assetPath, linked})
+		}
+	}
+	return untracked, nil
+}
+
+// referencedAssets returns the names of the files in assetsDir that content
+// links to.
+func referencedAssets(assetsDir, content string) ([]string, error) {
+	entries, err := os.ReadDir(assetsDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list assets: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.Contains(content, AssetsDirName+"/"+entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func handleAssets() {
+	if len(os.Args) > 2 && os.Args[2] == "gc" {
+		handleAssetsGC()
+		return
+	}
+	if len(os.Args) > 2 {
+		fmt.Printf("Error: unknown assets subcommand %q\n", os.Args[2])
+		fmt.Println("Usage: notes assets [gc [--dry-run]]")
+		os.Exit(1)
+	}
+
+	attachments, err := db.GetAttachments()
+	if err != nil {
+		log.Fatalf("Failed to get attachments: %v", err)
+	}
+	blocks, err := db.GetAllBlocks()
+	if err != nil {
+		log.Fatalf("Failed to get blocks: %v", err)
+	}
+	untracked, err := untrackedAssets(db, config.basePath)
+	if err != nil {
+		log.Fatalf("Failed to list assets: %v", err)
+	}
+	if len(attachments) == 0 && len(untracked) == 0 {
+		fmt.Println("No attachments. Add one with: notes add --attach <file>")
+		return
+	}
+
+	var total int64
+	size := func(assetPath string) string {
+		info, err := os.Stat(filepath.Join(config.basePath, filepath.FromSlash(assetPath)))
+		if err != nil {
+			return "missing"
+		}
+		total += info.Size()
+		return formatBytes(info.Size())
+	}
+	// Counted afresh, since only `notes assets gc` updates ref_count
+	for _, attachment := range attachments {
+		fmt.Printf("%3d refs  %9s  %s\n", referenceCount(blocks, attachment.AssetPath), size(attachment.AssetPath), attachment.AssetPath)
+	}
+	for _, asset := range untracked {
+		note := "untracked"
+		if !asset.Linked {
+			note = "untracked, unreferenced"
+		}
+		fmt.Printf("%3s refs  %9s  %s (%s)\n", "-", size(asset.AssetPath), asset.AssetPath, note)
+	}
+	fmt.Printf("\n%d asset(s), %s\n", len(attachments)+len(untracked), formatBytes(total))
+}
+
+func handleAssetsGC() {
+	fs := flag.NewFlagSet("assets gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "list what would be removed without removing it")
+	parseArgs(fs, os.Args[3:])
+	if !*dryRun {
+		requireWritable("notes assets gc")
+	}
+
+	removed, err := CollectAttachments(db, config.basePath, *dryRun)
+	if err != nil {
+		log.Fatalf("Failed to collect attachments: %v", err)
+	}
+
+	// Files dropped into assets/ by hand are kept while a block links them,
+	// or one that can be restored
+	untracked, err := untrackedAssets(db, config.basePath)
+	if err != nil {
+		log.Fatalf("Failed to list assets: %v", err)
+	}
+	for _, asset := range untracked {
+		if asset.Linked {
+			continue
+		}
+		if !*dryRun {
+			if err := os.Remove(filepath.Join(config.basePath, filepath.FromSlash(asset.AssetPath))); err != nil {
+				log.Fatalf("Failed to remove asset %s: %v", asset.AssetPath, err)
+			}
+		}
+		removed = append(removed, asset.AssetPath)
+	}
+
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	for _, assetPath := range removed {
+		fmt.Printf("%s %s\n", verb, assetPath)
+	}
+	fmt.Printf("%s %d unreferenced asset(s)\n", verb, len(removed))
+}
+
+// ExportBundle writes notes.md as the audience of filter sees it and the
+// assets it links to into dir, so the bundle can be opened or copied
+// elsewhere without broken links. It returns the number of assets written.
+func ExportBundle(config *Config, filter *VisibilityFilter, dir string) (int, error) {
+	content, err := NewReconciler(db, NewFileManager(config.notesPath), config).ExportMarkdownFile(filter)
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate notes.md: %w", err)
+	}
+	names, err := referencedAssets(config.AssetsDir(), content)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, AssetsDirName), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create export directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, filepath.Base(config.notesPath)), []byte(content), 0644); err != nil {
+		return 0, fmt.Errorf("failed to write notes.md: %w", err)
+	}
+	for _, name := range names {
+		if err := copyFile(filepath.Join(config.AssetsDir(), name), filepath.Join(dir, AssetsDirName, name)); err != nil {
+			return 0, fmt.Errorf("failed to export asset %s: %w", name, err)
+		}
+	}
+	return len(names), nil
+}
+
+func handleExport() {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "markdown", "markdown, or roam-json for a Roam/Logseq import file")
+	audience := fs.String("audience", VisibilityShared, "only export blocks visible to this level: private (all), shared or public")
+	args := parseArgs(fs, os.Args[2:])
+	if len(args) > 1 {
+		fmt.Println("Error: export takes at most one directory or file")
+		fmt.Println("Usage: notes export [--audience shared] [dir] | notes export --format roam-json [--audience shared] [file]")
+		os.Exit(1)
+	}
+	if !isVisibilityLevel(*audience) {
+		fmt.Printf("Error: unknown audience %q (available: %s)\n", *audience, strings.Join(visibilityLevels, ", "))
+		os.Exit(1)
+	}
+	filter, err := LoadVisibilityFilter(db, config, *audience)
+	if err != nil {
+		log.Fatalf("Failed to load block visibility: %v", err)
+	}
+
+	switch *format {
+	case "markdown":
+	case ExportFormatRoamJSON:
+		var path string
+		if len(args) == 1 {
+			path = args[0]
+		}
+		exportRoamFile(path, filter)
+		return
+	default:
+		fmt.Printf("Error: unknown export format %q (available: markdown, %s)\n", *format, ExportFormatRoamJSON)
+		os.Exit(1)
+	}
+
+	// A read-only repository is exported without regenerating its files
+	if len(args) == 0 {
+		requireWritable("notes export without a directory")
+	}
+	if !readOnly {
+		skipRegeneration = false
+		if err := regenerateAllFiles(); err != nil {
+			log.Fatalf("Failed to regenerate files: %v", err)
+		}
+	}
+	if len(args) == 0 {
+		return
+	}
+
+	dir := expandHome(args[0])
+	count, err := ExportBundle(config, filter, dir)
+	if err != nil {
+		log.Fatalf("Failed to export: %v", err)
+	}
+	fmt.Printf("Exported notes.md and %d asset(s) to %s\n", count, dir)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// AssetsDirName is the directory next to notes.md that attachments are copied
+// into. Blocks link to assets relative to the repository, e.g.
+// "assets/1a2b3c4d5e6f-diagram.png".
+const AssetsDirName = "assets"
+
+var imageExtensions = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".svg": true, ".webp": true,
+}
+
+// Attachment is a file copied into the assets directory and linked from a
+// block.
+type Attachment struct {
+	AssetPath    string // relative to the repository, with forward slashes
+	OriginalName string
+	BlockHash    string // block the file was first attached to
+	RefCount     int    // blocks linking to the file when last counted
+}
+
+// ImportAttachment copies sourcePath into assetsDir under a content-addressed
+// name, so attaching the same file twice stores it once. Content already in
+// assetsDir under another name is reused rather than copied again.
+func ImportAttachment(assetsDir, sourcePath string) (*Attachment, error) {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open attachment: %w", err)
+	}
+	defer source.Close()
+	return storeAttachment(assetsDir, filepath.Base(sourcePath), source)
+}
+
+// storeAttachment copies source into assetsDir like ImportAttachment, for
+// content that isn't in a file of its own, such as an e-mail attachment.
+func storeAttachment(assetsDir, originalName string, source io.ReadSeeker) (*Attachment, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, source); err != nil {
+		return nil, fmt.Errorf("failed to hash attachment %s: %w", originalName, err)
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))[:12]
+	assetName := findAsset(assetsDir, hash)
+	if assetName == "" {
+		assetName = hash + "-" + originalName
+	}
+
+	if err := os.MkdirAll(assetsDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create assets directory: %w", err)
+	}
+
+	destinationPath := filepath.Join(assetsDir, assetName)
+	if !fileExists(destinationPath) {
+		if _, err := source.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to read attachment %s: %w", originalName, err)
+		}
+		destination, err := os.Create(destinationPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create asset: %w", err)
+		}
+		if _, err := io.Copy(destination, source); err != nil {
+			destination.Close()
+			os.Remove(destinationPath)
+			return nil, fmt.Errorf("failed to copy attachment %s: %w", originalName, err)
+		}
+		if err := destination.Close(); err != nil {
+			return nil, fmt.Errorf("failed to write asset: %w", err)
+		}
+	}
+
+	return &Attachment{
+		AssetPath:    path.Join(AssetsDirName, assetName),
+		OriginalName: originalName,
+	}, nil
+}
+
+// findAsset returns the name of the file in assetsDir holding the content
+// with hash, or "" if there is none.
+func findAsset(assetsDir, hash string) string {
+	entries, err := os.ReadDir(assetsDir)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), hash+"-") {
+			return entry.Name()
+		}
+	}
+	return ""
+}
+
+// MarkdownLink renders the attachment as an image link for images and a
+// plain link otherwise.
+func (a *Attachment) MarkdownLink() string {
+	link := fmt.Sprintf("[%s](%s)", a.OriginalName, a.AssetPath)
+	if imageExtensions[strings.ToLower(filepath.Ext(a.OriginalName))] {
+		return "!" + link
+	}
+	return link
+}
+
+// assetLinkPrefix returns what "assets/" links must become in a file written
+// to fileDir so they still resolve, e.g. "../notes/assets/".
+func assetLinkPrefix(repoDir, fileDir string) string {
+	relative, err := filepath.Rel(fileDir, repoDir)
+	if err != nil || relative == "." {
+		return AssetsDirName + "/"
+	}
+	return filepath.ToSlash(relative) + "/" + AssetsDirName + "/"
+}
+
+// relinkAssets rewrites asset links in content from one prefix to another.
+func relinkAssets(content, from, to string) string {
+	if from == to {
+		return content
+	}
+	return strings.ReplaceAll(content, "]("+from, "]("+to)
+}
+
+// CollectAttachments recounts the blocks linking to each attachment and
+// deletes the attachments nothing links to any more, removing the asset file
+// and its attachments row. Attachments of blocks that `notes undo` or
+// `notes deleted --restore` can bring back are kept. With dryRun nothing is
+// changed. It returns the asset paths of the unreferenced attachments.
+func CollectAttachments(db *Database, repoDir string, dryRun bool) ([]string, error) {
+	attachments, err := db.GetAttachments()
+	if err != nil || len(attachments) == 0 {
+		return nil, err
+	}
+
+	blocks, err := db.GetAllBlocks()
+	if err != nil {
+		return nil, err
+	}
+	restorable, err := restorableContent(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, attachment := range attachments {
+		count := referenceCount(blocks, attachment.AssetPath)
+		if count > 0 {
+			if count != attachment.RefCount && !dryRun {
+				if err := db.SetAttachmentRefCount(attachment.AssetPath, count); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if linksAsset(restorable, attachment.AssetPath) {
+			continue
+		}
+
+		removed = append(removed, attachment.AssetPath)
+		if dryRun {
+			continue
+		}
+		assetPath := filepath.Join(repoDir, filepath.FromSlash(attachment.AssetPath))
+		if err := os.Remove(assetPath); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove asset %s: %w", assetPath, err)
+		}
+		if err := db.DeleteAttachment(attachment.AssetPath); err != nil {
+			return nil, err
+		}
+		infof("Removed unreferenced attachment %s", attachment.AssetPath)
+	}
+	return removed, nil
+}
+
+// restorableContent returns the content of the blocks `notes undo` and
+// `notes deleted --restore` can bring back: those deleted or replaced by
+// operations not yet undone, and those in the trash.
+func restorableContent(db *Database) ([]string, error) {
+	operations, err := db.GetUndoableOperations()
+	if err != nil {
+		return nil, err
+	}
+	var contents []string
+	for _, operation := range operations {
+		for _, block := range append(operation.Changes.Deleted, operation.Changes.Previous...) {
+			contents = append(contents, block.Content)
+		}
+	}
+
+	trashed, err := db.GetTrash(0, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range trashed {
+		contents = append(contents, block.Content)
+	}
+	return contents, nil
+}
+
+// referenceCount returns how many blocks link to assetPath.
+func referenceCount(blocks []*Block, assetPath string) int {
+	count := 0
+	for _, block := range blocks {
+		if strings.Contains(block.Content, assetPath) {
+			count++
+		}
+	}
+	return count
+}
+
+// linksAsset reports whether any of contents links to assetPath.
+func linksAsset(contents []string, assetPath string) bool {
+	for _, content := range contents {
+		if strings.Contains(content, assetPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyFile copies source to destination, replacing it if it exists.
+func copyFile(source, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(destination)
+		return err
+	}
+	return out.Close()
+}
+
+// linkOrCopy hard-links source to destination, falling back to a copy
+// across file systems. Assets are never modified in place, so sharing them
+// is safe.
+func linkOrCopy(source, destination string) error {
+	if err := os.Link(source, destination); err == nil {
+		return nil
+	}
+	return copyFile(source, destination)
+}
+
+// attachFiles imports each path into the repository's assets directory and
+// returns content with a link to each appended.
+func attachFiles(content string, paths []string) (string, []*Attachment, error) {
+	var attachments []*Attachment
+	for _, sourcePath := range paths {
+		attachment, err := ImportAttachment(config.AssetsDir(), sourcePath)
+		if err != nil {
+			return "", nil, err
+		}
+		attachments = append(attachments, attachment)
+		content = strings.TrimRight(content, "\n") + "\n" + attachment.MarkdownLink()
+	}
+	return strings.TrimLeft(content, "\n"), attachments, nil
+}
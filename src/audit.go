@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+// AuditLogName is the append-only log of mutations kept next to notes.db.
+const AuditLogName = "audit.jsonl"
+
+// Audit sources: which kind of process made a change.
+const (
+	AuditSourceCLI    = "cli"
+	AuditSourceDaemon = "daemon"
+	AuditSourceAPI    = "api"
+)
+
+// AuditEntry is one line of the audit log: a change to one block.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Source   string    `json:"source"`
+	User     string    `json:"user"`
+	PID      int       `json:"pid"`
+	Op       string    `json:"op"`     // operation kind: add, reconcile, undo, sync, meta, ...
+	Action   string    `json:"action"` // what happened to the block: created, updated, deleted, set, unset
+	Hash     string    `json:"hash"`
+	Previous string    `json:"previous,omitempty"` // the hash of an updated block before the change
+	Title    string    `json:"title,omitempty"`    // left out in encrypted repositories
+	File     string    `json:"file,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// AuditLog appends entries to the audit log. Failing to write it doesn't
+// fail the change, so errors are only logged. A nil *AuditLog records
+// nothing.
+type AuditLog struct {
+	path   string
+	user   string
+	source string
+
+	mu sync.Mutex
+}
+
+func NewAuditLog(path string) *AuditLog {
+	name := os.Getenv("USER")
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	return &AuditLog{path: path, user: name, source: AuditSourceCLI}
+}
+
+// SetSource sets the source of the entries written from now on.
+func (a *AuditLog) SetSource(source string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.source = source
+}
+
+// Append writes entries, stamping them with the time, source, user and
+// process. They are written with a single append so lines of concurrent
+// processes don't interleave.
+func (a *AuditLog) Append(entries []AuditEntry) {
+	if a == nil || len(entries) == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	var lines []byte
+	for _, entry := range entries {
+		entry.Time, entry.Source, entry.User, entry.PID = now, a.source, a.user, os.Getpid()
+		line, err := json.Marshal(entry)
+		if err != nil {
+			log.Printf("Warning: failed to encode audit entry: %v", err)
+			return
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("Warning: failed to open audit log: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(lines); err != nil {
+		log.Printf("Warning: failed to write audit log: %v", err)
+	}
+}
+
+// changeSetEntries returns an entry for each block changes added, updated or
+// deleted. Titles are only included when withTitles is set.
+func changeSetEntries(op string, changes *ChangeSet, withTitles bool) []AuditEntry {
+	var entries []AuditEntry
+	entry := func(action string, block *Block, previous string) {
+		audit := AuditEntry{Op: op, Action: action, Hash: block.ContentHash, Previous: previous, File: changes.File}
+		if withTitles {
+			audit.Title = block.Title()
+		}
+		entries = append(entries, audit)
+	}
+
+	for _, block := range changes.Added {
+		entry(EventCreated, block, "")
+	}
+	for i, block := range changes.Updated {
+		previous := ""
+		if i < len(changes.Previous) && changes.Previous[i].ContentHash != block.ContentHash {
+			previous = changes.Previous[i].ContentHash
+		}
+		entry(EventUpdated, block, previous)
+	}
+	for _, block := range changes.Deleted {
+		entry(EventDeleted, block, "")
+	}
+	return entries
+}
+
+// metaEntry returns the entry for setting key to value on a block, or
+// removing it if value is empty. Values aren't logged.
+func metaEntry(op, hash, key, value string) AuditEntry {
+	if value == "" {
+		return AuditEntry{Op: op, Action: "unset", Hash: hash, Detail: key}
+	}
+	return AuditEntry{Op: op, Action: "set", Hash: hash, Detail: key}
+}
+
+// readAuditTail returns the last n entries of the audit log at path, oldest
+// first, and the offset reading stopped at.
+func readAuditTail(path string, n int) ([]AuditEntry, int64, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	entries, err := readAuditEntries(file, n)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset, err := file.Seek(0, io.SeekCurrent)
+	return entries, offset, err
+}
+
+// readAuditEntries reads entries from r, keeping the last n, or all of them
+// if n is 0. Lines that aren't entries, such as one still being written,
+// are skipped.
+func readAuditEntries(r io.Reader, n int) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+		if n > 0 && len(entries) > n {
+			entries = entries[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return entries, nil
+}
+
+func printAuditEntry(entry AuditEntry, jsonOutput bool) {
+	if jsonOutput {
+		line, _ := json.Marshal(entry)
+		fmt.Println(string(line))
+		return
+	}
+	line := fmt.Sprintf("%s  %-6s %-10s %-9s %-8s %.12s", output.Style("timestamp", entry.Time.Local().Format("2006-01-02 15:04:05")),
+		entry.Source, entry.Op, entry.Action, entry.User, entry.Hash)
+	if entry.Previous != "" {
+		line += fmt.Sprintf(" (was %.12s)", entry.Previous)
+	}
+	if entry.Title != "" {
+		line += "  " + entry.Title
+	}
+	if entry.Detail != "" {
+		line += "  " + entry.Detail
+	}
+	if entry.File != "" {
+		line += "  [" + entry.File + "]"
+	}
+	fmt.Println(line)
+}
+
+func handleAudit() {
+	if len(os.Args) < 3 || os.Args[2] != "tail" {
+		fmt.Println("Usage: notes audit tail [-n 20] [-f] [--json]")
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("audit tail", flag.ExitOnError)
+	count := fs.Int("n", 20, "number of entries to show (0 for all)")
+	follow := fs.Bool("f", false, "keep printing entries as they are written")
+	jsonOutput := fs.Bool("json", false, "print entries as JSON lines")
+	parseArgs(fs, os.Args[3:])
+
+	path := db.audit.path
+	entries, offset, err := readAuditTail(path, *count)
+	if err != nil {
+		log.Fatalf("Failed to read audit log: %v", err)
+	}
+	if len(entries) == 0 && !*follow {
+		fmt.Printf("No changes recorded in %s yet\n", path)
+		return
+	}
+	for _, entry := range entries {
+		printAuditEntry(entry, *jsonOutput)
+	}
+	if !*follow {
+		return
+	}
+
+	for {
+		time.Sleep(time.Second)
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Fatalf("Failed to read audit log: %v", err)
+		}
+		info, err := file.Stat()
+		if err == nil && info.Size() < offset {
+			offset = 0 // replaced by a new log
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			log.Fatalf("Failed to read audit log: %v", err)
+		}
+		// Only complete lines are read; a partial one is picked up next time
+		content, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			log.Fatalf("Failed to read audit log: %v", err)
+		}
+		complete := len(content)
+		for complete > 0 && content[complete-1] != '\n' {
+			complete--
+		}
+		offset += int64(complete)
+		newEntries, err := readAuditEntries(bytes.NewReader(content[:complete]), 0)
+		if err != nil {
+			log.Fatalf("Failed to read audit log: %v", err)
+		}
+		for _, entry := range newEntries {
+			printAuditEntry(entry, *jsonOutput)
+		}
+	}
+}
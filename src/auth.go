@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	apiTokenPrefix = "notes_"
+
+	// selfSignedValidity is how long an automatically generated server
+	// certificate is valid; a new one is made when it expires.
+	selfSignedValidity = 2 * 365 * 24 * time.Hour
+)
+
+// APIToken is a named token that clients of `notes serve` authenticate
+// with. Only a hash of the secret is stored.
+type APIToken struct {
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt time.Time // zero if never used
+}
+
+// generateAPIToken returns a new random token secret.
+func generateAPIToken() (string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return apiTokenPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticator checks the bearer tokens of requests to `notes serve`: the
+// token given with --token or NOTES_TOKEN, if any, and the tokens created
+// with `notes token create`.
+type Authenticator struct {
+	token string
+	db    *Database
+}
+
+// Allows reports whether token may use the server.
+func (a *Authenticator) Allows(token string) bool {
+	if token == "" {
+		return false
+	}
+	if a.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1 {
+		return true
+	}
+	// Only tokens with the prefix can be stored ones, which saves a write
+	if a.db == nil || !strings.HasPrefix(token, apiTokenPrefix) {
+		return false
+	}
+	ok, err := a.db.UseAPIToken(hashAPIToken(token))
+	if err != nil {
+		log.Printf("Failed to check token: %v", err)
+	}
+	return ok
+}
+
+// Request reports whether r carries an allowed bearer token.
+func (a *Authenticator) Request(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && a.Allows(token)
+}
+
+// rateLimiter allows each client address a burst of requests that refills
+// at a steady rate, answering the rest with 429 Too Many Requests.
+type rateLimiter struct {
+	perMinute int
+	next      http.Handler
+
+	mu      sync.Mutex
+	clients map[string]*rateBucket
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute int, next http.Handler) *rateLimiter {
+	return &rateLimiter{perMinute: perMinute, next: next, clients: make(map[string]*rateBucket)}
+}
+
+func (l *rateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	if !l.allow(client, time.Now()) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	l.next.ServeHTTP(w, r)
+}
+
+func (l *rateLimiter) allow(client string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	capacity := float64(l.perMinute)
+	bucket, ok := l.clients[client]
+	if !ok {
+		// Forget clients whose buckets have refilled, so the map stays small
+		for address, other := range l.clients {
+			if now.Sub(other.last) > time.Minute {
+				delete(l.clients, address)
+			}
+		}
+		bucket = &rateBucket{tokens: capacity, last: now}
+		l.clients[client] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Minutes() * capacity
+	if bucket.tokens > capacity {
+		bucket.tokens = capacity
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// selfSignedCertificate returns the certificate and key files in dir,
+// generating a self-signed certificate for the host of addr and localhost
+// if there is none or it has expired.
+func selfSignedCertificate(dir, addr string) (string, string, error) {
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if pair, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if cert, err := x509.ParseCertificate(pair.Certificate[0]); err == nil && time.Now().Before(cert.NotAfter) {
+			return certFile, keyFile, nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "notes serve"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip == nil {
+			template.DNSNames = append(template.DNSNames, host)
+		} else if !ip.IsUnspecified() {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		}
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encode key: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return "", "", fmt.Errorf("failed to write key: %w", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return "", "", fmt.Errorf("failed to write certificate: %w", err)
+	}
+	return certFile, keyFile, nil
+}
+
+// certificateFingerprint returns the SHA-256 fingerprint of the first
+// certificate in certFile, which clients pin with NOTES_TLS_FINGERPRINT.
+func certificateFingerprint(certFile, keyFile string) (string, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to load certificate: %w", err)
+	}
+	sum := sha256.Sum256(pair.Certificate[0])
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// pinnedTLSConfig trusts exactly the server certificate with fingerprint,
+// for servers with self-signed certificates.
+func pinnedTLSConfig(fingerprint string) *tls.Config {
+	want := strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+	return &tls.Config{
+		// The chain can't be verified; the pinned fingerprint replaces it
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("server sent no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if hex.EncodeToString(sum[:]) != want {
+				return fmt.Errorf("server certificate doesn't match NOTES_TLS_FINGERPRINT")
+			}
+			return nil
+		},
+	}
+}
+
+func handleToken() {
+	if len(os.Args) < 3 {
+		printTokenUsage()
+	}
+
+	if os.Args[2] == "create" || os.Args[2] == "revoke" {
+		requireWritable("notes token " + os.Args[2])
+	}
+
+	switch os.Args[2] {
+	case "create":
+		if len(os.Args) != 4 || strings.TrimSpace(os.Args[3]) == "" {
+			printTokenUsage()
+		}
+		token, err := generateAPIToken()
+		if err != nil {
+			log.Fatalf("Failed to create token: %v", err)
+		}
+		if err := db.CreateAPIToken(os.Args[3], hashAPIToken(token)); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(token)
+		fmt.Fprintln(os.Stderr, "Store it now: it can't be shown again. Clients send it as NOTES_TOKEN.")
+
+	case "list":
+		tokens, err := db.GetAPITokens()
+		if err != nil {
+			log.Fatalf("Failed to get tokens: %v", err)
+		}
+		if len(tokens) == 0 {
+			fmt.Println("No tokens. Create one with: notes token create <name>")
+			return
+		}
+		now := time.Now()
+		for _, token := range tokens {
+			used := "never used"
+			if !token.LastUsedAt.IsZero() {
+				used = "used " + output.Time(token.LastUsedAt, now)
+			}
+			fmt.Printf("%-20s  created %s, %s\n", token.Name, output.Time(token.CreatedAt, now), used)
+		}
+
+	case "revoke":
+		if len(os.Args) != 4 {
+			printTokenUsage()
+		}
+		revoked, err := db.RevokeAPIToken(os.Args[3])
+		if err != nil {
+			log.Fatalf("Failed to revoke token: %v", err)
+		}
+		if !revoked {
+			fmt.Printf("Error: no token named %q\n", os.Args[3])
+			os.Exit(1)
+		}
+		fmt.Printf("Revoked token %q\n", os.Args[3])
+
+	default:
+		printTokenUsage()
+	}
+}
+
+func printTokenUsage() {
+	fmt.Println("Usage: notes token create <name> | list | revoke <name>")
+	os.Exit(1)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultBackupKeep is how many snapshots `notes backup` keeps.
+	DefaultBackupKeep = 10
+
+	backupManifestName = "manifest.json"
+	backupDBName       = "notes.db"
+	backupFilesDir     = "files"
+	backupAssetsDir    = "assets"
+	backupTimeLayout   = "20060102-150405.000"
+
+	// LastBackupTimeKey records when the watcher daemon last took a backup.
+	LastBackupTimeKey = "last_backup_time"
+)
+
+// BackupManifest records what a snapshot holds, so it can be restored
+// without knowing the repository it came from.
+type BackupManifest struct {
+	CreatedAt time.Time    `json:"created_at"`
+	Files     []BackupFile `json:"files"`
+	AssetsDir string       `json:"assets_dir,omitempty"`
+	Assets    []string     `json:"assets,omitempty"` // names saved under assets/
+}
+
+// BackupFile is a markdown file saved in a snapshot under files/Name.
+type BackupFile struct {
+	Path string `json:"path"`
+	Name string `json:"name"`
+}
+
+// CreateBackup writes a snapshot of the database, the markdown files and the
+// attachments in assetsDir to a new timestamped directory under dir and
+// returns its path. Attachments are hard-linked where possible, since they
+// never change.
+func CreateBackup(db *Database, dir string, markdownFiles []string, assetsDir string, now time.Time) (string, error) {
+	snapshot := filepath.Join(dir, now.Format(backupTimeLayout))
+	for n := 2; fileExists(snapshot); n++ {
+		snapshot = filepath.Join(dir, fmt.Sprintf("%s-%d", now.Format(backupTimeLayout), n))
+	}
+	if err := os.MkdirAll(filepath.Join(snapshot, backupFilesDir), 0755); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	if err := db.BackupTo(filepath.Join(snapshot, backupDBName)); err != nil {
+		os.RemoveAll(snapshot)
+		return "", err
+	}
+
+	manifest := BackupManifest{CreatedAt: now, Files: []BackupFile{}}
+	for i, path := range markdownFiles {
+		content, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			os.RemoveAll(snapshot)
+			return "", fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		// Watched files may share a base name, so number them
+		name := fmt.Sprintf("%03d-%s", i, filepath.Base(path))
+		if err := os.WriteFile(filepath.Join(snapshot, backupFilesDir, name), content, 0644); err != nil {
+			os.RemoveAll(snapshot)
+			return "", fmt.Errorf("failed to save %s: %w", path, err)
+		}
+		manifest.Files = append(manifest.Files, BackupFile{Path: path, Name: name})
+	}
+
+	assets, err := os.ReadDir(assetsDir)
+	if err != nil && !os.IsNotExist(err) {
+		os.RemoveAll(snapshot)
+		return "", fmt.Errorf("failed to list assets: %w", err)
+	}
+	if len(assets) > 0 {
+		manifest.AssetsDir = assetsDir
+		if err := os.MkdirAll(filepath.Join(snapshot, backupAssetsDir), 0755); err != nil {
+			os.RemoveAll(snapshot)
+			return "", fmt.Errorf("failed to create backup directory: %w", err)
+		}
+	}
+	for _, asset := range assets {
+		if asset.IsDir() {
+			continue
+		}
+		if err := linkOrCopy(filepath.Join(assetsDir, asset.Name()), filepath.Join(snapshot, backupAssetsDir, asset.Name())); err != nil {
+			os.RemoveAll(snapshot)
+			return "", fmt.Errorf("failed to save asset %s: %w", asset.Name(), err)
+		}
+		manifest.Assets = append(manifest.Assets, asset.Name())
+	}
+
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		os.RemoveAll(snapshot)
+		return "", fmt.Errorf("failed to encode backup manifest: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(snapshot, backupManifestName), encoded, 0644); err != nil {
+		os.RemoveAll(snapshot)
+		return "", fmt.Errorf("failed to write backup manifest: %w", err)
+	}
+	return snapshot, nil
+}
+
+// ListBackups returns the snapshots in dir, oldest first.
+func ListBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	var snapshots []string
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() && fileExists(filepath.Join(path, backupManifestName)) {
+			snapshots = append(snapshots, path)
+		}
+	}
+	// Timestamped names sort chronologically
+	sort.Strings(snapshots)
+	return snapshots, nil
+}
+
+// RotateBackups removes all but the newest keep snapshots in dir and
+// returns the removed ones.
+func RotateBackups(dir string, keep int) ([]string, error) {
+	snapshots, err := ListBackups(dir)
+	if err != nil || len(snapshots) <= keep {
+		return nil, err
+	}
+
+	removed := snapshots[:len(snapshots)-keep]
+	for _, snapshot := range removed {
+		if err := os.RemoveAll(snapshot); err != nil {
+			return nil, fmt.Errorf("failed to remove old backup %s: %w", snapshot, err)
+		}
+	}
+	return removed, nil
+}
+
+// readBackupManifest checks that snapshot is a complete backup and returns
+// its manifest.
+func readBackupManifest(snapshot string) (*BackupManifest, error) {
+	content, err := os.ReadFile(filepath.Join(snapshot, backupManifestName))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a notes backup: %w", snapshot, err)
+	}
+	var manifest BackupManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse backup manifest: %w", err)
+	}
+	if !fileExists(filepath.Join(snapshot, backupDBName)) {
+		return nil, fmt.Errorf("%s has no database", snapshot)
+	}
+	return &manifest, nil
+}
+
+// backedUpFiles lists the markdown files a backup saves: notes.md and
+// every watched file.
+func backedUpFiles(db *Database, config *Config) ([]string, error) {
+	watchedFiles, err := db.GetWatchedFiles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get watched files: %w", err)
+	}
+	return append([]string{config.notesPath}, watchedFiles...), nil
+}
+
+// AutoBackup takes a snapshot in the configured backup directory and
+// rotates it, as the watcher daemon does on schedule and before large
+// deletions.
+func AutoBackup(db *Database, config *Config, now time.Time, reason string) error {
+	files, err := backedUpFiles(db, config)
+	if err != nil {
+		return err
+	}
+	snapshot, err := CreateBackup(db, config.BackupDir(), files, config.AssetsDir(), now)
+	if err != nil {
+		return err
+	}
+	infof("Backed up to %s (%s)", snapshot, reason)
+
+	if _, err := RotateBackups(config.BackupDir(), config.BackupKeep()); err != nil {
+		return err
+	}
+	return db.SetMetadata(LastBackupTimeKey, now.Format(time.RFC3339))
+}
+
+// backupIfDue takes a scheduled backup when the configured interval has
+// passed since the last one.
+func backupIfDue(now time.Time) error {
+	every := config.BackupSchedule()
+	if every == 0 {
+		return nil
+	}
+
+	last, err := db.GetMetadata(LastBackupTimeKey)
+	if err != nil {
+		return err
+	}
+	if lastTime, err := time.Parse(time.RFC3339, last); err == nil && now.Sub(lastTime) < every {
+		return nil
+	}
+	return AutoBackup(db, config, now, "scheduled")
+}
+
+func handleBackup() {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	dir := fs.String("to", config.BackupDir(), "directory to write the snapshot to")
+	keep := fs.Int("keep", config.BackupKeep(), "number of snapshots to keep in the directory; 0 keeps all")
+	list := fs.Bool("list", false, "list existing snapshots instead of taking one")
+	parseArgs(fs, os.Args[2:])
+
+	backupDir := expandHome(*dir)
+	if *list {
+		snapshots, err := ListBackups(backupDir)
+		if err != nil {
+			log.Fatalf("Failed to list backups: %v", err)
+		}
+		if len(snapshots) == 0 {
+			fmt.Printf("No backups in %s\n", backupDir)
+		}
+		for _, snapshot := range snapshots {
+			fmt.Println(snapshot)
+		}
+		return
+	}
+
+	files, err := backedUpFiles(db, config)
+	if err != nil {
+		log.Fatalf("Failed to back up: %v", err)
+	}
+	snapshot, err := CreateBackup(db, backupDir, files, config.AssetsDir(), time.Now())
+	if err != nil {
+		log.Fatalf("Failed to back up: %v", err)
+	}
+	fmt.Printf("Backed up to %s\n", snapshot)
+
+	if *keep > 0 {
+		removed, err := RotateBackups(backupDir, *keep)
+		if err != nil {
+			log.Fatalf("Failed to rotate backups: %v", err)
+		}
+		if len(removed) > 0 {
+			fmt.Printf("Removed %d old backup(s)\n", len(removed))
+		}
+	}
+}
+
+func handleRestoreBackup() {
+	fs := flag.NewFlagSet("restore-backup", flag.ExitOnError)
+	args := parseArgs(fs, os.Args[2:])
+
+	if len(args) != 1 {
+		fmt.Println("Error: restore-backup command requires a snapshot")
+		fmt.Println("Usage: notes restore-backup <snapshot>")
+		os.Exit(1)
+	}
+
+	// A bare snapshot name refers to the backup directory
+	snapshot := expandHome(args[0])
+	if !strings.ContainsRune(args[0], filepath.Separator) && !fileExists(snapshot) {
+		snapshot = filepath.Join(config.BackupDir(), args[0])
+	}
+	manifest, err := readBackupManifest(snapshot)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if pid, running := daemonPID(config.PIDFile()); running {
+		fmt.Printf("Error: the watcher daemon is running (pid %d); stop it before restoring\n", pid)
+		os.Exit(1)
+	}
+
+	// Keep the current state in case the restore was a mistake
+	files, err := backedUpFiles(db, config)
+	if err != nil {
+		log.Fatalf("Failed to back up the current state: %v", err)
+	}
+	current, err := CreateBackup(db, config.BackupDir(), files, config.AssetsDir(), time.Now())
+	if err != nil {
+		log.Fatalf("Failed to back up the current state: %v", err)
+	}
+	fmt.Printf("Backed up the current state to %s\n", current)
+
+	if err := db.RestoreFrom(filepath.Join(snapshot, backupDBName)); err != nil {
+		log.Fatalf("Failed to restore database: %v", err)
+	}
+	for _, file := range manifest.Files {
+		content, err := os.ReadFile(filepath.Join(snapshot, backupFilesDir, file.Name))
+		if err != nil {
+			log.Fatalf("Failed to read %s from backup: %v", file.Path, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(file.Path), 0755); err != nil {
+			log.Fatalf("Failed to create directory for %s: %v", file.Path, err)
+		}
+		if err := os.WriteFile(file.Path, content, 0644); err != nil {
+			log.Fatalf("Failed to restore %s: %v", file.Path, err)
+		}
+	}
+
+	// Assets are named by content, so ones already present are left alone
+	if len(manifest.Assets) > 0 {
+		if err := os.MkdirAll(manifest.AssetsDir, 0755); err != nil {
+			log.Fatalf("Failed to create assets directory: %v", err)
+		}
+	}
+	for _, name := range manifest.Assets {
+		destination := filepath.Join(manifest.AssetsDir, name)
+		if fileExists(destination) {
+			continue
+		}
+		if err := copyFile(filepath.Join(snapshot, backupAssetsDir, name), destination); err != nil {
+			log.Fatalf("Failed to restore asset %s: %v", name, err)
+		}
+	}
+
+	fmt.Printf("Restored the database, %d file(s) and %d asset(s) from %s (taken %s)\n",
+		len(manifest.Files), len(manifest.Assets), snapshot, manifest.CreatedAt.Local().Format("2006-01-02 15:04:05"))
+}
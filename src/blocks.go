@@ -3,7 +3,7 @@ package main
 import (
 	"crypto/sha256"
 	"fmt"
-	"slices"
+	"regexp"
 	"strings"
 	"time"
 )
@@ -14,6 +14,9 @@ type Block struct {
 	ContentHash string    `json:"content_hash"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
+	TouchCount  int       `json:"touch_count"`
+	Words       int       `json:"words"`
+	Chars       int       `json:"chars"`
 }
 
 func NewBlock(content string) *Block {
@@ -25,10 +28,19 @@ func NewBlock(content string) *Block {
 		ContentHash: generateContentHash(trimmedContent),
 		CreatedAt:   now,
 		UpdatedAt:   now,
+		Words:       CountWords(trimmedContent),
+		Chars:       CountChars(trimmedContent),
 	}
 }
 
+// generateContentHash returns the identity of a block with content, after
+// the configured hash normalization, keyed in an unlocked encrypted
+// repository.
 func generateContentHash(content string) string {
+	return keyedHash(normalizeForHash(content))
+}
+
+func sha256Hex(content string) string {
 	hash := sha256.Sum256([]byte(content))
 	return fmt.Sprintf("%x", hash)
 }
@@ -43,27 +55,123 @@ func (b *Block) IsEmpty() bool {
 	return strings.TrimSpace(b.Content) == ""
 }
 
+// ParseBlocksFromMarkdown splits content into blocks at blank lines. A
+// blank line followed by an indented line doesn't end a block; see
+// encodeBlankLines.
 func ParseBlocksFromMarkdown(content string) []*Block {
-	if strings.TrimSpace(content) == "" {
-		return []*Block{}
+	return parseSections(splitSections(content, false, nil), true)
+}
+
+// textSection is a section of text read from a file, with the 1-based
+// lines it spans.
+type textSection struct {
+	Text       string
+	Start, End int
+}
+
+// splitSections splits text at blank lines and at lines isDelimiter, which
+// may be nil, accepts, or with delimitersOnly at those lines alone. A blank
+// line followed by an indented line continues the section. Sections are
+// trimmed of blank lines at their edges, and empty ones are left out.
+func splitSections(text string, delimitersOnly bool, isDelimiter func(string) bool) []textSection {
+	var sections []textSection
+	lines := strings.Split(text, "\n")
+	start := 0
+	for i := 0; i <= len(lines); i++ {
+		if i < len(lines) {
+			blank := !delimitersOnly && lines[i] == "" && !continuesBlock(lines[i+1:])
+			if !blank && (isDelimiter == nil || !isDelimiter(lines[i])) {
+				continue
+			}
+		}
+
+		first, last := start, i-1
+		for first <= last && strings.TrimSpace(lines[first]) == "" {
+			first++
+		}
+		for last >= first && strings.TrimSpace(lines[last]) == "" {
+			last--
+		}
+		if first <= last {
+			sections = append(sections, textSection{Text: strings.Join(lines[first:last+1], "\n"), Start: first + 1, End: last + 1})
+		}
+		start = i + 1
+	}
+	return sections
+}
+
+// continuesBlock reports whether the lines after a blank line continue the
+// block before it: the first of them that isn't blank is indented.
+func continuesBlock(rest []string) bool {
+	for _, line := range rest {
+		if strings.TrimSpace(line) != "" {
+			return strings.HasPrefix(line, blankLineIndent) || strings.HasPrefix(line, "\t")
+		}
 	}
+	return false
+}
 
-	sections := strings.Split(content, "\n\n")
-	var blocks []*Block
+// blankLineIndent is how lines after a blank line inside a block are
+// indented in files, so the block is read back whole.
+const blankLineIndent = "  "
 
-	for _, section := range sections {
-		trimmed := strings.TrimSpace(section)
-		if trimmed == "" {
-			continue
+// encodeBlankLines indents the lines after the first blank line in a
+// block's content, so reading the file back doesn't split the block there.
+// Markdown renders a paragraph indented this little as a plain paragraph.
+func encodeBlankLines(content string) string {
+	if !strings.Contains(content, "\n\n") {
+		return content
+	}
+	lines := strings.Split(content, "\n")
+	indent := false
+	for i, line := range lines {
+		switch {
+		case line == "":
+			indent = true
+		case indent:
+			lines[i] = blankLineIndent + line
 		}
+	}
+	return strings.Join(lines, "\n")
+}
 
-		normalizedSection := normalizeWhitespace(trimmed)
-		if normalizedSection != "" {
-			block := NewBlock(normalizedSection)
-			blocks = append(blocks, block)
+// decodeBlankLines undoes encodeBlankLines on a section read from a file.
+// Lines written without the indent, as people may type them, are kept as
+// they are.
+func decodeBlankLines(section string) string {
+	if !strings.Contains(section, "\n\n") {
+		return section
+	}
+	lines := strings.Split(section, "\n")
+	dedent := false
+	for i, line := range lines {
+		switch {
+		case strings.TrimSpace(line) == "":
+			dedent = true
+		case dedent:
+			if trimmed, ok := strings.CutPrefix(line, blankLineIndent); ok {
+				lines[i] = trimmed
+			} else {
+				lines[i] = strings.TrimPrefix(line, "\t")
+			}
 		}
 	}
+	return strings.Join(lines, "\n")
+}
 
+// parseSections makes a block of each section, decoding blank lines
+// inside blocks with decode.
+func parseSections(sections []textSection, decode bool) []*Block {
+	blocks := []*Block{}
+	for _, section := range sections {
+		text := section.Text
+		if decode {
+			text = decodeBlankLines(text)
+		}
+		if normalized := normalizeWhitespace(text); normalized != "" {
+			blocks = append(blocks, NewBlock(normalized))
+		}
+	}
 	return blocks
 }
 
@@ -79,19 +187,38 @@ func normalizeWhitespace(content string) string {
 	return strings.TrimSpace(result)
 }
 
-func BlocksToMarkdown(blocks []*Block) string {
+// FirstLine returns the first non-empty line of the block's content.
+func (b *Block) FirstLine() string {
+	for _, line := range strings.Split(b.Content, "\n") {
+		if trimmed := strings.TrimSpace(line); trimmed != "" {
+			return trimmed
+		}
+	}
+	return ""
+}
+
+// titleMarkers matches the heading, list and task markers a block's first
+// line may start with.
+var titleMarkers = regexp.MustCompile(`^(#{1,6}\s+|[-*+]\s+(\[[ xX]\]\s+)?|\d+[.)]\s+)`)
+
+// Title returns the block's first line without heading or list markers,
+// which is how people remember a block and may address it on the command
+// line.
+func (b *Block) Title() string {
+	return strings.TrimSpace(titleMarkers.ReplaceAllString(b.FirstLine(), ""))
+}
+
+func BlocksToMarkdown(blocks []*Block, orderer BlockOrderer) string {
 	if len(blocks) == 0 {
 		return ""
 	}
 
-	slices.SortStableFunc(blocks, func(a, b *Block) int {
-		return b.CreatedAt.Compare(a.CreatedAt)
-	})
+	orderer.Order(blocks)
 
 	var sections []string
 	for _, block := range blocks {
 		if !block.IsEmpty() {
-			sections = append(sections, block.Content)
+			sections = append(sections, encodeBlankLines(block.Content))
 		}
 	}
 
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// `notes bot` captures messages sent to a Telegram bot as blocks, for
+// capture from a phone without the CLI.
+
+const (
+	// DefaultBotTag is added to blocks captured by `notes bot`.
+	DefaultBotTag = "inbox"
+
+	defaultTelegramAPIURL = "https://api.telegram.org"
+
+	// telegramPollTimeout is how long one getUpdates call waits for
+	// messages before returning empty.
+	telegramPollTimeout = 50 * time.Second
+
+	// botRetryDelay is how long the bot waits after a failed poll.
+	botRetryDelay = 10 * time.Second
+
+	// telegramOffsetKey stores the next update to fetch in the metadata
+	// table, so a restarted bot doesn't capture a message twice.
+	telegramOffsetKey = "telegram_update_offset"
+)
+
+// TelegramClient calls the Telegram Bot API.
+type TelegramClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewTelegramClient(apiURL, token string) *TelegramClient {
+	return &TelegramClient{
+		baseURL: strings.TrimRight(apiURL, "/") + "/bot" + token,
+		client:  &http.Client{Timeout: telegramPollTimeout + 10*time.Second},
+	}
+}
+
+type TelegramUpdate struct {
+	UpdateID int              `json:"update_id"`
+	Message  *TelegramMessage `json:"message"`
+}
+
+type TelegramMessage struct {
+	MessageID int `json:"message_id"`
+	From      *struct {
+		ID       int64  `json:"id"`
+		Username string `json:"username"`
+	} `json:"from"`
+	Chat struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	Text    string `json:"text"`
+	Caption string `json:"caption"`
+}
+
+// call posts params to a Bot API method and decodes its result into result.
+func (c *TelegramClient) call(ctx context.Context, method string, params any, result any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		// The URL holds the token, so don't let it into logs
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("failed to call %s: %w", method, err)
+	}
+	defer response.Body.Close()
+
+	var reply struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("failed to decode %s response: %w", method, err)
+	}
+	if !reply.OK {
+		return fmt.Errorf("%s failed: %s", method, reply.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(reply.Result, result)
+}
+
+// GetUpdates waits for messages from offset on.
+func (c *TelegramClient) GetUpdates(ctx context.Context, offset int) ([]TelegramUpdate, error) {
+	var updates []TelegramUpdate
+	params := map[string]any{
+		"offset":          offset,
+		"timeout":         int(telegramPollTimeout.Seconds()),
+		"allowed_updates": []string{"message"},
+	}
+	err := c.call(ctx, "getUpdates", params, &updates)
+	return updates, err
+}
+
+// Reply answers message in its chat.
+func (c *TelegramClient) Reply(ctx context.Context, message *TelegramMessage, text string) error {
+	params := map[string]any{
+		"chat_id":             message.Chat.ID,
+		"text":                text,
+		"reply_to_message_id": message.MessageID,
+	}
+	return c.call(ctx, "sendMessage", params, nil)
+}
+
+// CaptureBot turns messages from allowed users into blocks.
+type CaptureBot struct {
+	telegram *TelegramClient
+	tag      string
+	allowed  map[string]bool // user IDs and lower case usernames
+}
+
+func (b *CaptureBot) allows(message *TelegramMessage) bool {
+	if message.From == nil {
+		return false
+	}
+	return b.allowed[strconv.FormatInt(message.From.ID, 10)] ||
+		message.From.Username != "" && b.allowed[strings.ToLower(message.From.Username)]
+}
+
+// capture stores the text of message as a block and returns the reply.
+func (b *CaptureBot) capture(message *TelegramMessage) (string, error) {
+	text := message.Text
+	if text == "" {
+		text = message.Caption
+	}
+	if strings.HasPrefix(text, "/") {
+		return "Send me any text and I'll add it to your notes, tagged #" + b.tag + ".", nil
+	}
+
+	block := NewBlock(clipContent(text, b.tag))
+	if block.IsEmpty() {
+		return "Only text is captured; photos and files aren't stored.", nil
+	}
+	changes, err := newMainReconciler().AddBlocks([]*Block{block})
+	if err != nil {
+		return "", err
+	}
+	if len(changes.Updated) > 0 {
+		return fmt.Sprintf("Already present as block %d, marked it touched", changes.Updated[0].ID), nil
+	}
+	return fmt.Sprintf("Added block %d", block.ID), nil
+}
+
+// handle answers one message.
+func (b *CaptureBot) handle(ctx context.Context, message *TelegramMessage) {
+	var reply string
+	if !b.allows(message) {
+		id := int64(0)
+		if message.From != nil {
+			id = message.From.ID
+		}
+		infof("Ignored message from user %d, who isn't allowed", id)
+		reply = fmt.Sprintf("You aren't allowed to add notes. To allow yourself, restart the bot with --allow %d", id)
+	} else {
+		var err error
+		if reply, err = b.capture(message); err != nil {
+			log.Printf("Failed to add note: %v", err)
+			reply = "Failed to add the note; see the bot's log"
+		}
+	}
+	if err := b.telegram.Reply(ctx, message, reply); err != nil {
+		log.Printf("Failed to reply: %v", err)
+	}
+}
+
+// Run polls for messages until ctx is cancelled.
+func (b *CaptureBot) Run(ctx context.Context) error {
+	stored, err := db.GetMetadata(telegramOffsetKey)
+	if err != nil {
+		return err
+	}
+	offset, _ := strconv.Atoi(stored)
+
+	for ctx.Err() == nil {
+		updates, err := b.telegram.GetUpdates(ctx, offset)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Printf("Failed to get messages, retrying in %s: %v", botRetryDelay, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(botRetryDelay):
+			}
+			continue
+		}
+
+		for _, update := range updates {
+			if update.Message != nil {
+				b.handle(ctx, update.Message)
+			}
+			offset = update.UpdateID + 1
+			if err := db.SetMetadata(telegramOffsetKey, strconv.Itoa(offset)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func handleBot() {
+	fs := flag.NewFlagSet("bot", flag.ExitOnError)
+	token := fs.String("telegram-token", os.Getenv("TELEGRAM_BOT_TOKEN"), "Telegram bot token from @BotFather (default $TELEGRAM_BOT_TOKEN)")
+	apiURL := fs.String("telegram-api", defaultTelegramAPIURL, "Bot API server, for a self-hosted one")
+	tag := fs.String("tag", DefaultBotTag, "tag to append to captured blocks")
+	var allowed stringList
+	fs.Var(&allowed, "allow", "Telegram user ID or username whose messages are captured (repeatable)")
+	parseArgs(fs, os.Args[2:])
+
+	if *token == "" {
+		fmt.Println("Error: bot requires a Telegram bot token; create a bot with @BotFather and set --telegram-token or TELEGRAM_BOT_TOKEN")
+		fmt.Println("Usage: notes bot [--telegram-token t] [--tag inbox] [--allow user]...")
+		os.Exit(1)
+	}
+	if remote != nil {
+		fmt.Println("Error: bot runs against a local repository; start it next to 'notes serve' instead")
+		os.Exit(1)
+	}
+
+	bot := &CaptureBot{
+		telegram: NewTelegramClient(*apiURL, *token),
+		tag:      strings.TrimPrefix(strings.TrimSpace(*tag), "#"),
+		allowed:  make(map[string]bool),
+	}
+	for _, user := range allowed {
+		bot.allowed[strings.ToLower(strings.TrimPrefix(strings.TrimSpace(user), "@"))] = true
+	}
+	if len(bot.allowed) == 0 {
+		fmt.Println("No users are allowed yet: message the bot to learn your user ID, then restart it with --allow <id>")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Println("Capturing Telegram messages; press Ctrl-C to stop")
+	if err := bot.Run(ctx); err != nil {
+		log.Fatalf("Failed to run bot: %v", err)
+	}
+	fmt.Println("Bot stopped.")
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const bulkEditHeader = "<!-- Edit, split or clear the text above each marker. Text after the last marker becomes new blocks. -->"
+
+// bulkEditMarkerPattern matches the line written after each block in a
+// `notes bulkedit` file, naming the block the text above it belongs to.
+var bulkEditMarkerPattern = regexp.MustCompile(`(?m)^<!-- notes:block (\d+) -->[ \t]*$`)
+
+// renameTag replaces tag from, and tags nested under it such as from/sub,
+// with to in content.
+func renameTag(content, from, to string) string {
+	return tagPattern.ReplaceAllStringFunc(content, func(match string) string {
+		tag := strings.TrimLeft(match, " \t\r\n")
+		name := strings.TrimPrefix(tag, "#")
+		if name != from && !strings.HasPrefix(name, from+"/") {
+			return match
+		}
+		return match[:len(match)-len(tag)] + "#" + to + strings.TrimPrefix(name, from)
+	})
+}
+
+// isValidTag reports whether tag, without its '#', would be read back as
+// the same tag.
+func isValidTag(tag string) bool {
+	match := tagPattern.FindStringSubmatch("#" + tag)
+	return match != nil && match[1] == tag
+}
+
+// hasTagOrChild reports whether block carries tag or a tag nested under it.
+func hasTagOrChild(block *Block, tag string) bool {
+	for _, candidate := range ExtractTags(block.Content) {
+		if candidate == tag || strings.HasPrefix(candidate, tag+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// searchQuery returns the blocks matching a --grep query, which takes the
+// same terms as `notes grep`: words to match and -words to exclude.
+func searchQuery(query string) ([]*Block, error) {
+	includeKeywords, excludeKeywords := parseSearchTerms(strings.Fields(query))
+	if len(includeKeywords) == 0 && len(excludeKeywords) == 0 {
+		return nil, fmt.Errorf("--grep requires at least one search term")
+	}
+	return db.SearchBlocks(includeKeywords, excludeKeywords)
+}
+
+// applyEdits stores edits as one operation and rewrites every file.
+func applyEdits(edits []BlockEdit) {
+	if len(edits) == 0 {
+		return
+	}
+	if _, err := newMainReconciler().UpdateBlocks(edits); err != nil {
+		log.Fatalf("Failed to update blocks: %v", err)
+	}
+	if err := regenerateAllFiles(); err != nil {
+		log.Fatalf("Failed to regenerate files: %v", err)
+	}
+}
+
+func handleRetag() {
+	fs := flag.NewFlagSet("retag", flag.ExitOnError)
+	from := fs.String("from", "", "tag to rename")
+	to := fs.String("to", "", "new name for the tag")
+	parseArgs(fs, os.Args[2:])
+
+	oldTag := strings.TrimPrefix(strings.TrimSpace(*from), "#")
+	newTag := strings.TrimPrefix(strings.TrimSpace(*to), "#")
+	if oldTag == "" || newTag == "" {
+		fmt.Println("Error: retag command requires --from and --to")
+		fmt.Println("Usage: notes retag --from old --to new")
+		os.Exit(1)
+	}
+	if !isValidTag(newTag) {
+		fmt.Printf("Error: %q is not a valid tag\n", newTag)
+		os.Exit(1)
+	}
+
+	blocks, err := db.SearchBlocks([]string{"#" + oldTag}, nil)
+	if err != nil {
+		log.Fatalf("Failed to search: %v", err)
+	}
+
+	var edits []BlockEdit
+	for _, block := range blocks {
+		if !hasTagOrChild(block, oldTag) {
+			continue
+		}
+		if content := renameTag(block.Content, oldTag, newTag); content != block.Content {
+			edits = append(edits, BlockEdit{Hash: block.ContentHash, Content: content})
+		}
+	}
+
+	applyEdits(edits)
+	fmt.Printf("Retagged %d block(s) from #%s to #%s\n", len(edits), oldTag, newTag)
+}
+
+func handleTag() {
+	fs := flag.NewFlagSet("tag", flag.ExitOnError)
+	query := fs.String("grep", "", "blocks to tag, as search terms like notes grep takes")
+	args := parseArgs(fs, os.Args[2:])
+
+	if len(args) != 2 || args[0] != "add" || *query == "" {
+		fmt.Println("Error: tag command requires a tag and a --grep query")
+		fmt.Println("Usage: notes tag add <tag> --grep \"query\"")
+		os.Exit(1)
+	}
+
+	tag := strings.TrimPrefix(strings.TrimSpace(args[1]), "#")
+	if !isValidTag(tag) {
+		fmt.Printf("Error: %q is not a valid tag\n", args[1])
+		os.Exit(1)
+	}
+
+	blocks, err := searchQuery(*query)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var edits []BlockEdit
+	for _, block := range blocks {
+		if !block.HasTag(tag) {
+			edits = append(edits, BlockEdit{Hash: block.ContentHash, Content: block.Content + "\n#" + tag})
+		}
+	}
+
+	applyEdits(edits)
+	fmt.Printf("Tagged %d block(s) with #%s (%d already had it)\n", len(edits), tag, len(blocks)-len(edits))
+}
+
+// bulkEditFile lays blocks out for editing, each followed by a marker
+// comment with its ID.
+func bulkEditFile(blocks []*Block) string {
+	var content strings.Builder
+	content.WriteString(bulkEditHeader + "\n\n")
+	for _, block := range blocks {
+		fmt.Fprintf(&content, "%s\n<!-- notes:block %d -->\n\n", block.Content, block.ID)
+	}
+	return content.String()
+}
+
+// parseBulkEdit maps block IDs to the text left above their marker, and
+// returns any text after the last marker.
+func parseBulkEdit(content string) (map[int]string, string) {
+	content = strings.Replace(content, bulkEditHeader, "", 1)
+
+	sections := make(map[int]string)
+	start := 0
+	for _, match := range bulkEditMarkerPattern.FindAllStringSubmatchIndex(content, -1) {
+		id, _ := strconv.Atoi(content[match[2]:match[3]])
+		sections[id] = strings.TrimSpace(content[start:match[0]])
+		start = match[1]
+	}
+	return sections, strings.TrimSpace(content[start:])
+}
+
+func handleBulkEdit() {
+	fs := flag.NewFlagSet("bulkedit", flag.ExitOnError)
+	query := fs.String("grep", "", "blocks to edit, as search terms like notes grep takes")
+	parseArgs(fs, os.Args[2:])
+
+	if *query == "" {
+		fmt.Println("Error: bulkedit command requires a --grep query")
+		fmt.Println("Usage: notes bulkedit --grep \"query\"")
+		os.Exit(1)
+	}
+
+	blocks, err := searchQuery(*query)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(blocks) == 0 {
+		fmt.Println("No blocks found matching the specified criteria")
+		return
+	}
+
+	edited, err := editInEditor(bulkEditFile(blocks), 3)
+	if err != nil {
+		log.Fatalf("Failed to edit blocks: %v", err)
+	}
+	sections, added := parseBulkEdit(edited)
+
+	// A block whose marker was removed is left alone, not deleted
+	var edits []BlockEdit
+	var deleted []*Block
+	reconciler := newMainReconciler()
+	split := 0
+	for _, block := range blocks {
+		section, ok := sections[block.ID]
+		switch {
+		case !ok || section == block.Content:
+		case section == "":
+			deleted = append(deleted, block)
+		case len(ParseBlocksFromMarkdown(section)) > 1:
+			if _, err := reconciler.SplitBlock(block.ContentHash, section); err != nil {
+				log.Fatalf("Failed to split block: %v", err)
+			}
+			split++
+		default:
+			edits = append(edits, BlockEdit{Hash: block.ContentHash, Content: section})
+		}
+	}
+
+	newBlocks := ParseBlocksFromMarkdown(added)
+	if len(edits) == 0 && split == 0 && len(deleted) == 0 && len(newBlocks) == 0 {
+		fmt.Println("No changes")
+		return
+	}
+
+	if len(deleted) > 0 {
+		if _, err := reconciler.DeleteBlocks(deleted); err != nil {
+			log.Fatalf("Failed to delete blocks: %v", err)
+		}
+	}
+	if len(newBlocks) > 0 {
+		if _, err := reconciler.AddBlocks(newBlocks); err != nil {
+			log.Fatalf("Failed to add blocks: %v", err)
+		}
+	}
+	if len(edits) > 0 {
+		applyEdits(edits)
+	} else if err := regenerateAllFiles(); err != nil {
+		log.Fatalf("Failed to regenerate files: %v", err)
+	}
+
+	fmt.Printf("Updated %d, split %d, deleted %d and added %d block(s)\n", len(edits), split, len(deleted), len(newBlocks))
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -13,27 +19,53 @@ import (
 var (
 	db               *Database
 	dbPath           string
+	notesPath        string
+	repoProfile      string // profile the repository was selected by, if any
+	config           *Config
 	multiFileWatcher *MultiFileWatcher // New multi-file watcher
+
+	dbOverride string // database path given with --db
 )
 
 func main() {
+	profileName := parseGlobalFlags()
+
 	if len(os.Args) < 2 {
 		printUsage()
 		os.Exit(1)
 	}
 
+	expandAlias()
 	command := os.Args[1]
 
-	var err error
-	basePath := os.Getenv("NOTES_PATH")
-	if basePath == "" {
-		basePath, err = os.Getwd()
-		if err != nil {
-			log.Fatalf("Failed to get current directory: %v", err)
-		}
+	// Completion must not prompt for a passphrase or fail without a repository
+	switch command {
+	case "completion":
+		handleCompletion()
+		return
+	case "alias":
+		handleAlias()
+		return
+	case "__complete":
+		handleComplete()
+		return
 	}
 
-	dbPath = filepath.Join(basePath, "notes.db")
+	if remoteURL := os.Getenv("NOTES_REMOTE"); remoteURL != "" && command != "serve" && command != "sync" {
+		runRemote(command, remoteURL)
+		return
+	}
+
+	basePath, err := resolveRepository(profileName)
+	if err != nil {
+		log.Fatalf("Failed to locate repository: %v", err)
+	}
+	debugf("using database %s and notes file %s", dbPath, notesPath)
+
+	if command == "profiles" {
+		handleProfiles()
+		return
+	}
 
 	if command != "init" {
 		if !fileExists(dbPath) {
@@ -41,11 +73,46 @@ func main() {
 			os.Exit(1)
 		}
 
-		db, err = NewDatabase(dbPath)
+		if !readOnly && !databaseWritable(dbPath) {
+			readOnly, readOnlyReason = true, dbPath+" isn't writable"
+			infof("Opening the repository read-only: %s", readOnlyReason)
+		}
+		if readOnly {
+			if mutatingCommands[command] {
+				requireWritable("notes " + command)
+			}
+			db, err = OpenReadOnlyDatabase(dbPath)
+		} else {
+			db, err = NewDatabase(dbPath)
+		}
 		if err != nil {
 			log.Fatalf("Failed to open database: %v", err)
 		}
 		defer db.Close()
+
+		if err := unlockDatabase(); err != nil {
+			log.Fatalf("Failed to unlock repository: %v", err)
+		}
+		if readOnly {
+			// Generated files are left as they are too
+			skipRegeneration = true
+		} else {
+			db.audit = NewAuditLog(filepath.Join(filepath.Dir(dbPath), AuditLogName))
+			if err := db.FillBlockCounts(); err != nil {
+				log.Fatalf("Failed to count block words: %v", err)
+			}
+			if err := db.FillBlockTitles(); err != nil {
+				log.Fatalf("Failed to store block titles: %v", err)
+			}
+		}
+
+		config, err = LoadConfig(basePath, notesPath)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+		SetHashNormalization(config.Normalize)
+		SetFileLimits(config.Limits)
+		output = NewFormatter(config.Theme)
 	}
 
 	switch command {
@@ -53,6 +120,10 @@ func main() {
 		handleInit()
 	case "add":
 		handleAdd()
+	case "clip":
+		handleClip()
+	case "web":
+		handleWeb()
 	case "grep":
 		handleGrep()
 	case "watch":
@@ -61,6 +132,122 @@ func main() {
 		handleUnwatch()
 	case "watcher":
 		handleWatcher()
+	case "import-roam":
+		handleImportRoam()
+	case "import-dir":
+		handleImportDir()
+	case "ingest":
+		handleIngest()
+	case "templates":
+		handleTemplates()
+	case "status":
+		handleStatus()
+	case "stats":
+		handleStats()
+	case "agenda":
+		handleAgenda()
+	case "recur":
+		handleRecur()
+	case "review":
+		handleReview()
+	case "random":
+		handleRandom()
+	case "daily":
+		handleDaily()
+	case "visibility":
+		handleVisibility()
+	case "cat":
+		handleCat()
+	case "pick":
+		handlePick()
+	case "summarize":
+		handleSummarize()
+	case "enrich":
+		handleEnrich()
+	case "open":
+		handleOpen()
+	case "edit":
+		handleEdit()
+	case "retag":
+		handleRetag()
+	case "tag":
+		handleTag()
+	case "bulkedit":
+		handleBulkEdit()
+	case "append":
+		handleAppend()
+	case "split":
+		handleSplit()
+	case "dedupe":
+		handleDedupe()
+	case "merge":
+		handleMerge()
+	case "undo":
+		handleUndo()
+	case "audit":
+		handleAudit()
+	case "diff":
+		handleDiff()
+	case "deleted":
+		handleDeleted()
+	case "regenerate":
+		handleRegenerate()
+	case "export":
+		handleExport()
+	case "assets":
+		handleAssets()
+	case "log":
+		handleLog()
+	case "block-at":
+		handleBlockAt()
+	case "touch":
+		handleTouch()
+	case "context":
+		handleContext()
+	case "lint":
+		handleLint()
+	case "bot":
+		handleBot()
+	case "mail-ingest":
+		handleMailIngest()
+	case "log-work":
+		handleLogWork()
+	case "timesheet":
+		handleTimesheet()
+	case "links":
+		handleLinks()
+	case "mentions":
+		handleMentions()
+	case "people":
+		handlePeople()
+	case "meta":
+		handleMeta()
+	case "reconcile":
+		handleReconcile()
+	case "mcp":
+		handleMCP()
+	case "lsp":
+		handleLSP()
+	case "serve":
+		handleServe()
+	case "token":
+		handleToken()
+	case "sync":
+		handleSync()
+	case "doctor":
+		handleDoctor()
+	case "backup":
+		handleBackup()
+	case "restore-backup":
+		handleRestoreBackup()
+	case "rehash":
+		handleRehash()
+	case "encrypt":
+		handleEncrypt()
+	case "decrypt":
+		handleDecrypt()
+	case "keyring":
+		handleKeyring()
 	default:
 		fmt.Printf("Unknown command: %s\n", command)
 		printUsage()
@@ -68,17 +255,282 @@ func main() {
 	}
 }
 
+// parseGlobalFlags consumes the options that may precede the command and
+// removes them from os.Args, so handlers keep reading their arguments from
+// os.Args[2:]. It returns the selected profile name.
+func parseGlobalFlags() string {
+	fs := flag.NewFlagSet("notes", flag.ExitOnError)
+	fs.Usage = printUsage
+	profile := fs.String("r", os.Getenv("NOTES_PROFILE"), "repository profile to use")
+	fs.StringVar(profile, "repo", *profile, "repository profile to use")
+	fs.StringVar(&dbOverride, "db", "", "database to use, overriding profiles and NOTES_PATH")
+	fs.BoolVar(&quietLogging, "quiet", false, "don't log progress, only warnings and errors")
+	fs.BoolVar(&quietLogging, "q", false, "shorthand for --quiet")
+	fs.BoolVar(&verboseLogging, "verbose", false, "log debugging detail")
+	fs.BoolVar(&verboseLogging, "v", false, "shorthand for --verbose")
+	fs.BoolVar(&skipRegeneration, "no-regenerate", false, "don't regenerate markdown files; run 'notes regenerate' afterwards")
+	fs.BoolVar(&plainOutput, "plain", false, "don't colour or style output")
+	fs.BoolVar(&readOnly, "read-only", false, "open the repository without changing it, e.g. a snapshot or mounted backup")
+
+	fs.Parse(os.Args[1:])
+	os.Args = append(os.Args[:1], fs.Args()...)
+	if quietLogging && verboseLogging {
+		fmt.Println("Error: --quiet and --verbose can't be used together")
+		os.Exit(1)
+	}
+	if verboseLogging {
+		log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	}
+	output = NewFormatter(nil)
+	return *profile
+}
+
+// resolveRepository sets dbPath and notesPath and returns the repository
+// directory. A database given with --db wins over a profile from the user
+// config, which wins over NOTES_PATH, then the user config's default profile
+// and finally the working directory.
+func resolveRepository(profileName string) (string, error) {
+	if dbOverride != "" {
+		path, err := ResolveAbsolutePath(expandHome(dbOverride))
+		if err != nil {
+			return "", err
+		}
+		dbPath = path
+		notesPath = filepath.Join(filepath.Dir(path), "notes.md")
+		return filepath.Dir(path), nil
+	}
+
+	userConfig, err := LoadUserConfig()
+	if err != nil {
+		return "", err
+	}
+
+	basePath := os.Getenv("NOTES_PATH")
+	if profileName == "" && basePath == "" {
+		profileName = userConfig.DefaultProfile
+	}
+
+	if profileName != "" {
+		profile, err := userConfig.Profile(profileName)
+		if err != nil {
+			return "", err
+		}
+		dbPath = profile.DB
+		notesPath = profile.Notes
+		repoProfile = profileName
+		return profile.Path, nil
+	}
+
+	if basePath == "" {
+		basePath, err = os.Getwd()
+		if err != nil {
+			return "", fmt.Errorf("failed to get current directory: %w", err)
+		}
+	}
+
+	dbPath = filepath.Join(basePath, "notes.db")
+	notesPath = filepath.Join(basePath, "notes.md")
+	return basePath, nil
+}
+
 func printUsage() {
-	fmt.Println("Usage: notes <command> [args]")
+	fmt.Println("Usage: notes [-r profile] [--db path] [-q|-v] [--no-regenerate] [--plain] [--read-only] <command> [args]")
 	fmt.Println("")
 	fmt.Println("Commands:")
 	fmt.Println("  init                    Initialize new repository")
 	fmt.Println("  add \"content\"            Add new note block")
+	fmt.Println("  add --single|--split \"content\"  Add content with blank lines as one block, or one block per paragraph")
+	fmt.Println("  add [-] [--single]      Read blocks from stdin (split on blank lines unless --single)")
+	fmt.Println("  add --template <name> [--var k=v] [\"text\"]  Add a block from a template")
+	fmt.Println("  add --attach <file> [\"text\"]  Copy a file into assets/ and link it from a new block")
+	fmt.Println("  templates               List available templates")
+	fmt.Println("  agenda [--days 7] [--all]  List upcoming @due(...) and @remind(...) items")
+	fmt.Println("  recur [--run]              List @every(...) templates, or clone the ones due now")
+	fmt.Println("  review [--limit 20] [--all] [--render]  Review #review blocks on a spaced-repetition schedule")
+	fmt.Println("  random [-n 3] [--bump]  Show long-untouched blocks, optionally marking them touched")
+	fmt.Println("  status                  Show watched files, sync state, daemon state and metrics, and recent errors")
+	fmt.Println("  stats [--weeks n] [--heatmap] [--json]  Show usage statistics")
+	fmt.Println("  clip [--tag t] [--notify]  Add the clipboard contents as a block")
+	fmt.Println("  web [--tag t] [--link-only] <url>  Add a web page's title, link and readable text as a block")
+	fmt.Println("  mail-ingest [--tag t] < message.eml  Add an e-mail from an allowed sender as a block, with its attachments")
+	fmt.Println("  bot [--telegram-token t] [--tag inbox] [--allow user]...  Capture messages sent to a Telegram bot as blocks")
 	fmt.Println("  grep \"term1\" \"term2\"      Search across all blocks (union of keywords)")
-	fmt.Println("  grep \"term\" \"-excluded\"   Use -prefix to exclude keywords")
-	fmt.Println("  watcher                 Start the file watcher daemon")
-	fmt.Println("  watch <file>            Add file to watch list")
+	fmt.Println("  grep \"term\" \"-excluded\"   Use -prefix to exclude keywords; grep's own flags take two dashes")
+	fmt.Println("  grep --render \"term\"      Style matching blocks as markdown instead of highlighting terms")
+	fmt.Println("  grep --interactive \"term\"  Pick a result to print, edit, delete or copy (--no-pager to disable paging)")
+	fmt.Println("  pick [--edit|--copy] [query]  Fuzzy-find a block by its first line (with fzf if installed) and print it")
+	fmt.Println("  summarize --tag t [--since \"1 month ago\"] [--dry-run]  Summarize blocks with the configured language model")
+	fmt.Println("  enrich [--list|--accept|--reject] [ids...]  Suggest titles and tags for untagged blocks with the language model")
+	fmt.Println("  grep --since \"2 weeks ago\" --until 2024-06-01 \"term\"  Only search blocks created in that time")
+	fmt.Println("  grep --sort relevance [--reverse] [--limit N] \"term\"  Order by updated, created, relevance or length")
+	fmt.Println("  log [-n 20] [--full] [--render] [--since t] [--until t]  List blocks newest first with their age and word count")
+	fmt.Println("  log --min-words 200       Only list blocks with at least (or --max-words at most) that many words")
+	fmt.Println("    --json | --count | --files | -l   Output as JSON, a count, per-file hits or first lines")
+	fmt.Println("  watcher [--poll 2s]     Start the file watcher daemon (optionally polling)")
+	fmt.Println("  watcher install-service [--poll 2s] [--no-start]  Run the daemon as a systemd/launchd user service")
+	fmt.Println("  watcher uninstall-service  Stop and remove that service")
+	fmt.Println("  watcher stop            Stop the running watcher daemon")
+	fmt.Println("  watch [--preserve-dates] <file>  Add file to watch list")
 	fmt.Println("  unwatch <file>          Remove file from watch list")
+	fmt.Println("  ingest <file> [--tag t] [--preserve-dates]  Import blocks from a file once, tagging new blocks")
+	fmt.Println("  import-dir <dir> [--recursive] [--tag t] [--watch]  Import every markdown file in a directory at once")
+	fmt.Println("  import-roam [--tag t] <export.json>  Import a Roam or Logseq JSON export")
+	fmt.Println("  daily [--yesterday] [text]  Append to today's journal block, or edit it")
+	fmt.Println("  log-work [--project p] [--duration 25m] <text>  Log a timestamped worklog block for work that just ended")
+	fmt.Println("  timesheet [--week|--since t] [--project p] [--json]  Total logged work per project and day")
+	fmt.Println("  profiles                List repository profiles from the user config")
+	fmt.Println("  alias add <name> <command> [args...]  Define a shortcut, e.g. alias add w grep \"#work\"")
+	fmt.Println("  alias [list] | alias rm <name>  List or remove shortcuts")
+	fmt.Println("  mcp [--audience level]  Serve the Model Context Protocol on stdio for LLM assistants")
+	fmt.Println("  lsp                     Serve the Language Server Protocol on stdio: tag and block completion, hover, go to definition")
+	fmt.Println("  serve [--addr host:port] [--token t] [--tls] [--rate-limit n] [--audience shared] [--metrics] [--ui]  Serve the repository to remote clients")
+	fmt.Println("  token create <name> | list | revoke <name>  Manage the tokens clients of 'notes serve' authenticate with")
+	fmt.Println("  sync [url]              Merge blocks with a 'notes serve' instance in both directions")
+	fmt.Println("  visibility <id> [level]  Show or set a block's visibility: private, shared, public or default")
+	fmt.Println("  completion bash|zsh|fish  Print a shell completion script")
+	fmt.Println("  cat [--render] <id>     Print a block, optionally styled for the terminal")
+	fmt.Println("  edit <id|title>         Edit a block in $EDITOR; blocks can also be addressed by title prefix")
+	fmt.Println("  open <id>               Open the file holding a block in $EDITOR at the block's line")
+	fmt.Println("  block-at [--json] <file> <line>  Print the hash of the block on a line of a file, for editor plugins")
+	fmt.Println("  touch <id>...           Mark blocks touched as if they had just been edited")
+	fmt.Println("  context [--json] <id>   Show a block's files, tags, metadata, visibility and links")
+	fmt.Println("  links <id>              List the blocks a block references with ((id)) and those referencing it")
+	fmt.Println("  mentions [--full] [--json] [--since t] <person>  List the blocks mentioning @person, latest first")
+	fmt.Println("  people [--json]         List everyone @mentioned, with how many blocks mention them")
+	fmt.Println("  lint [--json] [file...]  Report references to missing or deleted blocks, empty tags and malformed annotations")
+	fmt.Println("  meta [set|unset] <id> [key=value...]  Show, set or remove key/value metadata on a block; grep matches it as key:value")
+	fmt.Println("  retag --from old --to new  Rename a tag, and tags nested under it, in every block")
+	fmt.Println("  tag add <tag> --grep \"query\"  Add a tag to every block matching a search")
+	fmt.Println("  bulkedit --grep \"query\"  Edit every block matching a search in $EDITOR at once")
+	fmt.Println("  append [--top] <id> \"text\"  Add a line to the end (or start) of a block without an editor")
+	fmt.Println("  split <id>              Edit a block in $EDITOR and split it at blank lines")
+	fmt.Println("  merge <id1> <id2> ...   Merge blocks into one")
+	fmt.Println("  dedupe [--auto|--dry-run] [--threshold 0.7]  Find near-duplicate blocks and merge them")
+	fmt.Println("  regenerate              Rewrite notes.md and every watched file from the database")
+	fmt.Println("  export [--audience shared] [dir]  Regenerate, then copy notes.md and the assets it links to into dir")
+	fmt.Println("  export --format roam-json [--audience shared] [file]  Write all blocks as a Roam/Logseq JSON export")
+	fmt.Println("  assets [gc [--dry-run]]  List attachments and their references, or remove unreferenced ones")
+	fmt.Println("  reconcile [--force] [--json] [file...|--all]  Read changes from watched files into the database now")
+	fmt.Println("  undo [n]                Undo the last n operations (default 1)")
+	fmt.Println("  diff [--json] [--full] <since|snapshot>  List blocks added, modified and removed since a time or backup")
+	fmt.Println("  audit tail [-n 20] [-f] [--json]  Show the latest changes from the audit log, optionally following it")
+	fmt.Println("  deleted [--last] [-n 20] [--restore id]  Review or restore blocks removed from watched files")
+	fmt.Println("  doctor [--fix]          Check database and watched files for drift")
+	fmt.Println("  backup [--to dir] [--keep 10] [--list]  Snapshot the database, markdown files and assets, keeping the newest")
+	fmt.Println("  restore-backup <snapshot>  Restore a snapshot, backing up the current state first")
+	fmt.Println("  rehash                  Recompute block hashes after changing 'normalize', merging duplicates")
+	fmt.Println("  encrypt                 Encrypt block content with a passphrase")
+	fmt.Println("  decrypt                 Remove encryption from the repository")
+	fmt.Println("  keyring save|forget     Store the passphrase in the system keyring, or remove it")
+	fmt.Println("")
+	fmt.Println("Select a repository with -r/--repo <profile> or NOTES_PROFILE, or point NOTES_PATH at a directory.")
+	fmt.Println("Encrypted repositories read the passphrase from NOTES_PASSPHRASE or the system keyring, or prompt for it.")
+	fmt.Println("Set NOTES_REMOTE=https://host:port and NOTES_TOKEN to run add, grep and clip against 'notes serve'.")
+}
+
+// parseArgs parses flags appearing anywhere in args and returns the remaining
+// positional arguments. Dash-prefixed arguments that aren't defined on fs are
+// kept as positional, so "-word" search terms pass through.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	return parseFlagArgs(fs, args, false)
+}
+
+// parseLongArgs is parseArgs for commands taking search terms, where
+// "-word" excludes word: flags must be written with two dashes, so that
+// excluding a word that happens to name a flag, such as -count, still works.
+func parseLongArgs(fs *flag.FlagSet, args []string) []string {
+	return parseFlagArgs(fs, args, true)
+}
+
+func parseFlagArgs(fs *flag.FlagSet, args []string, longOnly bool) []string {
+	var flagArgs, positional []string
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			positional = append(positional, args[i+1:]...)
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' || longOnly && arg[1] != '-' {
+			positional = append(positional, arg)
+			continue
+		}
+
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		f := fs.Lookup(name)
+		if f == nil && name != "h" && name != "help" {
+			positional = append(positional, arg)
+			continue
+		}
+
+		flagArgs = append(flagArgs, arg)
+		if f == nil || hasValue {
+			continue
+		}
+		if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && boolFlag.IsBoolFlag() {
+			continue
+		}
+		if i+1 < len(args) {
+			i++
+			flagArgs = append(flagArgs, args[i])
+		}
+	}
+
+	fs.Parse(flagArgs)
+	return positional
+}
+
+// repositoryPassphrase is the passphrase the repository was unlocked with,
+// or "" if it isn't encrypted.
+var repositoryPassphrase string
+
+// unlockDatabase unlocks an encrypted repository with the passphrase from
+// NOTES_PASSPHRASE or the system keyring, prompting for it otherwise.
+// Encrypting an unencrypted repository is handled by handleEncrypt instead.
+func unlockDatabase() error {
+	encrypted, err := db.IsEncrypted()
+	if err != nil {
+		return err
+	}
+	if !encrypted {
+		return nil
+	}
+
+	passphrase := ""
+	if os.Getenv("NOTES_PASSPHRASE") == "" {
+		// Without a keyring tool this just falls through to the prompt
+		if stored, err := keyringLookup(filepath.Dir(dbPath)); err == nil && stored != "" {
+			if err := db.Unlock(stored); err == nil {
+				passphrase = stored
+			} else {
+				log.Printf("Warning: the passphrase in the system keyring doesn't unlock the repository; run 'notes keyring forget'")
+			}
+		}
+	}
+	if passphrase == "" {
+		if passphrase, err = readPassphrase("Passphrase: "); err != nil {
+			return err
+		}
+		if err := db.Unlock(passphrase); err != nil {
+			return err
+		}
+	}
+	repositoryPassphrase = passphrase
+
+	if readOnly {
+		return nil
+	}
+	keyed, err := db.KeyedHashes()
+	if err != nil {
+		return err
+	}
+	if !keyed {
+		infof("Keying block hashes with the encryption key")
+		if err := db.KeyContentHashes(); err != nil {
+			return fmt.Errorf("failed to key block hashes: %w", err)
+		}
+	}
+	return nil
 }
 
 func handleInit() {
@@ -87,6 +539,10 @@ func handleInit() {
 		return
 	}
 
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		log.Fatalf("Failed to create repository directory: %v", err)
+	}
+
 	database, err := NewDatabase(dbPath)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
@@ -97,102 +553,307 @@ func handleInit() {
 }
 
 func handleAdd() {
-	if len(os.Args) < 3 {
-		fmt.Println("Error: add command requires content argument")
-		fmt.Println("Usage: notes add \"content\"")
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	single := fs.Bool("single", false, "keep content with blank lines as a single block")
+	split := fs.Bool("split", false, "add one block per paragraph of the content, as stdin input is by default")
+	templateName := fs.String("template", "", "start the block from a named template")
+	var templateVars stringList
+	fs.Var(&templateVars, "var", "template variable as name=value (repeatable)")
+	var attachPaths stringList
+	fs.Var(&attachPaths, "attach", "copy a file into assets/ and link it from the block (repeatable)")
+	args := parseArgs(fs, os.Args[2:])
+
+	if remote != nil && (*templateName != "" || len(attachPaths) > 0) {
+		fmt.Println("Error: --template and --attach are not available with NOTES_REMOTE")
 		os.Exit(1)
 	}
 
-	content := os.Args[2]
-	if content == "" {
-		fmt.Println("Error: content cannot be empty")
+	if *single && *split {
+		fmt.Println("Error: --single and --split can't be used together")
 		os.Exit(1)
 	}
 
-	newBlock := NewBlock(content)
+	var content string
+	splitContent := *split
+	if *templateName != "" {
+		var err error
+		content, err = contentFromTemplate(*templateName, templateVars, strings.Join(args, " "))
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	} else if len(args) == 0 || args[0] == "-" {
+		var err error
+		content, err = readStdin()
+		if err != nil {
+			log.Fatalf("Failed to read from stdin: %v", err)
+		}
+		splitContent = !*single
+	} else {
+		content = args[0]
+		// A paragraph break in an argument is more likely a pasted list of
+		// notes than one block, so make the caller say which it is
+		if !*single && !*split && len(ParseBlocksFromMarkdown(content)) > 1 {
+			fmt.Println("Error: content contains blank lines; pass --single to add it as one block or --split to add one block per paragraph")
+			os.Exit(1)
+		}
+	}
 
-	if err := db.CreateBlock(newBlock); err != nil {
-		log.Fatalf("Failed to add note: %v", err)
+	var blocks []*Block
+	if splitContent {
+		blocks = ParseBlocksFromMarkdown(content)
+	} else {
+		// Trailing whitespace is dropped as when the block is read back
+		// from a file, so its hash doesn't change then
+		blocks = []*Block{NewBlock(normalizeWhitespace(content))}
 	}
 
-	fmt.Println("Note added successfully")
-}
+	var attachments []*Attachment
+	if len(attachPaths) > 0 {
+		if len(blocks) > 1 {
+			fmt.Println("Error: --attach can only be used when adding a single block")
+			os.Exit(1)
+		}
 
-func handleGrep() {
-	if len(os.Args) < 3 {
-		fmt.Println("Error: grep command requires search term(s)")
-		fmt.Println("Usage: notes grep \"term1\" \"term2\" -\"excluded\"")
-		os.Exit(1)
+		content := ""
+		if len(blocks) == 1 {
+			content = blocks[0].Content
+		}
+		var err error
+		content, attachments, err = attachFiles(content, attachPaths)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		blocks = []*Block{NewBlock(content)}
+		for _, attachment := range attachments {
+			attachment.BlockHash = blocks[0].ContentHash
+		}
 	}
 
-	// Parse all arguments after "notes grep"
-	args := os.Args[2:]
-	var includeKeywords []string
-	var excludeKeywords []string
+	if len(blocks) == 0 || blocks[0].IsEmpty() {
+		fmt.Println("Error: content cannot be empty")
+		os.Exit(1)
+	}
 
-	for _, arg := range args {
-		if arg == "" {
-			continue
+	existing := 0
+	var added []*Block
+	if remote != nil {
+		if err := remote.AddBlocks(blocks); err != nil {
+			log.Fatalf("Failed to add note: %v", err)
 		}
-		if arg[0] == '-' {
-			// Remove the ! prefix for exclude keywords
-			if len(arg) > 1 {
-				excludeKeywords = append(excludeKeywords, arg[1:])
-			}
-		} else {
-			includeKeywords = append(includeKeywords, arg)
+	} else {
+		changes, err := newMainReconciler().AddBlocks(blocks)
+		if err != nil {
+			log.Fatalf("Failed to add note: %v", err)
+		}
+		existing = len(changes.Updated)
+		added = changes.Added
+	}
+	for _, attachment := range attachments {
+		if err := db.AddAttachment(attachment); err != nil {
+			log.Fatalf("Failed to record attachment: %v", err)
 		}
 	}
 
-	if len(includeKeywords) == 0 && len(excludeKeywords) == 0 {
-		fmt.Println("Error: at least one search term is required")
-		os.Exit(1)
+	switch {
+	case len(blocks) == 1:
+		fmt.Println("Note added successfully")
+	case existing > 0:
+		fmt.Printf("Added %d notes (%d already present, marked touched)\n", len(blocks)-existing, existing)
+	default:
+		fmt.Printf("Added %d notes\n", len(blocks))
+	}
+	for _, block := range added {
+		warnSameTitle(block)
 	}
+	enrichAddedBlocks(added)
+}
 
-	blocks, err := db.SearchBlocks(includeKeywords, excludeKeywords)
+// contentFromTemplate renders a template, inserting text at its cursor, or
+// opens the rendered template in the editor when no text is given.
+func contentFromTemplate(name string, assignments []string, text string) (string, error) {
+	body, err := LoadTemplate(config.TemplatesDir(), name)
 	if err != nil {
-		log.Fatalf("Failed to search: %v", err)
+		return "", err
 	}
 
-	if len(blocks) == 0 {
-		fmt.Println("No blocks found matching the specified criteria")
+	vars, err := parseTemplateVars(assignments)
+	if err != nil {
+		return "", err
+	}
+
+	rendered, cursorLine, err := RenderTemplate(body, vars, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	if text != "" {
+		return InsertAtCursor(rendered, cursorLine, text), nil
+	}
+	return editInEditor(rendered, cursorLine)
+}
+
+// readStdin reads all of standard input, hinting at how to finish when the
+// user is typing at a terminal.
+func readStdin() (string, error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprintln(os.Stderr, "Reading note from stdin, finish with Ctrl-D")
+	}
+
+	content, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// newMainReconciler returns a reconciler for the repository's notes.md view.
+func newMainReconciler() *Reconciler {
+	return NewReconciler(db, NewFileManager(notesPath), config)
+}
+
+func handleEncrypt() {
+	encrypted, err := db.IsEncrypted()
+	if err != nil {
+		log.Fatalf("Failed to check encryption state: %v", err)
+	}
+	if encrypted {
+		fmt.Println("Repository is already encrypted")
 		return
 	}
 
-	for i, block := range blocks {
-		fmt.Println(block.Content)
-		if i < len(blocks)-1 {
-			fmt.Println()
+	passphrase, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		log.Fatalf("Failed to read passphrase: %v", err)
+	}
+	if os.Getenv("NOTES_PASSPHRASE") == "" {
+		confirmation, err := readPassphrase("Repeat passphrase: ")
+		if err != nil {
+			log.Fatalf("Failed to read passphrase: %v", err)
+		}
+		if confirmation != passphrase {
+			fmt.Println("Error: passphrases do not match")
+			os.Exit(1)
 		}
 	}
+
+	if err := db.EncryptRepository(passphrase); err != nil {
+		log.Fatalf("Failed to encrypt repository: %v", err)
+	}
+
+	fmt.Println("Repository encrypted. Generated markdown files are still plaintext.")
+	if keyringAvailable() {
+		fmt.Println("Run 'notes keyring save' to unlock it from the system keyring instead of a prompt.")
+	}
+}
+
+func handleDecrypt() {
+	encrypted, err := db.IsEncrypted()
+	if err != nil {
+		log.Fatalf("Failed to check encryption state: %v", err)
+	}
+	if !encrypted {
+		fmt.Println("Repository is not encrypted")
+		return
+	}
+
+	if err := db.DecryptRepository(); err != nil {
+		log.Fatalf("Failed to decrypt repository: %v", err)
+	}
+	// The passphrase is no use once the repository is decrypted
+	if err := keyringForget(filepath.Dir(dbPath)); err != nil && err != errNoKeyring {
+		log.Printf("Warning: failed to remove the passphrase from the system keyring: %v", err)
+	}
+
+	fmt.Println("Repository decrypted")
+}
+
+func handleIngest() {
+	fs := flag.NewFlagSet("ingest", flag.ExitOnError)
+	tag := fs.String("tag", "", "tag to append to each imported block")
+	preserveDates := fs.Bool("preserve-dates", false, "date the blocks by the file's front matter date or modification time")
+	args := parseArgs(fs, os.Args[2:])
+
+	if len(args) < 1 {
+		fmt.Println("Error: ingest command requires a file path")
+		fmt.Println("Usage: notes ingest <file> [--tag imported/meeting] [--preserve-dates]")
+		os.Exit(1)
+	}
+
+	reconciler := newMainReconciler()
+	reconciler.preserveDates = *preserveDates
+	changes, skipped, err := reconciler.IngestTaggedBlocks(args[0], *tag)
+	if err != nil {
+		log.Fatalf("Failed to ingest %s: %v", args[0], err)
+	}
+
+	fmt.Printf("Ingested %d blocks from %s (%d duplicates skipped)\n", len(changes.Added), args[0], skipped)
 }
 
 func handleWatch() {
-	if len(os.Args) < 3 {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	preserveDates := fs.Bool("preserve-dates", false, "import the file now, dating its blocks by its front matter date or modification time")
+	args := parseArgs(fs, os.Args[2:])
+
+	if len(args) < 1 {
 		fmt.Println("Error: watch command requires a file path")
-		fmt.Println("Usage: notes watch <file>")
+		fmt.Println("Usage: notes watch [--preserve-dates] <file>")
 		os.Exit(1)
 	}
 
-	filePath := os.Args[2]
-
-	// Resolve to absolute path for consistency
-	absPath, err := ResolveAbsolutePath(filePath)
-	if err != nil {
-		log.Fatalf("Failed to resolve file path: %v", err)
+	// Store the path with symlinks resolved, so the same file reached by
+	// another name isn't watched twice
+	if err := CanonicalizeWatchedFiles(db); err != nil {
+		log.Fatalf("Failed to update watched files: %v", err)
 	}
+	absPath := CanonicalPath(args[0])
 
 	// Check if file exists
 	if !fileExists(absPath) {
 		log.Fatalf("File does not exist: %s", absPath)
 	}
 
+	if config.FileConfig(absPath).Mirror {
+		fmt.Printf("Error: %s is configured as a mirror, which is output-only and can't be watched\n", absPath)
+		os.Exit(1)
+	}
+
+	// Catch log files and binaries before the daemon turns them into blocks
+	content, err := readTextFile(absPath)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkNewBlockCount(absPath, len(ParseBlocksFromMarkdown(content))); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Add file to watched files in database
 	if err := db.AddWatchedFile(absPath); err != nil {
 		log.Fatalf("Failed to add file to watch list: %v", err)
 	}
 
 	fmt.Printf("Added %s to watch list\n", absPath)
+
+	// The daemon would reconcile the file with blocks dated now, so the
+	// first reconcile happens here instead
+	if *preserveDates {
+		reconciler := NewReconciler(db, NewFileManager(absPath), config)
+		reconciler.preserveDates = true
+		changes, err := reconciler.ReconcileFromSpecificFile()
+		if err != nil {
+			log.Fatalf("Failed to reconcile %s: %v", absPath, err)
+		}
+		if err := reconciler.RegenerateSpecificFile(); err != nil {
+			log.Fatalf("Failed to regenerate %s: %v", absPath, err)
+		}
+		if err := newMainReconciler().RegenerateMarkdownFile(); err != nil {
+			log.Fatalf("Failed to regenerate markdown file: %v", err)
+		}
+		fmt.Printf("Imported %d blocks with their original dates\n", len(changes.Added))
+	}
 	fmt.Println("Start the watcher daemon with: notes watcher")
 }
 
@@ -203,13 +864,10 @@ func handleUnwatch() {
 		os.Exit(1)
 	}
 
-	filePath := os.Args[2]
-
-	// Resolve to absolute path for consistency
-	absPath, err := ResolveAbsolutePath(filePath)
-	if err != nil {
-		log.Fatalf("Failed to resolve file path: %v", err)
+	if err := CanonicalizeWatchedFiles(db); err != nil {
+		log.Fatalf("Failed to update watched files: %v", err)
 	}
+	absPath := CanonicalPath(os.Args[2])
 
 	// Check if file is in watch list
 	isWatched, err := db.IsFileWatched(absPath)
@@ -231,14 +889,197 @@ func handleUnwatch() {
 	fmt.Println("The watcher daemon will pick up these changes automatically")
 }
 
+// reconcileSummary is what `notes reconcile --json` prints for each file.
+type reconcileSummary struct {
+	File      string `json:"file"`
+	Added     int    `json:"added"`
+	Updated   int    `json:"updated"`
+	Deleted   int    `json:"deleted"`
+	Conflicts int    `json:"conflicts"`
+	Skipped   string `json:"skipped,omitempty"`  // why the file was left alone
+	Released  bool   `json:"released,omitempty"` // from the daemon's quarantine
+}
+
+func (s *reconcileSummary) String() string {
+	if s.Skipped != "" {
+		return fmt.Sprintf("Skipping %s: %s", s.File, s.Skipped)
+	}
+	summary := fmt.Sprintf("Reconciled %s: %d added, %d updated, %d deleted", s.File, s.Added, s.Updated, s.Deleted)
+	if s.Added == 0 && s.Updated == 0 && s.Deleted == 0 {
+		summary = fmt.Sprintf("Reconciled %s: no changes", s.File)
+	}
+	if s.Conflicts > 0 {
+		summary += fmt.Sprintf(", %d conflict(s)", s.Conflicts)
+	}
+	if s.Released {
+		summary += "; released from quarantine"
+	}
+	return summary
+}
+
+// handleReconcile runs the reconcile the watcher daemon would run on a
+// change, for scripts and cron jobs in setups without the daemon.
+func handleReconcile() {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	force := fs.Bool("force", false, "apply deletions over the limits.max_deletes and limits.max_delete_percent guard")
+	all := fs.Bool("all", false, "reconcile every watched file (the default without files)")
+	jsonOutput := fs.Bool("json", false, "print a JSON summary of the changes to each file")
+	args := parseArgs(fs, os.Args[2:])
+
+	if *all && len(args) > 0 {
+		fmt.Println("Error: --all can't be combined with files")
+		os.Exit(1)
+	}
+	if err := CanonicalizeWatchedFiles(db); err != nil {
+		log.Fatalf("Failed to update watched files: %v", err)
+	}
+	watchedFiles, err := db.GetWatchedFiles()
+	if err != nil {
+		log.Fatalf("Failed to get watched files: %v", err)
+	}
+
+	// Reconcile the given files, or every watched file
+	filePaths := watchedFiles
+	if len(args) > 0 {
+		filePaths = nil
+		for _, arg := range args {
+			absPath := CanonicalPath(arg)
+			if !slices.Contains(watchedFiles, absPath) {
+				fmt.Printf("Error: %s is not in the watch list\n", absPath)
+				os.Exit(1)
+			}
+			filePaths = append(filePaths, absPath)
+		}
+	}
+
+	summaries := []*reconcileSummary{}
+	refused := 0
+	for _, filePath := range filePaths {
+		summary := &reconcileSummary{File: filePath}
+		summaries = append(summaries, summary)
+		if !fileExists(filePath) {
+			summary.Skipped = "file does not exist"
+			if !*jsonOutput {
+				fmt.Println(summary)
+			}
+			continue
+		}
+
+		reconciler := NewReconciler(db, NewFileManager(filePath), config)
+		reconciler.force = *force
+		reconciler.backupBeforeDeleting = true
+		changes, err := reconciler.ReconcileFromSpecificFile()
+		if errors.Is(err, ErrTooManyDeletions) {
+			// Leave the file as it is so it can be forced through
+			summary.Skipped = err.Error()
+			if !*jsonOutput {
+				fmt.Printf("Error: %v\n", err)
+			}
+			refused++
+			continue
+		}
+		if err != nil {
+			log.Fatalf("Failed to reconcile %s: %v", filePath, err)
+		}
+		if err := reconciler.RegenerateSpecificFile(); err != nil {
+			log.Fatalf("Failed to regenerate %s: %v", filePath, err)
+		}
+		if summary.Released, err = db.ReleaseWatchedFile(filePath); err != nil {
+			log.Fatalf("Failed to release %s: %v", filePath, err)
+		}
+		summary.Added, summary.Updated, summary.Deleted = len(changes.Added), len(changes.Updated), len(changes.Deleted)
+		summary.Conflicts = len(changes.Conflicts)
+		if !*jsonOutput {
+			fmt.Println(summary)
+		}
+	}
+
+	if err := newMainReconciler().RegenerateMarkdownFile(); err != nil {
+		log.Fatalf("Failed to regenerate markdown file: %v", err)
+	}
+	if *jsonOutput {
+		encoded, err := json.MarshalIndent(summaries, "", "  ")
+		if err != nil {
+			log.Fatalf("Failed to encode summary: %v", err)
+		}
+		fmt.Println(string(encoded))
+	}
+	if refused > 0 {
+		os.Exit(1)
+	}
+}
+
+// runPeriodicTasks fires due reminders, clones recurring blocks, resurfaces
+// blocks, takes scheduled backups, samples the database size and saves the
+// daemon's metrics on its reminder tick.
+func runPeriodicTasks(reminderHooks *HookRunner, now time.Time) {
+	if _, err := SyncSchedule(db); err != nil {
+		log.Printf("Error updating schedule: %v", err)
+		multiFileWatcher.recordError("", err)
+	} else if err := FireDueReminders(db, reminderHooks, now); err != nil {
+		log.Printf("Error firing reminders: %v", err)
+		multiFileWatcher.recordError("", err)
+	}
+	if err := recurIfDue(now); err != nil {
+		log.Printf("Error cloning recurring blocks: %v", err)
+		multiFileWatcher.recordError("", err)
+	}
+	if err := resurfaceIfDue(now); err != nil {
+		log.Printf("Error resurfacing blocks: %v", err)
+		multiFileWatcher.recordError("", err)
+	}
+	if err := backupIfDue(now); err != nil {
+		log.Printf("Error taking scheduled backup: %v", err)
+		multiFileWatcher.recordError("", err)
+	}
+	if err := recordDatabaseSize(now); err != nil {
+		log.Printf("Error recording database size: %v", err)
+	}
+	multiFileWatcher.saveMetrics(true)
+}
+
 func handleWatcher() {
+	if len(os.Args) > 2 {
+		switch os.Args[2] {
+		case "install-service":
+			handleInstallService()
+			return
+		case "uninstall-service":
+			handleUninstallService()
+			return
+		case "stop":
+			handleWatcherStop()
+			return
+		}
+	}
+
+	fs := flag.NewFlagSet("watcher", flag.ExitOnError)
+	pollInterval := fs.Duration("poll", 0, "poll watched files at this interval instead of using filesystem events")
+	parseArgs(fs, os.Args[2:])
+
+	// Only one daemon may reconcile a repository at a time
+	daemonLock, err := acquireDaemonLock(config.PIDFile())
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer releaseDaemonLock(daemonLock)
+	db.audit.SetSource(AuditSourceDaemon)
+
+	// Clear a stop request that outlived the daemon it was meant for
+	os.Remove(config.StopFile())
+	defer os.Remove(config.StopFile())
+
 	// Initialize multi-file watcher
-	var err error
-	multiFileWatcher, err = NewMultiFileWatcher(db)
+	multiFileWatcher, err = NewMultiFileWatcher(db, config)
 	if err != nil {
 		log.Fatalf("Failed to create multi-file watcher: %v", err)
 	}
 
+	if *pollInterval > 0 {
+		multiFileWatcher.EnablePolling(*pollInterval)
+	}
+
 	fmt.Println("Starting file watcher daemon...")
 
 	// Start the watcher
@@ -253,28 +1094,52 @@ func handleWatcher() {
 	syncTicker := time.NewTicker(5 * time.Second)
 	defer syncTicker.Stop()
 
-	// Set up signal handling for graceful shutdown
+	reminderTicker := time.NewTicker(reminderInterval)
+	defer reminderTicker.Stop()
+	reminderHooks := NewHookRunner(config.HooksDir())
+
+	// Set up signal handling for graceful shutdown. Windows has no way to
+	// send SIGTERM to another process, so `notes watcher stop` leaves a
+	// stop file instead, which works everywhere.
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
+	stopTicker := time.NewTicker(daemonStopCheckPeriod)
+	defer stopTicker.Stop()
+
+	shutdown := func() {
+		// Stop the multi-file watcher
+		if err := multiFileWatcher.Stop(); err != nil {
+			log.Printf("Error stopping watcher: %v", err)
+		}
+		fmt.Println("File watcher daemon stopped.")
+	}
+
 	// Main daemon loop
 	for {
 		select {
 		case <-syncTicker.C:
-			// Periodically sync with database
-			if err := multiFileWatcher.SyncWithDatabase(); err != nil {
-				log.Printf("Error syncing with database: %v", err)
-			}
+			// Periodically sync with database, between reconciliations
+			multiFileWatcher.Submit(func() {
+				if err := multiFileWatcher.SyncWithDatabase(); err != nil {
+					log.Printf("Error syncing with database: %v", err)
+					multiFileWatcher.recordError("", err)
+				}
+			})
 
-		case sig := <-sigCh:
-			fmt.Printf("\nReceived %s signal. Shutting down gracefully...\n", sig)
+		case now := <-reminderTicker.C:
+			multiFileWatcher.Submit(func() { runPeriodicTasks(reminderHooks, now) })
 
-			// Stop the multi-file watcher
-			if err := multiFileWatcher.Stop(); err != nil {
-				log.Printf("Error stopping watcher: %v", err)
+		case <-stopTicker.C:
+			if stopRequested(config.StopFile()) {
+				fmt.Println("\nStop requested. Shutting down gracefully...")
+				shutdown()
+				return
 			}
 
-			fmt.Println("File watcher daemon stopped.")
+		case sig := <-sigCh:
+			fmt.Printf("\nReceived %s signal. Shutting down gracefully...\n", sig)
+			shutdown()
 			return
 		}
 	}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// clipboardTools lists the commands tried, in order, to write and read the
+// system clipboard on each platform.
+func clipboardTools() (copy, paste [][]string) {
+	switch runtime.GOOS {
+	case "darwin":
+		return [][]string{{"pbcopy"}}, [][]string{{"pbpaste"}}
+	case "windows":
+		return [][]string{{"clip"}}, [][]string{{"powershell", "-NoProfile", "-NonInteractive", "-Command", "Get-Clipboard -Raw"}}
+	default:
+		return [][]string{{"wl-copy"}, {"xclip", "-selection", "clipboard"}, {"xsel", "--clipboard", "--input"}},
+			[][]string{{"wl-paste", "--no-newline"}, {"xclip", "-selection", "clipboard", "-o"}, {"xsel", "--clipboard", "--output"}}
+	}
+}
+
+// copyToClipboard writes content with the first available clipboard tool.
+func copyToClipboard(content string) error {
+	copyTools, _ := clipboardTools()
+	for _, tool := range copyTools {
+		if _, err := exec.LookPath(tool[0]); err != nil {
+			continue
+		}
+		cmd := exec.Command(tool[0], tool[1:]...)
+		cmd.Stdin = strings.NewReader(content)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s failed: %w: %s", tool[0], err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+	return fmt.Errorf("no clipboard tool found")
+}
+
+// readClipboard returns the clipboard's text with the first available
+// clipboard tool.
+func readClipboard() (string, error) {
+	_, pasteTools := clipboardTools()
+	for _, tool := range pasteTools {
+		if _, err := exec.LookPath(tool[0]); err != nil {
+			continue
+		}
+		output, err := exec.Command(tool[0], tool[1:]...).Output()
+		if err != nil {
+			return "", fmt.Errorf("%s failed: %w", tool[0], err)
+		}
+		return string(output), nil
+	}
+	return "", fmt.Errorf("no clipboard tool found")
+}
+
+// clipContent turns clipboard text into the content of a single block.
+// Blank lines are dropped, since they would split the block in notes.md.
+func clipContent(text, tag string) string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		if line = strings.TrimRight(line, " \t"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	content := strings.Join(lines, "\n")
+
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "#")
+	if content != "" && tag != "" && !NewBlock(content).HasTag(tag) {
+		content += "\n#" + tag
+	}
+	return content
+}
+
+func handleClip() {
+	fs := flag.NewFlagSet("clip", flag.ExitOnError)
+	tag := fs.String("tag", "", "tag to append to the captured block")
+	notify := fs.Bool("notify", false, "confirm with a desktop notification, for use from a hotkey")
+	parseArgs(fs, os.Args[2:])
+
+	// Without a terminal, as from a hotkey, errors are only seen as notifications
+	fail := func(format string, args ...any) {
+		message := fmt.Sprintf(format, args...)
+		if *notify {
+			sendDesktopNotification("notes: capture failed", message)
+		}
+		fmt.Printf("Error: %s\n", message)
+		os.Exit(1)
+	}
+
+	text, err := readClipboard()
+	if err != nil {
+		fail("failed to read clipboard: %v", err)
+	}
+
+	block := NewBlock(clipContent(text, *tag))
+	if block.IsEmpty() {
+		fail("clipboard is empty")
+	}
+
+	if remote != nil {
+		err = remote.AddBlocks([]*Block{block})
+	} else {
+		_, err = newMainReconciler().AddBlocks([]*Block{block})
+	}
+	if err != nil {
+		fail("failed to add note: %v", err)
+	}
+
+	if *notify {
+		if err := sendDesktopNotification("notes: captured", block.FirstLine()); err != nil {
+			log.Printf("Failed to send desktop notification: %v", err)
+		}
+	}
+	fmt.Println("Note added successfully")
+}
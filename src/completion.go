@@ -0,0 +1,407 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// completionCommands lists each command with the flags it accepts, for
+// shell completion. TestCompletionCommandsMatchDispatch fails when it falls
+// out of step with the switch in main or the handlers' flag sets.
+var completionCommands = map[string][]string{
+	"init":           nil,
+	"add":            {"--single", "--split", "--template", "--var", "--attach"},
+	"clip":           {"--tag", "--notify"},
+	"web":            {"--tag", "--link-only"},
+	"mail-ingest":    {"--tag"},
+	"bot":            {"--telegram-token", "--telegram-api", "--tag", "--allow"},
+	"grep":           {"--json", "--count", "--files", "--first-line", "--interactive", "--no-pager", "--render", "--since", "--until", "--sort", "--reverse", "--limit", "--min-words", "--max-words"},
+	"log":            {"-n", "--full", "--render", "--no-pager", "--since", "--until", "--min-words", "--max-words"},
+	"watch":          {"--preserve-dates"},
+	"unwatch":        nil,
+	"watcher":        {"--poll", "--no-start"},
+	"ingest":         {"--tag", "--preserve-dates"},
+	"import-dir":     {"--recursive", "--tag", "--watch", "--preserve-dates"},
+	"import-roam":    {"--tag"},
+	"templates":      nil,
+	"status":         nil,
+	"stats":          {"--weeks", "--top", "--heatmap", "--json"},
+	"agenda":         {"--days", "--all"},
+	"recur":          {"--run"},
+	"review":         {"--limit", "--all", "--render"},
+	"random":         {"-n", "--bump"},
+	"daily":          {"--yesterday"},
+	"log-work":       {"--project", "--duration"},
+	"timesheet":      {"--week", "--since", "--until", "--project", "--json"},
+	"visibility":     nil,
+	"cat":            {"--render"},
+	"pick":           {"--edit", "--copy", "--render", "--no-fzf"},
+	"summarize":      {"--tag", "--summary-tag", "--since", "--until", "--audience", "--prompt", "--dry-run"},
+	"enrich":         {"--limit", "--list", "--accept", "--reject", "--tags-only"},
+	"open":           nil,
+	"edit":           nil,
+	"block-at":       {"--json"},
+	"touch":          nil,
+	"context":        {"--json"},
+	"links":          nil,
+	"mentions":       {"--full", "--json", "--since", "--until"},
+	"people":         {"--json"},
+	"lint":           {"--json"},
+	"meta":           nil,
+	"retag":          {"--from", "--to"},
+	"tag":            {"--grep"},
+	"bulkedit":       {"--grep"},
+	"append":         {"--top"},
+	"split":          nil,
+	"merge":          nil,
+	"dedupe":         {"--threshold", "--auto", "--dry-run"},
+	"undo":           nil,
+	"audit":          {"-n", "-f", "--json"},
+	"deleted":        {"--last", "-n", "--restore"},
+	"regenerate":     nil,
+	"export":         {"--format", "--audience"},
+	"assets":         {"--dry-run"},
+	"reconcile":      {"--force", "--all", "--json"},
+	"mcp":            {"--audience"},
+	"lsp":            {"--stdio"},
+	"serve":          {"--addr", "--token", "--tls-cert", "--tls-key", "--audience", "--metrics", "--ui", "--tls", "--rate-limit"},
+	"token":          nil,
+	"sync":           nil,
+	"doctor":         {"--fix"},
+	"backup":         {"--to", "--keep", "--list"},
+	"diff":           {"--json", "--full"},
+	"restore-backup": nil,
+	"rehash":         nil,
+	"encrypt":        nil,
+	"decrypt":        nil,
+	"keyring":        nil,
+	"profiles":       nil,
+	"alias":          nil,
+	"completion":     nil,
+}
+
+// globalFlags are the options that may precede the command. Those taking a
+// value map to true.
+var globalFlags = map[string]bool{
+	"-r": true, "--repo": true, "--db": true,
+	"-q": false, "--quiet": false, "-v": false, "--verbose": false, "--no-regenerate": false, "--plain": false, "--read-only": false,
+}
+
+// completionShells maps each supported shell to its completion script. The
+// scripts hand the words typed so far to `notes __complete`, which prints
+// one candidate per line.
+var completionShells = map[string]string{
+	"bash": `_notes_complete() {
+    local IFS=$'\n'
+    COMPREPLY=($(notes __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+    if [[ ${#COMPREPLY[@]} -eq 1 && ${COMPREPLY[0]} == */ ]]; then
+        compopt -o nospace
+    fi
+}
+complete -F _notes_complete notes
+`,
+	"zsh": `#compdef notes
+_notes() {
+    local -a candidates
+    candidates=("${(@f)$(notes __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+    candidates=(${candidates:#})
+    compadd -Q -S '' -- ${candidates:#*[^/]}
+    compadd -Q -- ${candidates:#*/}
+}
+compdef _notes notes
+`,
+	"fish": `function __notes_complete
+    set -l words (commandline -opc)
+    notes __complete $words[2..-1] (commandline -ct) 2>/dev/null
+end
+complete -c notes -f -a '(__notes_complete)'
+`,
+}
+
+func handleCompletion() {
+	if len(os.Args) != 3 || completionShells[os.Args[2]] == "" {
+		fmt.Println("Error: completion command requires a shell")
+		fmt.Println("Usage: notes completion bash|zsh|fish")
+		os.Exit(1)
+	}
+	fmt.Print(completionShells[os.Args[2]])
+}
+
+// handleComplete prints the candidates for the last of the given words.
+// It runs before the repository is opened and stays quiet on any error,
+// since its output goes straight into the user's command line.
+func handleComplete() {
+	words := os.Args[2:]
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	for _, candidate := range completeWords(words) {
+		fmt.Println(candidate)
+	}
+}
+
+func completeWords(words []string) []string {
+	current := words[len(words)-1]
+	previous := ""
+	if len(words) > 1 {
+		previous = words[len(words)-2]
+	}
+
+	// Global options come before the command
+	args := words[:len(words)-1]
+	profile := os.Getenv("NOTES_PROFILE")
+	for len(args) > 0 {
+		takesValue, ok := globalFlags[args[0]]
+		if !ok {
+			break
+		}
+		if takesValue && len(args) > 1 && args[0] != "--db" {
+			profile = args[1]
+		}
+		if takesValue {
+			args = args[min(2, len(args)):]
+		} else {
+			args = args[1:]
+		}
+	}
+	if len(args) == 0 {
+		switch {
+		case previous == "-r" || previous == "--repo":
+			return completeProfiles(current)
+		case previous == "--db":
+			return completeFiles(current)
+		case strings.HasPrefix(current, "-"):
+			return withPrefix(sortedKeys(globalFlags), current)
+		}
+		return withPrefix(append(sortedKeys(completionCommands), completeAliases()...), current)
+	}
+
+	// An alias completes like the command it expands to
+	command := args[0]
+	if _, builtin := completionCommands[command]; !builtin {
+		if userConfig, err := LoadUserConfig(); err == nil && len(userConfig.Aliases[command]) > 0 {
+			args = append(slices.Clone(userConfig.Aliases[command]), args[1:]...)
+			command = args[0]
+		}
+	}
+	positional := 0
+	for _, arg := range args[1:] {
+		if !strings.HasPrefix(arg, "-") {
+			positional++
+		}
+	}
+
+	switch {
+	case previous == "--tag" || previous == "--summary-tag" || previous == "--from" || (previous == "--to" && command == "retag"):
+		return completeTags(profile, current, false)
+	case previous == "--audience":
+		return withPrefix(visibilityLevels, current)
+	case previous == "--sort":
+		return withPrefix(searchSorts, current)
+	case previous == "--format" && command == "export":
+		return withPrefix([]string{"markdown", ExportFormatRoamJSON}, current)
+	case previous == "--attach" || previous == "--tls-cert" || previous == "--tls-key" || (previous == "--to" && command == "backup"):
+		return completeFiles(current)
+	case strings.HasPrefix(current, "-"):
+		return withPrefix(completionCommands[command], current)
+	case strings.HasPrefix(current, "#"):
+		return completeTags(profile, current, true)
+	}
+
+	switch command {
+	case "watch", "ingest", "import-dir", "import-roam", "restore-backup", "lint":
+		return completeFiles(current)
+	case "unwatch", "reconcile":
+		return completeWatchedFiles(profile, current)
+	case "completion":
+		return withPrefix(sortedKeys(completionShells), current)
+	case "export", "block-at":
+		if positional == 0 {
+			return completeFiles(current)
+		}
+	case "assets":
+		if positional == 0 {
+			return withPrefix([]string{"gc"}, current)
+		}
+	case "audit":
+		if positional == 0 {
+			return withPrefix([]string{"tail"}, current)
+		}
+	case "keyring":
+		if positional == 0 {
+			return withPrefix([]string{"save", "forget"}, current)
+		}
+	case "token":
+		if positional == 0 {
+			return withPrefix([]string{"create", "list", "revoke"}, current)
+		}
+	case "watcher":
+		if positional == 0 {
+			return withPrefix([]string{"install-service", "stop", "uninstall-service"}, current)
+		}
+	case "alias":
+		if positional == 0 {
+			return withPrefix([]string{"add", "list", "rm"}, current)
+		}
+		if positional == 1 && args[1] == "rm" {
+			return withPrefix(completeAliases(), current)
+		}
+		if positional == 2 && args[1] == "add" {
+			return withPrefix(sortedKeys(completionCommands), current)
+		}
+	case "meta":
+		if positional == 0 {
+			return withPrefix([]string{"keys", "set", "unset"}, current)
+		}
+	case "mentions":
+		if positional == 0 {
+			return completePeople(profile, current)
+		}
+	case "visibility":
+		if positional == 1 {
+			return withPrefix(append(slices.Clone(visibilityLevels), "default"), current)
+		}
+	}
+	return nil
+}
+
+func withPrefix(candidates []string, prefix string) []string {
+	var matches []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, prefix) {
+			matches = append(matches, candidate)
+		}
+	}
+	return matches
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func completeAliases() []string {
+	userConfig, err := LoadUserConfig()
+	if err != nil {
+		return nil
+	}
+	return sortedKeys(userConfig.Aliases)
+}
+
+func completeProfiles(prefix string) []string {
+	userConfig, err := LoadUserConfig()
+	if err != nil {
+		return nil
+	}
+	return withPrefix(userConfig.ProfileNames(), prefix)
+}
+
+// completeFiles lists the files and directories starting with prefix,
+// directories with a trailing slash.
+func completeFiles(prefix string) []string {
+	dir, base := filepath.Split(prefix)
+	readDir := "."
+	if dir != "" {
+		readDir = expandHome(dir)
+	}
+	entries, err := os.ReadDir(readDir)
+	if err != nil {
+		return nil
+	}
+
+	var matches []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, base) || (strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".")) {
+			continue
+		}
+		if entry.IsDir() {
+			name += "/"
+		}
+		matches = append(matches, dir+name)
+	}
+	return matches
+}
+
+// openCompletionDatabase opens the repository for reading tags and watched
+// files, or returns nil. Encrypted repositories would need the passphrase,
+// so they are skipped.
+func openCompletionDatabase(profile string) *Database {
+	if _, err := resolveRepository(profile); err != nil || !fileExists(dbPath) {
+		return nil
+	}
+	database, err := NewDatabase(dbPath)
+	if err != nil {
+		return nil
+	}
+	if encrypted, err := database.IsEncrypted(); err != nil || encrypted {
+		database.Close()
+		return nil
+	}
+	return database
+}
+
+func completeTags(profile, prefix string, withHash bool) []string {
+	database := openCompletionDatabase(profile)
+	if database == nil {
+		return nil
+	}
+	defer database.Close()
+
+	seen := make(map[string]bool)
+	err := database.IterateBlocks(func(block *Block) error {
+		for _, tag := range ExtractTags(block.Content) {
+			if withHash {
+				tag = "#" + tag
+			}
+			seen[tag] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil
+	}
+	return withPrefix(sortedKeys(seen), prefix)
+}
+
+func completePeople(profile, prefix string) []string {
+	database := openCompletionDatabase(profile)
+	if database == nil {
+		return nil
+	}
+	defer database.Close()
+
+	seen := make(map[string]bool)
+	err := database.IterateBlocks(func(block *Block) error {
+		for _, name := range ExtractMentions(block.Content) {
+			seen[name] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil
+	}
+	return withPrefix(sortedKeys(seen), prefix)
+}
+
+func completeWatchedFiles(profile, prefix string) []string {
+	database := openCompletionDatabase(profile)
+	if database == nil {
+		return nil
+	}
+	defer database.Close()
+
+	files, err := database.GetWatchedFiles()
+	if err != nil {
+		return nil
+	}
+	return withPrefix(files, prefix)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// flagDefiners maps the FlagSet methods that define a flag to the position of
+// the flag's name among their arguments.
+var flagDefiners = map[string]int{
+	"String": 0, "Bool": 0, "Int": 0, "Int64": 0, "Uint": 0, "Float64": 0, "Duration": 0, "Func": 0, "BoolFunc": 0,
+	"StringVar": 1, "BoolVar": 1, "IntVar": 1, "Int64Var": 1, "UintVar": 1, "Float64Var": 1, "DurationVar": 1, "Var": 1, "TextVar": 1,
+}
+
+// completionSource is the package's source, parsed to find what main
+// dispatches and which flags each handler defines.
+type completionSource struct {
+	funcs map[string]*ast.FuncDecl
+}
+
+func parseCompletionSource(t *testing.T) *completionSource {
+	t.Helper()
+	fset := token.NewFileSet()
+	files, err := parser.ParseDir(fset, ".", func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := &completionSource{funcs: make(map[string]*ast.FuncDecl)}
+	for _, file := range files["main"].Files {
+		for _, decl := range file.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil {
+				source.funcs[fn.Name.Name] = fn
+			}
+		}
+	}
+	return source
+}
+
+// commands returns the commands main handles, with the function each one
+// calls.
+func (s *completionSource) commands() map[string]string {
+	commands := make(map[string]string)
+	ast.Inspect(s.funcs["main"].Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SwitchStmt:
+			if tag, ok := n.Tag.(*ast.Ident); !ok || tag.Name != "command" {
+				return true
+			}
+			for _, stmt := range n.Body.List {
+				clause := stmt.(*ast.CaseClause)
+				handler := ""
+				if len(clause.Body) > 0 {
+					if call, ok := callOf(clause.Body[0]); ok {
+						handler = call
+					}
+				}
+				for _, expr := range clause.List {
+					commands[stringLiteral(expr)] = handler
+				}
+			}
+		case *ast.IfStmt:
+			// if command == "profiles" { handleProfiles(); return }
+			cond, ok := n.Cond.(*ast.BinaryExpr)
+			if !ok || cond.Op != token.EQL {
+				return true
+			}
+			if ident, ok := cond.X.(*ast.Ident); ok && ident.Name == "command" && len(n.Body.List) > 0 {
+				if call, ok := callOf(n.Body.List[0]); ok {
+					commands[stringLiteral(cond.Y)] = call
+				}
+			}
+		}
+		return true
+	})
+	delete(commands, "")
+	return commands
+}
+
+// flags returns the flags defined by handler and the functions it calls, as
+// they are typed on the command line.
+func (s *completionSource) flags(handler string) []string {
+	var flags []string
+	visited := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		fn := s.funcs[name]
+		if fn == nil || visited[name] {
+			return
+		}
+		visited[name] = true
+
+		ast.Inspect(fn.Body, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			switch fun := call.Fun.(type) {
+			case *ast.Ident:
+				visit(fun.Name)
+			case *ast.SelectorExpr:
+				receiver, ok := fun.X.(*ast.Ident)
+				if !ok || receiver.Name != "fs" {
+					return true
+				}
+				index, ok := flagDefiners[fun.Sel.Name]
+				if !ok || index >= len(call.Args) {
+					return true
+				}
+				if flag := stringLiteral(call.Args[index]); len(flag) == 1 {
+					flags = append(flags, "-"+flag)
+				} else if flag != "" {
+					flags = append(flags, "--"+flag)
+				}
+			}
+			return true
+		})
+	}
+	visit(handler)
+	slices.Sort(flags)
+	return slices.Compact(flags)
+}
+
+func callOf(stmt ast.Stmt) (string, bool) {
+	expr, ok := stmt.(*ast.ExprStmt)
+	if !ok {
+		return "", false
+	}
+	call, ok := expr.X.(*ast.CallExpr)
+	if !ok {
+		return "", false
+	}
+	ident, ok := call.Fun.(*ast.Ident)
+	if !ok {
+		return "", false
+	}
+	return ident.Name, true
+}
+
+func stringLiteral(expr ast.Expr) string {
+	lit, ok := expr.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return ""
+	}
+	value, err := strconv.Unquote(lit.Value)
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+// completionCommands is written by hand, so this catches a command added to
+// main or a flag added to a handler without it.
+func TestCompletionCommandsMatchDispatch(t *testing.T) {
+	source := parseCompletionSource(t)
+	commands := source.commands()
+	delete(commands, "__complete")
+
+	for command, handler := range commands {
+		completed, ok := completionCommands[command]
+		if !ok {
+			t.Errorf("command %q is missing from completionCommands", command)
+			continue
+		}
+		defined := source.flags(handler)
+		for _, flag := range defined {
+			if !slices.Contains(completed, flag) {
+				t.Errorf("flag %s of %q is missing from completionCommands", flag, command)
+			}
+		}
+		for _, flag := range completed {
+			if !slices.Contains(defined, flag) {
+				t.Errorf("completionCommands offers %s for %q, which doesn't define it", flag, command)
+			}
+		}
+	}
+	for command := range completionCommands {
+		if _, ok := commands[command]; !ok {
+			t.Errorf("completionCommands lists %q, which main doesn't handle", command)
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	ConfigDirName  = ".notes"
+	ConfigFileName = "config.json"
+
+	// DefaultWatchedOrder keeps watched files in the order they were written.
+	DefaultWatchedOrder = "manual"
+)
+
+// Config holds repository settings read from .notes/config.json next to
+// notes.db. A missing file is equivalent to an empty config.
+type Config struct {
+	// Order is the block order used for notes.md.
+	Order string `json:"order,omitempty"`
+
+	// WatchedOrder is the block order used for watched files that don't set
+	// their own. It defaults to the author's order as written in the file.
+	WatchedOrder string `json:"watched_order,omitempty"`
+
+	// Files holds per-file settings keyed by path. Relative keys are resolved
+	// against the repository directory; ~ is the home directory.
+	Files map[string]FileConfig `json:"files,omitempty"`
+
+	// Routes maps tags to output files: each file is kept as a mirror of
+	// the blocks tagged with its tag or a tag nested under it, e.g.
+	// {"work": "work.md"}. Routes are merged into Files when loading.
+	Routes map[string]string `json:"routes,omitempty"`
+
+	// DailyTemplate is the initial content of a new `notes daily` block when
+	// no "daily" template exists. {{date}} is replaced with the journal date.
+	DailyTemplate string `json:"daily_template,omitempty"`
+
+	// Normalize lists the normalization steps applied to block content
+	// before hashing, e.g. ["lowercase", "nfc"]. See normalize.go.
+	Normalize []string `json:"normalize,omitempty"`
+
+	// Notify lists the watcher daemon events that raise a desktop
+	// notification. Unset means errors and conflicts; an empty list
+	// disables notifications.
+	Notify []string `json:"notify"`
+
+	// Layout is how blocks are laid out in generated files that don't set
+	// their own. See layout.go.
+	Layout *Layout `json:"layout,omitempty"`
+
+	// DefaultVisibility is the visibility of blocks without a visibility tag
+	// or explicit setting. See visibility.go.
+	DefaultVisibility string `json:"default_visibility,omitempty"`
+
+	// Resurface makes the watcher daemon mark forgotten blocks touched
+	// periodically, like `notes random --bump`.
+	Resurface *ResurfaceConfig `json:"resurface,omitempty"`
+
+	// Backup sets where `notes backup` writes snapshots and how many it
+	// keeps. See backup.go.
+	Backup *BackupConfig `json:"backup,omitempty"`
+
+	// References is how ((block-id)) references are written into generated
+	// files that don't set their own: link, transclude or none. See links.go.
+	References string `json:"references,omitempty"`
+
+	// Limits bounds the size of files read and the number of blocks one
+	// watched file may create. See limits.go.
+	Limits *Limits `json:"limits,omitempty"`
+
+	// Debounce is how long the watcher daemon waits for a watched file to
+	// stop changing before reconciling it, as a Go duration. While a file
+	// keeps changing the wait doubles, up to MaxDebounce.
+	Debounce    string `json:"debounce,omitempty"`
+	MaxDebounce string `json:"max_debounce,omitempty"`
+
+	// AI selects the language model `notes summarize` uses. See ai.go.
+	AI *AIConfig `json:"ai,omitempty"`
+
+	// Mail sets who `notes mail-ingest` accepts mail from. See mail.go.
+	Mail *MailConfig `json:"mail,omitempty"`
+
+	// Theme sets the colours, timestamp format and block separator of
+	// terminal output. See theme.go.
+	Theme *ThemeConfig `json:"theme,omitempty"`
+
+	// SkipUnchanged makes regeneration leave generated files alone when
+	// their content wouldn't change, so their mtimes don't churn, e.g. under
+	// version control.
+	SkipUnchanged bool `json:"skip_unchanged,omitempty"`
+
+	basePath    string
+	notesPath   string
+	ignoreRules *IgnoreRules
+}
+
+// ResurfaceConfig schedules periodic resurfacing. Every is a Go duration
+// such as "24h".
+type ResurfaceConfig struct {
+	Count int    `json:"count"`
+	Every string `json:"every"`
+}
+
+// BackupConfig holds backup settings. Dir defaults to .notes/backups and
+// may start with ~; Keep defaults to DefaultBackupKeep. Every is a Go
+// duration such as "24h" at which the watcher daemon takes a snapshot, and
+// DeleteThreshold makes it take one before a reconcile deleting more than
+// that many blocks. Both are off when unset.
+type BackupConfig struct {
+	Dir             string `json:"dir,omitempty"`
+	Keep            int    `json:"keep,omitempty"`
+	Every           string `json:"every,omitempty"`
+	DeleteThreshold int    `json:"delete_threshold,omitempty"`
+}
+
+// FileConfig holds settings for one generated file.
+type FileConfig struct {
+	Order  string  `json:"order,omitempty"`
+	Layout *Layout `json:"layout,omitempty"`
+
+	// Mirror makes the file output-only: it is generated from all blocks,
+	// like notes.md, and edits to it are never reconciled. See mirror.go.
+	Mirror bool `json:"mirror,omitempty"`
+
+	// ReadOnly removes write permission from a mirror after each write.
+	ReadOnly bool `json:"read_only,omitempty"`
+
+	// Limit keeps only the first Limit blocks of a mirror; 0 keeps all.
+	Limit int `json:"limit,omitempty"`
+
+	// Tag keeps only the blocks of a mirror tagged with it or a tag nested
+	// under it. Set by Routes.
+	Tag string `json:"tag,omitempty"`
+
+	// Local keeps the blocks a watched file creates to itself: they are left
+	// out of notes.md and mirrors, and removing a block from the file only
+	// detaches it. Blocks in a local file also survive being deleted from
+	// other files.
+	Local bool `json:"local,omitempty"`
+
+	// References overrides how ((block-id)) references are written.
+	References string `json:"references,omitempty"`
+
+	// Debounce and MaxDebounce override the daemon's debounce for a watched
+	// file.
+	Debounce    string `json:"debounce,omitempty"`
+	MaxDebounce string `json:"max_debounce,omitempty"`
+}
+
+func LoadConfig(basePath, notesPath string) (*Config, error) {
+	config := &Config{basePath: basePath, notesPath: notesPath}
+
+	ignoreRules, err := LoadIgnoreRules(filepath.Join(basePath, IgnoreFileName))
+	if err != nil {
+		return nil, err
+	}
+	config.ignoreRules = ignoreRules
+
+	configPath := filepath.Join(basePath, ConfigDirName, ConfigFileName)
+	if !fileExists(configPath) {
+		return config, nil
+	}
+
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %w", configPath, err)
+	}
+
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", configPath, err)
+	}
+
+	if err := config.applyRoutes(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", configPath, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", configPath, err)
+	}
+
+	return config, nil
+}
+
+// TemplatesDir holds named block templates used by `notes add --template`.
+func (c *Config) TemplatesDir() string {
+	return filepath.Join(c.basePath, ConfigDirName, "templates")
+}
+
+// AssetsDir holds attachments copied in by `notes add --attach`.
+func (c *Config) AssetsDir() string {
+	return filepath.Join(c.basePath, AssetsDirName)
+}
+
+// PIDFile is written by the watcher daemon while it runs.
+func (c *Config) PIDFile() string {
+	return filepath.Join(c.basePath, ConfigDirName, "watcher.pid")
+}
+
+// StopFile is written by `notes watcher stop` to ask the daemon to exit.
+func (c *Config) StopFile() string {
+	return filepath.Join(c.basePath, ConfigDirName, "watcher.stop")
+}
+
+// TLSDir holds the self-signed certificate of `notes serve --tls`.
+func (c *Config) TLSDir() string {
+	return filepath.Join(c.basePath, ConfigDirName, "tls")
+}
+
+// BackupDir is where `notes backup` writes snapshots by default.
+func (c *Config) BackupDir() string {
+	if c.Backup == nil || c.Backup.Dir == "" {
+		return filepath.Join(c.basePath, ConfigDirName, "backups")
+	}
+	return c.resolvePath(c.Backup.Dir)
+}
+
+// BackupKeep returns how many snapshots backup rotation keeps.
+func (c *Config) BackupKeep() int {
+	if c.Backup == nil || c.Backup.Keep == 0 {
+		return DefaultBackupKeep
+	}
+	return c.Backup.Keep
+}
+
+// BackupSchedule returns the daemon's backup interval, zero when scheduled
+// backups are not configured.
+func (c *Config) BackupSchedule() time.Duration {
+	if c.Backup == nil || c.Backup.Every == "" {
+		return 0
+	}
+	every, _ := time.ParseDuration(c.Backup.Every)
+	return every
+}
+
+// BackupDeleteThreshold returns how many blocks one reconcile may delete
+// before the daemon backs up first, zero when disabled.
+func (c *Config) BackupDeleteThreshold() int {
+	if c.Backup == nil {
+		return 0
+	}
+	return c.Backup.DeleteThreshold
+}
+
+// HooksDir is where hook scripts such as post-reconcile are looked up.
+func (c *Config) HooksDir() string {
+	return filepath.Join(c.basePath, ConfigDirName, "hooks")
+}
+
+func (c *Config) validate() error {
+	if _, err := GetOrderer(c.Order); err != nil {
+		return err
+	}
+	if _, err := GetOrderer(c.WatchedOrder); err != nil {
+		return fmt.Errorf("watched_order: %w", err)
+	}
+	for _, event := range c.Notify {
+		if !slices.Contains(notifyEvents, event) {
+			return fmt.Errorf("notify: unknown event %q (available: %s)", event, strings.Join(notifyEvents, ", "))
+		}
+	}
+	for _, step := range c.Normalize {
+		if !isNormalizationStep(step) {
+			return fmt.Errorf("normalize: unknown step %q (available: %s)", step, strings.Join(normalizationSteps, ", "))
+		}
+	}
+	if c.DefaultVisibility != "" && !isVisibilityLevel(c.DefaultVisibility) {
+		return fmt.Errorf("default_visibility: unknown level %q (available: %s)", c.DefaultVisibility, strings.Join(visibilityLevels, ", "))
+	}
+	if c.Resurface != nil {
+		if _, err := time.ParseDuration(c.Resurface.Every); err != nil {
+			return fmt.Errorf("resurface.every: %w", err)
+		}
+	}
+	if c.Backup != nil {
+		if c.Backup.Keep < 0 {
+			return fmt.Errorf("backup.keep: must not be negative")
+		}
+		if c.Backup.Every != "" {
+			if _, err := time.ParseDuration(c.Backup.Every); err != nil {
+				return fmt.Errorf("backup.every: %w", err)
+			}
+		}
+		if c.Backup.DeleteThreshold < 0 {
+			return fmt.Errorf("backup.delete_threshold: must not be negative")
+		}
+	}
+	if c.References != "" && !isReferenceMode(c.References) {
+		return fmt.Errorf("references: unknown mode %q (available: %s)", c.References, strings.Join(referenceModes, ", "))
+	}
+	if c.Limits != nil {
+		if err := c.Limits.validate(); err != nil {
+			return fmt.Errorf("limits: %w", err)
+		}
+	}
+	if err := validateDebounce(c.Debounce, c.MaxDebounce); err != nil {
+		return err
+	}
+	if c.AI != nil {
+		if err := c.AI.validate(); err != nil {
+			return fmt.Errorf("ai.%w", err)
+		}
+	}
+	if c.Mail != nil {
+		if err := c.Mail.validate(); err != nil {
+			return fmt.Errorf("mail.%w", err)
+		}
+	}
+	if c.Theme != nil {
+		if err := c.Theme.validate(); err != nil {
+			return fmt.Errorf("theme.%w", err)
+		}
+	}
+	if err := c.Layout.validate(); err != nil {
+		return fmt.Errorf("layout: %w", err)
+	}
+	for path, fileConfig := range c.Files {
+		if _, err := GetOrderer(fileConfig.Order); err != nil {
+			return fmt.Errorf("files[%s]: %w", path, err)
+		}
+		if err := fileConfig.Layout.validate(); err != nil {
+			return fmt.Errorf("files[%s].layout: %w", path, err)
+		}
+		if (fileConfig.ReadOnly || fileConfig.Limit != 0 || fileConfig.Tag != "") && !fileConfig.Mirror {
+			return fmt.Errorf("files[%s]: read_only, limit and tag only apply to mirror files", path)
+		}
+		if fileConfig.Mirror && CanonicalPath(c.resolvePath(path)) == CanonicalPath(c.notesPath) {
+			return fmt.Errorf("files[%s]: notes.md can't be a mirror", path)
+		}
+		if fileConfig.Limit < 0 {
+			return fmt.Errorf("files[%s].limit: must not be negative", path)
+		}
+		if fileConfig.Local && (fileConfig.Mirror || CanonicalPath(c.resolvePath(path)) == CanonicalPath(c.notesPath)) {
+			return fmt.Errorf("files[%s]: local only applies to watched files", path)
+		}
+		if fileConfig.References != "" && !isReferenceMode(fileConfig.References) {
+			return fmt.Errorf("files[%s].references: unknown mode %q (available: %s)", path, fileConfig.References, strings.Join(referenceModes, ", "))
+		}
+		if err := validateDebounce(fileConfig.Debounce, fileConfig.MaxDebounce); err != nil {
+			return fmt.Errorf("files[%s].%w", path, err)
+		}
+	}
+	return nil
+}
+
+// applyRoutes turns each route into a tagged mirror in Files, keeping any
+// other settings the file already has there.
+func (c *Config) applyRoutes() error {
+	for _, tag := range sortedKeys(c.Routes) {
+		path := c.Routes[tag]
+		name := strings.TrimPrefix(tag, "#")
+		if name == "" || path == "" {
+			return fmt.Errorf("routes: tag and file must not be empty")
+		}
+		if tags := ExtractTags("#" + name); len(tags) != 1 || tags[0] != name {
+			return fmt.Errorf("routes[%s]: not a valid tag", tag)
+		}
+
+		key := path
+		for existing := range c.Files {
+			if CanonicalPath(c.resolvePath(existing)) == CanonicalPath(c.resolvePath(path)) {
+				key = existing
+				break
+			}
+		}
+		if c.Files == nil {
+			c.Files = make(map[string]FileConfig)
+		}
+		fileConfig := c.Files[key]
+		if fileConfig.Tag != "" && fileConfig.Tag != name {
+			return fmt.Errorf("routes[%s]: %s is already routed #%s", tag, path, fileConfig.Tag)
+		}
+		fileConfig.Mirror = true
+		fileConfig.Tag = name
+		c.Files[key] = fileConfig
+	}
+	return nil
+}
+
+func validateDebounce(debounce, maxDebounce string) error {
+	for name, value := range map[string]string{"debounce": debounce, "max_debounce": maxDebounce} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		} else if d <= 0 {
+			return fmt.Errorf("%s: must be positive", name)
+		}
+	}
+	return nil
+}
+
+// DebounceWindow returns how long the watcher daemon waits after filePath last
+// changed before reconciling it, and how far that wait may grow while the
+// file keeps changing.
+func (c *Config) DebounceWindow(filePath string) (time.Duration, time.Duration) {
+	fileConfig := c.FileConfig(filePath)
+	duration := func(values ...string) time.Duration {
+		for _, value := range values {
+			if d, err := time.ParseDuration(value); err == nil {
+				return d
+			}
+		}
+		return 0
+	}
+
+	base := duration(fileConfig.Debounce, c.Debounce)
+	if base == 0 {
+		base = DefaultDebounce
+	}
+	maxWindow := duration(fileConfig.MaxDebounce, c.MaxDebounce)
+	if maxWindow == 0 {
+		maxWindow = DefaultMaxDebounce
+	}
+	return base, max(base, maxWindow)
+}
+
+// NotifyEvents returns the daemon events to raise desktop notifications for.
+func (c *Config) NotifyEvents() []string {
+	if c.Notify == nil {
+		return defaultNotifyEvents
+	}
+	return c.Notify
+}
+
+// BlockVisibility returns the visibility of blocks that don't set their own.
+func (c *Config) BlockVisibility() string {
+	if c.DefaultVisibility == "" {
+		return DefaultVisibility
+	}
+	return c.DefaultVisibility
+}
+
+// ResurfaceSchedule returns the daemon's resurfacing interval and block
+// count, both zero when resurfacing is not configured.
+func (c *Config) ResurfaceSchedule() (time.Duration, int) {
+	if c.Resurface == nil {
+		return 0, 0
+	}
+	every, _ := time.ParseDuration(c.Resurface.Every)
+	return every, c.Resurface.Count
+}
+
+// FileConfig returns the settings for filePath, with unset fields falling
+// back to the repository-wide defaults. notes.md and mirrors use Order,
+// watched files use WatchedOrder; all of them use Layout.
+func (c *Config) FileConfig(filePath string) FileConfig {
+	var fileConfig FileConfig
+	for key, candidate := range c.Files {
+		if CanonicalPath(c.resolvePath(key)) == CanonicalPath(filePath) {
+			fileConfig = candidate
+			break
+		}
+	}
+
+	if fileConfig.Order == "" {
+		if CanonicalPath(filePath) == CanonicalPath(c.notesPath) || fileConfig.Mirror {
+			fileConfig.Order = c.Order
+		} else if c.WatchedOrder != "" {
+			fileConfig.Order = c.WatchedOrder
+		} else {
+			fileConfig.Order = DefaultWatchedOrder
+		}
+	}
+	if fileConfig.Layout == nil {
+		fileConfig.Layout = c.Layout
+	}
+	if fileConfig.References == "" {
+		fileConfig.References = c.References
+	}
+	if fileConfig.References == "" {
+		fileConfig.References = ReferencesLink
+	}
+	return fileConfig
+}
+
+// resolvePath resolves a path from the config file, which may start with ~
+// or be relative to the repository directory.
+func (c *Config) resolvePath(path string) string {
+	path = expandHome(path)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(c.basePath, path)
+	}
+	return filepath.Clean(path)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	EncryptionSaltKey  = "encryption_salt"
+	EncryptionCheckKey = "encryption_check"
+
+	// EncryptionKeyedHashesKey is set once an encrypted repository's block
+	// hashes are keyed by its encryption key.
+	EncryptionKeyedHashesKey = "encryption_keyed_hashes"
+
+	encryptedPrefix   = "enc:v1:"
+	encryptionCheck   = "gravitynotes"
+	keyDerivationIter = 600000
+	keyLength         = 32
+	saltLength        = 16
+)
+
+// contentHashSalt is the salt the content hash key is derived from the
+// passphrase with.
+const contentHashSalt = "gravitynotes content hash"
+
+// contentHashKey keys block hashes with HMAC while an encrypted repository is
+// unlocked, so the hashes in notes.db don't confirm guesses at its content.
+var contentHashKey []byte
+
+// SetContentHashKey keys all content hashes computed from now on with key,
+// or stops keying them if key is nil.
+func SetContentHashKey(key []byte) {
+	contentHashKey = key
+}
+
+// keyedHash returns the hex SHA-256 of value, as an HMAC keyed by
+// contentHashKey when one is set.
+func keyedHash(value string) string {
+	if contentHashKey == nil {
+		return sha256Hex(value)
+	}
+	mac := hmac.New(sha256.New, contentHashKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// BlockCipher encrypts block content with AES-256-GCM. Ciphertexts are stored
+// as text so they fit in the existing content column.
+type BlockCipher struct {
+	aead cipher.AEAD
+
+	// hashKey is the content hash key derived from the same passphrase.
+	hashKey []byte
+}
+
+func NewBlockCipher(key []byte) (*BlockCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+
+	return &BlockCipher{aead: aead}, nil
+}
+
+// newPassphraseCipher returns the cipher for passphrase and the repository's
+// salt. Its content hash key is derived with a fixed salt instead, so synced
+// repositories sharing the passphrase hash blocks alike.
+func newPassphraseCipher(passphrase string, salt []byte) (*BlockCipher, error) {
+	blockCipher, err := NewBlockCipher(deriveKey(passphrase, salt))
+	if err != nil {
+		return nil, err
+	}
+	blockCipher.hashKey = deriveKey(passphrase, []byte(contentHashSalt))
+	return blockCipher, nil
+}
+
+func (c *BlockCipher) Encrypt(plaintext string) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := c.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt reverses Encrypt. Values without the encryption prefix are returned
+// unchanged so a partially migrated store stays readable.
+func (c *BlockCipher) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode ciphertext: %w", err)
+	}
+
+	nonceSize := c.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", fmt.Errorf("ciphertext too short")
+	}
+
+	plaintext, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt: %w", err)
+	}
+
+	return string(plaintext), nil
+}
+
+func isEncryptedValue(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	return salt, nil
+}
+
+// deriveKey stretches a passphrase into an AES key with PBKDF2-HMAC-SHA256.
+func deriveKey(passphrase string, salt []byte) []byte {
+	return pbkdf2.Key([]byte(passphrase), salt, keyDerivationIter, keyLength, sha256.New)
+}
+
+// readPassphrase returns $NOTES_PASSPHRASE if set, otherwise prompts on the
+// terminal with echo disabled.
+func readPassphrase(prompt string) (string, error) {
+	if passphrase := os.Getenv("NOTES_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+
+	info, err := os.Stdin.Stat()
+	isTerminal := err == nil && info.Mode()&os.ModeCharDevice != 0
+
+	fmt.Fprint(os.Stderr, prompt)
+	if isTerminal {
+		setTerminalEcho(false)
+		defer func() {
+			setTerminalEcho(true)
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+
+	passphrase := strings.TrimRight(line, "\r\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase cannot be empty")
+	}
+	return passphrase, nil
+}
+
+func setTerminalEcho(on bool) {
+	mode := "-echo"
+	if on {
+		mode = "echo"
+	}
+	cmd := exec.Command("stty", mode)
+	cmd.Stdin = os.Stdin
+	_ = cmd.Run()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	dailyTagPrefix       = "daily/"
+	dailyDateLayout      = "2006-01-02"
+	defaultDailyTemplate = "# {{date}}"
+)
+
+// DailyTag returns the tag that identifies the journal block for day.
+func DailyTag(day time.Time) string {
+	return dailyTagPrefix + day.Format(dailyDateLayout)
+}
+
+// FindDailyBlock returns the journal block for day, or nil if none exists.
+func FindDailyBlock(db *Database, day time.Time) (*Block, error) {
+	tag := DailyTag(day)
+	candidates, err := db.SearchBlocks([]string{"#" + tag}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for daily block: %w", err)
+	}
+
+	for _, block := range candidates {
+		if block.HasTag(tag) {
+			return block, nil
+		}
+	}
+	return nil, nil
+}
+
+// NewDailyContent renders the daily template for day, making sure the result
+// carries the day's tag even if the template forgot it.
+func NewDailyContent(template string, day time.Time) (string, error) {
+	if template == "" {
+		template = defaultDailyTemplate
+	}
+
+	content, _, err := RenderTemplate(template, nil, day)
+	if err != nil {
+		return "", err
+	}
+	content = strings.TrimSpace(content)
+
+	block := &Block{Content: content}
+	if !block.HasTag(DailyTag(day)) {
+		content += "\n#" + DailyTag(day)
+	}
+	return content, nil
+}
+
+// dailyTemplate prefers a "daily" template file over the config setting.
+func dailyTemplate() string {
+	if template, err := LoadTemplate(config.TemplatesDir(), "daily"); err == nil {
+		return template
+	}
+	return config.DailyTemplate
+}
+
+func handleDaily() {
+	fs := flag.NewFlagSet("daily", flag.ExitOnError)
+	yesterday := fs.Bool("yesterday", false, "use yesterday's journal block")
+	text := strings.Join(parseArgs(fs, os.Args[2:]), " ")
+
+	day := time.Now()
+	if *yesterday {
+		day = day.AddDate(0, 0, -1)
+	}
+
+	block, err := FindDailyBlock(db, day)
+	if err != nil {
+		log.Fatalf("Failed to find daily block: %v", err)
+	}
+
+	var content string
+	if block != nil {
+		content = block.Content
+	} else {
+		content, err = NewDailyContent(dailyTemplate(), day)
+		if err != nil {
+			log.Fatalf("Failed to render daily template: %v", err)
+		}
+	}
+
+	if strings.TrimSpace(text) != "" {
+		content = content + "\n" + strings.TrimSpace(text)
+	} else {
+		content, err = editInEditor(content, 0)
+		if err != nil {
+			log.Fatalf("Failed to edit daily block: %v", err)
+		}
+	}
+
+	if strings.TrimSpace(content) == "" {
+		fmt.Println("Daily block is empty, nothing saved")
+		return
+	}
+
+	reconciler := newMainReconciler()
+
+	if block == nil {
+		if _, err := reconciler.AddBlocks([]*Block{NewBlock(content)}); err != nil {
+			log.Fatalf("Failed to create daily block: %v", err)
+		}
+		fmt.Printf("Created daily block for %s\n", day.Format(dailyDateLayout))
+		return
+	}
+
+	if _, err := reconciler.UpdateBlock(block.ContentHash, content); err != nil {
+		log.Fatalf("Failed to update daily block: %v", err)
+	}
+	fmt.Printf("Updated daily block for %s\n", day.Format(dailyDateLayout))
+}
@@ -1,16 +1,74 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
 )
 
 type Database struct {
-	db *sql.DB
+	db     *sql.DB
+	cipher *BlockCipher
+	audit  *AuditLog // nil unless the repository's audit log is enabled
+
+	readOnly bool
+}
+
+// blockColumns is the column list every block query selects, in scanBlock order.
+const blockColumns = `id, content, content_hash, created_at, updated_at, touch_count, word_count, char_count`
+
+// prefixedBlockColumns qualifies blockColumns with a table alias for joins.
+func prefixedBlockColumns(alias string) string {
+	columns := strings.Split(blockColumns, ", ")
+	for i, column := range columns {
+		columns[i] = alias + "." + column
+	}
+	return strings.Join(columns, ", ")
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func (d *Database) scanBlock(scanner rowScanner) (*Block, error) {
+	var block Block
+	var words, chars sql.NullInt64
+	err := scanner.Scan(&block.ID, &block.Content, &block.ContentHash,
+		&block.CreatedAt, &block.UpdatedAt, &block.TouchCount, &words, &chars)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.cipher != nil {
+		block.Content, err = d.cipher.Decrypt(block.Content)
+		if err != nil {
+			return nil, fmt.Errorf("block %d: %w", block.ID, err)
+		}
+	}
+	block.setCounts(words, chars)
+	return &block, nil
+}
+
+func (d *Database) scanBlocks(rows *sql.Rows) ([]*Block, error) {
+	var blocks []*Block
+	for rows.Next() {
+		block, err := d.scanBlock(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan block: %w", err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, rows.Err()
 }
 
 func NewDatabase(dbPath string) (*Database, error) {
@@ -24,9 +82,83 @@ func NewDatabase(dbPath string) (*Database, error) {
 		return nil, fmt.Errorf("failed to create tables: %w", err)
 	}
 
+	if err := database.migrate(); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
 	return database, nil
 }
 
+// OpenReadOnlyDatabase opens the database at dbPath without ever writing to
+// it: tables aren't created or migrated, and SQLite refuses every write.
+func OpenReadOnlyDatabase(dbPath string) (*Database, error) {
+	uri := url.URL{Scheme: "file", Path: filepath.ToSlash(dbPath), RawQuery: "mode=ro"}
+	db, err := sql.Open("sqlite", uri.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	return &Database{db: db, readOnly: true}, nil
+}
+
+// ReadOnly reports whether the database was opened read-only.
+func (d *Database) ReadOnly() bool {
+	return d.readOnly
+}
+
+// BackupTo writes a consistent copy of the database to path with SQLite's
+// online backup API, which is safe while other connections write to it.
+func (d *Database) BackupTo(path string) error {
+	return d.copyDatabase(path, false)
+}
+
+// RestoreFrom replaces the contents of the database with the database at
+// path, using the same API.
+func (d *Database) RestoreFrom(path string) error {
+	return d.copyDatabase(path, true)
+}
+
+func (d *Database) copyDatabase(path string, restore bool) error {
+	conn, err := d.db.Conn(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to get database connection: %w", err)
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		type backuper interface {
+			NewBackup(dstURI string) (*sqlite.Backup, error)
+			NewRestore(srcURI string) (*sqlite.Backup, error)
+		}
+		source, ok := driverConn.(backuper)
+		if !ok {
+			return fmt.Errorf("database driver does not support backups")
+		}
+
+		newCopy := source.NewBackup
+		if restore {
+			newCopy = source.NewRestore
+		}
+		backup, err := newCopy(path)
+		if err != nil {
+			return fmt.Errorf("failed to start copy: %w", err)
+		}
+		for more := true; more; {
+			if more, err = backup.Step(-1); err != nil {
+				backup.Finish()
+				return fmt.Errorf("failed to copy database: %w", err)
+			}
+		}
+		if err := backup.Finish(); err != nil {
+			return fmt.Errorf("failed to finish copy: %w", err)
+		}
+		return nil
+	})
+}
+
 func (d *Database) createTables() error {
 	blocksTable := `
 	CREATE TABLE IF NOT EXISTS blocks (
@@ -34,7 +166,8 @@ func (d *Database) createTables() error {
 		content TEXT NOT NULL,
 		content_hash TEXT UNIQUE NOT NULL,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		touch_count INTEGER NOT NULL DEFAULT 0
 	);`
 
 	metadataTable := `
@@ -46,7 +179,9 @@ func (d *Database) createTables() error {
 	watchedFilesTable := `
 	CREATE TABLE IF NOT EXISTS watched_files (
 		file_path TEXT PRIMARY KEY,
-		started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		quarantined_at TIMESTAMP,
+		quarantine_reason TEXT
 	);`
 
 	fileBlocksTable := `
@@ -58,6 +193,138 @@ func (d *Database) createTables() error {
 		FOREIGN KEY (block_hash) REFERENCES blocks(content_hash) ON DELETE CASCADE
 	);`
 
+	fileSnapshotsTable := `
+	CREATE TABLE IF NOT EXISTS file_snapshots (
+		file_path TEXT PRIMARY KEY,
+		content TEXT NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	operationsTable := `
+	CREATE TABLE IF NOT EXISTS operations (
+		id INTEGER PRIMARY KEY,
+		kind TEXT NOT NULL,
+		file_path TEXT NOT NULL DEFAULT '',
+		changes TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		undone INTEGER NOT NULL DEFAULT 0
+	);`
+
+	watcherErrorsTable := `
+	CREATE TABLE IF NOT EXISTS watcher_errors (
+		id INTEGER PRIMARY KEY,
+		file_path TEXT NOT NULL DEFAULT '',
+		message TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	attachmentsTable := `
+	CREATE TABLE IF NOT EXISTS attachments (
+		asset_path TEXT PRIMARY KEY,
+		original_name TEXT NOT NULL,
+		block_hash TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		ref_count INTEGER NOT NULL DEFAULT 1
+	);`
+
+	scheduleTable := `
+	CREATE TABLE IF NOT EXISTS schedule (
+		block_hash TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		due_at TIMESTAMP NOT NULL,
+		fired INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (block_hash, kind, due_at)
+	);`
+
+	reviewsTable := `
+	CREATE TABLE IF NOT EXISTS reviews (
+		block_hash TEXT PRIMARY KEY,
+		interval_days INTEGER NOT NULL,
+		ease REAL NOT NULL,
+		repetitions INTEGER NOT NULL,
+		due_at TIMESTAMP NOT NULL
+	);`
+
+	frontMatterTable := `
+	CREATE TABLE IF NOT EXISTS file_front_matter (
+		file_path TEXT PRIMARY KEY,
+		content TEXT NOT NULL
+	);`
+
+	sizeSamplesTable := `
+	CREATE TABLE IF NOT EXISTS size_samples (
+		day TEXT PRIMARY KEY,
+		bytes INTEGER NOT NULL
+	);`
+
+	webSourcesTable := `
+	CREATE TABLE IF NOT EXISTS web_sources (
+		url TEXT PRIMARY KEY,
+		url_hash TEXT,
+		block_hash TEXT NOT NULL,
+		title TEXT NOT NULL,
+		fetched_at TIMESTAMP NOT NULL
+	);`
+
+	visibilityTable := `
+	CREATE TABLE IF NOT EXISTS block_visibility (
+		block_hash TEXT PRIMARY KEY,
+		visibility TEXT NOT NULL
+	);`
+
+	localBlocksTable := `
+	CREATE TABLE IF NOT EXISTS local_blocks (
+		block_hash TEXT PRIMARY KEY,
+		file_path TEXT NOT NULL
+	);`
+
+	blockLinksTable := `
+	CREATE TABLE IF NOT EXISTS block_links (
+		source_hash TEXT NOT NULL,
+		target_hash TEXT NOT NULL,
+		PRIMARY KEY (source_hash, target_hash)
+	);`
+
+	blockMetaTable := `
+	CREATE TABLE IF NOT EXISTS block_meta (
+		block_hash TEXT NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (block_hash, key)
+	);`
+
+	trashTable := `
+	CREATE TABLE IF NOT EXISTS trash (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		run INTEGER NOT NULL,
+		file_path TEXT NOT NULL,
+		content TEXT NOT NULL,
+		content_hash TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		deleted_at TIMESTAMP NOT NULL
+	);`
+
+	recurrencesTable := `
+	CREATE TABLE IF NOT EXISTS recurrences (
+		template_hash TEXT PRIMARY KEY,
+		last_run TIMESTAMP NOT NULL
+	);`
+
+	apiTokensTable := `
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP NOT NULL,
+		last_used_at TIMESTAMP
+	);`
+
+	tombstonesTable := `
+	CREATE TABLE IF NOT EXISTS tombstones (
+		content_hash TEXT PRIMARY KEY,
+		clock INTEGER NOT NULL
+	);`
+
 	if _, err := d.db.Exec(blocksTable); err != nil {
 		return fmt.Errorf("failed to create blocks table: %w", err)
 	}
@@ -74,6 +341,182 @@ func (d *Database) createTables() error {
 		return fmt.Errorf("failed to create file_blocks table: %w", err)
 	}
 
+	if _, err := d.db.Exec(fileSnapshotsTable); err != nil {
+		return fmt.Errorf("failed to create file_snapshots table: %w", err)
+	}
+
+	if _, err := d.db.Exec(operationsTable); err != nil {
+		return fmt.Errorf("failed to create operations table: %w", err)
+	}
+
+	if _, err := d.db.Exec(watcherErrorsTable); err != nil {
+		return fmt.Errorf("failed to create watcher_errors table: %w", err)
+	}
+
+	if _, err := d.db.Exec(attachmentsTable); err != nil {
+		return fmt.Errorf("failed to create attachments table: %w", err)
+	}
+
+	if _, err := d.db.Exec(scheduleTable); err != nil {
+		return fmt.Errorf("failed to create schedule table: %w", err)
+	}
+
+	if _, err := d.db.Exec(reviewsTable); err != nil {
+		return fmt.Errorf("failed to create reviews table: %w", err)
+	}
+
+	if _, err := d.db.Exec(frontMatterTable); err != nil {
+		return fmt.Errorf("failed to create file_front_matter table: %w", err)
+	}
+
+	if _, err := d.db.Exec(tombstonesTable); err != nil {
+		return fmt.Errorf("failed to create tombstones table: %w", err)
+	}
+
+	if _, err := d.db.Exec(sizeSamplesTable); err != nil {
+		return fmt.Errorf("failed to create size_samples table: %w", err)
+	}
+
+	if _, err := d.db.Exec(webSourcesTable); err != nil {
+		return fmt.Errorf("failed to create web_sources table: %w", err)
+	}
+
+	if _, err := d.db.Exec(visibilityTable); err != nil {
+		return fmt.Errorf("failed to create block_visibility table: %w", err)
+	}
+
+	if _, err := d.db.Exec(localBlocksTable); err != nil {
+		return fmt.Errorf("failed to create local_blocks table: %w", err)
+	}
+
+	if _, err := d.db.Exec(blockLinksTable); err != nil {
+		return fmt.Errorf("failed to create block_links table: %w", err)
+	}
+
+	if _, err := d.db.Exec(blockMetaTable); err != nil {
+		return fmt.Errorf("failed to create block_meta table: %w", err)
+	}
+
+	if _, err := d.db.Exec(trashTable); err != nil {
+		return fmt.Errorf("failed to create trash table: %w", err)
+	}
+
+	if _, err := d.db.Exec(recurrencesTable); err != nil {
+		return fmt.Errorf("failed to create recurrences table: %w", err)
+	}
+
+	if _, err := d.db.Exec(apiTokensTable); err != nil {
+		return fmt.Errorf("failed to create api_tokens table: %w", err)
+	}
+
+	return nil
+}
+
+// migrate brings databases created by older versions up to the current schema.
+func (d *Database) migrate() error {
+	if err := d.addColumnIfMissing("blocks", "touch_count", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := d.addColumnIfMissing("blocks", "clock", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := d.addColumnIfMissing("file_blocks", "position", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	// NULL until FillBlockCounts counts blocks stored by older versions,
+	// which needs the content decrypted
+	if err := d.addColumnIfMissing("blocks", "word_count", "INTEGER"); err != nil {
+		return err
+	}
+	if err := d.addColumnIfMissing("blocks", "char_count", "INTEGER"); err != nil {
+		return err
+	}
+	if err := d.addColumnIfMissing("attachments", "ref_count", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+	// NULL until FillBlockTitles, for the same reason as the counts
+	if err := d.addColumnIfMissing("blocks", "title", "TEXT"); err != nil {
+		return err
+	}
+	if err := d.addColumnIfMissing("watched_files", "quarantined_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+	if err := d.addColumnIfMissing("watched_files", "quarantine_reason", "TEXT"); err != nil {
+		return err
+	}
+	if err := d.addColumnIfMissing("web_sources", "url_hash", "TEXT"); err != nil {
+		return err
+	}
+	if err := d.fillWebSourceHashes(); err != nil {
+		return err
+	}
+	if err := d.createIndexes(); err != nil {
+		return err
+	}
+	return d.createSyncTriggers()
+}
+
+// indexes are created after migration, since some cover columns older
+// databases only gain then.
+var indexes = map[string]string{
+	// Time-based queries such as `notes log` and --since, and recency order
+	"idx_blocks_created_at": `blocks(created_at)`,
+	"idx_blocks_updated_at": `blocks(updated_at)`,
+
+	// Which files hold a block, looked up per block on every reconcile and
+	// delete; the primary key only serves lookups by file
+	"idx_file_blocks_block_hash": `file_blocks(block_hash)`,
+
+	// A file's blocks in position order, for regeneration
+	"idx_file_blocks_position": `file_blocks(file_path, position)`,
+
+	// Backlinks for `notes links`
+	"idx_block_links_target_hash": `block_links(target_hash)`,
+
+	// key:value search terms
+	"idx_block_meta_key_value": `block_meta(key, value)`,
+
+	// Addressing blocks by title prefix
+	"idx_blocks_title": `blocks(title COLLATE NOCASE)`,
+
+	// Captured pages, looked up by URL hash since the URL may be encrypted
+	"idx_web_sources_url_hash": `web_sources(url_hash)`,
+}
+
+func (d *Database) createIndexes() error {
+	for name, on := range indexes {
+		if _, err := d.db.Exec(`CREATE INDEX IF NOT EXISTS ` + name + ` ON ` + on); err != nil {
+			return fmt.Errorf("failed to create index %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (d *Database) addColumnIfMissing(table, column, definition string) error {
+	rows, err := d.db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return fmt.Errorf("failed to scan column name: %w", err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	rows.Close()
+
+	query := fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition)
+	if _, err := d.db.Exec(query); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
@@ -82,11 +525,20 @@ func (d *Database) Close() error {
 }
 
 func (d *Database) CreateBlock(block *Block) error {
-	query := `INSERT INTO blocks (content, content_hash, created_at, updated_at) 
-			  VALUES (?, ?, ?, ?)`
+	query := `INSERT INTO blocks (content, content_hash, created_at, updated_at, word_count, char_count, title)
+			  VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	content, err := d.storedContent(block.Content)
+	if err != nil {
+		return err
+	}
+	title, err := d.storedContent(block.Title())
+	if err != nil {
+		return err
+	}
 
-	result, err := d.db.Exec(query, block.Content, block.ContentHash,
-		block.CreatedAt, block.UpdatedAt)
+	result, err := d.db.Exec(query, content, block.ContentHash,
+		block.CreatedAt, block.UpdatedAt, CountWords(block.Content), CountChars(block.Content), title)
 	if err != nil {
 		return fmt.Errorf("failed to insert block: %w", err)
 	}
@@ -101,14 +553,9 @@ func (d *Database) CreateBlock(block *Block) error {
 }
 
 func (d *Database) GetBlockByHash(hash string) (*Block, error) {
-	query := `SELECT id, content, content_hash, created_at, updated_at 
-			  FROM blocks WHERE content_hash = ?`
+	query := `SELECT ` + blockColumns + ` FROM blocks WHERE content_hash = ?`
 
-	row := d.db.QueryRow(query, hash)
-
-	var block Block
-	err := row.Scan(&block.ID, &block.Content, &block.ContentHash,
-		&block.CreatedAt, &block.UpdatedAt)
+	block, err := d.scanBlock(d.db.QueryRow(query, hash))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -116,258 +563,2815 @@ func (d *Database) GetBlockByHash(hash string) (*Block, error) {
 		return nil, fmt.Errorf("failed to scan block: %w", err)
 	}
 
-	return &block, nil
+	return block, nil
 }
 
-func (d *Database) GetAllBlocks() ([]*Block, error) {
-	query := `SELECT id, content, content_hash, created_at, updated_at 
-			  FROM blocks ORDER BY updated_at DESC`
+// sqlBatchSize bounds the number of rows per multi-row statement, keeping
+// queries well under SQLite's host parameter limit.
+const sqlBatchSize = 500
 
-	rows, err := d.db.Query(query)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query blocks: %w", err)
-	}
-	defer rows.Close()
+// placeholders returns "(?, ?), (?, ?)" style groups for multi-row statements.
+func placeholders(rows, columns int) string {
+	group := "(" + strings.TrimSuffix(strings.Repeat("?, ", columns), ", ") + ")"
+	return strings.TrimSuffix(strings.Repeat(group+", ", rows), ", ")
+}
 
-	var blocks []*Block
-	for rows.Next() {
-		var block Block
-		err := rows.Scan(&block.ID, &block.Content, &block.ContentHash,
-			&block.CreatedAt, &block.UpdatedAt)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan block: %w", err)
-		}
-		blocks = append(blocks, &block)
-	}
+// minHashPrefixLength is the shortest hash prefix accepted as an identifier,
+// so short numbers are always taken as block IDs.
+const minHashPrefixLength = 4
 
-	return blocks, nil
+// AmbiguousIdentifierError is returned when a hash prefix matches more than
+// one block.
+type AmbiguousIdentifierError struct {
+	Prefix     string
+	Candidates []*Block
 }
 
-func (d *Database) DeleteBlock(id int) error {
-	query := `DELETE FROM blocks WHERE id = ?`
-	_, err := d.db.Exec(query, id)
-	if err != nil {
-		return fmt.Errorf("failed to delete block: %w", err)
+func (e *AmbiguousIdentifierError) Error() string {
+	var message strings.Builder
+	fmt.Fprintf(&message, "%q is ambiguous, it matches %d blocks:", e.Prefix, len(e.Candidates))
+	for _, block := range e.Candidates {
+		fmt.Fprintf(&message, "\n  %d  %.12s  %s", block.ID, block.ContentHash, block.FirstLine())
 	}
-	return nil
+	return message.String()
 }
 
-func (d *Database) UpdateBlockTimestamp(hash string, timestamp time.Time) error {
-	query := `UPDATE blocks SET updated_at = ? WHERE content_hash = ?`
-	_, err := d.db.Exec(query, timestamp, hash)
+// LookupBlock finds a block by numeric ID, full content hash, unambiguous
+// hash prefix or, failing those, title, as given on the command line or by
+// MCP clients.
+func (d *Database) LookupBlock(identifier string) (*Block, error) {
+	block, err := d.GetBlockByIDPrefix(identifier)
 	if err != nil {
-		return fmt.Errorf("failed to update block timestamp: %w", err)
+		return nil, err
 	}
-	return nil
+	if block == nil {
+		if block, err = d.GetBlockByTitle(identifier); err != nil {
+			return nil, err
+		}
+	}
+	if block == nil {
+		return nil, fmt.Errorf("no block found for %q", identifier)
+	}
+	return block, nil
 }
 
-func (d *Database) GetMetadata(key string) (string, error) {
-	query := `SELECT value FROM metadata WHERE key = ?`
-	row := d.db.QueryRow(query, key)
-
-	var value string
-	err := row.Scan(&value)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return "", nil
+// GetBlockByIDPrefix resolves identifier like a git short SHA. A number is
+// first tried as a block ID; anything else of at least minHashPrefixLength
+// hex digits is matched against the start of content hashes. It returns nil
+// if nothing matches and an *AmbiguousIdentifierError if several blocks do.
+func (d *Database) GetBlockByIDPrefix(identifier string) (*Block, error) {
+	identifier = strings.ToLower(strings.TrimSpace(identifier))
+	if id, err := strconv.Atoi(identifier); err == nil {
+		block, err := d.GetBlockByID(id)
+		if err != nil || block != nil {
+			return block, err
 		}
-		return "", fmt.Errorf("failed to get metadata: %w", err)
 	}
 
-	return value, nil
+	if len(identifier) < minHashPrefixLength {
+		return nil, nil
+	}
+	blocks, err := d.GetBlocksByHashPrefix(identifier)
+	if err != nil {
+		return nil, err
+	}
+	switch len(blocks) {
+	case 0:
+		return nil, nil
+	case 1:
+		return blocks[0], nil
+	default:
+		return nil, &AmbiguousIdentifierError{Prefix: identifier, Candidates: blocks}
+	}
 }
 
-func (d *Database) SetMetadata(key, value string) error {
-	query := `INSERT OR REPLACE INTO metadata (key, value) VALUES (?, ?)`
-	_, err := d.db.Exec(query, key, value)
+// GetBlocksByHashPrefix returns the blocks whose content hash starts with
+// prefix, oldest first. A prefix that isn't hexadecimal matches nothing.
+func (d *Database) GetBlocksByHashPrefix(prefix string) ([]*Block, error) {
+	prefix = strings.ToLower(prefix)
+	if prefix == "" || strings.Trim(prefix, "0123456789abcdef") != "" {
+		return nil, nil
+	}
+
+	query := `SELECT ` + blockColumns + ` FROM blocks WHERE content_hash LIKE ? ORDER BY id`
+	rows, err := d.db.Query(query, prefix+"%")
 	if err != nil {
-		return fmt.Errorf("failed to set metadata: %w", err)
+		return nil, fmt.Errorf("failed to query blocks by hash prefix: %w", err)
 	}
-	return nil
+	defer rows.Close()
+
+	return d.scanBlocks(rows)
 }
 
-func (d *Database) SearchBlocks(includeKeywords, excludeKeywords []string) ([]*Block, error) {
-	if len(includeKeywords) == 0 && len(excludeKeywords) == 0 {
-		return nil, fmt.Errorf("at least one keyword is required")
+// GetBlockByTitle returns the block titled title, ignoring case, or else
+// the one block whose title starts with it. It returns nil if nothing
+// matches and an *AmbiguousIdentifierError if several blocks do.
+func (d *Database) GetBlockByTitle(title string) (*Block, error) {
+	matches, err := d.GetBlocksByTitlePrefix(title)
+	if err != nil {
+		return nil, err
 	}
 
-	var whereParts []string
-	var args []any
-
-	// Build include conditions (OR logic for union)
-	if len(includeKeywords) > 0 {
-		var includeParts []string
-		for _, keyword := range includeKeywords {
-			includeParts = append(includeParts, "content LIKE ?")
-			args = append(args, "%"+keyword+"%")
+	var exact []*Block
+	for _, block := range matches {
+		if strings.EqualFold(block.Title(), strings.TrimSpace(title)) {
+			exact = append(exact, block)
 		}
-		whereParts = append(whereParts, "("+strings.Join(includeParts, " OR ")+")")
 	}
-
-	// Build exclude conditions (AND NOT logic)
-	for _, keyword := range excludeKeywords {
-		whereParts = append(whereParts, "content NOT LIKE ?")
-		args = append(args, "%"+keyword+"%")
+	if len(exact) > 0 {
+		matches = exact
+	}
+	switch len(matches) {
+	case 0:
+		return nil, nil
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, &AmbiguousIdentifierError{Prefix: title, Candidates: matches}
 	}
+}
 
-	// If we only have exclude keywords and no include keywords, we need to select all blocks first
-	if len(includeKeywords) == 0 && len(excludeKeywords) > 0 {
-		whereParts = append([]string{"1=1"}, whereParts...)
+// GetBlocksByTitlePrefix returns the blocks whose title starts with prefix,
+// ignoring case, oldest first.
+func (d *Database) GetBlocksByTitlePrefix(prefix string) ([]*Block, error) {
+	prefix = strings.TrimSpace(prefix)
+	if prefix == "" {
+		return nil, nil
 	}
 
-	query := `SELECT id, content, content_hash, created_at, updated_at 
-			  FROM blocks WHERE ` + strings.Join(whereParts, " AND ") + ` ORDER BY updated_at DESC`
+	// Encrypted titles can only be compared once decrypted
+	query := `SELECT ` + blockColumns + ` FROM blocks`
+	var args []any
+	if d.cipher == nil {
+		query += ` WHERE title LIKE ? ESCAPE '\'`
+		args = append(args, likePattern.Replace(prefix)+"%")
+	}
+
+	var blocks []*Block
+	err := d.iterateBlocks(query+` ORDER BY id`, args, func(block *Block) error {
+		// LIKE ignores the case of ASCII letters only
+		if title := block.Title(); len(title) >= len(prefix) && strings.EqualFold(title[:len(prefix)], prefix) {
+			blocks = append(blocks, block)
+		}
+		return nil
+	})
+	return blocks, err
+}
+
+// likePattern escapes the wildcards of a LIKE pattern.
+var likePattern = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (d *Database) GetBlockByID(id int) (*Block, error) {
+	query := `SELECT ` + blockColumns + ` FROM blocks WHERE id = ?`
+
+	block, err := d.scanBlock(d.db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to scan block: %w", err)
+	}
+
+	return block, nil
+}
+
+// GetBlocksByHashes looks up many blocks at once, returning them keyed by
+// hash. Hashes without a block are absent from the map.
+func (d *Database) GetBlocksByHashes(hashes []string) (map[string]*Block, error) {
+	blocks := make(map[string]*Block, len(hashes))
+
+	for start := 0; start < len(hashes); start += sqlBatchSize {
+		batch := hashes[start:min(start+sqlBatchSize, len(hashes))]
+
+		args := make([]any, len(batch))
+		for i, hash := range batch {
+			args[i] = hash
+		}
+
+		query := `SELECT ` + blockColumns + ` FROM blocks WHERE content_hash IN (` +
+			strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ") + `)`
+		rows, err := d.db.Query(query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query blocks: %w", err)
+		}
+
+		found, err := d.scanBlocks(rows)
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range found {
+			blocks[block.ContentHash] = block
+		}
+	}
+
+	return blocks, nil
+}
+
+// CreateBlocks inserts blocks in a single transaction using multi-row
+// statements and sets their IDs. All hashes must be new and distinct.
+func (d *Database) CreateBlocks(blocks []*Block) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := d.createBlocksTx(tx, blocks); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit blocks: %w", err)
+	}
+	return nil
+}
+
+func (d *Database) createBlocksTx(tx *sql.Tx, blocks []*Block) error {
+	byHash := make(map[string]*Block, len(blocks))
+	for start := 0; start < len(blocks); start += sqlBatchSize {
+		batch := blocks[start:min(start+sqlBatchSize, len(blocks))]
+
+		args := make([]any, 0, len(batch)*7)
+		for _, block := range batch {
+			content, err := d.storedContent(block.Content)
+			if err != nil {
+				return err
+			}
+			title, err := d.storedContent(block.Title())
+			if err != nil {
+				return err
+			}
+			args = append(args, content, block.ContentHash, block.CreatedAt, block.UpdatedAt,
+				CountWords(block.Content), CountChars(block.Content), title)
+			byHash[block.ContentHash] = block
+		}
+
+		query := `INSERT INTO blocks (content, content_hash, created_at, updated_at, word_count, char_count, title) VALUES ` +
+			placeholders(len(batch), 7) + ` RETURNING id, content_hash`
+		rows, err := tx.Query(query, args...)
+		if err != nil {
+			return fmt.Errorf("failed to insert blocks: %w", err)
+		}
+
+		for rows.Next() {
+			var id int
+			var hash string
+			if err := rows.Scan(&id, &hash); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan inserted block id: %w", err)
+			}
+			byHash[hash].ID = id
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to insert blocks: %w", err)
+		}
+	}
+	return nil
+}
+
+// DeleteBlocksByHashes deletes many blocks and their file associations in a
+// single transaction.
+func (d *Database) DeleteBlocksByHashes(hashes []string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := deleteBlocksTx(tx, hashes); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit block deletion: %w", err)
+	}
+	return nil
+}
+
+func deleteBlocksTx(tx *sql.Tx, hashes []string) error {
+	for start := 0; start < len(hashes); start += sqlBatchSize {
+		batch := hashes[start:min(start+sqlBatchSize, len(hashes))]
+
+		args := make([]any, len(batch))
+		for i, hash := range batch {
+			args[i] = hash
+		}
+		in := `(` + strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ") + `)`
+
+		if _, err := tx.Exec(`DELETE FROM blocks WHERE content_hash IN `+in, args...); err != nil {
+			return fmt.Errorf("failed to delete blocks: %w", err)
+		}
+		if _, err := tx.Exec(`DELETE FROM file_blocks WHERE block_hash IN `+in, args...); err != nil {
+			return fmt.Errorf("failed to delete file-block associations: %w", err)
+		}
+		if _, err := tx.Exec(`DELETE FROM local_blocks WHERE block_hash IN `+in, args...); err != nil {
+			return fmt.Errorf("failed to delete local block marks: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetAllBlocks returns every block in the store. Callers that render blocks
+// should apply a BlockOrderer rather than rely on the order returned here.
+func (d *Database) GetAllBlocks() ([]*Block, error) {
+	query := `SELECT ` + blockColumns + ` FROM blocks ORDER BY id`
+
+	rows, err := d.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query blocks: %w", err)
+	}
+	defer rows.Close()
+
+	return d.scanBlocks(rows)
+}
+
+// GetGlobalBlocks returns every block except those local to a watched
+// file, i.e. the blocks of notes.md and mirrors.
+func (d *Database) GetGlobalBlocks() ([]*Block, error) {
+	query := `SELECT ` + blockColumns + ` FROM blocks
+			  WHERE content_hash NOT IN (SELECT block_hash FROM local_blocks) ORDER BY id`
+
+	rows, err := d.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query blocks: %w", err)
+	}
+	defer rows.Close()
+
+	return d.scanBlocks(rows)
+}
+
+// IterateBlocks calls fn with every block in ID order, reading them one at
+// a time instead of loading the whole store into memory. An error from fn
+// stops the iteration and is returned.
+func (d *Database) IterateBlocks(fn func(*Block) error) error {
+	return d.iterateBlocks(`SELECT `+blockColumns+` FROM blocks ORDER BY id`, nil, fn)
+}
+
+// IterateGlobalBlocks is IterateBlocks over the blocks GetGlobalBlocks
+// returns, in the order of the SQL ORDER BY clause orderBy.
+func (d *Database) IterateGlobalBlocks(orderBy string, fn func(*Block) error) error {
+	query := `SELECT ` + blockColumns + ` FROM blocks
+			  WHERE content_hash NOT IN (SELECT block_hash FROM local_blocks) ORDER BY ` + orderBy
+	return d.iterateBlocks(query, nil, fn)
+}
+
+func (d *Database) iterateBlocks(query string, args []any, fn func(*Block) error) error {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query blocks: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		block, err := d.scanBlock(rows)
+		if err != nil {
+			return fmt.Errorf("failed to scan block: %w", err)
+		}
+		if err := fn(block); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// CountGlobalBlocks returns the number of blocks that aren't local to a
+// watched file.
+func (d *Database) CountGlobalBlocks() (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM blocks WHERE content_hash NOT IN (SELECT block_hash FROM local_blocks)`
+	if err := d.db.QueryRow(query).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count blocks: %w", err)
+	}
+	return count, nil
+}
+
+// CountBlocks returns the number of blocks in the store.
+func (d *Database) CountBlocks() (int, error) {
+	var count int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM blocks`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count blocks: %w", err)
+	}
+	return count, nil
+}
+
+func (d *Database) DeleteBlock(id int) error {
+	var hash string
+	err := d.db.QueryRow(`SELECT content_hash FROM blocks WHERE id = ?`, id).Scan(&hash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return fmt.Errorf("failed to delete block: %w", err)
+	}
+	return d.DeleteBlockByHash(hash)
+}
+
+func (d *Database) UpdateBlockTimestamp(hash string, timestamp time.Time) error {
+	query := `UPDATE blocks SET updated_at = ?, touch_count = touch_count + 1 WHERE content_hash = ?`
+	_, err := d.db.Exec(query, timestamp, hash)
+	if err != nil {
+		return fmt.Errorf("failed to update block timestamp: %w", err)
+	}
+	return nil
+}
+
+// UpdateBlockContent replaces the content of the block identified by oldHash,
+// keeping its created_at and marking it touched. If the new content already
+// exists as another block the two are merged. File associations follow the
+// block to its new hash.
+func (d *Database) UpdateBlockContent(oldHash, content string) (*Block, error) {
+	updated := NewBlock(content)
+	if updated.ContentHash == oldHash {
+		return d.GetBlockByHash(oldHash)
+	}
+
+	stored, err := d.storedContent(updated.Content)
+	if err != nil {
+		return nil, err
+	}
+	title, err := d.storedContent(updated.Title())
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var existingID int
+	err = tx.QueryRow(`SELECT id FROM blocks WHERE content_hash = ?`, updated.ContentHash).Scan(&existingID)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec(`UPDATE blocks SET content = ?, content_hash = ?, updated_at = ?, touch_count = touch_count + 1,
+			word_count = ?, char_count = ?, title = ? WHERE content_hash = ?`,
+			stored, updated.ContentHash, updated.UpdatedAt, updated.Words, updated.Chars, title, oldHash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update block content: %w", err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("failed to look up block: %w", err)
+	default:
+		if _, err := tx.Exec(`DELETE FROM blocks WHERE content_hash = ?`, oldHash); err != nil {
+			return nil, fmt.Errorf("failed to delete merged block: %w", err)
+		}
+		_, err = tx.Exec(`UPDATE blocks SET updated_at = ?, touch_count = touch_count + 1 WHERE id = ?`,
+			updated.UpdatedAt, existingID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update block timestamp: %w", err)
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE OR IGNORE file_blocks SET block_hash = ? WHERE block_hash = ?`,
+		updated.ContentHash, oldHash); err != nil {
+		return nil, fmt.Errorf("failed to move file-block associations: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM file_blocks WHERE block_hash = ?`, oldHash); err != nil {
+		return nil, fmt.Errorf("failed to remove stale file-block associations: %w", err)
+	}
+
+	// An edited block keeps its review schedule, fired reminders and the
+	// periods its template was already cloned for
+	if err := moveBlockStateTx(tx, []string{oldHash}, []string{updated.ContentHash}); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit block update: %w", err)
+	}
+
+	return d.GetBlockByHash(updated.ContentHash)
+}
+
+// ReplaceBlocks deletes the blocks in oldHashes and stores replacements in
+// their place, for splitting and merging. Each file that contained one of the
+// old blocks gets the replacements where the first of them was. Replacements
+// whose content already exists are bumped instead of inserted.
+func (d *Database) ReplaceBlocks(oldHashes []string, replacements []*Block) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	old := make(map[string]bool)
+	for _, hash := range oldHashes {
+		old[hash] = true
+	}
+
+	// Work out the new order of every affected file before deleting
+	fileOrders := make(map[string][]string)
+	for _, hash := range oldHashes {
+		files, err := queryStrings(tx, `SELECT file_path FROM file_blocks WHERE block_hash = ?`, hash)
+		if err != nil {
+			return fmt.Errorf("failed to query block files: %w", err)
+		}
+		for _, filePath := range files {
+			if fileOrders[filePath] != nil {
+				continue
+			}
+			current, err := queryStrings(tx, `SELECT block_hash FROM file_blocks WHERE file_path = ? ORDER BY position`, filePath)
+			if err != nil {
+				return fmt.Errorf("failed to query file blocks: %w", err)
+			}
+			fileOrders[filePath] = replaceInOrder(current, old, replacements)
+		}
+	}
+
+	for _, hash := range oldHashes {
+		if err := deleteBlockTx(tx, hash); err != nil {
+			return err
+		}
+	}
+
+	for _, block := range replacements {
+		content, err := d.storedContent(block.Content)
+		if err != nil {
+			return err
+		}
+		title, err := d.storedContent(block.Title())
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO blocks (content, content_hash, created_at, updated_at, touch_count, word_count, char_count, title)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(content_hash) DO UPDATE SET updated_at = excluded.updated_at, touch_count = touch_count + 1`,
+			content, block.ContentHash, block.CreatedAt, block.UpdatedAt, block.TouchCount,
+			CountWords(block.Content), CountChars(block.Content), title)
+		if err != nil {
+			return fmt.Errorf("failed to store block: %w", err)
+		}
+	}
+
+	var replacementHashes []string
+	for _, block := range replacements {
+		replacementHashes = append(replacementHashes, block.ContentHash)
+	}
+	if err := moveBlockStateTx(tx, oldHashes, replacementHashes); err != nil {
+		return err
+	}
+
+	for filePath, order := range fileOrders {
+		if _, err := tx.Exec(`DELETE FROM file_blocks WHERE file_path = ?`, filePath); err != nil {
+			return fmt.Errorf("failed to clear file-block associations: %w", err)
+		}
+		for position, hash := range order {
+			if _, err := tx.Exec(`INSERT INTO file_blocks (file_path, block_hash, position) VALUES (?, ?, ?)`,
+				filePath, hash, position); err != nil {
+				return fmt.Errorf("failed to add file-block association: %w", err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit block replacement: %w", err)
+	}
+	return nil
+}
+
+// blockStateTables lists the state kept per block that follows it when its
+// hash changes or it is split or merged: the table, its block hash column
+// and a copy of a row to the hash given first. Copies that clash with state
+// the new block already has are dropped. Tables without a copy refer to one
+// block only, and are pointed at the first new block instead.
+var blockStateTables = []struct{ table, column, copyRows string }{
+	{"schedule", "block_hash", `INSERT OR IGNORE INTO schedule (block_hash, kind, due_at, fired)
+		SELECT ?, kind, due_at, fired FROM schedule WHERE block_hash = ?`},
+	{"reviews", "block_hash", `INSERT OR IGNORE INTO reviews (block_hash, interval_days, ease, repetitions, due_at)
+		SELECT ?, interval_days, ease, repetitions, due_at FROM reviews WHERE block_hash = ?`},
+	{"block_meta", "block_hash", `INSERT OR IGNORE INTO block_meta (block_hash, key, value)
+		SELECT ?, key, value FROM block_meta WHERE block_hash = ?`},
+	{"block_visibility", "block_hash", `INSERT OR IGNORE INTO block_visibility (block_hash, visibility)
+		SELECT ?, visibility FROM block_visibility WHERE block_hash = ?`},
+	{"local_blocks", "block_hash", `INSERT OR IGNORE INTO local_blocks (block_hash, file_path)
+		SELECT ?, file_path FROM local_blocks WHERE block_hash = ?`},
+	{"recurrences", "template_hash", `INSERT OR IGNORE INTO recurrences (template_hash, last_run)
+		SELECT ?, last_run FROM recurrences WHERE template_hash = ?`},
+	{"web_sources", "block_hash", ""},
+	{"attachments", "block_hash", ""},
+}
+
+// moveBlockStateTx gives every block in newHashes the state of the blocks in
+// oldHashes, then removes the state of those that aren't among the new ones.
+// Schedule items that a new block doesn't contain are pruned when the
+// schedule is next synced, so fired reminders stay fired in whichever part
+// they end up.
+func moveBlockStateTx(tx *sql.Tx, oldHashes, newHashes []string) error {
+	kept := make(map[string]bool)
+	for _, hash := range newHashes {
+		kept[hash] = true
+	}
+
+	for _, hash := range oldHashes {
+		if kept[hash] {
+			continue
+		}
+		for _, state := range blockStateTables {
+			if state.copyRows == "" {
+				if len(newHashes) == 0 {
+					continue
+				}
+				update := fmt.Sprintf(`UPDATE %s SET %s = ? WHERE %s = ?`, state.table, state.column, state.column)
+				if _, err := tx.Exec(update, newHashes[0], hash); err != nil {
+					return fmt.Errorf("failed to move %s: %w", state.table, err)
+				}
+				continue
+			}
+
+			for _, newHash := range newHashes {
+				if _, err := tx.Exec(state.copyRows, newHash, hash); err != nil {
+					return fmt.Errorf("failed to move %s: %w", state.table, err)
+				}
+			}
+			if _, err := tx.Exec(`DELETE FROM `+state.table+` WHERE `+state.column+` = ?`, hash); err != nil {
+				return fmt.Errorf("failed to remove stale %s: %w", state.table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// replaceInOrder swaps the old hashes in order for the replacements, placed
+// where the first old hash was, without introducing duplicates.
+func replaceInOrder(order []string, old map[string]bool, replacements []*Block) []string {
+	var result []string
+	seen := make(map[string]bool)
+	add := func(hash string) {
+		if !seen[hash] {
+			seen[hash] = true
+			result = append(result, hash)
+		}
+	}
+
+	replaced := false
+	for _, hash := range order {
+		if !old[hash] {
+			add(hash)
+			continue
+		}
+		if !replaced {
+			replaced = true
+			for _, block := range replacements {
+				add(block.ContentHash)
+			}
+		}
+	}
+	return result
+}
+
+func queryStrings(tx *sql.Tx, query string, args ...any) ([]string, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+func (d *Database) GetMetadata(key string) (string, error) {
+	query := `SELECT value FROM metadata WHERE key = ?`
+	row := d.db.QueryRow(query, key)
+
+	var value string
+	err := row.Scan(&value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get metadata: %w", err)
+	}
+
+	return value, nil
+}
+
+func (d *Database) SetMetadata(key, value string) error {
+	query := `INSERT OR REPLACE INTO metadata (key, value) VALUES (?, ?)`
+	_, err := d.db.Exec(query, key, value)
+	if err != nil {
+		return fmt.Errorf("failed to set metadata: %w", err)
+	}
+	return nil
+}
+
+func (d *Database) SearchBlocks(includeKeywords, excludeKeywords []string) ([]*Block, error) {
+	return d.SearchBlocksWith(includeKeywords, excludeKeywords, SearchOptions{})
+}
+
+// SearchBlocksWith is SearchBlocks filtered, sorted and limited as opts
+// says. Keywords of the form key:value whose key is set on some block match
+// that metadata instead of content; every such term must hold.
+func (d *Database) SearchBlocksWith(includeKeywords, excludeKeywords []string, opts SearchOptions) ([]*Block, error) {
+	if len(includeKeywords) == 0 && len(excludeKeywords) == 0 {
+		return nil, fmt.Errorf("at least one keyword is required")
+	}
+
+	filters, includeKeywords, excludeKeywords, err := d.splitMetaTerms(includeKeywords, excludeKeywords)
+	if err != nil {
+		return nil, err
+	}
+
+	// Encrypted content can't be matched in SQL, so filter after decrypting
+	if d.cipher != nil {
+		return d.searchDecryptedBlocks(includeKeywords, excludeKeywords, filters, opts)
+	}
+
+	whereParts, args := timeRangeConditions(opts.Range)
+	wordParts, wordArgs := wordRangeConditions(opts.Words)
+	whereParts = append(whereParts, wordParts...)
+	args = append(args, wordArgs...)
+	metaParts, metaArgs := metaConditions(filters)
+	whereParts = append(whereParts, metaParts...)
+	args = append(args, metaArgs...)
+
+	// Build include conditions (OR logic for union)
+	if len(includeKeywords) > 0 {
+		var includeParts []string
+		for _, keyword := range includeKeywords {
+			includeParts = append(includeParts, "content LIKE ?")
+			args = append(args, "%"+keyword+"%")
+		}
+		whereParts = append(whereParts, "("+strings.Join(includeParts, " OR ")+")")
+	}
+
+	// Build exclude conditions (AND NOT logic)
+	for _, keyword := range excludeKeywords {
+		whereParts = append(whereParts, "content NOT LIKE ?")
+		args = append(args, "%"+keyword+"%")
+	}
+
+	// If we only have exclude keywords and no include keywords, we need to select all blocks first
+	if len(whereParts) == 0 {
+		whereParts = []string{"1=1"}
+	}
+
+	orderBy, orderArgs := searchOrderBy(includeKeywords, opts)
+	query := `SELECT ` + blockColumns + `
+			  FROM blocks WHERE ` + strings.Join(whereParts, " AND ") + ` ORDER BY ` + orderBy
+	args = append(args, orderArgs...)
+	if opts.Limit > 0 {
+		query += fmt.Sprintf(` LIMIT %d`, opts.Limit)
+	}
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search blocks: %w", err)
+	}
+	defer rows.Close()
+
+	return d.scanBlocks(rows)
+}
+
+// GetBlocksInRange returns up to limit blocks created within r with a word
+// count within words, newest first. A limit of 0 returns all of them.
+func (d *Database) GetBlocksInRange(r TimeRange, words WordRange, limit int) ([]*Block, error) {
+	whereParts, args := timeRangeConditions(r)
+	wordParts, wordArgs := wordRangeConditions(words)
+	whereParts = append(whereParts, wordParts...)
+	args = append(args, wordArgs...)
+	query := `SELECT ` + blockColumns + ` FROM blocks`
+	if len(whereParts) > 0 {
+		query += ` WHERE ` + strings.Join(whereParts, " AND ")
+	}
+	query += ` ORDER BY created_at DESC, id DESC`
+	if limit > 0 {
+		query += fmt.Sprintf(` LIMIT %d`, limit)
+	}
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query blocks: %w", err)
+	}
+	defer rows.Close()
+
+	return d.scanBlocks(rows)
+}
+
+// searchOrderBy returns the ORDER BY clause for opts, matching
+// orderSearchResults. Relevance counts occurrences of the include keywords,
+// case-insensitively for ASCII as LIKE matches them.
+func searchOrderBy(includeKeywords []string, opts SearchOptions) (string, []any) {
+	var key string
+	var args []any
+	switch opts.Sort {
+	case SearchSortCreated:
+		key = "created_at"
+	case SearchSortLength:
+		key = "LENGTH(content)"
+	case SearchSortRelevance:
+		var counts []string
+		for _, keyword := range includeKeywords {
+			counts = append(counts, "(LENGTH(content) - LENGTH(REPLACE(LOWER(content), LOWER(?), ''))) / LENGTH(?)")
+			args = append(args, keyword, keyword)
+		}
+		if len(counts) > 0 {
+			key = strings.Join(counts, " + ")
+		}
+	}
+
+	direction := "DESC"
+	if opts.Reverse {
+		direction = "ASC"
+	}
+	orderBy := "updated_at " + direction + ", id " + direction
+	if key != "" {
+		orderBy = key + " " + direction + ", " + orderBy
+	}
+	return orderBy, args
+}
+
+// timeRangeConditions returns the WHERE conditions on created_at for r,
+// which idx_blocks_created_at serves.
+func timeRangeConditions(r TimeRange) ([]string, []any) {
+	var whereParts []string
+	var args []any
+	if !r.Since.IsZero() {
+		whereParts = append(whereParts, "created_at >= ?")
+		args = append(args, r.Since)
+	}
+	if !r.Until.IsZero() {
+		whereParts = append(whereParts, "created_at < ?")
+		args = append(args, r.Until)
+	}
+	return whereParts, args
+}
+
+// wordRangeConditions returns the WHERE conditions selecting word counts
+// within r.
+func wordRangeConditions(r WordRange) ([]string, []any) {
+	var whereParts []string
+	var args []any
+	if r.Min > 0 {
+		whereParts = append(whereParts, "word_count >= ?")
+		args = append(args, r.Min)
+	}
+	if r.Max > 0 {
+		whereParts = append(whereParts, "word_count <= ?")
+		args = append(args, r.Max)
+	}
+	return whereParts, args
+}
+
+func (d *Database) GetBlocksCreatedAfter(timestamp time.Time) ([]*Block, error) {
+	query := `SELECT ` + blockColumns + `
+			  FROM blocks WHERE created_at > ? ORDER BY updated_at DESC`
+
+	rows, err := d.db.Query(query, timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query blocks: %w", err)
+	}
+	defer rows.Close()
+
+	return d.scanBlocks(rows)
+}
+
+func (d *Database) DeleteBlocksByTag(tag string) (int, error) {
+	if d.cipher != nil {
+		blocks, err := d.searchDecryptedBlocks([]string{tag}, nil, nil, SearchOptions{})
+		if err != nil {
+			return 0, fmt.Errorf("failed to find blocks with tag '%s': %w", tag, err)
+		}
+		for _, block := range blocks {
+			if err := d.DeleteBlockByHash(block.ContentHash); err != nil {
+				return 0, err
+			}
+		}
+		return len(blocks), nil
+	}
+
+	query := `DELETE FROM blocks WHERE content LIKE ?`
+	result, err := d.db.Exec(query, "%"+tag+"%")
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete blocks with tag '%s': %w", tag, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get affected rows count: %w", err)
+	}
+
+	return int(rowsAffected), nil
+}
+
+// DeleteBlockByHash deletes a block and its file associations. SQLite does
+// not enforce the foreign keys declared on file_blocks, so the cascade is
+// done here.
+func (d *Database) DeleteBlockByHash(hash string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM blocks WHERE content_hash = ?`, hash); err != nil {
+		return fmt.Errorf("failed to delete block by hash: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM file_blocks WHERE block_hash = ?`, hash); err != nil {
+		return fmt.Errorf("failed to delete file-block associations: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM local_blocks WHERE block_hash = ?`, hash); err != nil {
+		return fmt.Errorf("failed to delete local block mark: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit block deletion: %w", err)
+	}
+	return nil
+}
+
+// Watched Files methods
+func (d *Database) AddWatchedFile(filePath string) error {
+	query := `INSERT OR IGNORE INTO watched_files (file_path) VALUES (?)`
+	_, err := d.db.Exec(query, filePath)
+	if err != nil {
+		return fmt.Errorf("failed to add watched file: %w", err)
+	}
+	return nil
+}
+
+// RemoveWatchedFile removes a file from the watch list along with its block
+// associations and snapshot. The blocks themselves are kept.
+func (d *Database) RemoveWatchedFile(filePath string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		`DELETE FROM watched_files WHERE file_path = ?`,
+		`DELETE FROM file_blocks WHERE file_path = ?`,
+		`DELETE FROM file_snapshots WHERE file_path = ?`,
+		`DELETE FROM file_front_matter WHERE file_path = ?`,
+	} {
+		if _, err := tx.Exec(query, filePath); err != nil {
+			return fmt.Errorf("failed to remove watched file: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit watched file removal: %w", err)
+	}
+	return nil
+}
+
+// RenameWatchedFile moves a watched file and its associations, snapshot
+// and local blocks to newPath. If newPath is already watched, oldPath is
+// a duplicate entry for the same file and is dropped instead.
+func (d *Database) RenameWatchedFile(oldPath, newPath string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow(`SELECT 1 FROM watched_files WHERE file_path = ?`, newPath).Scan(&exists)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to check watched file: %w", err)
+	}
+
+	queries := []string{
+		`UPDATE watched_files SET file_path = ? WHERE file_path = ?`,
+		`UPDATE OR IGNORE file_blocks SET file_path = ? WHERE file_path = ?`,
+		`UPDATE OR IGNORE file_snapshots SET file_path = ? WHERE file_path = ?`,
+		`UPDATE OR IGNORE file_front_matter SET file_path = ? WHERE file_path = ?`,
+		`UPDATE local_blocks SET file_path = ? WHERE file_path = ?`,
+	}
+	if err == nil {
+		queries = []string{`UPDATE local_blocks SET file_path = ? WHERE file_path = ?`}
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, newPath, oldPath); err != nil {
+			return fmt.Errorf("failed to rename watched file: %w", err)
+		}
+	}
+	for _, query := range []string{
+		`DELETE FROM watched_files WHERE file_path = ?`,
+		`DELETE FROM file_blocks WHERE file_path = ?`,
+		`DELETE FROM file_snapshots WHERE file_path = ?`,
+		`DELETE FROM file_front_matter WHERE file_path = ?`,
+	} {
+		if _, err := tx.Exec(query, oldPath); err != nil {
+			return fmt.Errorf("failed to rename watched file: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit watched file rename: %w", err)
+	}
+	return nil
+}
+
+func (d *Database) GetWatchedFiles() ([]string, error) {
+	query := `SELECT file_path FROM watched_files ORDER BY started_at DESC`
+	rows, err := d.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query watched files: %w", err)
+	}
+	defer rows.Close()
+
+	var files []string
+	for rows.Next() {
+		var filePath string
+		err := rows.Scan(&filePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan watched file: %w", err)
+		}
+		files = append(files, filePath)
+	}
+
+	return files, nil
+}
+
+func (d *Database) IsFileWatched(filePath string) (bool, error) {
+	query := `SELECT 1 FROM watched_files WHERE file_path = ?`
+	row := d.db.QueryRow(query, filePath)
+
+	var dummy int
+	err := row.Scan(&dummy)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check if file is watched: %w", err)
+	}
+	return true, nil
+}
+
+// FileQuarantine records why the watcher daemon stopped reconciling a file.
+type FileQuarantine struct {
+	Since  time.Time
+	Reason string
+}
+
+// QuarantineWatchedFile makes the watcher daemon skip filePath until it is
+// released, after reconciling it kept failing with reason.
+func (d *Database) QuarantineWatchedFile(filePath, reason string) error {
+	query := `UPDATE watched_files SET quarantined_at = ?, quarantine_reason = ? WHERE file_path = ?`
+	if _, err := d.db.Exec(query, time.Now(), reason, filePath); err != nil {
+		return fmt.Errorf("failed to quarantine watched file: %w", err)
+	}
+	return nil
+}
+
+// ReleaseWatchedFile lifts the quarantine of filePath, reporting whether it
+// was quarantined.
+func (d *Database) ReleaseWatchedFile(filePath string) (bool, error) {
+	query := `UPDATE watched_files SET quarantined_at = NULL, quarantine_reason = NULL
+		WHERE file_path = ? AND quarantined_at IS NOT NULL`
+	result, err := d.db.Exec(query, filePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to release watched file: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// GetFileQuarantine returns the quarantine of filePath, or nil if it isn't
+// quarantined.
+func (d *Database) GetFileQuarantine(filePath string) (*FileQuarantine, error) {
+	query := `SELECT quarantined_at, COALESCE(quarantine_reason, '') FROM watched_files
+		WHERE file_path = ? AND quarantined_at IS NOT NULL`
+	var quarantine FileQuarantine
+	err := d.db.QueryRow(query, filePath).Scan(&quarantine.Since, &quarantine.Reason)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file quarantine: %w", err)
+	}
+	return &quarantine, nil
+}
+
+// File-Block association methods
+
+// addFileBlockAssociationsTx associates many blocks with filePath in tx.
+// Existing associations are ignored.
+func addFileBlockAssociationsTx(tx *sql.Tx, filePath string, blockHashes []string) error {
+	for start := 0; start < len(blockHashes); start += sqlBatchSize {
+		batch := blockHashes[start:min(start+sqlBatchSize, len(blockHashes))]
+
+		args := make([]any, 0, len(batch)*2)
+		for _, hash := range batch {
+			args = append(args, filePath, hash)
+		}
+
+		query := `INSERT OR IGNORE INTO file_blocks (file_path, block_hash) VALUES ` + placeholders(len(batch), 2)
+		if _, err := tx.Exec(query, args...); err != nil {
+			return fmt.Errorf("failed to add file-block associations: %w", err)
+		}
+	}
+	return nil
+}
+
+func (d *Database) GetFileBlockHashes(filePath string) ([]string, error) {
+	query := `SELECT block_hash FROM file_blocks WHERE file_path = ?`
+	rows, err := d.db.Query(query, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query file blocks: %w", err)
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		err := rows.Scan(&hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan block hash: %w", err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, nil
+}
+
+// setFileBlockPositionsTx records the order in which blocks appear in
+// filePath. Associated blocks missing from blockHashes keep their relative
+// order after the listed ones.
+func setFileBlockPositionsTx(tx *sql.Tx, filePath string, blockHashes []string) error {
+	if _, err := tx.Exec(`UPDATE file_blocks SET position = position + ? WHERE file_path = ?`,
+		len(blockHashes), filePath); err != nil {
+		return fmt.Errorf("failed to shift file block positions: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`UPDATE file_blocks SET position = ? WHERE file_path = ? AND block_hash = ?`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare position update: %w", err)
+	}
+	defer stmt.Close()
+
+	for i, hash := range blockHashes {
+		if _, err := stmt.Exec(i, filePath, hash); err != nil {
+			return fmt.Errorf("failed to set file block position: %w", err)
+		}
+	}
+	return nil
+}
+
+// FileBlockChanges are the writes reconciling a file makes to the blocks it
+// holds.
+type FileBlockChanges struct {
+	FilePath string
+
+	// Created are stored as new blocks, local to the file if Local is set
+	Created []*Block
+	Local   bool
+
+	// Associated are the hashes of the blocks the file holds, in the order
+	// of Positions
+	Associated []string
+	Positions  []string
+
+	// Detached lose their association with the file only
+	Detached []string
+
+	// Deleted are deleted everywhere, after a copy of Trashed is kept
+	Trashed []*Block
+	Deleted []string
+}
+
+// ApplyFileBlockChanges makes the writes of a reconcile in a single
+// transaction, so one that fails or is interrupted leaves the file's blocks
+// as they were instead of half stored and half deleted.
+func (d *Database) ApplyFileBlockChanges(changes *FileBlockChanges) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := d.createBlocksTx(tx, changes.Created); err != nil {
+		return err
+	}
+	if changes.Local {
+		var created []string
+		for _, block := range changes.Created {
+			created = append(created, block.ContentHash)
+		}
+		if err := markLocalBlocksTx(tx, changes.FilePath, created); err != nil {
+			return err
+		}
+	}
+	if err := addFileBlockAssociationsTx(tx, changes.FilePath, changes.Associated); err != nil {
+		return err
+	}
+
+	for _, hash := range changes.Detached {
+		if _, err := tx.Exec(`DELETE FROM file_blocks WHERE file_path = ? AND block_hash = ?`, changes.FilePath, hash); err != nil {
+			return fmt.Errorf("failed to remove file-block association: %w", err)
+		}
+	}
+	if len(changes.Trashed) > 0 {
+		if _, err := d.trashBlocksTx(tx, changes.FilePath, changes.Trashed); err != nil {
+			return err
+		}
+	}
+	if err := deleteBlocksTx(tx, changes.Deleted); err != nil {
+		return err
+	}
+
+	if err := setFileBlockPositionsTx(tx, changes.FilePath, changes.Positions); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit file blocks: %w", err)
+	}
+	return nil
+}
+
+// GetFileBlocks returns the blocks associated with filePath in the order
+// they were last written to it. Associations whose block has been deleted
+// are skipped.
+func (d *Database) GetFileBlocks(filePath string) ([]*Block, error) {
+	query := `SELECT ` + prefixedBlockColumns("b") + `
+			  FROM file_blocks fb JOIN blocks b ON b.content_hash = fb.block_hash
+			  WHERE fb.file_path = ? ORDER BY fb.position, b.id`
+	rows, err := d.db.Query(query, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query file blocks: %w", err)
+	}
+	defer rows.Close()
+
+	return d.scanBlocks(rows)
+}
+
+// GetBlockFiles returns the watched files a block appears in.
+func (d *Database) GetBlockFiles(blockHash string) ([]string, error) {
+	query := `SELECT file_path FROM file_blocks WHERE block_hash = ? ORDER BY file_path`
+	rows, err := d.db.Query(query, blockHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query block files: %w", err)
+	}
+	defer rows.Close()
+
+	var files []string
+	for rows.Next() {
+		var filePath string
+		if err := rows.Scan(&filePath); err != nil {
+			return nil, fmt.Errorf("failed to scan file path: %w", err)
+		}
+		files = append(files, filePath)
+	}
+
+	return files, rows.Err()
+}
+
+// FileBlock is one row of the file_blocks association table.
+type FileBlock struct {
+	FilePath  string
+	BlockHash string
+}
+
+// GetOrphanedFileBlocks returns associations whose block or watched file no
+// longer exists.
+func (d *Database) GetOrphanedFileBlocks() ([]FileBlock, error) {
+	query := `SELECT fb.file_path, fb.block_hash FROM file_blocks fb
+			  LEFT JOIN blocks b ON b.content_hash = fb.block_hash
+			  LEFT JOIN watched_files w ON w.file_path = fb.file_path
+			  WHERE b.id IS NULL OR w.file_path IS NULL`
+	rows, err := d.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query orphaned file blocks: %w", err)
+	}
+	defer rows.Close()
+
+	var orphans []FileBlock
+	for rows.Next() {
+		var orphan FileBlock
+		if err := rows.Scan(&orphan.FilePath, &orphan.BlockHash); err != nil {
+			return nil, fmt.Errorf("failed to scan file block: %w", err)
+		}
+		orphans = append(orphans, orphan)
+	}
+
+	return orphans, rows.Err()
+}
+
+func (d *Database) RemoveFileBlockAssociation(filePath, blockHash string) error {
+	query := `DELETE FROM file_blocks WHERE file_path = ? AND block_hash = ?`
+	_, err := d.db.Exec(query, filePath, blockHash)
+	if err != nil {
+		return fmt.Errorf("failed to remove file-block association: %w", err)
+	}
+	return nil
+}
+
+// RepairBlockHash sets the stored hash of a block to the hash of its content
+// without touching its timestamps. If another block already has that hash the
+// two are duplicates: the broken row is dropped and its touches, file
+// associations and block state are merged into the other block, which is
+// reported by the returned bool.
+func (d *Database) RepairBlockHash(block *Block) (bool, error) {
+	correctHash := generateContentHash(block.Content)
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var existingID int
+	var updatedAt time.Time
+	duplicate := false
+	err = tx.QueryRow(`SELECT id, updated_at FROM blocks WHERE content_hash = ?`, correctHash).Scan(&existingID, &updatedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		if _, err := tx.Exec(`UPDATE blocks SET content_hash = ? WHERE id = ?`, correctHash, block.ID); err != nil {
+			return false, fmt.Errorf("failed to repair block hash: %w", err)
+		}
+	case err != nil:
+		return false, fmt.Errorf("failed to look up block: %w", err)
+	default:
+		duplicate = true
+		if _, err := tx.Exec(`DELETE FROM blocks WHERE id = ?`, block.ID); err != nil {
+			return false, fmt.Errorf("failed to delete duplicate block: %w", err)
+		}
+		if block.UpdatedAt.After(updatedAt) {
+			updatedAt = block.UpdatedAt
+		}
+		_, err = tx.Exec(`UPDATE blocks SET updated_at = ?, touch_count = touch_count + ? WHERE id = ?`,
+			updatedAt, block.TouchCount, existingID)
+		if err != nil {
+			return false, fmt.Errorf("failed to merge duplicate block: %w", err)
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE OR IGNORE file_blocks SET block_hash = ? WHERE block_hash = ?`,
+		correctHash, block.ContentHash); err != nil {
+		return false, fmt.Errorf("failed to move file-block associations: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM file_blocks WHERE block_hash = ?`, block.ContentHash); err != nil {
+		return false, fmt.Errorf("failed to remove stale file-block associations: %w", err)
+	}
+	if err := moveBlockStateTx(tx, []string{block.ContentHash}, []string{correctHash}); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit hash repair: %w", err)
+	}
+	return duplicate, nil
+}
+
+// File snapshot methods
+
+// GetFileSnapshot returns the content the file had when it was last
+// reconciled or generated. ok is false if no snapshot has been stored yet.
+func (d *Database) GetFileSnapshot(filePath string) (content string, ok bool, err error) {
+	query := `SELECT content FROM file_snapshots WHERE file_path = ?`
+	err = d.db.QueryRow(query, filePath).Scan(&content)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to get file snapshot: %w", err)
+	}
+
+	if d.cipher != nil {
+		content, err = d.cipher.Decrypt(content)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to decrypt file snapshot: %w", err)
+		}
+	}
+	return content, true, nil
+}
+
+func (d *Database) SetFileSnapshot(filePath, content string) error {
+	stored, err := d.storedContent(content)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT OR REPLACE INTO file_snapshots (file_path, content, updated_at) VALUES (?, ?, ?)`
+	if _, err := d.db.Exec(query, filePath, stored, time.Now()); err != nil {
+		return fmt.Errorf("failed to set file snapshot: %w", err)
+	}
+	return nil
+}
+
+// GetFileFrontMatter returns the front matter last seen at the top of
+// filePath, including its --- delimiters, or "" if it had none.
+func (d *Database) GetFileFrontMatter(filePath string) (string, error) {
+	var content string
+	err := d.db.QueryRow(`SELECT content FROM file_front_matter WHERE file_path = ?`, filePath).Scan(&content)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get front matter: %w", err)
+	}
+
+	if d.cipher != nil {
+		if content, err = d.cipher.Decrypt(content); err != nil {
+			return "", fmt.Errorf("failed to decrypt front matter: %w", err)
+		}
+	}
+	return content, nil
+}
+
+// SetFileFrontMatter stores the front matter of filePath; an empty string
+// removes it.
+func (d *Database) SetFileFrontMatter(filePath, content string) error {
+	if content == "" {
+		if _, err := d.db.Exec(`DELETE FROM file_front_matter WHERE file_path = ?`, filePath); err != nil {
+			return fmt.Errorf("failed to remove front matter: %w", err)
+		}
+		return nil
+	}
+
+	stored, err := d.storedContent(content)
+	if err != nil {
+		return err
+	}
+	query := `INSERT OR REPLACE INTO file_front_matter (file_path, content) VALUES (?, ?)`
+	if _, err := d.db.Exec(query, filePath, stored); err != nil {
+		return fmt.Errorf("failed to set front matter: %w", err)
+	}
+	return nil
+}
+
+// GetFileSnapshotTime returns when filePath was last reconciled or
+// generated. ok is false if that has never happened.
+func (d *Database) GetFileSnapshotTime(filePath string) (updatedAt time.Time, ok bool, err error) {
+	query := `SELECT updated_at FROM file_snapshots WHERE file_path = ?`
+	err = d.db.QueryRow(query, filePath).Scan(&updatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return time.Time{}, false, nil
+		}
+		return time.Time{}, false, fmt.Errorf("failed to get file snapshot time: %w", err)
+	}
+	return updatedAt, true, nil
+}
+
+// Attachment methods
+
+// AddAttachment records an attachment, or another reference to an asset
+// that an earlier block attached.
+func (d *Database) AddAttachment(attachment *Attachment) error {
+	query := `INSERT INTO attachments (asset_path, original_name, block_hash, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(asset_path) DO UPDATE SET ref_count = ref_count + 1`
+	if _, err := d.db.Exec(query, attachment.AssetPath, attachment.OriginalName, attachment.BlockHash, time.Now()); err != nil {
+		return fmt.Errorf("failed to add attachment: %w", err)
+	}
+	return nil
+}
+
+func (d *Database) GetAttachments() ([]*Attachment, error) {
+	rows, err := d.db.Query(`SELECT asset_path, original_name, block_hash, ref_count FROM attachments ORDER BY asset_path`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query attachments: %w", err)
+	}
+	defer rows.Close()
+
+	var attachments []*Attachment
+	for rows.Next() {
+		attachment := &Attachment{}
+		if err := rows.Scan(&attachment.AssetPath, &attachment.OriginalName, &attachment.BlockHash, &attachment.RefCount); err != nil {
+			return nil, fmt.Errorf("failed to scan attachment: %w", err)
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, rows.Err()
+}
+
+func (d *Database) SetAttachmentRefCount(assetPath string, count int) error {
+	if _, err := d.db.Exec(`UPDATE attachments SET ref_count = ? WHERE asset_path = ?`, count, assetPath); err != nil {
+		return fmt.Errorf("failed to update attachment references: %w", err)
+	}
+	return nil
+}
+
+func (d *Database) DeleteAttachment(assetPath string) error {
+	if _, err := d.db.Exec(`DELETE FROM attachments WHERE asset_path = ?`, assetPath); err != nil {
+		return fmt.Errorf("failed to delete attachment: %w", err)
+	}
+	return nil
+}
+
+// Schedule methods
+
+// ReplaceScheduleItems makes the schedule table hold exactly items. Items
+// already present keep their fired state.
+func (d *Database) ReplaceScheduleItems(items []*ScheduleItem) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`CREATE TEMP TABLE IF NOT EXISTS current_schedule (
+		block_hash TEXT NOT NULL, kind TEXT NOT NULL, due_at TIMESTAMP NOT NULL)`); err != nil {
+		return fmt.Errorf("failed to create temporary schedule table: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM current_schedule`); err != nil {
+		return fmt.Errorf("failed to clear temporary schedule table: %w", err)
+	}
+
+	for _, item := range items {
+		if _, err := tx.Exec(`INSERT INTO current_schedule (block_hash, kind, due_at) VALUES (?, ?, ?)`,
+			item.BlockHash, item.Kind, item.At.UTC()); err != nil {
+			return fmt.Errorf("failed to stage schedule item: %w", err)
+		}
+	}
+
+	prune := `DELETE FROM schedule WHERE NOT EXISTS (SELECT 1 FROM current_schedule c
+		WHERE c.block_hash = schedule.block_hash AND c.kind = schedule.kind AND c.due_at = schedule.due_at)`
+	if _, err := tx.Exec(prune); err != nil {
+		return fmt.Errorf("failed to prune schedule: %w", err)
+	}
+
+	insert := `INSERT OR IGNORE INTO schedule (block_hash, kind, due_at) SELECT block_hash, kind, due_at FROM current_schedule`
+	if _, err := tx.Exec(insert); err != nil {
+		return fmt.Errorf("failed to update schedule: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit schedule: %w", err)
+	}
+	return nil
+}
+
+// GetScheduleItems returns every schedule item with its block's content,
+// ordered by due time.
+func (d *Database) GetScheduleItems() ([]*ScheduleItem, error) {
+	query := `SELECT s.block_hash, s.kind, s.due_at, s.fired, b.content
+		FROM schedule s JOIN blocks b ON b.content_hash = s.block_hash
+		ORDER BY s.due_at`
+	rows, err := d.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schedule: %w", err)
+	}
+	defer rows.Close()
+
+	var items []*ScheduleItem
+	for rows.Next() {
+		item := &ScheduleItem{}
+		if err := rows.Scan(&item.BlockHash, &item.Kind, &item.At, &item.Fired, &item.Content); err != nil {
+			return nil, fmt.Errorf("failed to scan schedule item: %w", err)
+		}
+		if d.cipher != nil {
+			if item.Content, err = d.cipher.Decrypt(item.Content); err != nil {
+				return nil, fmt.Errorf("block %.12s: %w", item.BlockHash, err)
+			}
+		}
+		item.At = item.At.Local()
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (d *Database) MarkScheduleItemFired(item *ScheduleItem) error {
+	query := `UPDATE schedule SET fired = 1 WHERE block_hash = ? AND kind = ? AND due_at = ?`
+	if _, err := d.db.Exec(query, item.BlockHash, item.Kind, item.At.UTC()); err != nil {
+		return fmt.Errorf("failed to mark reminder fired: %w", err)
+	}
+	return nil
+}
+
+// Review methods
+
+// GetReviewStates returns the stored review state of every block, keyed by
+// block hash.
+func (d *Database) GetReviewStates() (map[string]*ReviewState, error) {
+	rows, err := d.db.Query(`SELECT block_hash, interval_days, ease, repetitions, due_at FROM reviews`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query reviews: %w", err)
+	}
+	defer rows.Close()
+
+	states := make(map[string]*ReviewState)
+	for rows.Next() {
+		state := &ReviewState{}
+		if err := rows.Scan(&state.BlockHash, &state.IntervalDays, &state.Ease, &state.Repetitions, &state.DueAt); err != nil {
+			return nil, fmt.Errorf("failed to scan review: %w", err)
+		}
+		states[state.BlockHash] = state
+	}
+	return states, rows.Err()
+}
+
+func (d *Database) SaveReviewState(state *ReviewState) error {
+	query := `INSERT OR REPLACE INTO reviews (block_hash, interval_days, ease, repetitions, due_at) VALUES (?, ?, ?, ?, ?)`
+	if _, err := d.db.Exec(query, state.BlockHash, state.IntervalDays, state.Ease, state.Repetitions, state.DueAt); err != nil {
+		return fmt.Errorf("failed to save review: %w", err)
+	}
+	return nil
+}
+
+// Recurrence methods
+
+// GetRecurrenceRuns returns when each recurring template was last cloned,
+// keyed by template hash.
+func (d *Database) GetRecurrenceRuns() (map[string]time.Time, error) {
+	rows, err := d.db.Query(`SELECT template_hash, last_run FROM recurrences`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query recurrences: %w", err)
+	}
+	defer rows.Close()
+
+	runs := make(map[string]time.Time)
+	for rows.Next() {
+		var hash string
+		var lastRun time.Time
+		if err := rows.Scan(&hash, &lastRun); err != nil {
+			return nil, fmt.Errorf("failed to scan recurrence: %w", err)
+		}
+		runs[hash] = lastRun.Local()
+	}
+	return runs, rows.Err()
+}
+
+// SetRecurrenceRun records that the template was cloned for the occurrence
+// at lastRun.
+func (d *Database) SetRecurrenceRun(templateHash string, lastRun time.Time) error {
+	query := `INSERT OR REPLACE INTO recurrences (template_hash, last_run) VALUES (?, ?)`
+	if _, err := d.db.Exec(query, templateHash, lastRun.UTC()); err != nil {
+		return fmt.Errorf("failed to save recurrence: %w", err)
+	}
+	return nil
+}
+
+func (d *Database) DeleteRecurrence(templateHash string) error {
+	if _, err := d.db.Exec(`DELETE FROM recurrences WHERE template_hash = ?`, templateHash); err != nil {
+		return fmt.Errorf("failed to delete recurrence: %w", err)
+	}
+	return nil
+}
+
+// Trash methods
+
+// maxTrashedBlocks bounds the trash table; the oldest entries are pruned.
+const maxTrashedBlocks = 1000
+
+// trashBlocksTx keeps a copy of blocks a reconcile of filePath is about to
+// delete, as one run, and returns the run's number.
+func (d *Database) trashBlocksTx(tx *sql.Tx, filePath string, blocks []*Block) (int, error) {
+	var run int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(run), 0) + 1 FROM trash`).Scan(&run); err != nil {
+		return 0, fmt.Errorf("failed to number trash run: %w", err)
+	}
+
+	now := time.Now()
+	for _, block := range blocks {
+		content, err := d.storedContent(block.Content)
+		if err != nil {
+			return 0, err
+		}
+		query := `INSERT INTO trash (run, file_path, content, content_hash, created_at, deleted_at) VALUES (?, ?, ?, ?, ?, ?)`
+		if _, err := tx.Exec(query, run, filePath, content, block.ContentHash, block.CreatedAt, now); err != nil {
+			return 0, fmt.Errorf("failed to trash block: %w", err)
+		}
+	}
+
+	prune := `DELETE FROM trash WHERE id NOT IN (SELECT id FROM trash ORDER BY id DESC LIMIT ?)`
+	if _, err := tx.Exec(prune, maxTrashedBlocks); err != nil {
+		return 0, fmt.Errorf("failed to prune trash: %w", err)
+	}
+	return run, nil
+}
+
+// GetTrash returns up to limit trashed blocks, newest first, or only those
+// of the last run with lastRun.
+func (d *Database) GetTrash(limit int, lastRun bool) ([]*TrashedBlock, error) {
+	query := `SELECT id, run, file_path, content, content_hash, created_at, deleted_at FROM trash`
+	if lastRun {
+		query += ` WHERE run = (SELECT MAX(run) FROM trash)`
+	}
+	query += ` ORDER BY id DESC`
+	var args []any
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+	return d.queryTrash(query, args...)
+}
+
+// GetTrashedBlock returns the trashed block with id, or nil.
+func (d *Database) GetTrashedBlock(id int) (*TrashedBlock, error) {
+	trashed, err := d.queryTrash(`SELECT id, run, file_path, content, content_hash, created_at, deleted_at
+		FROM trash WHERE id = ?`, id)
+	if err != nil || len(trashed) == 0 {
+		return nil, err
+	}
+	return trashed[0], nil
+}
+
+func (d *Database) queryTrash(query string, args ...any) ([]*TrashedBlock, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query trash: %w", err)
+	}
+	defer rows.Close()
+
+	var trashed []*TrashedBlock
+	for rows.Next() {
+		t := &TrashedBlock{}
+		if err := rows.Scan(&t.ID, &t.Run, &t.FilePath, &t.Content, &t.ContentHash, &t.CreatedAt, &t.DeletedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan trashed block: %w", err)
+		}
+		if d.cipher != nil {
+			if t.Content, err = d.cipher.Decrypt(t.Content); err != nil {
+				return nil, fmt.Errorf("trashed block %d: %w", t.ID, err)
+			}
+		}
+		trashed = append(trashed, t)
+	}
+	return trashed, rows.Err()
+}
+
+func (d *Database) DeleteTrashedBlock(id int) error {
+	if _, err := d.db.Exec(`DELETE FROM trash WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete trashed block: %w", err)
+	}
+	return nil
+}
+
+// API token methods
+
+// CreateAPIToken stores a token for `notes serve` by the hash of its secret.
+func (d *Database) CreateAPIToken(name, tokenHash string) error {
+	var exists bool
+	if err := d.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM api_tokens WHERE name = ?)`, name).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up token: %w", err)
+	}
+	if exists {
+		return fmt.Errorf("a token named %q already exists", name)
+	}
+	query := `INSERT INTO api_tokens (name, token_hash, created_at) VALUES (?, ?, ?)`
+	if _, err := d.db.Exec(query, name, tokenHash, time.Now()); err != nil {
+		return fmt.Errorf("failed to create token: %w", err)
+	}
+	return nil
+}
+
+// GetAPITokens returns the API tokens, oldest first.
+func (d *Database) GetAPITokens() ([]*APIToken, error) {
+	rows, err := d.db.Query(`SELECT name, created_at, last_used_at FROM api_tokens ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []*APIToken
+	for rows.Next() {
+		token := &APIToken{}
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&token.Name, &token.CreatedAt, &lastUsed); err != nil {
+			return nil, fmt.Errorf("failed to scan token: %w", err)
+		}
+		token.LastUsedAt = lastUsed.Time
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// UseAPIToken reports whether a token with tokenHash exists, recording
+// that it was used.
+func (d *Database) UseAPIToken(tokenHash string) (bool, error) {
+	result, err := d.db.Exec(`UPDATE api_tokens SET last_used_at = ? WHERE token_hash = ?`, time.Now(), tokenHash)
+	if err != nil {
+		return false, fmt.Errorf("failed to check token: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// RevokeAPIToken deletes the token called name and reports whether there
+// was one.
+func (d *Database) RevokeAPIToken(name string) (bool, error) {
+	result, err := d.db.Exec(`DELETE FROM api_tokens WHERE name = ?`, name)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke token: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// Watcher error methods
+
+// maxWatcherErrors bounds the watcher_errors table; older rows are pruned.
+const maxWatcherErrors = 100
+
+// WatcherError is a failure recorded by the watcher daemon for `notes status`.
+type WatcherError struct {
+	FilePath  string
+	Message   string
+	CreatedAt time.Time
+}
+
+// RecordWatcherError stores a daemon failure, keeping only the most recent
+// maxWatcherErrors entries.
+func (d *Database) RecordWatcherError(filePath string, err error) error {
+	query := `INSERT INTO watcher_errors (file_path, message, created_at) VALUES (?, ?, ?)`
+	if _, execErr := d.db.Exec(query, filePath, err.Error(), time.Now()); execErr != nil {
+		return fmt.Errorf("failed to record watcher error: %w", execErr)
+	}
+
+	prune := `DELETE FROM watcher_errors WHERE id NOT IN
+		(SELECT id FROM watcher_errors ORDER BY id DESC LIMIT ?)`
+	if _, execErr := d.db.Exec(prune, maxWatcherErrors); execErr != nil {
+		return fmt.Errorf("failed to prune watcher errors: %w", execErr)
+	}
+	return nil
+}
+
+// GetRecentWatcherErrors returns up to limit recorded errors, newest first.
+func (d *Database) GetRecentWatcherErrors(limit int) ([]WatcherError, error) {
+	query := `SELECT file_path, message, created_at FROM watcher_errors ORDER BY id DESC LIMIT ?`
+	rows, err := d.db.Query(query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query watcher errors: %w", err)
+	}
+	defer rows.Close()
+
+	var watcherErrors []WatcherError
+	for rows.Next() {
+		var watcherError WatcherError
+		if err := rows.Scan(&watcherError.FilePath, &watcherError.Message, &watcherError.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan watcher error: %w", err)
+		}
+		watcherErrors = append(watcherErrors, watcherError)
+	}
+	return watcherErrors, rows.Err()
+}
+
+// SizeSample is the size of the database file on one day.
+type SizeSample struct {
+	Day   string `json:"day"`
+	Bytes int64  `json:"bytes"`
+}
+
+// RecordSizeSample stores the database size for day (YYYY-MM-DD), replacing
+// an earlier sample of the same day.
+func (d *Database) RecordSizeSample(day string, bytes int64) error {
+	query := `INSERT OR REPLACE INTO size_samples (day, bytes) VALUES (?, ?)`
+	if _, err := d.db.Exec(query, day, bytes); err != nil {
+		return fmt.Errorf("failed to record size sample: %w", err)
+	}
+	return nil
+}
+
+// GetSizeSamples returns all recorded size samples, oldest first.
+func (d *Database) GetSizeSamples() ([]SizeSample, error) {
+	rows, err := d.db.Query(`SELECT day, bytes FROM size_samples ORDER BY day`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query size samples: %w", err)
+	}
+	defer rows.Close()
+
+	var samples []SizeSample
+	for rows.Next() {
+		var sample SizeSample
+		if err := rows.Scan(&sample.Day, &sample.Bytes); err != nil {
+			return nil, fmt.Errorf("failed to scan size sample: %w", err)
+		}
+		samples = append(samples, sample)
+	}
+	return samples, rows.Err()
+}
+
+// Web source methods
+
+// WebSource records the page a block was captured from with `notes web`.
+type WebSource struct {
+	URL       string
+	BlockHash string
+	Title     string
+	FetchedAt time.Time
+}
+
+// GetWebSource returns the source stored for url, or nil if the page hasn't
+// been captured. Sources are looked up by the hash of their URL, which is
+// keyed like block hashes, since the URL itself is encrypted along with the
+// title in encrypted repositories.
+func (d *Database) GetWebSource(url string) (*WebSource, error) {
+	source := &WebSource{URL: url}
+	err := d.db.QueryRow(`SELECT block_hash, title, fetched_at FROM web_sources WHERE url_hash = ?`, keyedHash(url)).
+		Scan(&source.BlockHash, &source.Title, &source.FetchedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get web source: %w", err)
+	}
+	if d.cipher != nil {
+		if source.Title, err = d.cipher.Decrypt(source.Title); err != nil {
+			return nil, fmt.Errorf("web source title: %w", err)
+		}
+	}
+	return source, nil
+}
+
+func (d *Database) SaveWebSource(source *WebSource) error {
+	url, err := d.storedContent(source.URL)
+	if err != nil {
+		return err
+	}
+	title, err := d.storedContent(source.Title)
+	if err != nil {
+		return err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Encrypted URLs differ every time, so replace by hash rather than key
+	urlHash := keyedHash(source.URL)
+	if _, err := tx.Exec(`DELETE FROM web_sources WHERE url_hash = ?`, urlHash); err != nil {
+		return fmt.Errorf("failed to replace web source: %w", err)
+	}
+	query := `INSERT OR REPLACE INTO web_sources (url, url_hash, block_hash, title, fetched_at) VALUES (?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(query, url, urlHash, source.BlockHash, title, source.FetchedAt); err != nil {
+		return fmt.Errorf("failed to save web source: %w", err)
+	}
+	return tx.Commit()
+}
+
+// fillWebSourceHashes hashes the URLs of sources saved before they were
+// looked up by hash. Those URLs were never encrypted or keyed.
+func (d *Database) fillWebSourceHashes() error {
+	rows, err := d.db.Query(`SELECT url FROM web_sources WHERE url_hash IS NULL`)
+	if err != nil {
+		return fmt.Errorf("failed to query web sources: %w", err)
+	}
+	var urls []string
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan web source: %w", err)
+		}
+		urls = append(urls, url)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to query web sources: %w", err)
+	}
+
+	for _, url := range urls {
+		if _, err := d.db.Exec(`UPDATE web_sources SET url_hash = ? WHERE url = ?`, sha256Hex(url), url); err != nil {
+			return fmt.Errorf("failed to hash web source: %w", err)
+		}
+	}
+	return nil
+}
+
+// rekeyWebSources rehashes every source's URL with the current content hash
+// key, encrypting URLs and titles stored in plaintext by older versions.
+func (d *Database) rekeyWebSources() error {
+	rows, err := d.db.Query(`SELECT rowid, url, title FROM web_sources`)
+	if err != nil {
+		return fmt.Errorf("failed to query web sources: %w", err)
+	}
+	type webSourceRow struct {
+		rowid      int64
+		url, title string
+	}
+	var sources []webSourceRow
+	for rows.Next() {
+		var row webSourceRow
+		if err := rows.Scan(&row.rowid, &row.url, &row.title); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan web source: %w", err)
+		}
+		sources = append(sources, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to query web sources: %w", err)
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, source := range sources {
+		plainURL, err := d.cipher.Decrypt(source.url)
+		if err != nil {
+			return fmt.Errorf("web source %d: %w", source.rowid, err)
+		}
+		plainTitle, err := d.cipher.Decrypt(source.title)
+		if err != nil {
+			return fmt.Errorf("web source %d: %w", source.rowid, err)
+		}
+		url, err := d.storedContent(plainURL)
+		if err != nil {
+			return err
+		}
+		title, err := d.storedContent(plainTitle)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE web_sources SET url = ?, url_hash = ?, title = ? WHERE rowid = ?`,
+			url, keyedHash(plainURL), title, source.rowid); err != nil {
+			return fmt.Errorf("failed to update web source: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Block visibility methods
+
+// GetVisibilityOverrides returns the visibility set explicitly with
+// `notes visibility`, keyed by block hash.
+func (d *Database) GetVisibilityOverrides() (map[string]string, error) {
+	rows, err := d.db.Query(`SELECT block_hash, visibility FROM block_visibility`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query block visibility: %w", err)
+	}
+	defer rows.Close()
+
+	overrides := make(map[string]string)
+	for rows.Next() {
+		var hash, visibility string
+		if err := rows.Scan(&hash, &visibility); err != nil {
+			return nil, fmt.Errorf("failed to scan block visibility: %w", err)
+		}
+		overrides[hash] = visibility
+	}
+	return overrides, rows.Err()
+}
+
+// SetVisibilityOverride sets the visibility of a block, or clears it when
+// visibility is empty.
+func (d *Database) SetVisibilityOverride(hash, visibility string) error {
+	var err error
+	if visibility == "" {
+		_, err = d.db.Exec(`DELETE FROM block_visibility WHERE block_hash = ?`, hash)
+	} else {
+		_, err = d.db.Exec(`INSERT OR REPLACE INTO block_visibility (block_hash, visibility) VALUES (?, ?)`, hash, visibility)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set block visibility: %w", err)
+	}
+	d.audit.Append([]AuditEntry{metaEntry("visibility", hash, "visibility", visibility)})
+	return nil
+}
+
+// Local block methods
+
+// markLocalBlocksTx records blocks as local to filePath, which created them.
+func markLocalBlocksTx(tx *sql.Tx, filePath string, hashes []string) error {
+	for _, hash := range hashes {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO local_blocks (block_hash, file_path) VALUES (?, ?)`, hash, filePath); err != nil {
+			return fmt.Errorf("failed to mark local block: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetLocalBlockFiles returns the file each local block belongs to, keyed by
+// block hash.
+func (d *Database) GetLocalBlockFiles() (map[string]string, error) {
+	rows, err := d.db.Query(`SELECT block_hash, file_path FROM local_blocks`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query local blocks: %w", err)
+	}
+	defer rows.Close()
+
+	files := make(map[string]string)
+	for rows.Next() {
+		var hash, filePath string
+		if err := rows.Scan(&hash, &filePath); err != nil {
+			return nil, fmt.Errorf("failed to scan local block: %w", err)
+		}
+		files[hash] = filePath
+	}
+	return files, rows.Err()
+}
+
+// Block link methods
+
+// ReplaceBlockLinks stores links as the complete link graph, mapping each
+// referencing block's hash to the hashes of the blocks it references.
+func (d *Database) ReplaceBlockLinks(links map[string][]string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM block_links`); err != nil {
+		return fmt.Errorf("failed to clear block links: %w", err)
+	}
+	for source, targets := range links {
+		for _, target := range targets {
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO block_links (source_hash, target_hash) VALUES (?, ?)`, source, target); err != nil {
+				return fmt.Errorf("failed to store block link: %w", err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit block links: %w", err)
+	}
+	return nil
+}
 
+// GetLinkedHashes returns the hashes of the blocks hash references.
+func (d *Database) GetLinkedHashes(hash string) ([]string, error) {
+	return d.queryHashes(`SELECT target_hash FROM block_links WHERE source_hash = ? ORDER BY target_hash`, hash)
+}
+
+// GetBacklinkHashes returns the hashes of the blocks referencing hash.
+func (d *Database) GetBacklinkHashes(hash string) ([]string, error) {
+	return d.queryHashes(`SELECT source_hash FROM block_links WHERE target_hash = ? ORDER BY source_hash`, hash)
+}
+
+func (d *Database) queryHashes(query string, args ...any) ([]string, error) {
 	rows, err := d.db.Query(query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to search blocks: %w", err)
+		return nil, fmt.Errorf("failed to query block links: %w", err)
 	}
 	defer rows.Close()
 
-	var blocks []*Block
+	var hashes []string
 	for rows.Next() {
-		var block Block
-		err := rows.Scan(&block.ID, &block.Content, &block.ContentHash,
-			&block.CreatedAt, &block.UpdatedAt)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan block: %w", err)
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, fmt.Errorf("failed to scan block link: %w", err)
 		}
-		blocks = append(blocks, &block)
+		hashes = append(hashes, hash)
 	}
-
-	return blocks, nil
+	return hashes, rows.Err()
 }
 
-func (d *Database) GetBlocksCreatedAfter(timestamp time.Time) ([]*Block, error) {
-	query := `SELECT id, content, content_hash, created_at, updated_at 
-			  FROM blocks WHERE created_at > ? ORDER BY updated_at DESC`
+// Block metadata methods
 
-	rows, err := d.db.Query(query, timestamp)
+// GetBlockMeta returns the metadata set on a block.
+func (d *Database) GetBlockMeta(hash string) (map[string]string, error) {
+	rows, err := d.db.Query(`SELECT key, value FROM block_meta WHERE block_hash = ?`, hash)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query blocks: %w", err)
+		return nil, fmt.Errorf("failed to query block metadata: %w", err)
 	}
 	defer rows.Close()
 
-	var blocks []*Block
+	meta := make(map[string]string)
 	for rows.Next() {
-		var block Block
-		err := rows.Scan(&block.ID, &block.Content, &block.ContentHash,
-			&block.CreatedAt, &block.UpdatedAt)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan block: %w", err)
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, fmt.Errorf("failed to scan block metadata: %w", err)
 		}
-		blocks = append(blocks, &block)
+		meta[key] = value
 	}
+	return meta, rows.Err()
+}
 
-	return blocks, nil
+// SetBlockMeta sets a metadata key on a block, or removes it when value is
+// empty.
+func (d *Database) SetBlockMeta(hash, key, value string) error {
+	var err error
+	if value == "" {
+		_, err = d.db.Exec(`DELETE FROM block_meta WHERE block_hash = ? AND key = ?`, hash, key)
+	} else {
+		_, err = d.db.Exec(`INSERT OR REPLACE INTO block_meta (block_hash, key, value) VALUES (?, ?, ?)`, hash, key, value)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set block metadata: %w", err)
+	}
+	d.audit.Append([]AuditEntry{metaEntry("meta", hash, key, value)})
+	return nil
 }
 
-func (d *Database) DeleteBlocksByTag(tag string) (int, error) {
-	query := `DELETE FROM blocks WHERE content LIKE ?`
-	result, err := d.db.Exec(query, "%"+tag+"%")
+// GetMetaKeys returns every metadata key set on at least one block.
+func (d *Database) GetMetaKeys() ([]string, error) {
+	rows, err := d.db.Query(`SELECT DISTINCT key FROM block_meta ORDER BY key`)
 	if err != nil {
-		return 0, fmt.Errorf("failed to delete blocks with tag '%s': %w", tag, err)
+		return nil, fmt.Errorf("failed to query metadata keys: %w", err)
 	}
+	defer rows.Close()
 
-	rowsAffected, err := result.RowsAffected()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("failed to scan metadata key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// splitMetaTerms separates key:value terms naming a metadata key in use
+// from plain keywords, so text such as "todo:" or a URL is still searched
+// for in content.
+func (d *Database) splitMetaTerms(includeKeywords, excludeKeywords []string) ([]MetaFilter, []string, []string, error) {
+	if !slices.ContainsFunc(append(slices.Clone(includeKeywords), excludeKeywords...), isMetaTerm) {
+		return nil, includeKeywords, excludeKeywords, nil
+	}
+	keys, err := d.GetMetaKeys()
 	if err != nil {
-		return 0, fmt.Errorf("failed to get affected rows count: %w", err)
+		return nil, nil, nil, err
 	}
 
-	return int(rowsAffected), nil
+	var filters []MetaFilter
+	split := func(terms []string, exclude bool) []string {
+		var keywords []string
+		for _, term := range terms {
+			filter, ok := parseMetaFilter(term, exclude)
+			if ok && slices.Contains(keys, filter.Key) {
+				filters = append(filters, filter)
+			} else {
+				keywords = append(keywords, term)
+			}
+		}
+		return keywords
+	}
+	includeKeywords = split(includeKeywords, false)
+	excludeKeywords = split(excludeKeywords, true)
+	return filters, includeKeywords, excludeKeywords, nil
 }
 
-func (d *Database) DeleteBlockByHash(hash string) error {
-	query := `DELETE FROM blocks WHERE content_hash = ?`
-	_, err := d.db.Exec(query, hash)
+// metaConditions returns the WHERE conditions on blocks for filters.
+func metaConditions(filters []MetaFilter) ([]string, []any) {
+	var whereParts []string
+	var args []any
+	for _, filter := range filters {
+		condition := "content_hash IN (SELECT block_hash FROM block_meta WHERE key = ? AND value = ? COLLATE NOCASE)"
+		if filter.Exclude {
+			condition = "content_hash NOT IN (SELECT block_hash FROM block_meta WHERE key = ? AND value = ? COLLATE NOCASE)"
+		}
+		whereParts = append(whereParts, condition)
+		args = append(args, filter.Key, filter.Value)
+	}
+	return whereParts, args
+}
+
+// Operation journal methods
+
+// RecordOperation appends changes to the operations journal. The change set is
+// stored as JSON (encrypted like block content) so it can be inverted later.
+func (d *Database) RecordOperation(kind string, changes *ChangeSet) error {
+	payload, err := json.Marshal(changes)
 	if err != nil {
-		return fmt.Errorf("failed to delete block by hash: %w", err)
+		return fmt.Errorf("failed to encode operation: %w", err)
+	}
+
+	stored, err := d.storedContent(string(payload))
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO operations (kind, file_path, changes, created_at) VALUES (?, ?, ?, ?)`
+	if _, err := d.db.Exec(query, kind, changes.File, stored, time.Now()); err != nil {
+		return fmt.Errorf("failed to record operation: %w", err)
 	}
+	d.audit.Append(changeSetEntries(kind, changes, d.cipher == nil))
 	return nil
 }
 
-// Watched Files methods
-func (d *Database) AddWatchedFile(filePath string) error {
-	query := `INSERT OR IGNORE INTO watched_files (file_path) VALUES (?)`
-	_, err := d.db.Exec(query, filePath)
+// GetRecentOperations returns up to limit operations that haven't been
+// undone, newest first.
+func (d *Database) GetRecentOperations(limit int) ([]*Operation, error) {
+	return d.queryOperations(`SELECT id, kind, file_path, changes, created_at FROM operations
+			  WHERE undone = 0 ORDER BY id DESC LIMIT ?`, limit)
+}
+
+// GetUndoableOperations returns the operations that haven't been undone,
+// oldest first.
+func (d *Database) GetUndoableOperations() ([]*Operation, error) {
+	return d.queryOperations(`SELECT id, kind, file_path, changes, created_at FROM operations
+			  WHERE undone = 0 ORDER BY id`)
+}
+
+// GetOperationsSince returns the operations recorded after the one with
+// afterID, oldest first, including ones since undone.
+func (d *Database) GetOperationsSince(afterID int) ([]*Operation, error) {
+	return d.queryOperations(`SELECT id, kind, file_path, changes, created_at FROM operations
+			  WHERE id > ? ORDER BY id`, afterID)
+}
+
+// GetOperationsAfter returns the operations recorded after t that haven't
+// been undone, oldest first.
+func (d *Database) GetOperationsAfter(t time.Time) ([]*Operation, error) {
+	return d.queryOperations(`SELECT id, kind, file_path, changes, created_at FROM operations
+			  WHERE created_at > ? AND undone = 0 ORDER BY id`, t)
+}
+
+// LastOperationID returns the ID of the newest operation, or 0 if none has
+// been recorded.
+func (d *Database) LastOperationID() (int, error) {
+	var id int
+	if err := d.db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM operations`).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to get last operation: %w", err)
+	}
+	return id, nil
+}
+
+func (d *Database) queryOperations(query string, args ...any) ([]*Operation, error) {
+	rows, err := d.db.Query(query, args...)
 	if err != nil {
-		return fmt.Errorf("failed to add watched file: %w", err)
+		return nil, fmt.Errorf("failed to query operations: %w", err)
+	}
+	defer rows.Close()
+
+	var operations []*Operation
+	for rows.Next() {
+		var operation Operation
+		var payload string
+		if err := rows.Scan(&operation.ID, &operation.Kind, &operation.File, &payload, &operation.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan operation: %w", err)
+		}
+
+		if d.cipher != nil {
+			if payload, err = d.cipher.Decrypt(payload); err != nil {
+				return nil, fmt.Errorf("operation %d: %w", operation.ID, err)
+			}
+		}
+		if err := json.Unmarshal([]byte(payload), &operation.Changes); err != nil {
+			return nil, fmt.Errorf("failed to decode operation %d: %w", operation.ID, err)
+		}
+		operations = append(operations, &operation)
+	}
+
+	return operations, rows.Err()
+}
+
+// UndoOperation inverts an operation in a single transaction: added blocks
+// are deleted, updated blocks get their previous content and timestamps back,
+// and deleted blocks are restored along with their association to the
+// operation's file.
+func (d *Database) UndoOperation(operation *Operation) error {
+	changes := operation.Changes
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Blocks that replaced others outside of any file (split, merge) hand
+	// their file associations back to the blocks they replaced
+	var replacedFiles []string
+	if changes.File == "" && len(changes.Added) > 0 && len(changes.Deleted) > 0 {
+		seen := make(map[string]bool)
+		for _, block := range changes.Added {
+			files, err := queryStrings(tx, `SELECT file_path FROM file_blocks WHERE block_hash = ?`, block.ContentHash)
+			if err != nil {
+				return fmt.Errorf("failed to query block files: %w", err)
+			}
+			for _, filePath := range files {
+				if !seen[filePath] {
+					seen[filePath] = true
+					replacedFiles = append(replacedFiles, filePath)
+				}
+			}
+		}
+	}
+
+	for _, block := range changes.Added {
+		if err := deleteBlockTx(tx, block.ContentHash); err != nil {
+			return err
+		}
+	}
+
+	for i := len(changes.Updated) - 1; i >= 0; i-- {
+		after, before := changes.Updated[i], changes.Previous[i]
+		if after.ContentHash != before.ContentHash {
+			if _, err := tx.Exec(`UPDATE OR IGNORE file_blocks SET block_hash = ? WHERE block_hash = ?`,
+				before.ContentHash, after.ContentHash); err != nil {
+				return fmt.Errorf("failed to move file-block associations: %w", err)
+			}
+			if err := deleteBlockTx(tx, after.ContentHash); err != nil {
+				return err
+			}
+		}
+		if err := d.restoreBlockTx(tx, before); err != nil {
+			return err
+		}
+	}
+
+	for _, block := range changes.Deleted {
+		if err := d.restoreBlockTx(tx, block); err != nil {
+			return err
+		}
+		if changes.File != "" {
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO file_blocks (file_path, block_hash)
+				SELECT file_path, ? FROM watched_files WHERE file_path = ?`, block.ContentHash, changes.File); err != nil {
+				return fmt.Errorf("failed to restore file-block association: %w", err)
+			}
+		}
+		for _, filePath := range append(replacedFiles, changes.Files[block.ContentHash]...) {
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO file_blocks (file_path, block_hash, position)
+				SELECT w.file_path, ?, (SELECT COALESCE(MAX(position), 0) + 1 FROM file_blocks WHERE file_path = w.file_path)
+				FROM watched_files w WHERE w.file_path = ?`, block.ContentHash, filePath); err != nil {
+				return fmt.Errorf("failed to restore file-block association: %w", err)
+			}
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE operations SET undone = 1 WHERE id = ?`, operation.ID); err != nil {
+		return fmt.Errorf("failed to mark operation undone: %w", err)
 	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit undo: %w", err)
+	}
+
+	// Undoing reverses each change
+	inverse := &ChangeSet{File: changes.File, Added: changes.Deleted, Deleted: changes.Added,
+		Updated: changes.Previous, Previous: changes.Updated}
+	entries := changeSetEntries("undo", inverse, d.cipher == nil)
+	for i := range entries {
+		entries[i].Detail = fmt.Sprintf("undid %s #%d", operation.Kind, operation.ID)
+	}
+	d.audit.Append(entries)
 	return nil
 }
 
-func (d *Database) RemoveWatchedFile(filePath string) error {
-	query := `DELETE FROM watched_files WHERE file_path = ?`
-	_, err := d.db.Exec(query, filePath)
+func deleteBlockTx(tx *sql.Tx, hash string) error {
+	if _, err := tx.Exec(`DELETE FROM blocks WHERE content_hash = ?`, hash); err != nil {
+		return fmt.Errorf("failed to delete block: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM file_blocks WHERE block_hash = ?`, hash); err != nil {
+		return fmt.Errorf("failed to delete file-block associations: %w", err)
+	}
+	return nil
+}
+
+// restoreBlockTx writes block back with its recorded timestamps, inserting it
+// if it no longer exists.
+func (d *Database) restoreBlockTx(tx *sql.Tx, block *Block) error {
+	content, err := d.storedContent(block.Content)
 	if err != nil {
-		return fmt.Errorf("failed to remove watched file: %w", err)
+		return err
+	}
+	title, err := d.storedContent(block.Title())
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO blocks (content, content_hash, created_at, updated_at, touch_count, word_count, char_count, title)
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			  ON CONFLICT(content_hash) DO UPDATE SET
+			  created_at = excluded.created_at, updated_at = excluded.updated_at, touch_count = excluded.touch_count`
+	if _, err := tx.Exec(query, content, block.ContentHash, block.CreatedAt, block.UpdatedAt, block.TouchCount,
+		CountWords(block.Content), CountChars(block.Content), title); err != nil {
+		return fmt.Errorf("failed to restore block: %w", err)
 	}
 	return nil
 }
 
-func (d *Database) GetWatchedFiles() ([]string, error) {
-	query := `SELECT file_path FROM watched_files ORDER BY started_at DESC`
-	rows, err := d.db.Query(query)
+// storedContent returns content as it should be written to the blocks table.
+func (d *Database) storedContent(content string) (string, error) {
+	if d.cipher == nil {
+		return content, nil
+	}
+	return d.cipher.Encrypt(content)
+}
+
+func (d *Database) searchDecryptedBlocks(includeKeywords, excludeKeywords []string, filters []MetaFilter, opts SearchOptions) ([]*Block, error) {
+	// Metadata isn't encrypted, so it can still narrow the query
+	query := `SELECT ` + blockColumns + ` FROM blocks`
+	whereParts, args := metaConditions(filters)
+	if len(whereParts) > 0 {
+		query += ` WHERE ` + strings.Join(whereParts, " AND ")
+	}
+
+	var matches []*Block
+	err := d.iterateBlocks(query+` ORDER BY id`, args, func(block *Block) error {
+		if !opts.Range.Contains(block.CreatedAt) || !opts.Words.Contains(block.Words) {
+			return nil
+		}
+		contentLower := strings.ToLower(block.Content)
+
+		included := len(includeKeywords) == 0
+		for _, keyword := range includeKeywords {
+			if strings.Contains(contentLower, strings.ToLower(keyword)) {
+				included = true
+				break
+			}
+		}
+		for _, keyword := range excludeKeywords {
+			if strings.Contains(contentLower, strings.ToLower(keyword)) {
+				included = false
+				break
+			}
+		}
+
+		if included {
+			matches = append(matches, block)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to query watched files: %w", err)
+		return nil, err
 	}
-	defer rows.Close()
 
-	var files []string
-	for rows.Next() {
-		var filePath string
-		err := rows.Scan(&filePath)
+	orderSearchResults(matches, includeKeywords, opts)
+	if opts.Limit > 0 && len(matches) > opts.Limit {
+		matches = matches[:opts.Limit]
+	}
+	return matches, nil
+}
+
+// FillBlockTitles stores the titles of blocks stored before titles were
+// tracked. Like FillBlockCounts, it runs after the database is unlocked.
+func (d *Database) FillBlockTitles() error {
+	var blocks []*Block
+	err := d.iterateBlocks(`SELECT `+blockColumns+` FROM blocks WHERE title IS NULL`, nil,
+		func(block *Block) error {
+			blocks = append(blocks, block)
+			return nil
+		})
+	if err != nil || len(blocks) == 0 {
+		return err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, block := range blocks {
+		title, err := d.storedContent(block.Title())
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan watched file: %w", err)
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE blocks SET title = ? WHERE id = ?`, title, block.ID); err != nil {
+			return fmt.Errorf("failed to store block title: %w", err)
 		}
-		files = append(files, filePath)
 	}
-
-	return files, nil
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit block titles: %w", err)
+	}
+	return nil
 }
 
-func (d *Database) IsFileWatched(filePath string) (bool, error) {
-	query := `SELECT 1 FROM watched_files WHERE file_path = ?`
-	row := d.db.QueryRow(query, filePath)
+// FillBlockCounts counts the words and characters of blocks stored before
+// counts were tracked. It runs after the database is unlocked, since the
+// content of an encrypted repository can't be counted before.
+func (d *Database) FillBlockCounts() error {
+	var blocks []*Block
+	err := d.iterateBlocks(`SELECT `+blockColumns+` FROM blocks WHERE word_count IS NULL OR char_count IS NULL`, nil,
+		func(block *Block) error {
+			blocks = append(blocks, block)
+			return nil
+		})
+	if err != nil || len(blocks) == 0 {
+		return err
+	}
 
-	var dummy int
-	err := row.Scan(&dummy)
+	tx, err := d.db.Begin()
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return false, nil
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, block := range blocks {
+		if _, err := tx.Exec(`UPDATE blocks SET word_count = ?, char_count = ? WHERE id = ?`,
+			block.Words, block.Chars, block.ID); err != nil {
+			return fmt.Errorf("failed to store block counts: %w", err)
 		}
-		return false, fmt.Errorf("failed to check if file is watched: %w", err)
 	}
-	return true, nil
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit block counts: %w", err)
+	}
+	return nil
 }
 
-// File-Block association methods
-func (d *Database) AddFileBlockAssociation(filePath, blockHash string) error {
-	query := `INSERT OR IGNORE INTO file_blocks (file_path, block_hash) VALUES (?, ?)`
-	_, err := d.db.Exec(query, filePath, blockHash)
+// Encryption methods
+func (d *Database) IsEncrypted() (bool, error) {
+	salt, err := d.GetMetadata(EncryptionSaltKey)
+	if err != nil {
+		return false, err
+	}
+	return salt != "", nil
+}
+
+// Unlock derives the repository key from passphrase and enables transparent
+// decryption of block content.
+func (d *Database) Unlock(passphrase string) error {
+	encodedSalt, err := d.GetMetadata(EncryptionSaltKey)
+	if err != nil {
+		return err
+	}
+	salt, err := base64.StdEncoding.DecodeString(encodedSalt)
+	if err != nil {
+		return fmt.Errorf("failed to decode encryption salt: %w", err)
+	}
+
+	blockCipher, err := newPassphraseCipher(passphrase, salt)
+	if err != nil {
+		return err
+	}
+
+	check, err := d.GetMetadata(EncryptionCheckKey)
+	if err != nil {
+		return err
+	}
+	if plaintext, err := blockCipher.Decrypt(check); err != nil || plaintext != encryptionCheck {
+		return fmt.Errorf("incorrect passphrase")
+	}
+
+	d.cipher = blockCipher
+	keyed, err := d.KeyedHashes()
 	if err != nil {
-		return fmt.Errorf("failed to add file-block association: %w", err)
+		return err
+	}
+	if keyed {
+		SetContentHashKey(blockCipher.hashKey)
 	}
 	return nil
 }
 
-func (d *Database) GetFileBlockHashes(filePath string) ([]string, error) {
-	query := `SELECT block_hash FROM file_blocks WHERE file_path = ?`
-	rows, err := d.db.Query(query, filePath)
+// KeyedHashes reports whether the repository's block hashes are keyed by its
+// encryption key. Repositories encrypted before hashes were keyed aren't
+// until KeyContentHashes is called.
+func (d *Database) KeyedHashes() (bool, error) {
+	keyed, err := d.GetMetadata(EncryptionKeyedHashesKey)
+	return keyed != "", err
+}
+
+// KeyContentHashes rehashes every block of an unlocked repository with the
+// content hash key, so stored hashes no longer reveal which content they
+// belong to to anyone without the passphrase.
+func (d *Database) KeyContentHashes() error {
+	if d.cipher == nil {
+		return fmt.Errorf("repository is not unlocked")
+	}
+	SetContentHashKey(d.cipher.hashKey)
+	if _, _, err := RehashBlocks(d); err != nil {
+		return err
+	}
+	if err := d.rekeyWebSources(); err != nil {
+		return err
+	}
+	return d.SetMetadata(EncryptionKeyedHashesKey, "1")
+}
+
+// EncryptRepository encrypts every stored block with a key derived from
+// passphrase, then keys the block hashes. If that is interrupted, the next
+// writable run finishes it.
+func (d *Database) EncryptRepository(passphrase string) error {
+	salt, err := newSalt()
 	if err != nil {
-		return nil, fmt.Errorf("failed to query file blocks: %w", err)
+		return err
 	}
-	defer rows.Close()
 
-	var hashes []string
-	for rows.Next() {
-		var hash string
-		err := rows.Scan(&hash)
+	blockCipher, err := newPassphraseCipher(passphrase, salt)
+	if err != nil {
+		return err
+	}
+
+	check, err := blockCipher.Encrypt(encryptionCheck)
+	if err != nil {
+		return err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := rewriteContent(tx, func(content string) (string, error) {
+		if isEncryptedValue(content) {
+			return "", fmt.Errorf("repository already contains encrypted blocks")
+		}
+		return blockCipher.Encrypt(content)
+	}); err != nil {
+		return err
+	}
+
+	metadata := map[string]string{
+		EncryptionSaltKey:  base64.StdEncoding.EncodeToString(salt),
+		EncryptionCheckKey: check,
+	}
+	for key, value := range metadata {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO metadata (key, value) VALUES (?, ?)`, key, value); err != nil {
+			return fmt.Errorf("failed to set metadata: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit encryption: %w", err)
+	}
+
+	d.cipher = blockCipher
+	return d.KeyContentHashes()
+}
+
+// DecryptRepository writes every block back as plaintext, with plain
+// hashes. The database must have been unlocked first.
+func (d *Database) DecryptRepository() error {
+	if d.cipher == nil {
+		return fmt.Errorf("repository is not unlocked")
+	}
+
+	// Unkey the hashes first: an encrypted repository without keyed hashes
+	// has them keyed again if decrypting is interrupted
+	if _, err := d.db.Exec(`DELETE FROM metadata WHERE key = ?`, EncryptionKeyedHashesKey); err != nil {
+		return fmt.Errorf("failed to clear encryption metadata: %w", err)
+	}
+	SetContentHashKey(nil)
+	if _, _, err := RehashBlocks(d); err != nil {
+		return err
+	}
+	if err := d.rekeyWebSources(); err != nil {
+		return err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := rewriteContent(tx, d.cipher.Decrypt); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM metadata WHERE key IN (?, ?)`, EncryptionSaltKey, EncryptionCheckKey); err != nil {
+		return fmt.Errorf("failed to clear encryption metadata: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit decryption: %w", err)
+	}
+
+	d.cipher = nil
+	return nil
+}
+
+// encryptedColumns lists the text columns encryption applies to, as
+// table -> key column, content column.
+var encryptedColumns = []struct{ table, key, content string }{
+	{"blocks", "id", "content"},
+	{"blocks", "id", "title"},
+	{"file_snapshots", "file_path", "content"},
+	{"file_front_matter", "file_path", "content"},
+	{"trash", "id", "content"},
+	{"operations", "id", "changes"},
+	{"web_sources", "rowid", "url"},
+	{"web_sources", "rowid", "title"},
+}
+
+func rewriteContent(tx *sql.Tx, transform func(string) (string, error)) error {
+	for _, target := range encryptedColumns {
+		query := fmt.Sprintf(`SELECT %s, %s FROM %s`, target.key, target.content, target.table)
+		rows, err := tx.Query(query)
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan block hash: %w", err)
+			return fmt.Errorf("failed to query %s: %w", target.table, err)
+		}
+
+		contents := make(map[any]string)
+		for rows.Next() {
+			var key any
+			var content sql.NullString
+			if err := rows.Scan(&key, &content); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan %s row: %w", target.table, err)
+			}
+			// Titles not filled in yet are left for FillBlockTitles
+			if content.Valid {
+				contents[key] = content.String
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to query %s: %w", target.table, err)
+		}
+
+		update := fmt.Sprintf(`UPDATE %s SET %s = ? WHERE %s = ?`, target.table, target.content, target.key)
+		for key, content := range contents {
+			rewritten, err := transform(content)
+			if err != nil {
+				return fmt.Errorf("%s %v: %w", target.table, key, err)
+			}
+			if _, err := tx.Exec(update, rewritten, key); err != nil {
+				return fmt.Errorf("failed to update %s %v: %w", target.table, key, err)
+			}
 		}
-		hashes = append(hashes, hash)
 	}
 
-	return hashes, nil
+	return nil
 }
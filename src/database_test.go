@@ -0,0 +1,76 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Encrypting a repository keys every block hash, so the state kept under the
+// old hash has to move with the block: a fired reminder mustn't fire again,
+// a template mustn't clone again and an attachment has to keep its block.
+func TestRehashKeepsBlockState(t *testing.T) {
+	d, err := NewDatabase(filepath.Join(t.TempDir(), "notes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	block := NewBlock("water the plants @remind(2020-01-02 09:00) @every(week) ![photo](assets/plants.jpg)")
+	if err := d.CreateBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SyncSchedule(d); err != nil {
+		t.Fatal(err)
+	}
+	items, err := d.GetScheduleItems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("expected one schedule item, got %d", len(items))
+	}
+	if err := d.MarkScheduleItemFired(items[0]); err != nil {
+		t.Fatal(err)
+	}
+	lastRun := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := d.SetRecurrenceRun(block.ContentHash, lastRun); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddAttachment(&Attachment{AssetPath: "assets/plants.jpg", OriginalName: "plants.jpg", BlockHash: block.ContentHash}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.EncryptRepository("passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	defer d.DecryptRepository()
+	newHash := generateContentHash(block.Content)
+	if newHash == block.ContentHash {
+		t.Fatal("encrypting didn't key the block hash")
+	}
+
+	items, err = d.GetScheduleItems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].BlockHash != newHash || !items[0].Fired {
+		t.Errorf("fired reminder didn't move to the new hash: %+v", items)
+	}
+
+	runs, err := d.GetRecurrenceRuns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || !runs[newHash].Equal(lastRun) {
+		t.Errorf("recurrence didn't move to the new hash: %v", runs)
+	}
+
+	attachments, err := d.GetAttachments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != 1 || attachments[0].BlockHash != newHash {
+		t.Errorf("attachment didn't move to the new hash: %+v", attachments)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var monthNames = map[string]time.Month{
+	"january": time.January, "february": time.February, "march": time.March, "april": time.April,
+	"may": time.May, "june": time.June, "july": time.July, "august": time.August,
+	"september": time.September, "october": time.October, "november": time.November, "december": time.December,
+	"jan": time.January, "feb": time.February, "mar": time.March, "apr": time.April, "jun": time.June,
+	"jul": time.July, "aug": time.August, "sep": time.September, "sept": time.September,
+	"oct": time.October, "nov": time.November, "dec": time.December,
+}
+
+var (
+	clockPattern      = regexp.MustCompile(`^(\d{1,2})(?::(\d{2}))?\s*(am|pm)?$`)
+	dayOfMonthPattern = regexp.MustCompile(`^(\d{1,2})(st|nd|rd|th)?$`)
+	datePeriodPattern = regexp.MustCompile(`^(day|week|month|year)s?$`)
+)
+
+// ParseDateTime parses a day as ParseDate does, optionally followed by a
+// time of day such as "14:00", "9am", "5:30pm", "noon" or "at 5pm". Without
+// a time it resolves to defaultHour:00.
+func ParseDateTime(expression string, now time.Time, future bool, defaultHour int) (time.Time, error) {
+	fields := strings.Fields(strings.ToLower(strings.ReplaceAll(expression, ",", " ")))
+	if len(fields) == 0 {
+		return time.Time{}, fmt.Errorf("expected a date and optional time, got %q", expression)
+	}
+
+	// "june 3" also ends in something that parses as a time, so the whole
+	// expression is tried as a day first
+	day, err := ParseDate(strings.Join(fields, " "), now, future)
+	hour, minute := defaultHour, 0
+	if err != nil {
+		// "5 pm" splits into two fields
+		if n := len(fields); n > 2 && (fields[n-1] == "am" || fields[n-1] == "pm") {
+			fields = append(fields[:n-2], fields[n-2]+fields[n-1])
+		}
+		n := len(fields)
+		if n < 2 {
+			return time.Time{}, err
+		}
+		var clockErr error
+		if hour, minute, clockErr = parseClock(fields[n-1]); clockErr != nil {
+			return time.Time{}, err
+		}
+		fields = fields[:n-1]
+		if len(fields) > 1 && fields[len(fields)-1] == "at" {
+			fields = fields[:len(fields)-1]
+		}
+		if day, err = ParseDate(strings.Join(fields, " "), now, future); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, now.Location()), nil
+}
+
+// ParseDate parses a day relative to now and returns its midnight. It
+// understands "today", "tomorrow", "yesterday", YYYY-MM-DD, weekday names
+// ("friday", "next friday", "last friday", "this friday"), "next week" or
+// "last month" (their first day, weeks starting on Monday), month days
+// ("june 3", "3rd june", "june 3 2025"), "in 3 days" and "3 weeks ago".
+//
+// Bare weekdays and month days without a year are ambiguous. With future
+// set they resolve to the next such day, as in annotations like
+// @due(friday); otherwise to the last one, as in --since friday. A bare
+// weekday never means today.
+func ParseDate(expression string, now time.Time, future bool) (time.Time, error) {
+	fields := strings.Fields(strings.ToLower(strings.ReplaceAll(expression, ",", " ")))
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	direction := -1
+	if future {
+		direction = 1
+	}
+
+	switch len(fields) {
+	case 1:
+		switch fields[0] {
+		case "today":
+			return today, nil
+		case "tomorrow":
+			return today.AddDate(0, 0, 1), nil
+		case "yesterday":
+			return today.AddDate(0, 0, -1), nil
+		}
+		if weekday, ok := weekdayNames[fields[0]]; ok {
+			return nearestWeekday(today, weekday, direction), nil
+		}
+		if day, err := time.ParseInLocation("2006-01-02", fields[0], now.Location()); err == nil {
+			return day, nil
+		}
+
+	case 2:
+		if day, ok := relativeDay(fields[0], fields[1], today); ok {
+			return day, nil
+		}
+		if day, ok := monthDay(fields, today, direction); ok {
+			return day, nil
+		}
+
+	case 3:
+		n, err := strconv.Atoi(fields[1])
+		if fields[0] == "in" && err == nil && datePeriodPattern.MatchString(fields[2]) {
+			return addPeriods(today, datePeriodPattern.FindStringSubmatch(fields[2])[1], n), nil
+		}
+		n, err = strconv.Atoi(fields[0])
+		if fields[2] == "ago" && err == nil && datePeriodPattern.MatchString(fields[1]) {
+			return addPeriods(today, datePeriodPattern.FindStringSubmatch(fields[1])[1], -n), nil
+		}
+		if day, ok := monthDay(fields, today, direction); ok {
+			return day, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised date %q", expression)
+}
+
+// nearestWeekday returns the first weekday after today, or before it for a
+// negative direction.
+func nearestWeekday(today time.Time, weekday time.Weekday, direction int) time.Time {
+	for offset := 1; offset <= 7; offset++ {
+		candidate := today.AddDate(0, 0, offset*direction)
+		if candidate.Weekday() == weekday {
+			return candidate
+		}
+	}
+	return today
+}
+
+// relativeDay resolves "next", "last" or "this" followed by a weekday, week,
+// month or year.
+func relativeDay(modifier, unit string, today time.Time) (time.Time, bool) {
+	direction := map[string]int{"next": 1, "last": -1, "this": 0}
+	n, ok := direction[modifier]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	monday := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	if weekday, ok := weekdayNames[unit]; ok {
+		if n == 0 {
+			return monday.AddDate(0, 0, (int(weekday)+6)%7), true
+		}
+		return nearestWeekday(today, weekday, n), true
+	}
+
+	switch unit {
+	case "week":
+		return monday.AddDate(0, 0, 7*n), true
+	case "month":
+		return time.Date(today.Year(), today.Month()+time.Month(n), 1, 0, 0, 0, 0, today.Location()), true
+	case "year":
+		return time.Date(today.Year()+n, time.January, 1, 0, 0, 0, 0, today.Location()), true
+	}
+	return time.Time{}, false
+}
+
+// monthDay resolves "june 3", "3 june" or either followed by a year. Without
+// a year it picks the nearest such day in direction, today included.
+func monthDay(fields []string, today time.Time, direction int) (time.Time, bool) {
+	month, ok := monthNames[fields[0]]
+	dayField := fields[1]
+	if !ok {
+		month, ok = monthNames[fields[1]]
+		dayField = fields[0]
+	}
+	match := dayOfMonthPattern.FindStringSubmatch(dayField)
+	if !ok || match == nil {
+		return time.Time{}, false
+	}
+	day, _ := strconv.Atoi(match[1])
+
+	if len(fields) == 3 {
+		year, err := strconv.Atoi(fields[2])
+		date := time.Date(year, month, day, 0, 0, 0, 0, today.Location())
+		if err != nil || year < 1000 || date.Day() != day {
+			return time.Time{}, false
+		}
+		return date, true
+	}
+
+	// Look up to a leap year ahead or back for February 29
+	for offset := 0; offset <= 8; offset++ {
+		date := time.Date(today.Year()+offset*direction, month, day, 0, 0, 0, 0, today.Location())
+		if date.Day() != day {
+			continue // no June 31, or not a leap year
+		}
+		if direction > 0 && !date.Before(today) || direction < 0 && !date.After(today) {
+			return date, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func addPeriods(today time.Time, unit string, n int) time.Time {
+	switch unit {
+	case "day":
+		return today.AddDate(0, 0, n)
+	case "week":
+		return today.AddDate(0, 0, 7*n)
+	case "month":
+		return today.AddDate(0, n, 0)
+	default:
+		return today.AddDate(n, 0, 0)
+	}
+}
+
+func parseClock(field string) (int, int, error) {
+	switch field {
+	case "noon":
+		return 12, 0, nil
+	case "midnight":
+		return 0, 0, nil
+	}
+
+	match := clockPattern.FindStringSubmatch(field)
+	if match == nil {
+		return 0, 0, fmt.Errorf("unrecognised time %q", field)
+	}
+
+	hour, _ := strconv.Atoi(match[1])
+	minute := 0
+	if match[2] != "" {
+		minute, _ = strconv.Atoi(match[2])
+	}
+
+	if minute > 59 || hour > 23 || (match[3] != "" && (hour < 1 || hour > 12)) {
+		return 0, 0, fmt.Errorf("unrecognised time %q", field)
+	}
+
+	switch {
+	case match[3] == "am" && hour == 12:
+		hour = 0
+	case match[3] == "pm" && hour < 12:
+		hour += 12
+	}
+	return hour, minute, nil
+}
+
+// frontMatterDateKeys are the front matter keys SourceTime reads, in order.
+var frontMatterDateKeys = []string{"date", "created", "created_at"}
+
+// SourceTime returns when the file at path holding content was written: the
+// date in its YAML front matter if it has one, otherwise its modification
+// time. It dates imported blocks for --preserve-dates.
+func SourceTime(path, content string) (time.Time, error) {
+	frontMatter, _ := SplitFrontMatter(content)
+	if t, ok := frontMatterDate(frontMatter); ok {
+		return t, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get modification time: %w", err)
+	}
+	return info.ModTime(), nil
+}
+
+// frontMatterDate finds the first date key in frontMatter, with a value
+// such as 2024-06-01, "2024-06-01 14:00" or an RFC 3339 timestamp.
+func frontMatterDate(frontMatter string) (time.Time, bool) {
+	values := make(map[string]string)
+	for _, line := range strings.Split(frontMatter, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if ok {
+			values[strings.ToLower(strings.TrimSpace(key))] = strings.Trim(strings.TrimSpace(value), `"'`)
+		}
+	}
+
+	for _, key := range frontMatterDateKeys {
+		value := values[key]
+		for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+			if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
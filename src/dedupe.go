@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	// DefaultDedupeThreshold is the shingle similarity above which two
+	// blocks count as duplicates.
+	DefaultDedupeThreshold = 0.7
+
+	// dedupeShingleSize is the length in characters of the shingles blocks
+	// are compared by. Short shingles tolerate small edits like typo fixes.
+	dedupeShingleSize = 4
+)
+
+// normalizeForDedupe reduces content to its lower-cased words, without tags
+// or punctuation, so blocks differing only in those compare equal.
+func normalizeForDedupe(content string) string {
+	content = tagPattern.ReplaceAllString(content, " ")
+	content = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return ' '
+	}, content)
+	return strings.Join(strings.Fields(content), " ")
+}
+
+// shingleSet returns the overlapping character shingles of normalized
+// content. Content shorter than a shingle is its own single shingle.
+func shingleSet(normalized string) map[string]bool {
+	runes := []rune(normalized)
+	set := make(map[string]bool)
+	if len(runes) <= dedupeShingleSize {
+		set[normalized] = true
+		return set
+	}
+	for i := 0; i+dedupeShingleSize <= len(runes); i++ {
+		set[string(runes[i:i+dedupeShingleSize])] = true
+	}
+	return set
+}
+
+// shingleSimilarity is the Jaccard index of two shingle sets.
+func shingleSimilarity(a, b map[string]bool) float64 {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	shared := 0
+	for shingle := range a {
+		if b[shingle] {
+			shared++
+		}
+	}
+	union := len(a) + len(b) - shared
+	if union == 0 {
+		return 0
+	}
+	return float64(shared) / float64(union)
+}
+
+// DuplicateCluster is a group of blocks similar enough to be merged, in ID
+// order, and the one whose content the merged block keeps.
+type DuplicateCluster struct {
+	Blocks []*Block
+	Keep   *Block
+}
+
+// Similarity returns how similar block is to the block kept.
+func (c *DuplicateCluster) Similarity(block *Block) float64 {
+	return shingleSimilarity(shingleSet(normalizeForDedupe(c.Keep.Content)), shingleSet(normalizeForDedupe(block.Content)))
+}
+
+// FindDuplicates groups blocks whose normalized content is identical or
+// whose shingle similarity is at least threshold. Similarity is transitive
+// here: if a is like b and b like c, all three form one cluster. Clusters
+// are ordered by their lowest block ID.
+func FindDuplicates(blocks []*Block, threshold float64) []*DuplicateCluster {
+	type entry struct {
+		block    *Block
+		shingles map[string]bool
+	}
+	var entries []entry
+	byNormalized := make(map[[sha256.Size]byte]int)
+	parent := make([]int, 0, len(blocks))
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	union := func(i, j int) { parent[find(i)] = find(j) }
+
+	for _, block := range blocks {
+		normalized := normalizeForDedupe(block.Content)
+		if normalized == "" {
+			continue
+		}
+		i := len(entries)
+		entries = append(entries, entry{block, shingleSet(normalized)})
+		parent = append(parent, i)
+		hash := sha256.Sum256([]byte(normalized))
+		if j, ok := byNormalized[hash]; ok {
+			union(i, j)
+		} else {
+			byNormalized[hash] = i
+		}
+	}
+
+	// Two sets can only reach the threshold if the smaller is at least
+	// threshold times the size of the larger, so each entry is compared
+	// with the next larger ones until they get too large.
+	order := make([]int, len(entries))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return len(entries[order[a]].shingles) < len(entries[order[b]].shingles) })
+	for a, i := range order {
+		for _, j := range order[a+1:] {
+			if float64(len(entries[i].shingles)) < threshold*float64(len(entries[j].shingles)) {
+				break
+			}
+			if find(i) != find(j) && shingleSimilarity(entries[i].shingles, entries[j].shingles) >= threshold {
+				union(i, j)
+			}
+		}
+	}
+
+	groups := make(map[int][]int)
+	for i := range entries {
+		groups[find(i)] = append(groups[find(i)], i)
+	}
+	var clusters []*DuplicateCluster
+	for _, members := range groups {
+		if len(members) < 2 {
+			continue
+		}
+		cluster := &DuplicateCluster{}
+		for _, i := range members {
+			cluster.Blocks = append(cluster.Blocks, entries[i].block)
+		}
+		sort.Slice(cluster.Blocks, func(a, b int) bool { return cluster.Blocks[a].ID < cluster.Blocks[b].ID })
+
+		// Keep the most complete version, the oldest on a tie
+		cluster.Keep = cluster.Blocks[0]
+		for _, block := range cluster.Blocks[1:] {
+			if len(block.Content) > len(cluster.Keep.Content) {
+				cluster.Keep = block
+			}
+		}
+		clusters = append(clusters, cluster)
+	}
+	sort.Slice(clusters, func(a, b int) bool { return clusters[a].Blocks[0].ID < clusters[b].Blocks[0].ID })
+	return clusters
+}
+
+// dedupedContent is the content of keep with the tags of the other blocks
+// it absorbs added on a last line.
+func dedupedContent(keep *Block, blocks []*Block) string {
+	var missing []string
+	for _, block := range blocks {
+		for _, tag := range ExtractTags(block.Content) {
+			if !keep.HasTag(tag) && !slices.Contains(missing, "#"+tag) {
+				missing = append(missing, "#"+tag)
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return keep.Content
+	}
+	return keep.Content + "\n" + strings.Join(missing, " ")
+}
+
+// MergeDuplicates replaces the blocks of cluster with one block holding the
+// content of the block kept and the tags of all of them. It keeps the
+// earliest creation time and the combined touch count, and takes the place
+// of the blocks in every file that had one of them.
+func (r *Reconciler) MergeDuplicates(cluster *DuplicateCluster) (*ChangeSet, error) {
+	changes := NewChangeSet("")
+
+	merged := NewBlock(dedupedContent(cluster.Keep, cluster.Blocks))
+	merged.CreatedAt = cluster.Blocks[0].CreatedAt
+	for _, block := range cluster.Blocks {
+		if block.CreatedAt.Before(merged.CreatedAt) {
+			merged.CreatedAt = block.CreatedAt
+		}
+		merged.TouchCount += block.TouchCount
+	}
+
+	return changes, r.replaceBlocks(changes, OperationMerge, cluster.Blocks, []*Block{merged})
+}
+
+// printCluster lists the blocks of cluster with their similarity to the
+// block kept, which is marked with a *.
+func printCluster(n int, cluster *DuplicateCluster) {
+	fmt.Printf("Cluster %d (%d blocks):\n", n, len(cluster.Blocks))
+	for _, block := range cluster.Blocks {
+		marker := " "
+		if block == cluster.Keep {
+			marker = "*"
+		}
+		fmt.Printf("  %s %5d  %s  %3.0f%%  %s\n", marker, block.ID, block.CreatedAt.Local().Format("2006-01-02"),
+			cluster.Similarity(block)*100, block.FirstLine())
+	}
+}
+
+// promptMerge asks whether to merge cluster, letting the user pick another
+// block to keep. It returns false for skip and ok=false when the user quits
+// or input ends.
+func promptMerge(input *bufio.Scanner, cluster *DuplicateCluster) (merge, ok bool) {
+	for {
+		fmt.Printf("Merge into %d? y/n, the ID of another block to keep, q to quit: ", cluster.Keep.ID)
+		if !input.Scan() {
+			fmt.Println()
+			return false, false
+		}
+
+		answer := strings.TrimSpace(input.Text())
+		switch answer {
+		case "y":
+			return true, true
+		case "n", "":
+			return false, true
+		case "q":
+			return false, false
+		}
+
+		if id, err := strconv.Atoi(answer); err == nil {
+			for _, block := range cluster.Blocks {
+				if block.ID == id {
+					cluster.Keep = block
+					return true, true
+				}
+			}
+		}
+	}
+}
+
+func handleDedupe() {
+	fs := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	threshold := fs.Float64("threshold", DefaultDedupeThreshold, "similarity from 0 to 1 above which blocks are duplicates")
+	auto := fs.Bool("auto", false, "merge every cluster without asking")
+	dryRun := fs.Bool("dry-run", false, "only list the clusters")
+	parseArgs(fs, os.Args[2:])
+
+	if *threshold <= 0 || *threshold > 1 {
+		fmt.Println("Error: --threshold must be above 0 and at most 1")
+		os.Exit(1)
+	}
+	if *auto && *dryRun {
+		fmt.Println("Error: --auto and --dry-run can't be combined")
+		os.Exit(1)
+	}
+
+	blocks, err := db.GetAllBlocks()
+	if err != nil {
+		log.Fatalf("Failed to get blocks: %v", err)
+	}
+	clusters := FindDuplicates(blocks, *threshold)
+	if len(clusters) == 0 {
+		fmt.Println("No duplicates found")
+		return
+	}
+
+	input := bufio.NewScanner(os.Stdin)
+	reconciler := newMainReconciler()
+	merged, removed := 0, 0
+	for i, cluster := range clusters {
+		printCluster(i+1, cluster)
+		if *dryRun {
+			continue
+		}
+		if !*auto {
+			merge, ok := promptMerge(input, cluster)
+			if !ok {
+				break
+			}
+			if !merge {
+				continue
+			}
+		}
+
+		changes, err := reconciler.MergeDuplicates(cluster)
+		if err != nil {
+			log.Fatalf("Failed to merge blocks: %v", err)
+		}
+		merged++
+		removed += len(changes.Deleted) - len(changes.Added)
+	}
+
+	if *dryRun {
+		fmt.Printf("%d cluster(s) of duplicates\n", len(clusters))
+		return
+	}
+	if merged > 0 {
+		if err := regenerateAllFiles(); err != nil {
+			log.Fatalf("Failed to regenerate files: %v", err)
+		}
+	}
+	fmt.Printf("Merged %d cluster(s), removing %d block(s)\n", merged, removed)
+}
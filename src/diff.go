@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BlockDiff is what changed in the store between two points: blocks added,
+// blocks whose content changed and blocks removed. Blocks are matched by ID,
+// so an edited block is modified rather than removed and added again.
+type BlockDiff struct {
+	Since    time.Time       `json:"since"`
+	Snapshot string          `json:"snapshot,omitempty"`
+	Added    []*Block        `json:"added"`
+	Modified []ModifiedBlock `json:"modified"`
+	Removed  []*Block        `json:"removed"`
+}
+
+// ModifiedBlock is a block with its content at the start of a diff.
+type ModifiedBlock struct {
+	Block    *Block `json:"block"`
+	Previous *Block `json:"previous"`
+}
+
+func (d *BlockDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Modified) == 0 && len(d.Removed) == 0
+}
+
+// diffBlocks compares the blocks of two states of the store.
+func diffBlocks(before, after []*Block) *BlockDiff {
+	diff := &BlockDiff{Added: []*Block{}, Modified: []ModifiedBlock{}, Removed: []*Block{}}
+	beforeByID := make(map[int]*Block)
+	beforeHashes := make(map[string]bool)
+	for _, block := range before {
+		beforeByID[block.ID] = block
+		beforeHashes[block.ContentHash] = true
+	}
+	afterByID := make(map[int]bool)
+	afterHashes := make(map[string]bool)
+	for _, block := range after {
+		afterByID[block.ID] = true
+		afterHashes[block.ContentHash] = true
+	}
+
+	// A block restored under a new ID, e.g. by undo, is neither added nor
+	// removed
+	for _, block := range after {
+		previous := beforeByID[block.ID]
+		switch {
+		case previous == nil && !beforeHashes[block.ContentHash]:
+			diff.Added = append(diff.Added, block)
+		case previous != nil && previous.ContentHash != block.ContentHash:
+			diff.Modified = append(diff.Modified, ModifiedBlock{Block: block, Previous: previous})
+		}
+	}
+	for _, block := range before {
+		if !afterByID[block.ID] && !afterHashes[block.ContentHash] {
+			diff.Removed = append(diff.Removed, block)
+		}
+	}
+
+	sort.SliceStable(diff.Added, func(i, j int) bool { return diff.Added[i].CreatedAt.Before(diff.Added[j].CreatedAt) })
+	sort.SliceStable(diff.Modified, func(i, j int) bool {
+		return diff.Modified[i].Block.UpdatedAt.Before(diff.Modified[j].Block.UpdatedAt)
+	})
+	sort.SliceStable(diff.Removed, func(i, j int) bool { return diff.Removed[i].ID < diff.Removed[j].ID })
+	return diff
+}
+
+// blocksBefore rebuilds the blocks the store held before operations, oldest
+// first, were applied to current, by undoing them in memory.
+func blocksBefore(current []*Block, operations []*Operation) []*Block {
+	state := make(map[string]*Block, len(current))
+	for _, block := range current {
+		state[block.ContentHash] = block
+	}
+
+	for i := len(operations) - 1; i >= 0; i-- {
+		changes := operations[i].Changes
+		for _, block := range changes.Added {
+			delete(state, block.ContentHash)
+		}
+		for j := len(changes.Updated) - 1; j >= 0; j-- {
+			if j >= len(changes.Previous) {
+				continue
+			}
+			delete(state, changes.Updated[j].ContentHash)
+			state[changes.Previous[j].ContentHash] = changes.Previous[j]
+		}
+		for _, block := range changes.Deleted {
+			state[block.ContentHash] = block
+		}
+	}
+
+	blocks := make([]*Block, 0, len(state))
+	for _, block := range state {
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// DiffSince compares the store now with its state at since, rebuilt from
+// the operations journal.
+func DiffSince(db *Database, since time.Time) (*BlockDiff, error) {
+	current, err := db.GetAllBlocks()
+	if err != nil {
+		return nil, err
+	}
+	operations, err := db.GetOperationsAfter(since)
+	if err != nil {
+		return nil, err
+	}
+	diff := diffBlocks(blocksBefore(current, operations), current)
+	diff.Since = since
+	return diff, nil
+}
+
+// DiffSnapshot compares the store now with the database saved in a backup
+// snapshot.
+func DiffSnapshot(db *Database, snapshot string, manifest *BackupManifest) (*BlockDiff, error) {
+	saved, err := OpenReadOnlyDatabase(filepath.Join(snapshot, backupDBName))
+	if err != nil {
+		return nil, err
+	}
+	defer saved.Close()
+	// Snapshots of an encrypted repository share its key
+	saved.cipher = db.cipher
+
+	before, err := saved.GetAllBlocks()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	current, err := db.GetAllBlocks()
+	if err != nil {
+		return nil, err
+	}
+	diff := diffBlocks(before, current)
+	diff.Since, diff.Snapshot = manifest.CreatedAt, snapshot
+	return diff, nil
+}
+
+// printDiff writes diff as a markdown changelog. Blocks are listed by their
+// title, or in full with full.
+func printDiff(diff *BlockDiff, full bool) {
+	heading := "# Changes since " + diff.Since.Local().Format("2006-01-02 15:04")
+	if diff.Snapshot != "" {
+		heading += " (backup " + filepath.Base(diff.Snapshot) + ")"
+	}
+	fmt.Println(heading)
+	if diff.IsEmpty() {
+		fmt.Println("\nNo changes.")
+		return
+	}
+
+	item := func(block *Block, note string) {
+		if !full {
+			fmt.Printf("- #%d %s%s\n", block.ID, block.Title(), note)
+			return
+		}
+		fmt.Printf("- #%d%s\n", block.ID, note)
+		for _, line := range strings.Split(block.Content, "\n") {
+			fmt.Println(strings.TrimRight("  "+line, " "))
+		}
+	}
+
+	if len(diff.Added) > 0 {
+		fmt.Printf("\n## Added (%d)\n\n", len(diff.Added))
+		for _, block := range diff.Added {
+			item(block, "")
+		}
+	}
+	if len(diff.Modified) > 0 {
+		fmt.Printf("\n## Modified (%d)\n\n", len(diff.Modified))
+		for _, modified := range diff.Modified {
+			if full {
+				item(modified.Block, "")
+				fmt.Println("  was:")
+				for _, line := range strings.Split(modified.Previous.Content, "\n") {
+					fmt.Println(strings.TrimRight("  > "+line, " "))
+				}
+				continue
+			}
+			note := ""
+			if title := modified.Previous.Title(); title != modified.Block.Title() {
+				note = fmt.Sprintf(" (was: %s)", title)
+			}
+			item(modified.Block, note)
+		}
+	}
+	if len(diff.Removed) > 0 {
+		fmt.Printf("\n## Removed (%d)\n\n", len(diff.Removed))
+		for _, block := range diff.Removed {
+			item(block, "")
+		}
+	}
+}
+
+func handleDiff() {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "print the changes as JSON")
+	full := fs.Bool("full", false, "print whole blocks rather than their titles")
+	args := parseArgs(fs, os.Args[2:])
+
+	if len(args) != 1 {
+		fmt.Println("Error: diff requires a time or backup snapshot")
+		fmt.Println("Usage: notes diff [--json] [--full] <since|snapshot>")
+		os.Exit(1)
+	}
+
+	// Like restore-backup, a bare snapshot name refers to the backup directory
+	snapshot := expandHome(args[0])
+	if !strings.ContainsRune(args[0], filepath.Separator) && !fileExists(snapshot) {
+		snapshot = filepath.Join(config.BackupDir(), args[0])
+	}
+
+	var diff *BlockDiff
+	if manifest, err := readBackupManifest(snapshot); err == nil {
+		diff, err = DiffSnapshot(db, snapshot, manifest)
+		if err != nil {
+			log.Fatalf("Failed to compare with %s: %v", snapshot, err)
+		}
+	} else {
+		since, err := ParseTimeExpression(args[0], time.Now())
+		if err != nil {
+			fmt.Printf("Error: %s is neither a backup snapshot nor a time: %v\n", args[0], err)
+			os.Exit(1)
+		}
+		if diff, err = DiffSince(db, since); err != nil {
+			log.Fatalf("Failed to compute changes: %v", err)
+		}
+	}
+
+	if *jsonOutput {
+		encoded, err := json.MarshalIndent(diff, "", "  ")
+		if err != nil {
+			log.Fatalf("Failed to encode changes: %v", err)
+		}
+		fmt.Println(string(encoded))
+		return
+	}
+	printDiff(diff, *full)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// DoctorIssue is one inconsistency found by RunDoctor, with the action that
+// repairs it.
+type DoctorIssue struct {
+	Description string
+	fix         func() error
+}
+
+// RunDoctor checks the database and generated files for drift: stored hashes
+// that don't match content, orphaned file_blocks rows, watched files that no
+// longer exist, and watched files whose content differs from what the
+// database would generate.
+func RunDoctor(db *Database, config *Config) ([]DoctorIssue, error) {
+	var issues []DoctorIssue
+
+	blocks, err := db.GetAllBlocks()
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range blocks {
+		if generateContentHash(block.Content) == block.ContentHash {
+			continue
+		}
+		block := block
+		issues = append(issues, DoctorIssue{
+			Description: fmt.Sprintf("block %d: stored hash %.12s does not match its content", block.ID, block.ContentHash),
+			fix: func() error {
+				_, err := db.RepairBlockHash(block)
+				return err
+			},
+		})
+	}
+
+	watchedFiles, err := db.GetWatchedFiles()
+	if err != nil {
+		return nil, err
+	}
+	missingFiles := make(map[string]bool)
+	for _, filePath := range watchedFiles {
+		if fileExists(filePath) {
+			continue
+		}
+		filePath := filePath
+		missingFiles[filePath] = true
+		issues = append(issues, DoctorIssue{
+			Description: fmt.Sprintf("watched file %s does not exist", filePath),
+			fix:         func() error { return db.RemoveWatchedFile(filePath) },
+		})
+	}
+
+	orphans, err := db.GetOrphanedFileBlocks()
+	if err != nil {
+		return nil, err
+	}
+	for _, orphan := range orphans {
+		if missingFiles[orphan.FilePath] {
+			continue // removed together with the watched file
+		}
+		orphan := orphan
+		issues = append(issues, DoctorIssue{
+			Description: fmt.Sprintf("file_blocks row for %s references missing block %.12s or unwatched file", orphan.FilePath, orphan.BlockHash),
+			fix:         func() error { return db.RemoveFileBlockAssociation(orphan.FilePath, orphan.BlockHash) },
+		})
+	}
+
+	for _, filePath := range watchedFiles {
+		// A watched notes.md holds every block, so it is checked below
+		if missingFiles[filePath] || CanonicalPath(filePath) == CanonicalPath(config.notesPath) {
+			continue
+		}
+
+		reconciler := NewReconciler(db, NewFileManager(filePath), config)
+		inSync, err := reconciler.IsFileInSync()
+		if err != nil {
+			return nil, err
+		}
+		if inSync {
+			continue
+		}
+		issues = append(issues, DoctorIssue{
+			Description: fmt.Sprintf("watched file %s differs from the database", filePath),
+			fix: func() error {
+				// Reconcile first so unsynced edits in the file are kept
+				if _, err := reconciler.ReconcileFromSpecificFile(); err != nil {
+					return err
+				}
+				return reconciler.RegenerateSpecificFile()
+			},
+		})
+	}
+
+	mainReconciler := NewReconciler(db, NewFileManager(config.notesPath), config)
+	inSync, err := mainReconciler.IsMarkdownFileInSync()
+	if err != nil {
+		return nil, err
+	}
+	if !inSync {
+		description := fmt.Sprintf("%s differs from the database", config.notesPath)
+		if !fileExists(config.notesPath) {
+			description = fmt.Sprintf("%s does not exist", config.notesPath)
+		}
+		issues = append(issues, DoctorIssue{
+			Description: description,
+			// Unsynced edits to a watched notes.md are reconciled first
+			fix: mainReconciler.RegenerateMarkdownFile,
+		})
+	}
+
+	return issues, nil
+}
+
+func handleDoctor() {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "repair the problems found")
+	parseArgs(fs, os.Args[2:])
+	if *fix {
+		requireWritable("notes doctor --fix")
+	}
+
+	issues, err := RunDoctor(db, config)
+	if err != nil {
+		log.Fatalf("Failed to run checks: %v", err)
+	}
+
+	if len(issues) == 0 {
+		fmt.Println("No problems found")
+		return
+	}
+
+	failed := 0
+	for _, issue := range issues {
+		if !*fix {
+			fmt.Printf("- %s\n", issue.Description)
+			continue
+		}
+
+		if err := issue.fix(); err != nil {
+			fmt.Printf("- %s (fix failed: %v)\n", issue.Description, err)
+			failed++
+		} else {
+			fmt.Printf("- %s (fixed)\n", issue.Description)
+		}
+	}
+
+	if !*fix {
+		fmt.Printf("\n%d problem(s) found. Run 'notes doctor --fix' to repair.\n", len(issues))
+		os.Exit(1)
+	}
+	if failed > 0 {
+		fmt.Printf("\n%d problem(s) could not be fixed\n", failed)
+		os.Exit(1)
+	}
+}
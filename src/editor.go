@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lineAwareEditors accept a "+N" argument to open a file at line N.
+var lineAwareEditors = map[string]bool{
+	"vi": true, "vim": true, "nvim": true, "nano": true,
+	"emacs": true, "micro": true, "kak": true, "joe": true,
+}
+
+// editInEditor writes initial to a temporary markdown file, opens it in
+// $VISUAL/$EDITOR and returns the saved content. If line is positive the
+// editor is positioned there when it supports it.
+func editInEditor(initial string, line int) (string, error) {
+	tmpFile, err := os.CreateTemp("", "notes-*.md")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmpFile.WriteString(initial); err != nil {
+		tmpFile.Close()
+		return "", fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", fmt.Errorf("failed to close temporary file: %w", err)
+	}
+
+	if err := runEditor(tmpPath, line); err != nil {
+		return "", err
+	}
+
+	content, err := os.ReadFile(tmpPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read edited file: %w", err)
+	}
+	return string(content), nil
+}
+
+// runEditor opens the user's editor on filePath and waits for it to exit.
+// $EDITOR may contain flags, e.g. "code --wait".
+func runEditor(filePath string, line int) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	parts := strings.Fields(editor)
+	args := parts[1:]
+	if line > 0 && lineAwareEditors[filepath.Base(parts[0])] {
+		args = append(args, "+"+strconv.Itoa(line))
+	}
+	args = append(args, filePath)
+
+	cmd := exec.Command(parts[0], args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("editor %s failed: %w", parts[0], err)
+	}
+	return nil
+}
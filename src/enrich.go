@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Metadata keys holding enrichment suggestions until they are accepted or
+// rejected. A rejected block is marked so it isn't suggested for again.
+const (
+	MetaSuggestedTitle = "suggested_title"
+	MetaSuggestedTags  = "suggested_tags"
+	MetaEnrichRejected = "enrich_rejected"
+)
+
+const (
+	// DefaultEnrichLimit is how many blocks one `notes enrich` run asks the
+	// model about.
+	DefaultEnrichLimit = 20
+
+	// enrichKnownTags is how many of the most used tags are offered to the
+	// model to choose from.
+	enrichKnownTags = 50
+)
+
+const enrichInstructions = `You help organise a person's notes. For the note you are given, propose a short one-line title (at most 8 words, no trailing period) and 1 to 3 tags. Prefer tags from the list of existing tags when one fits; new tags are lower case words joined by hyphens. Reply with JSON only, in the form {"title": "...", "tags": ["...", "..."]}.`
+
+// Suggestion is a title and tags proposed for a block.
+type Suggestion struct {
+	Title string   `json:"title"`
+	Tags  []string `json:"tags"`
+}
+
+// parseSuggestion reads the model's reply, allowing for text or code fences
+// around the JSON object, and keeps only tags that are valid as written.
+func parseSuggestion(reply string) (*Suggestion, error) {
+	start, end := strings.Index(reply, "{"), strings.LastIndex(reply, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("no JSON object in reply %q", reply)
+	}
+	var suggestion Suggestion
+	if err := json.Unmarshal([]byte(reply[start:end+1]), &suggestion); err != nil {
+		return nil, fmt.Errorf("failed to parse reply %q: %w", reply, err)
+	}
+
+	suggestion.Title = NewBlock(suggestion.Title).FirstLine()
+	var tags []string
+	for _, tag := range suggestion.Tags {
+		tag = strings.ToLower(strings.Join(strings.Fields(strings.TrimPrefix(strings.TrimSpace(tag), "#")), "-"))
+		if valid := ExtractTags("#" + tag); len(valid) == 1 && valid[0] == tag && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	suggestion.Tags = tags
+	return &suggestion, nil
+}
+
+// needsEnrichment reports whether block has no tags and no pending or
+// rejected suggestions.
+func needsEnrichment(block *Block, meta map[string]string) bool {
+	if len(ExtractTags(block.Content)) > 0 {
+		return false
+	}
+	_, rejected := meta[MetaEnrichRejected]
+	return !hasSuggestion(meta) && !rejected
+}
+
+func hasSuggestion(meta map[string]string) bool {
+	return meta[MetaSuggestedTitle] != "" || meta[MetaSuggestedTags] != ""
+}
+
+// knownTags returns the most used tags of the blocks filter allows, most
+// used first.
+func knownTags(db *Database, filter *VisibilityFilter) ([]string, error) {
+	counts := make(map[string]int)
+	err := db.IterateBlocks(func(block *Block) error {
+		if !filter.Allows(block) {
+			return nil
+		}
+		for _, tag := range ExtractTags(block.Content) {
+			counts[tag]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	tags := sortedKeys(counts)
+	sort.SliceStable(tags, func(i, j int) bool { return counts[tags[i]] > counts[tags[j]] })
+	return tags[:min(len(tags), enrichKnownTags)], nil
+}
+
+// Enricher asks a language model for suggestions and stores them as block
+// metadata.
+type Enricher struct {
+	db       *Database
+	provider Provider
+	filter   *VisibilityFilter
+	tags     []string
+}
+
+// NewEnricher returns an Enricher using the configured model, or an error
+// if none is configured.
+func NewEnricher(db *Database, config *Config) (*Enricher, error) {
+	provider, err := NewProvider(config.AI)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := LoadVisibilityFilter(db, config, config.AI.audience())
+	if err != nil {
+		return nil, err
+	}
+	tags, err := knownTags(db, filter)
+	if err != nil {
+		return nil, err
+	}
+	return &Enricher{db: db, provider: provider, filter: filter, tags: tags}, nil
+}
+
+// Enrich stores suggestions for those of blocks that need them and that the
+// model may see. It returns how many blocks got suggestions, stopping at the
+// first error.
+func (e *Enricher) Enrich(ctx context.Context, blocks []*Block) (int, error) {
+	enriched := 0
+	for _, block := range blocks {
+		meta, err := e.db.GetBlockMeta(block.ContentHash)
+		if err != nil {
+			return enriched, err
+		}
+		if !needsEnrichment(block, meta) || !e.filter.Allows(block) {
+			continue
+		}
+
+		prompt := fmt.Sprintf("Existing tags: %s\n\nNote:\n%s\n", strings.Join(e.tags, ", "), block.Content)
+		reply, err := e.provider.Complete(ctx, enrichInstructions, prompt)
+		if err != nil {
+			return enriched, err
+		}
+		suggestion, err := parseSuggestion(reply)
+		if err != nil {
+			return enriched, fmt.Errorf("block %d: %w", block.ID, err)
+		}
+		if len(suggestion.Tags) == 0 && suggestion.Title == "" {
+			continue
+		}
+
+		if err := e.db.SetBlockMeta(block.ContentHash, MetaSuggestedTitle, suggestion.Title); err != nil {
+			return enriched, err
+		}
+		if err := e.db.SetBlockMeta(block.ContentHash, MetaSuggestedTags, strings.Join(suggestion.Tags, " ")); err != nil {
+			return enriched, err
+		}
+		enriched++
+	}
+	return enriched, nil
+}
+
+// enrichAddedBlocks runs the enrichment pass over blocks just added, when
+// the config asks for it. Failures are reported but don't fail the add.
+func enrichAddedBlocks(blocks []*Block) {
+	if config.AI == nil || !config.AI.EnrichOnAdd || len(blocks) == 0 {
+		return
+	}
+	enricher, err := NewEnricher(db, config)
+	if err == nil {
+		var enriched int
+		if enriched, err = enricher.Enrich(context.Background(), blocks); enriched > 0 {
+			fmt.Println("Suggested a title and tags; review them with: notes enrich --list")
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: enrichment failed: %v", err)
+	}
+}
+
+// applySuggestion returns content with the suggested title as its first
+// line and the suggested tags on its last.
+func applySuggestion(content string, meta map[string]string, tagsOnly bool) string {
+	if title := meta[MetaSuggestedTitle]; title != "" && !tagsOnly && NewBlock(content).FirstLine() != title {
+		content = title + "\n" + content
+	}
+	var tags []string
+	for _, tag := range strings.Fields(meta[MetaSuggestedTags]) {
+		if !NewBlock(content).HasTag(tag) {
+			tags = append(tags, "#"+tag)
+		}
+	}
+	if len(tags) > 0 {
+		content += "\n" + strings.Join(tags, " ")
+	}
+	return content
+}
+
+// clearSuggestion removes the suggestions stored for the block with hash.
+func clearSuggestion(hash string) {
+	for _, key := range []string{MetaSuggestedTitle, MetaSuggestedTags} {
+		if err := db.SetBlockMeta(hash, key, ""); err != nil {
+			log.Fatalf("Failed to clear suggestion: %v", err)
+		}
+	}
+}
+
+// pendingSuggestions returns the blocks with suggestions, in ID order, or
+// those of ids.
+func pendingSuggestions(ids []string) ([]*Block, map[string]map[string]string) {
+	var blocks []*Block
+	if len(ids) > 0 {
+		for _, id := range ids {
+			block, err := db.LookupBlock(id)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			blocks = append(blocks, block)
+		}
+	} else {
+		err := db.IterateBlocks(func(block *Block) error {
+			blocks = append(blocks, block)
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("Failed to get blocks: %v", err)
+		}
+	}
+
+	var pending []*Block
+	metas := make(map[string]map[string]string)
+	for _, block := range blocks {
+		meta, err := db.GetBlockMeta(block.ContentHash)
+		if err != nil {
+			log.Fatalf("Failed to get block metadata: %v", err)
+		}
+		if hasSuggestion(meta) {
+			pending = append(pending, block)
+			metas[block.ContentHash] = meta
+		} else if len(ids) > 0 {
+			fmt.Printf("Error: block %d has no suggestions\n", block.ID)
+			os.Exit(1)
+		}
+	}
+	return pending, metas
+}
+
+func handleEnrich() {
+	fs := flag.NewFlagSet("enrich", flag.ExitOnError)
+	limit := fs.Int("limit", DefaultEnrichLimit, "ask about at most this many blocks")
+	list := fs.Bool("list", false, "list pending suggestions")
+	accept := fs.Bool("accept", false, "apply the suggestions for the given blocks, or all")
+	reject := fs.Bool("reject", false, "discard the suggestions for the given blocks, or all")
+	tagsOnly := fs.Bool("tags-only", false, "with --accept, add the tags but not the title")
+	ids := parseArgs(fs, os.Args[2:])
+	if !*list {
+		requireWritable("notes enrich")
+	}
+
+	switch {
+	case *list:
+		blocks, metas := pendingSuggestions(ids)
+		if len(blocks) == 0 {
+			fmt.Println("No pending suggestions")
+			return
+		}
+		for _, block := range blocks {
+			meta := metas[block.ContentHash]
+			fmt.Printf("%5d  %s\n", block.ID, block.FirstLine())
+			if title := meta[MetaSuggestedTitle]; title != "" {
+				fmt.Printf("       title: %s\n", title)
+			}
+			if tags := strings.Fields(meta[MetaSuggestedTags]); len(tags) > 0 {
+				fmt.Printf("       tags:  #%s\n", strings.Join(tags, " #"))
+			}
+		}
+		return
+
+	case *accept && *reject:
+		fmt.Println("Error: --accept and --reject can't be combined")
+		os.Exit(1)
+
+	case *accept:
+		blocks, metas := pendingSuggestions(ids)
+		if len(blocks) == 0 {
+			fmt.Println("No pending suggestions")
+			return
+		}
+		edits := make([]BlockEdit, len(blocks))
+		for i, block := range blocks {
+			edits[i] = BlockEdit{Hash: block.ContentHash, Content: applySuggestion(block.Content, metas[block.ContentHash], *tagsOnly)}
+		}
+		if _, err := newMainReconciler().UpdateBlocks(edits); err != nil {
+			log.Fatalf("Failed to update blocks: %v", err)
+		}
+		// The metadata moved with each block to its new hash
+		for _, edit := range edits {
+			clearSuggestion(NewBlock(edit.Content).ContentHash)
+		}
+		if err := regenerateAllFiles(); err != nil {
+			log.Fatalf("Failed to regenerate files: %v", err)
+		}
+		fmt.Printf("Applied suggestions to %d block(s)\n", len(edits))
+		return
+
+	case *reject:
+		blocks, _ := pendingSuggestions(ids)
+		for _, block := range blocks {
+			clearSuggestion(block.ContentHash)
+			if err := db.SetBlockMeta(block.ContentHash, MetaEnrichRejected, "1"); err != nil {
+				log.Fatalf("Failed to reject suggestion: %v", err)
+			}
+		}
+		fmt.Printf("Rejected suggestions for %d block(s)\n", len(blocks))
+		return
+	}
+
+	if *tagsOnly {
+		fmt.Println("Error: --tags-only only applies with --accept")
+		os.Exit(1)
+	}
+	if *limit < 1 {
+		fmt.Println("Error: --limit must be at least 1")
+		os.Exit(1)
+	}
+
+	enricher, err := NewEnricher(db, config)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Newest blocks first, or those given
+	var candidates []*Block
+	if len(ids) > 0 {
+		for _, id := range ids {
+			block, err := db.LookupBlock(id)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			candidates = append(candidates, block)
+		}
+	} else {
+		blocks, err := db.GetAllBlocks()
+		if err != nil {
+			log.Fatalf("Failed to get blocks: %v", err)
+		}
+		for i := len(blocks) - 1; i >= 0 && len(candidates) < *limit; i-- {
+			meta, err := db.GetBlockMeta(blocks[i].ContentHash)
+			if err != nil {
+				log.Fatalf("Failed to get block metadata: %v", err)
+			}
+			if needsEnrichment(blocks[i], meta) && enricher.filter.Allows(blocks[i]) {
+				candidates = append(candidates, blocks[i])
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		fmt.Println("No untagged blocks to enrich")
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	infof("Asking %s about %d block(s)", config.AI.Model, len(candidates))
+	enriched, err := enricher.Enrich(ctx, candidates)
+	if enriched > 0 {
+		fmt.Printf("Stored suggestions for %d block(s); review them with: notes enrich --list\n", enriched)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if enriched == 0 {
+		fmt.Println("No suggestions")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	eventsPath = "/events"
+
+	// eventsPollInterval is how often /events checks the operations journal,
+	// which every process writing to the repository appends to.
+	eventsPollInterval = time.Second
+
+	// eventsHeartbeat keeps idle streams from being closed by proxies.
+	eventsHeartbeat = 15 * time.Second
+)
+
+// Block event types streamed by /events.
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+)
+
+// BlockEvent is one block change, sent as the data of a server-sent event
+// named by its Type.
+type BlockEvent struct {
+	Type      string    `json:"type"`
+	Operation string    `json:"operation"`
+	File      string    `json:"file,omitempty"`
+	Time      time.Time `json:"time"`
+	Block     *Block    `json:"block"`
+	Previous  *Block    `json:"previous,omitempty"` // updated blocks only
+}
+
+// operationEvents splits a journaled operation into one event per block.
+func operationEvents(operation *Operation) []*BlockEvent {
+	var events []*BlockEvent
+	event := func(kind string, block, previous *Block) {
+		events = append(events, &BlockEvent{
+			Type:      kind,
+			Operation: operation.Kind,
+			File:      operation.File,
+			Time:      operation.CreatedAt,
+			Block:     block,
+			Previous:  previous,
+		})
+	}
+
+	changes := operation.Changes
+	for _, block := range changes.Added {
+		event(EventCreated, block, nil)
+	}
+	for i, block := range changes.Updated {
+		var previous *Block
+		if i < len(changes.Previous) {
+			previous = changes.Previous[i]
+		}
+		event(EventUpdated, block, previous)
+	}
+	for _, block := range changes.Deleted {
+		event(EventDeleted, block, nil)
+	}
+	return events
+}
+
+// eventsHandler streams block changes as server-sent events for `notes
+// serve`. Each event's ID is the operation it belongs to, so a client that
+// reconnects with Last-Event-ID misses nothing; a new client starts with the
+// next change.
+type eventsHandler struct {
+	auth     *Authenticator
+	audience string // blocks not visible to it are left out
+}
+
+func (h eventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Browsers' EventSource can't set headers, so the token may be a parameter
+	if !h.auth.Request(r) && !h.auth.Allows(r.URL.Query().Get("token")) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	lastID, err := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+	if err != nil {
+		if lastID, err = db.LastOperationID(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	poll := time.NewTicker(eventsPollInterval)
+	defer poll.Stop()
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case <-poll.C:
+			operations, err := db.GetOperationsSince(lastID)
+			if err != nil {
+				log.Printf("Failed to read operations for /events: %v", err)
+				continue
+			}
+			if len(operations) == 0 {
+				continue
+			}
+			if err := h.writeEvents(w, operations); err != nil {
+				log.Printf("Failed to stream events: %v", err)
+				return
+			}
+			flusher.Flush()
+			lastID = operations[len(operations)-1].ID
+		}
+	}
+}
+
+func (h eventsHandler) writeEvents(w http.ResponseWriter, operations []*Operation) error {
+	var filter *VisibilityFilter
+	if h.audience != "" && h.audience != VisibilityPrivate {
+		var err error
+		if filter, err = LoadVisibilityFilter(db, config, h.audience); err != nil {
+			return err
+		}
+	}
+
+	for _, operation := range operations {
+		for _, event := range operationEvents(operation) {
+			if event = visibleEvent(filter, event); event == nil {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				return fmt.Errorf("failed to encode event: %w", err)
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", operation.ID, event.Type, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// visibleEvent returns event as the audience of filter sees it, or nil if
+// it shouldn't see it at all. A block edited out of the audience looks
+// deleted to it, and one edited into it looks created.
+func visibleEvent(filter *VisibilityFilter, event *BlockEvent) *BlockEvent {
+	if filter == nil {
+		return event
+	}
+	visible := filter.Allows(event.Block)
+	if event.Type != EventUpdated || event.Previous == nil {
+		if visible {
+			return event
+		}
+		return nil
+	}
+
+	wasVisible := filter.Allows(event.Previous)
+	switch {
+	case visible && wasVisible:
+		return event
+	case visible:
+		return &BlockEvent{Type: EventCreated, Operation: event.Operation, File: event.File, Time: event.Time, Block: event.Block}
+	case wasVisible:
+		return &BlockEvent{Type: EventDeleted, Operation: event.Operation, File: event.File, Time: event.Time, Block: event.Previous}
+	}
+	return nil
+}
@@ -1,13 +1,35 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"unicode/utf8"
 )
 
+// ErrFileChanged marks a write refused because the file was changed on disk
+// since it was last read, so writing would clobber that edit.
+var ErrFileChanged = errors.New("file changed on disk since it was read")
+
 type FileManager struct {
 	notesPath string
+
+	// skipUnchanged leaves the markdown file alone, mtime included, when
+	// what would be written is already there.
+	skipUnchanged bool
+
+	// seen is the markdown file as it was last read or written, which it
+	// must still be for the next write to go ahead. Nil until then. As in
+	// polling, the content hash is only compared when size or mtime differ,
+	// so a file that was only touched still counts as unchanged.
+	seen *fileState
 }
 
 func NewFileManager(filename string) *FileManager {
@@ -29,24 +51,232 @@ func (fm *FileManager) ReadFile(filePath string) (string, error) {
 		return "", nil
 	}
 
+	// Stat before reading, so an edit saved meanwhile makes the file look
+	// changed rather than slipping past the next write's check
+	info, statErr := os.Stat(filePath)
+	content, err := readTextFile(filePath)
+	if err == nil && statErr == nil && filePath == fm.notesPath {
+		fm.remember(info, content)
+	}
+	return content, err
+}
+
+// remember records content, found in a file described by info, as the
+// version of the markdown file the next write expects.
+func (fm *FileManager) remember(info os.FileInfo, content string) {
+	fm.seen = &fileState{modTime: info.ModTime(), size: info.Size(), hash: sha256Hex(content)}
+}
+
+// checkUnchanged returns ErrFileChanged if the markdown file was changed
+// since it was last read or written. Files never read, and files deleted
+// since, have nothing to lose.
+func (fm *FileManager) checkUnchanged() error {
+	if fm.seen == nil {
+		return nil
+	}
+	info, err := os.Stat(fm.notesPath)
+	if err != nil {
+		return nil
+	}
+	if info.ModTime().Equal(fm.seen.modTime) && info.Size() == fm.seen.size {
+		return nil
+	}
+	content, err := os.ReadFile(fm.notesPath)
+	if err != nil {
+		return fmt.Errorf("failed to read file %s: %w", fm.notesPath, err)
+	}
+	if sha256Hex(string(content)) != fm.seen.hash {
+		return fmt.Errorf("%s: %w", fm.notesPath, ErrFileChanged)
+	}
+	fm.seen.modTime, fm.seen.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// readTextFile reads a file within the configured size limit and checks
+// that it holds text.
+func readTextFile(filePath string) (string, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file %s: %w", filePath, err)
+	}
+	if err := checkFileSize(filePath, info.Size()); err != nil {
+		return "", err
+	}
+
 	content, err := os.ReadFile(filePath)
 	if err != nil {
 		return "", fmt.Errorf("failed to read file %s: %w", filePath, err)
 	}
+	if err := checkTextContent(filePath, content); err != nil {
+		return "", err
+	}
+	if !utf8.Valid(content) {
+		log.Printf("Warning: %s isn't valid UTF-8; the invalid bytes are read as %q", filePath, utf8.RuneError)
+		return strings.ToValidUTF8(string(content), string(utf8.RuneError)), nil
+	}
 
 	return string(content), nil
 }
 
+// WriteMarkdownFile replaces the markdown file with content, unless it was
+// changed on disk since it was last read, in which case ErrFileChanged is
+// returned so the caller can read the edit back and try again.
 func (fm *FileManager) WriteMarkdownFile(content string) error {
-	return fm.WriteFile(fm.notesPath, content)
+	if fm.unchanged(content) {
+		return nil
+	}
+	if err := fm.checkUnchanged(); err != nil {
+		return err
+	}
+	if err := fm.WriteFile(fm.notesPath, content); err != nil {
+		return err
+	}
+	if info, err := os.Stat(fm.notesPath); err == nil {
+		fm.remember(info, content)
+	}
+	return nil
+}
+
+// unchanged reports whether skipUnchanged is set and the markdown file
+// already holds content, so writing it can be skipped.
+func (fm *FileManager) unchanged(content string) bool {
+	if !fm.skipUnchanged {
+		return false
+	}
+	current, err := os.ReadFile(fm.notesPath)
+	return err == nil && string(current) == content
+}
+
+// StreamMarkdownFile writes the markdown file through a buffered writer
+// passed to write, for content too large to build in memory first. The
+// content goes to a temporary file that replaces the markdown file only
+// once write succeeds, so a failure leaves the old file in place. Like
+// WriteMarkdownFile, it returns ErrFileChanged rather than replace a file
+// changed since it was last read.
+func (fm *FileManager) StreamMarkdownFile(write func(io.Writer) error) error {
+	file, err := createAtomicFile(fm.notesPath)
+	if err != nil {
+		return err
+	}
+	defer file.Abort()
+
+	hasher := sha256.New()
+	buffered := bufio.NewWriter(io.MultiWriter(file, hasher))
+	if err := write(buffered); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return fmt.Errorf("failed to write file %s: %w", fm.notesPath, err)
+	}
+	if fm.skipUnchanged && sameFileContent(file.Name(), file.target) {
+		return nil
+	}
+	if err := fm.checkUnchanged(); err != nil {
+		return err
+	}
+	if err := file.Commit(); err != nil {
+		return err
+	}
+	if info, err := os.Stat(file.target); err == nil {
+		fm.seen = &fileState{modTime: info.ModTime(), size: info.Size(), hash: fmt.Sprintf("%x", hasher.Sum(nil))}
+	}
+	return nil
 }
 
+// WriteFile replaces filePath with content atomically, so a crash or a full
+// disk mid-write leaves the old file rather than a truncated one.
 func (fm *FileManager) WriteFile(filePath, content string) error {
-	err := os.WriteFile(filePath, []byte(content), 0644)
+	file, err := createAtomicFile(filePath)
 	if err != nil {
+		return err
+	}
+	defer file.Abort()
+
+	if _, err := io.WriteString(file, content); err != nil {
 		return fmt.Errorf("failed to write file %s: %w", filePath, err)
 	}
+	return file.Commit()
+}
+
+// atomicFile is a temporary file next to the file it replaces once it is
+// committed. Readers, and the file after a crash, see either the old
+// content or the new, never part of it.
+type atomicFile struct {
+	*os.File
+	target string
+	mode   os.FileMode
+}
+
+// createAtomicFile starts replacing filePath, or the file it links to, since
+// replacing a symlink would cut it off from its target. The replacement
+// keeps the permissions of the file it replaces.
+func createAtomicFile(filePath string) (*atomicFile, error) {
+	target := CanonicalPath(filePath)
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(target); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file for %s: %w", filePath, err)
+	}
+	return &atomicFile{File: file, target: target, mode: mode}, nil
+}
+
+// Commit flushes the new content to disk and renames it over the target.
+func (f *atomicFile) Commit() error {
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to write file %s: %w", f.target, err)
+	}
+	if err := f.Chmod(f.mode); err != nil {
+		return fmt.Errorf("failed to write file %s: %w", f.target, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write file %s: %w", f.target, err)
+	}
+	if err := os.Rename(f.Name(), f.target); err != nil {
+		return fmt.Errorf("failed to write file %s: %w", f.target, err)
+	}
+	syncDir(filepath.Dir(f.target))
+	return nil
+}
+
+// Abort removes the temporary file unless it was committed.
+func (f *atomicFile) Abort() {
+	f.Close()
+	if fileExists(f.Name()) {
+		os.Remove(f.Name())
+	}
+}
 
+// syncDir flushes a rename in dir to disk. Not every platform can open a
+// directory to sync it, Windows among them, and the rename itself has
+// happened either way, so failures are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// WriteReadOnlyMarkdownFile writes content and then removes write
+// permission from the file, restoring it first if an earlier write removed it.
+func (fm *FileManager) WriteReadOnlyMarkdownFile(content string) error {
+	if fm.unchanged(content) {
+		return nil
+	}
+	if fm.markdownFileExists() {
+		if err := os.Chmod(fm.notesPath, 0644); err != nil {
+			return fmt.Errorf("failed to make %s writable: %w", fm.notesPath, err)
+		}
+	}
+	if err := fm.WriteMarkdownFile(content); err != nil {
+		return err
+	}
+	if err := os.Chmod(fm.notesPath, 0444); err != nil {
+		return fmt.Errorf("failed to make %s read-only: %w", fm.notesPath, err)
+	}
 	return nil
 }
 
@@ -54,22 +284,86 @@ func (fm *FileManager) markdownFileExists() bool {
 	return fileExists(fm.notesPath)
 }
 
+// sameFileContent reports whether the files at a and b hold the same bytes,
+// reading both a chunk at a time.
+func sameFileContent(a, b string) bool {
+	fileA, err := os.Open(a)
+	if err != nil {
+		return false
+	}
+	defer fileA.Close()
+	fileB, err := os.Open(b)
+	if err != nil {
+		return false
+	}
+	defer fileB.Close()
+
+	infoA, errA := fileA.Stat()
+	infoB, errB := fileB.Stat()
+	if errA != nil || errB != nil || infoA.Size() != infoB.Size() {
+		return false
+	}
+
+	readerA, readerB := bufio.NewReader(fileA), bufio.NewReader(fileB)
+	bufferA, bufferB := make([]byte, 64*1024), make([]byte, 64*1024)
+	for {
+		n, errA := io.ReadFull(readerA, bufferA)
+		m, errB := io.ReadFull(readerB, bufferB)
+		if n != m || !bytes.Equal(bufferA[:n], bufferB[:m]) {
+			return false
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == errA
+		}
+		if errA != nil || errB != nil {
+			return false
+		}
+	}
+}
+
 func fileExists(filePath string) bool {
 	_, err := os.Stat(filePath)
 	return !os.IsNotExist(err)
 }
 
 func ResolveAbsolutePath(filePath string) (string, error) {
-	if filepath.IsAbs(filePath) {
-		return filePath, nil
+	// filepath.Abs also handles drive-relative paths like C:notes.md on
+	// Windows, which joining onto the working directory would mangle
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", filePath, err)
 	}
+	return normalizeVolume(absPath), nil
+}
 
-	cwd, err := os.Getwd()
+// CanonicalPath returns the absolute path of filePath with symlinks
+// resolved, so a file reached through a symlinked directory has one name.
+// For a file that doesn't exist, only its directory is resolved; a path that
+// can't be resolved is returned cleaned.
+func CanonicalPath(filePath string) string {
+	absPath, err := ResolveAbsolutePath(filePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to get current working directory: %w", err)
+		return filepath.Clean(filePath)
+	}
+	if resolved, err := filepath.EvalSymlinks(absPath); err == nil {
+		return normalizeVolume(resolved)
+	}
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(absPath)); err == nil {
+		return normalizeVolume(filepath.Join(dir, filepath.Base(absPath)))
 	}
+	return absPath
+}
 
-	return filepath.Join(cwd, filePath), nil
+// normalizeVolume upper-cases a Windows drive letter, so c:\notes.md and
+// C:\notes.md are stored as one path. Separators are already made
+// consistent by filepath.Clean. Paths without a drive letter are returned
+// as they are.
+func normalizeVolume(path string) string {
+	volume := filepath.VolumeName(path)
+	if len(volume) != 2 || volume[1] != ':' {
+		return path
+	}
+	return strings.ToUpper(volume) + path[2:]
 }
 
 func (fm *FileManager) EnsureDirectoryExists() error {
@@ -107,11 +401,5 @@ func (fm *FileManager) ReadExternalMarkdownFile(filePath string) (string, error)
 		return "", fmt.Errorf("file not found: %s", filePath)
 	}
 
-	// Read the file
-	content, err := os.ReadFile(filePath)
-	if err != nil {
-		return "", fmt.Errorf("failed to read external markdown file: %w", err)
-	}
-
-	return string(content), nil
+	return readTextFile(filePath)
 }
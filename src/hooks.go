@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+const (
+	HookPreReconcile  = "pre-reconcile"
+	HookPostReconcile = "post-reconcile"
+	HookPostAdd       = "post-add"
+	HookPostUpdate    = "post-update"
+	HookReminder      = "reminder"
+
+	hookTimeout = 30 * time.Second
+)
+
+// ChangeSet describes the blocks affected by one operation. It is the payload
+// hooks receive on stdin.
+type ChangeSet struct {
+	Hook    string   `json:"hook,omitempty"`
+	File    string   `json:"file,omitempty"`
+	Added   []*Block `json:"added"`
+	Updated []*Block `json:"updated"`
+	Deleted []*Block `json:"deleted"`
+
+	// Previous holds the state of each Updated block before the change, at
+	// the same index.
+	Previous []*Block `json:"previous,omitempty"`
+
+	// Conflicts holds the conflict blocks written because a block was
+	// edited in both the file and the database. They are also in Added.
+	Conflicts []*Block `json:"conflicts,omitempty"`
+
+	// Files maps the hashes of Deleted blocks to the watched files they
+	// were in, for deletions made outside of any file, so undo can put
+	// them back.
+	Files map[string][]string `json:"files,omitempty"`
+}
+
+func NewChangeSet(file string) *ChangeSet {
+	return &ChangeSet{
+		File:    file,
+		Added:   []*Block{},
+		Updated: []*Block{},
+		Deleted: []*Block{},
+	}
+}
+
+// AddUpdate records that before was changed into after.
+func (c *ChangeSet) AddUpdate(before, after *Block) {
+	c.Updated = append(c.Updated, after)
+	c.Previous = append(c.Previous, before)
+}
+
+func (c *ChangeSet) IsEmpty() bool {
+	return len(c.Added) == 0 && len(c.Updated) == 0 && len(c.Deleted) == 0
+}
+
+// HookRunner executes the scripts in a repository's .notes/hooks directory.
+// Missing or non-executable hooks are skipped.
+type HookRunner struct {
+	dir string
+}
+
+func NewHookRunner(dir string) *HookRunner {
+	return &HookRunner{dir: dir}
+}
+
+// Run executes the named hook with changes as JSON on stdin. A non-zero exit
+// is returned as an error; pre-hooks use that to veto the operation.
+func (h *HookRunner) Run(name string, changes *ChangeSet) error {
+	changes.Hook = name
+	payload, err := json.Marshal(changes)
+	if err != nil {
+		return fmt.Errorf("failed to encode hook payload: %w", err)
+	}
+	_, err = h.run(name, payload, "NOTES_FILE="+changes.File)
+	return err
+}
+
+// Exists reports whether the named hook is present and executable.
+func (h *HookRunner) Exists(name string) bool {
+	info, err := os.Stat(filepath.Join(h.dir, name))
+	return err == nil && !info.IsDir() && info.Mode()&0111 != 0
+}
+
+// run executes the named hook with payload on stdin and reports whether it
+// existed.
+func (h *HookRunner) run(name string, payload []byte, env ...string) (bool, error) {
+	if !h.Exists(name) {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, filepath.Join(h.dir, name))
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Env = append(append(os.Environ(), "NOTES_HOOK="+name), env...)
+
+	if err := cmd.Run(); err != nil {
+		return true, fmt.Errorf("hook %s failed: %w: %s", name, err, bytes.TrimSpace(output.Bytes()))
+	}
+	return true, nil
+}
+
+// RunPost executes a post-operation hook, logging failures instead of
+// returning them since the operation has already happened.
+func (h *HookRunner) RunPost(name string, changes *ChangeSet) {
+	if err := h.Run(name, changes); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
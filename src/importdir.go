@@ -0,0 +1,197 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// markdownExtensions are the file extensions import-dir picks up.
+var markdownExtensions = map[string]bool{".md": true, ".markdown": true}
+
+// DirectoryImport reports what ImportDirectory stored and skipped.
+type DirectoryImport struct {
+	Changes *ChangeSet
+	Skipped int              // blocks already in the store
+	Failed  map[string]error // files that couldn't be read
+}
+
+// findMarkdownFiles lists the markdown files in dir, and in its
+// subdirectories with recursive. Hidden files and directories, such as
+// .git or .obsidian, the notes repository's own files and backups are left
+// out.
+func findMarkdownFiles(dir string, recursive bool) ([]string, error) {
+	skip := map[string]bool{
+		CanonicalPath(config.notesPath):   true,
+		CanonicalPath(config.BackupDir()): true,
+	}
+
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(entry.Name(), ".") || skip[CanonicalPath(path)] {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			if path != dir && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if markdownExtensions[strings.ToLower(filepath.Ext(path))] && !config.FileConfig(CanonicalPath(path)).Mirror {
+			files = append(files, CanonicalPath(path))
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// ImportDirectory ingests files like IngestTaggedBlocks, storing the blocks
+// of all of them as one operation and regenerating the markdown file once.
+// Files that can't be read are reported and skipped. progress is called
+// after each file.
+func (r *Reconciler) ImportDirectory(dir string, files []string, tag string, progress func()) (*DirectoryImport, error) {
+	result := &DirectoryImport{Changes: NewChangeSet(dir), Failed: make(map[string]error)}
+
+	seen := make(map[string]bool)
+	for _, filePath := range files {
+		added, skipped, err := r.taggedBlocksToIngest(filePath, tag, seen)
+		if err == nil {
+			err = checkNewBlockCount(filePath, len(added))
+		}
+		if err != nil {
+			for _, block := range added {
+				delete(seen, block.ContentHash)
+			}
+			result.Failed[filePath] = err
+		} else {
+			result.Changes.Added = append(result.Changes.Added, added...)
+			result.Skipped += skipped
+		}
+		progress()
+	}
+
+	if err := r.storeIngestedBlocks(result.Changes); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// progressBar draws a bar on stderr while a long command works through
+// items. It draws nothing when stderr isn't a terminal or with --quiet.
+type progressBar struct {
+	label   string
+	done    int
+	total   int
+	enabled bool
+}
+
+const progressBarWidth = 30
+
+func newProgressBar(label string, total int) *progressBar {
+	info, err := os.Stderr.Stat()
+	isTerminal := err == nil && info.Mode()&os.ModeCharDevice != 0
+	return &progressBar{label: label, total: total, enabled: isTerminal && !quietLogging && total > 0}
+}
+
+// Advance counts one more item as done and redraws the bar.
+func (p *progressBar) Advance() {
+	p.done++
+	if !p.enabled {
+		return
+	}
+	filled := progressBarWidth * p.done / p.total
+	fmt.Fprintf(os.Stderr, "\r%s [%s%s] %d/%d", p.label,
+		strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), p.done, p.total)
+}
+
+// Finish clears the bar so the report starts on a clean line.
+func (p *progressBar) Finish() {
+	if p.enabled {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+}
+
+func handleImportDir() {
+	fs := flag.NewFlagSet("import-dir", flag.ExitOnError)
+	recursive := fs.Bool("recursive", false, "also import files in subdirectories")
+	tag := fs.String("tag", "", "tag to append to each imported block")
+	watch := fs.Bool("watch", false, "also add the files to the watch list")
+	preserveDates := fs.Bool("preserve-dates", false, "date the blocks by each file's front matter date or modification time")
+	args := parseArgs(fs, os.Args[2:])
+
+	if len(args) != 1 {
+		fmt.Println("Error: import-dir command requires a directory")
+		fmt.Println("Usage: notes import-dir [--recursive] [--tag imported] [--watch] [--preserve-dates] <dir>")
+		os.Exit(1)
+	}
+	// Watched blocks are kept as the file has them, so the watcher would
+	// import the untagged blocks again
+	if *watch && *tag != "" {
+		fmt.Println("Error: --tag can't be combined with --watch, since blocks of watched files are kept as written")
+		os.Exit(1)
+	}
+
+	dir := CanonicalPath(expandHome(args[0]))
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		fmt.Printf("Error: %s is not a directory\n", args[0])
+		os.Exit(1)
+	}
+
+	files, err := findMarkdownFiles(dir, *recursive)
+	if err != nil {
+		log.Fatalf("Failed to list %s: %v", dir, err)
+	}
+	if len(files) == 0 {
+		fmt.Printf("No markdown files found in %s\n", dir)
+		return
+	}
+
+	reconciler := newMainReconciler()
+	reconciler.preserveDates = *preserveDates
+	bar := newProgressBar("Importing", len(files))
+	result, err := reconciler.ImportDirectory(dir, files, *tag, bar.Advance)
+	bar.Finish()
+	if err != nil {
+		log.Fatalf("Failed to import %s: %v", dir, err)
+	}
+
+	watched := 0
+	if *watch {
+		if err := CanonicalizeWatchedFiles(db); err != nil {
+			log.Fatalf("Failed to update watched files: %v", err)
+		}
+		for _, filePath := range files {
+			if result.Failed[filePath] != nil {
+				continue
+			}
+			if err := db.AddWatchedFile(filePath); err != nil {
+				log.Fatalf("Failed to add %s to watch list: %v", filePath, err)
+			}
+			watched++
+		}
+	}
+
+	fmt.Printf("Imported %d blocks from %d files in %s (%d duplicates skipped)\n",
+		len(result.Changes.Added), len(files)-len(result.Failed), dir, result.Skipped)
+	if watched > 0 {
+		fmt.Printf("Added %d files to the watch list; start the watcher daemon with: notes watcher\n", watched)
+	}
+	if len(result.Failed) > 0 {
+		fmt.Printf("Skipped %d files:\n", len(result.Failed))
+		for _, filePath := range sortedKeys(result.Failed) {
+			fmt.Printf("  %s: %v\n", filePath, result.Failed[filePath])
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// startPager pipes output through $PAGER, or less, when stdout is a
+// terminal. less is told to exit straight away if everything fits on one
+// screen. The returned function closes the pipe and waits for the pager.
+func startPager() (io.Writer, func()) {
+	if !stdoutIsTerminal() {
+		return os.Stdout, func() {}
+	}
+
+	pager := strings.Fields(os.Getenv("PAGER"))
+	if len(pager) == 0 {
+		pager = []string{"less"}
+	}
+
+	cmd := exec.Command(pager[0], pager[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if os.Getenv("LESS") == "" {
+		cmd.Env = append(os.Environ(), "LESS=FRX")
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return os.Stdout, func() {}
+	}
+	if err := cmd.Start(); err != nil {
+		return os.Stdout, func() {}
+	}
+
+	return stdin, func() {
+		stdin.Close()
+		cmd.Wait()
+	}
+}
+
+// selectSearchResult lists blocks by number and lets the user pick one to
+// print, edit, delete or copy to the clipboard, until they quit.
+func selectSearchResult(blocks []*Block) {
+	if len(blocks) == 0 {
+		fmt.Println("No blocks found matching the specified criteria")
+		return
+	}
+
+	input := bufio.NewScanner(os.Stdin)
+	listBlocks(blocks)
+	for {
+		fmt.Print("Select a block (l to list, q to quit): ")
+		if !input.Scan() {
+			fmt.Println()
+			return
+		}
+
+		answer := strings.TrimSpace(input.Text())
+		switch answer {
+		case "q":
+			return
+		case "l":
+			listBlocks(blocks)
+			continue
+		}
+
+		n, err := strconv.Atoi(answer)
+		if err != nil || n < 1 || n > len(blocks) {
+			continue
+		}
+		block := blocks[n-1]
+
+		fmt.Print("[p]rint, [e]dit, [d]elete, [c]opy: ")
+		if !input.Scan() {
+			fmt.Println()
+			return
+		}
+
+		switch strings.TrimSpace(input.Text()) {
+		case "p":
+			fmt.Printf("\n%s\n\n", block.Content)
+		case "e":
+			if edited := editSearchResult(block); edited != nil {
+				blocks[n-1] = edited
+			}
+		case "d":
+			fmt.Print("Delete this block everywhere? [y/N]: ")
+			if input.Scan() && strings.EqualFold(strings.TrimSpace(input.Text()), "y") {
+				deleteSearchResult(block)
+				blocks = append(blocks[:n-1], blocks[n:]...)
+				if len(blocks) == 0 {
+					return
+				}
+				listBlocks(blocks)
+			}
+		case "c":
+			if err := copyToClipboard(block.Content); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			} else {
+				fmt.Println("Copied to clipboard")
+			}
+		}
+	}
+}
+
+func listBlocks(blocks []*Block) {
+	for i, block := range blocks {
+		fmt.Printf("%4d  %s\n", i+1, block.Title())
+	}
+}
+
+// editSearchResult opens block in the editor and stores the result. It
+// returns the updated block, or nil if nothing changed.
+func editSearchResult(block *Block) *Block {
+	content, err := editInEditor(block.Content+"\n", 0)
+	if err != nil {
+		log.Fatalf("Failed to edit block: %v", err)
+	}
+
+	changes, err := newMainReconciler().UpdateBlock(block.ContentHash, content)
+	if err != nil {
+		log.Fatalf("Failed to update block: %v", err)
+	}
+	if len(changes.Updated) == 0 {
+		fmt.Println("Block unchanged")
+		return nil
+	}
+
+	if err := regenerateAllFiles(); err != nil {
+		log.Fatalf("Failed to regenerate files: %v", err)
+	}
+	fmt.Println("Block updated")
+	updated := changes.Updated[len(changes.Updated)-1]
+	warnSameTitle(updated)
+	return updated
+}
+
+func deleteSearchResult(block *Block) {
+	if _, err := newMainReconciler().DeleteBlocks([]*Block{block}); err != nil {
+		log.Fatalf("Failed to delete block: %v", err)
+	}
+	if err := regenerateAllFiles(); err != nil {
+		log.Fatalf("Failed to regenerate files: %v", err)
+	}
+	fmt.Println("Block deleted")
+}
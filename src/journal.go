@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Operation kinds recorded in the journal.
+const (
+	OperationAdd       = "add"
+	OperationUpdate    = "update"
+	OperationDelete    = "delete"
+	OperationReconcile = "reconcile"
+	OperationIngest    = "ingest"
+	OperationImport    = "import"
+	OperationSplit     = "split"
+	OperationMerge     = "merge"
+)
+
+// Operation is one journaled mutation.
+type Operation struct {
+	ID        int
+	Kind      string
+	File      string
+	CreatedAt time.Time
+	Changes   ChangeSet
+}
+
+// Summary describes the operation in one line.
+func (o *Operation) Summary() string {
+	summary := fmt.Sprintf("%s #%d at %s: +%d ~%d -%d", o.Kind, o.ID, o.CreatedAt.Local().Format("2006-01-02 15:04:05"),
+		len(o.Changes.Added), len(o.Changes.Updated), len(o.Changes.Deleted))
+	if o.File != "" {
+		summary += " (" + o.File + ")"
+	}
+	return summary
+}
+
+// skipRegeneration is set by the global --no-regenerate option, so batch
+// scripts can make many changes and run `notes regenerate` once at the end.
+var skipRegeneration bool
+
+// regenerateAllFiles rewrites notes.md and every watched file from the
+// database, after operations that bypass the normal reconcile flow.
+func regenerateAllFiles() error {
+	if err := newMainReconciler().RegenerateMarkdownFile(); err != nil {
+		return err
+	}
+
+	watchedFiles, err := db.GetWatchedFiles()
+	if err != nil {
+		return err
+	}
+	for _, filePath := range watchedFiles {
+		if !fileExists(filePath) {
+			continue
+		}
+		reconciler := NewReconciler(db, NewFileManager(filePath), config)
+		if err := reconciler.RegenerateSpecificFile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func handleUndo() {
+	count := 1
+	if len(os.Args) > 2 {
+		n, err := strconv.Atoi(os.Args[2])
+		if err != nil || n < 1 {
+			fmt.Println("Error: undo count must be a positive number")
+			fmt.Println("Usage: notes undo [n]")
+			os.Exit(1)
+		}
+		count = n
+	}
+
+	operations, err := db.GetRecentOperations(count)
+	if err != nil {
+		log.Fatalf("Failed to read operations journal: %v", err)
+	}
+	if len(operations) == 0 {
+		fmt.Println("Nothing to undo")
+		return
+	}
+
+	for _, operation := range operations {
+		if err := db.UndoOperation(operation); err != nil {
+			log.Fatalf("Failed to undo %s: %v", operation.Summary(), err)
+		}
+		fmt.Printf("Undid %s\n", operation.Summary())
+	}
+
+	if err := regenerateAllFiles(); err != nil {
+		log.Fatalf("Failed to regenerate files: %v", err)
+	}
+}
+
+func handleRegenerate() {
+	skipRegeneration = false
+	if err := regenerateAllFiles(); err != nil {
+		log.Fatalf("Failed to regenerate files: %v", err)
+	}
+}
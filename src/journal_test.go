@@ -0,0 +1,55 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The operations journal holds block content, so encrypting and decrypting a
+// repository has to rewrite it along with the blocks for undo to keep working.
+func TestUndoAfterEncryptAndDecrypt(t *testing.T) {
+	d, err := NewDatabase(filepath.Join(t.TempDir(), "notes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	block := NewBlock("secret plans #project")
+	if err := d.CreateBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	changes := NewChangeSet("")
+	changes.Added = append(changes.Added, block)
+	if err := d.RecordOperation("add", changes); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.EncryptRepository("passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	if err := d.db.QueryRow(`SELECT changes FROM operations`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stored, "secret plans") {
+		t.Fatalf("journal still holds plaintext after encrypt: %s", stored)
+	}
+
+	if err := d.DecryptRepository(); err != nil {
+		t.Fatal(err)
+	}
+	operations, err := d.GetRecentOperations(1)
+	if err != nil {
+		t.Fatalf("reading journal after decrypt: %v", err)
+	}
+	if len(operations) != 1 {
+		t.Fatalf("got %d operations, want 1", len(operations))
+	}
+	if err := d.UndoOperation(operations[0]); err != nil {
+		t.Fatal(err)
+	}
+	if undone, err := d.GetBlockByHash(block.ContentHash); err != nil || undone != nil {
+		t.Fatalf("block still present after undo: %v, %v", undone, err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+)
+
+// keyringService names the passphrases notes keeps in the system keyring.
+// Each is stored under the directory of its repository as the account.
+const keyringService = "gravitynotes"
+
+// errNoKeyring is returned where no keyring tool is available. Windows has
+// no command that reads a stored credential back, so it never has one.
+var errNoKeyring = errors.New("no system keyring found (macOS Keychain, or secret-tool on Linux)")
+
+// keyringAvailable reports whether the platform's keyring tool is installed.
+func keyringAvailable() bool {
+	switch runtime.GOOS {
+	case "darwin":
+		_, err := exec.LookPath("security")
+		return err == nil
+	case "windows":
+		return false
+	default:
+		_, err := exec.LookPath("secret-tool")
+		return err == nil
+	}
+}
+
+// keyringLookup returns the passphrase stored for the repository in repoDir,
+// or "" if there is none.
+func keyringLookup(repoDir string) (string, error) {
+	if !keyringAvailable() {
+		return "", errNoKeyring
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "find-generic-password", "-s", keyringService, "-a", repoDir, "-w")
+	} else {
+		cmd = exec.Command("secret-tool", "lookup", "service", keyringService, "repository", repoDir)
+	}
+	output, err := cmd.Output()
+	// Both tools fail when nothing is stored
+	if err != nil {
+		return "", nil
+	}
+
+	passphrase := strings.TrimRight(string(output), "\r\n")
+	// security prints passphrases that aren't plain ASCII as hex
+	if runtime.GOOS == "darwin" {
+		decoded, err := hex.DecodeString(passphrase)
+		if err == nil && utf8.Valid(decoded) && !isPrintableASCII(string(decoded)) {
+			passphrase = string(decoded)
+		}
+	}
+	return passphrase, nil
+}
+
+// keyringStore stores passphrase for the repository in repoDir, replacing
+// any stored before. It is passed on stdin, never as an argument other
+// processes could see.
+func keyringStore(repoDir, passphrase string) error {
+	if !keyringAvailable() {
+		return errNoKeyring
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "-i")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %s -a %s -X %s\n",
+			shellQuote(keyringService), shellQuote(repoDir), hex.EncodeToString([]byte(passphrase))))
+	} else {
+		cmd = exec.Command("secret-tool", "store", "--label", "notes passphrase for "+repoDir,
+			"service", keyringService, "repository", repoDir)
+		cmd.Stdin = strings.NewReader(passphrase)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %w: %s", cmd.Args[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// keyringForget removes the passphrase stored for the repository in repoDir.
+// Removing one that isn't stored isn't an error.
+func keyringForget(repoDir string) error {
+	if !keyringAvailable() {
+		return errNoKeyring
+	}
+	if stored, err := keyringLookup(repoDir); err != nil || stored == "" {
+		return err
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "delete-generic-password", "-s", keyringService, "-a", repoDir)
+	} else {
+		cmd = exec.Command("secret-tool", "clear", "service", keyringService, "repository", repoDir)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %w: %s", cmd.Args[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func isPrintableASCII(s string) bool {
+	for _, r := range s {
+		if r < ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func handleKeyring() {
+	if len(os.Args) < 3 || (os.Args[2] != "save" && os.Args[2] != "forget") {
+		fmt.Println("Error: keyring command requires save or forget")
+		fmt.Println("Usage: notes keyring save|forget")
+		os.Exit(1)
+	}
+	repoDir := filepath.Dir(dbPath)
+
+	if os.Args[2] == "forget" {
+		if err := keyringForget(repoDir); err != nil {
+			log.Fatalf("Failed to remove passphrase: %v", err)
+		}
+		fmt.Println("Passphrase removed from the system keyring")
+		return
+	}
+
+	if repositoryPassphrase == "" {
+		fmt.Println("Error: the repository isn't encrypted; run 'notes encrypt' first")
+		os.Exit(1)
+	}
+	if err := keyringStore(repoDir, repositoryPassphrase); err != nil {
+		log.Fatalf("Failed to store passphrase: %v", err)
+	}
+	fmt.Println("Passphrase stored in the system keyring; notes will unlock the repository without asking")
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// Generated header and footer text is wrapped in these markers so it is
+	// replaced, not turned into blocks, when the file is read back.
+	GeneratedStartMarker = "<!-- notes:generated-start -->"
+	GeneratedEndMarker   = "<!-- notes:generated-end -->"
+)
+
+// blockIDPattern matches the comment written after each block when
+// block_ids is enabled. It is always stripped when a file is parsed.
+var blockIDPattern = regexp.MustCompile(`(?m)^<!-- notes:block \d+ -->[ \t]*(?:\n|$)`)
+
+// Date sections, from newest to oldest, used when date_headers is enabled.
+var dateSectionLabels = []string{"Today", "Yesterday", "This week", "Last week", "This month", "Earlier"}
+
+// Layout controls how blocks are laid out in a generated file. The zero
+// value writes blocks separated by blank lines and nothing else.
+type Layout struct {
+	// Separator is a line written between blocks, e.g. "---".
+	Separator string `json:"separator,omitempty"`
+
+	// Delimiters are lines that end a block when the file is read back, in
+	// addition to blank lines, e.g. "---" for entries separated by
+	// horizontal rules. They never become part of a block.
+	Delimiters []string `json:"delimiters,omitempty"`
+
+	// DelimitersOnly keeps blank lines inside blocks, so only Delimiters
+	// separate them. Blocks are then written with Separator, or else the
+	// first delimiter, between them.
+	DelimitersOnly bool `json:"delimiters_only,omitempty"`
+
+	// DateHeaders groups blocks under "## Today", "## This week" and so on
+	// by when they were last touched. It suits the recency order best; with
+	// other orders a heading is repeated whenever the section changes.
+	DateHeaders bool `json:"date_headers,omitempty"`
+
+	// BlockIDs writes an HTML comment with the block's ID after each block,
+	// for use with commands that take one, such as `notes split`.
+	BlockIDs bool `json:"block_ids,omitempty"`
+
+	// Header and Footer are Go templates written before and after the
+	// blocks. They are executed with LayoutData.
+	Header string `json:"header,omitempty"`
+	Footer string `json:"footer,omitempty"`
+
+	// Workspaces lists tags whose blocks are grouped, in this order, under
+	// "# @tag" headings after the blocks carrying none of them. Blocks
+	// written under such a heading get its tag when the file is read back.
+	// See workspaces.go.
+	Workspaces []string `json:"workspaces,omitempty"`
+}
+
+// LayoutData is available to header and footer templates.
+type LayoutData struct {
+	File   string // base name of the generated file
+	Blocks int    // number of blocks in the file
+	Date   string // date of generation, YYYY-MM-DD
+}
+
+func (l *Layout) validate() error {
+	if l == nil {
+		return nil
+	}
+	if strings.ContainsAny(l.Separator, "\n\r") {
+		return fmt.Errorf("separator must be a single line")
+	}
+	for _, delimiter := range l.Delimiters {
+		if strings.TrimSpace(delimiter) == "" || strings.ContainsAny(delimiter, "\n\r") {
+			return fmt.Errorf("delimiters must be single lines that aren't blank, got %q", delimiter)
+		}
+	}
+	if l.DelimitersOnly {
+		switch {
+		case len(l.Delimiters) == 0:
+			return fmt.Errorf("delimiters_only needs delimiters")
+		case l.DateHeaders || len(l.Workspaces) > 0:
+			// Their headings would run into the block below
+			return fmt.Errorf("delimiters_only can't be combined with date_headers or workspaces")
+		case l.Separator != "" && !l.isDelimiter(l.Separator):
+			return fmt.Errorf("separator must be one of the delimiters with delimiters_only, or blocks wouldn't be read back")
+		}
+	}
+	for name, text := range map[string]string{"header": l.Header, "footer": l.Footer} {
+		if _, err := template.New(name).Parse(text); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return l.validateWorkspaces()
+}
+
+// Render orders blocks and writes them out with the layout's decorations.
+func (l *Layout) Render(blocks []*Block, orderer BlockOrderer, filePath string, now time.Time) (string, error) {
+	if l == nil || l.separator() == "" && !l.DateHeaders && !l.BlockIDs && l.Header == "" && l.Footer == "" && !l.hasWorkspaces() {
+		return BlocksToMarkdown(blocks, orderer), nil
+	}
+
+	orderer.Order(blocks)
+
+	var body strings.Builder
+	writer := l.newBlockWriter(&sectionWriter{w: &body}, now)
+	for _, group := range l.groupByWorkspace(blocks) {
+		if group.workspace != "" {
+			if err := writer.StartSection(workspaceHeadingPrefix + group.workspace); err != nil {
+				return "", err
+			}
+		}
+		for _, block := range group.blocks {
+			if err := writer.WriteBlock(block, block.Content); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	header, footer, err := l.decorations(writer.count, filePath, now)
+	if err != nil {
+		return "", err
+	}
+
+	var rendered strings.Builder
+	sections := &sectionWriter{w: &rendered}
+	for _, section := range []string{header, body.String(), footer} {
+		if err := sections.Write(section); err != nil {
+			return "", err
+		}
+	}
+	return rendered.String(), nil
+}
+
+// decorations renders the header and footer templates for a file of count
+// blocks.
+func (l *Layout) decorations(count int, filePath string, now time.Time) (header, footer string, err error) {
+	if l == nil {
+		return "", "", nil
+	}
+	data := LayoutData{File: filepath.Base(filePath), Blocks: count, Date: now.Format("2006-01-02")}
+	if header, err = executeLayoutTemplate("header", l.Header, data); err != nil {
+		return "", "", err
+	}
+	if footer, err = executeLayoutTemplate("footer", l.Footer, data); err != nil {
+		return "", "", err
+	}
+	return header, footer, nil
+}
+
+// sectionWriter writes sections of a generated file separated by blank
+// lines, skipping empty ones.
+type sectionWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (sw *sectionWriter) Write(section string) error {
+	if section == "" {
+		return nil
+	}
+	if sw.started {
+		if _, err := io.WriteString(sw.w, "\n\n"); err != nil {
+			return err
+		}
+	}
+	sw.started = true
+	_, err := io.WriteString(sw.w, section)
+	return err
+}
+
+// finalNewlineWriter holds back trailing newlines so a streamed file ends
+// in exactly one once closed, as FileLayout.Wrap does.
+type finalNewlineWriter struct {
+	w     io.Writer
+	held  int
+	wrote bool
+}
+
+func (f *finalNewlineWriter) Write(p []byte) (int, error) {
+	trimmed := bytes.TrimRight(p, "\n")
+	if len(trimmed) == 0 {
+		f.held += len(p)
+		return len(p), nil
+	}
+	if f.held > 0 {
+		if _, err := io.WriteString(f.w, strings.Repeat("\n", f.held)); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := f.w.Write(trimmed); err != nil {
+		return 0, err
+	}
+	f.held = len(p) - len(trimmed)
+	f.wrote = true
+	return len(p), nil
+}
+
+func (f *finalNewlineWriter) Close() error {
+	if !f.wrote {
+		return nil
+	}
+	_, err := io.WriteString(f.w, "\n")
+	return err
+}
+
+// blockWriter lays out blocks one at a time, in the order they are given,
+// so a generated file can be streamed rather than built in memory.
+type blockWriter struct {
+	layout   *Layout
+	sections *sectionWriter
+	now      time.Time
+	count    int
+	section  string
+
+	// afterHeading is set when a heading was just written, so the next
+	// block needs no separator.
+	afterHeading bool
+}
+
+func (l *Layout) newBlockWriter(sections *sectionWriter, now time.Time) *blockWriter {
+	if l == nil {
+		l = &Layout{}
+	}
+	return &blockWriter{layout: l, sections: sections, now: now}
+}
+
+// WriteBlock writes content, block's content as it should appear in the
+// file, with any date header, separator and ID comment due. Empty blocks
+// are skipped.
+func (bw *blockWriter) WriteBlock(block *Block, content string) error {
+	if block.IsEmpty() {
+		return nil
+	}
+
+	startsSection := bw.afterHeading
+	bw.afterHeading = false
+	if bw.layout.DateHeaders {
+		if label := dateSection(block.UpdatedAt, bw.now); label != bw.section {
+			if err := bw.sections.Write("## " + label); err != nil {
+				return err
+			}
+			bw.section = label
+			startsSection = true
+		}
+	}
+	if separator := bw.layout.separator(); separator != "" && bw.count > 0 && !startsSection {
+		if err := bw.sections.Write(separator); err != nil {
+			return err
+		}
+	}
+
+	content = bw.layout.blockMarkdown(content)
+	if bw.layout.BlockIDs && block.ID != 0 {
+		content += fmt.Sprintf("\n<!-- notes:block %d -->", block.ID)
+	}
+	bw.count++
+	return bw.sections.Write(content)
+}
+
+// StartSection writes a heading such as a workspace's. Date headers start
+// over under it.
+func (bw *blockWriter) StartSection(heading string) error {
+	bw.section = ""
+	bw.afterHeading = true
+	return bw.sections.Write(heading)
+}
+
+// executeLayoutTemplate renders a header or footer template between the
+// generated-region markers. An empty template renders nothing.
+func executeLayoutTemplate(name, text string, data LayoutData) (string, error) {
+	if strings.TrimSpace(text) == "" {
+		return "", nil
+	}
+
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %s template: %w", name, err)
+	}
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("failed to render %s template: %w", name, err)
+	}
+
+	// Blank lines inside the markers are fine, but not at their edges
+	return GeneratedStartMarker + "\n" + strings.Trim(rendered.String(), "\n") + "\n" + GeneratedEndMarker, nil
+}
+
+// dateSection names the section a block last touched at t belongs in.
+// Weeks start on Monday.
+func dateSection(t, now time.Time) string {
+	t = t.In(now.Location())
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	thisWeek := startOfWeek(now)
+
+	switch {
+	case !t.Before(today):
+		return "Today"
+	case !t.Before(today.AddDate(0, 0, -1)):
+		return "Yesterday"
+	case !t.Before(thisWeek):
+		return "This week"
+	case !t.Before(thisWeek.AddDate(0, 0, -7)):
+		return "Last week"
+	case !t.Before(time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())):
+		return "This month"
+	default:
+		return "Earlier"
+	}
+}
+
+// IsDecoration reports whether a section of a file read back from disk was
+// written by the layout rather than being a block.
+func (l *Layout) IsDecoration(section string) bool {
+	if l == nil {
+		return false
+	}
+
+	section = strings.TrimSpace(section)
+	if l.Separator != "" && section == strings.TrimSpace(l.Separator) {
+		return true
+	}
+	if label, ok := strings.CutPrefix(section, "## "); ok && l.DateHeaders {
+		return slices.Contains(dateSectionLabels, label)
+	}
+	return false
+}
+
+// separator returns the line written between blocks.
+func (l *Layout) separator() string {
+	if l == nil {
+		return ""
+	}
+	if l.Separator == "" && l.DelimitersOnly {
+		return l.Delimiters[0]
+	}
+	return l.Separator
+}
+
+func (l *Layout) isDelimiter(line string) bool {
+	line = strings.TrimSpace(line)
+	for _, delimiter := range l.Delimiters {
+		if line == strings.TrimSpace(delimiter) {
+			return true
+		}
+	}
+	return false
+}
+
+// sectionSpans splits text read from a file into the sections blocks are
+// parsed from: runs of lines separated by blank lines or delimiter lines,
+// or with DelimitersOnly by delimiter lines alone.
+func (l *Layout) sectionSpans(text string) []textSection {
+	if l == nil {
+		return splitSections(text, false, nil)
+	}
+	return splitSections(text, l.DelimitersOnly, l.isDelimiter)
+}
+
+// sections splits text read from a file into the sections blocks and
+// decorations are made of.
+func (l *Layout) sections(text string) []string {
+	var sections []string
+	for _, span := range l.sectionSpans(text) {
+		sections = append(sections, span.Text)
+	}
+	return sections
+}
+
+// joinSections joins sections so that sections splits them apart again.
+func (l *Layout) joinSections(sections []string) string {
+	if l != nil && l.DelimitersOnly {
+		return strings.Join(sections, "\n"+l.Delimiters[0]+"\n")
+	}
+	return strings.Join(sections, "\n\n")
+}
+
+// ParseBlocks parses the blocks of a file's body, split as sections splits
+// it.
+func (l *Layout) ParseBlocks(content string) []*Block {
+	if l == nil {
+		return ParseBlocksFromMarkdown(content)
+	}
+	return parseSections(l.sectionSpans(content), !l.DelimitersOnly)
+}
+
+// blockMarkdown is content as it is written into a file with this layout:
+// with blank lines encoded unless only delimiters separate blocks.
+func (l *Layout) blockMarkdown(content string) string {
+	if l != nil && l.DelimitersOnly {
+		return content
+	}
+	return encodeBlankLines(content)
+}
+
+// sectionAt returns the section of content holding the 1-based line, and
+// the lines it spans. The section is empty when the line is between
+// sections or past the end.
+func (l *Layout) sectionAt(content string, line int) (section string, start, end int) {
+	for _, span := range l.sectionSpans(content) {
+		if span.Start <= line && line <= span.End {
+			return span.Text, span.Start, span.End
+		}
+	}
+	return "", 0, 0
+}
+
+// stripBlockIDs removes block ID comments from a section.
+func stripBlockIDs(section string) string {
+	if !strings.Contains(section, "<!-- notes:block ") {
+		return section
+	}
+	return strings.Trim(blockIDPattern.ReplaceAllString(section, ""), "\n")
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Defaults for the sanity limits on files notes reads. They are generous
+// for notes but stop an accidentally watched log file or binary from
+// turning into thousands of blocks.
+const (
+	DefaultMaxFileMB    = 50
+	DefaultMaxNewBlocks = 1000
+
+	DefaultMaxDeletes       = 100
+	DefaultMaxDeletePercent = 75
+
+	// deletePercentMinBlocks keeps the percentage guard from firing on small
+	// files, where removing a few blocks is a large share.
+	deletePercentMinBlocks = 10
+
+	// binarySniffBytes is how much of a file is checked for NUL bytes.
+	binarySniffBytes = 8000
+)
+
+// Limits bounds what a single file may contribute. Zero fields use the
+// defaults above.
+type Limits struct {
+	// MaxFileMB is the largest file, in megabytes, notes will read.
+	MaxFileMB int `json:"max_file_mb,omitempty"`
+
+	// MaxNewBlocks is the most blocks reconciling one watched file may
+	// create at once. Beyond it the file is left alone and an error raised.
+	MaxNewBlocks int `json:"max_new_blocks,omitempty"`
+
+	// MaxDeletes and MaxDeletePercent bound how many of a watched file's
+	// blocks one reconcile may remove, as a count and as a percentage of
+	// the blocks it held. Beyond either the reconcile is refused until
+	// `notes reconcile --force`.
+	MaxDeletes       int `json:"max_deletes,omitempty"`
+	MaxDeletePercent int `json:"max_delete_percent,omitempty"`
+}
+
+// ErrTooManyDeletions marks a reconcile refused by the deletion guard.
+var ErrTooManyDeletions = errors.New("too many deletions")
+
+var fileLimits Limits
+
+// SetFileLimits applies the configured limits to all files read from now
+// on. A nil limits restores the defaults.
+func SetFileLimits(limits *Limits) {
+	fileLimits = Limits{}
+	if limits != nil {
+		fileLimits = *limits
+	}
+}
+
+func (l Limits) validate() error {
+	if l.MaxFileMB < 0 {
+		return fmt.Errorf("max_file_mb must not be negative")
+	}
+	if l.MaxNewBlocks < 0 {
+		return fmt.Errorf("max_new_blocks must not be negative")
+	}
+	if l.MaxDeletes < 0 {
+		return fmt.Errorf("max_deletes must not be negative")
+	}
+	if l.MaxDeletePercent < 0 || l.MaxDeletePercent > 100 {
+		return fmt.Errorf("max_delete_percent must be between 0 and 100")
+	}
+	return nil
+}
+
+func (l Limits) maxFileBytes() int64 {
+	if l.MaxFileMB == 0 {
+		return DefaultMaxFileMB << 20
+	}
+	return int64(l.MaxFileMB) << 20
+}
+
+func (l Limits) maxNewBlocks() int {
+	if l.MaxNewBlocks == 0 {
+		return DefaultMaxNewBlocks
+	}
+	return l.MaxNewBlocks
+}
+
+func (l Limits) maxDeletes() int {
+	if l.MaxDeletes == 0 {
+		return DefaultMaxDeletes
+	}
+	return l.MaxDeletes
+}
+
+func (l Limits) maxDeletePercent() int {
+	if l.MaxDeletePercent == 0 {
+		return DefaultMaxDeletePercent
+	}
+	return l.MaxDeletePercent
+}
+
+// checkFileSize refuses files larger than the configured limit before they
+// are read into memory.
+func checkFileSize(filePath string, size int64) error {
+	if limit := fileLimits.maxFileBytes(); size > limit {
+		return fmt.Errorf("%s is %.1f MB, over the %d MB limit (raise limits.max_file_mb to read it)", filePath, float64(size)/(1<<20), limit>>20)
+	}
+	return nil
+}
+
+// checkTextContent refuses content that doesn't look like text, going by
+// NUL bytes near the start. Invalid UTF-8, such as a stray Latin-1 byte, is
+// left for readTextFile to repair.
+func checkTextContent(filePath string, content []byte) error {
+	if bytes.IndexByte(content[:min(len(content), binarySniffBytes)], 0) >= 0 {
+		return fmt.Errorf("%s looks like a binary file, not markdown", filePath)
+	}
+	return nil
+}
+
+// checkNewBlockCount refuses to create more blocks from one file than the
+// configured limit.
+func checkNewBlockCount(filePath string, count int) error {
+	if limit := fileLimits.maxNewBlocks(); count > limit {
+		return fmt.Errorf("%s would create %d new blocks, over the limit of %d; is it really a notes file? (raise limits.max_new_blocks if it is)", filePath, count, limit)
+	}
+	return nil
+}
+
+// checkDeletions refuses a reconcile that would remove count of the total
+// blocks a file held, when that looks more like a sync glitch or an app
+// truncating the file than an edit.
+func checkDeletions(filePath string, count, total int) error {
+	if limit := fileLimits.maxDeletes(); count > limit {
+		return fmt.Errorf("%w: %s would remove %d blocks, over the limit of %d; run `notes reconcile --force %s` if this was intended",
+			ErrTooManyDeletions, filePath, count, limit, filePath)
+	}
+	if limit := fileLimits.maxDeletePercent(); count >= deletePercentMinBlocks && count*100 > total*limit {
+		return fmt.Errorf("%w: %s would remove %d of its %d blocks, over the limit of %d%%; run `notes reconcile --force %s` if this was intended",
+			ErrTooManyDeletions, filePath, count, total, limit, filePath)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Ways a ((block-id)) reference is written into generated files.
+const (
+	// ReferencesLink writes a markdown link to the file holding the block,
+	// titled with its first line. It is the default.
+	ReferencesLink = "link"
+
+	// ReferencesTransclude writes the referenced block's content in place.
+	ReferencesTransclude = "transclude"
+
+	// ReferencesNone leaves references as written.
+	ReferencesNone = "none"
+)
+
+var referenceModes = []string{ReferencesLink, ReferencesTransclude, ReferencesNone}
+
+// blockRefPattern matches a reference to another block by ID or hash
+// prefix, as `notes cat` takes them, e.g. ((42)) or ((3f9a2c1b)).
+var blockRefPattern = regexp.MustCompile(`\(\(([0-9a-fA-F]+)\)\)`)
+
+// Rendered references are recognised by these when a file is read back and
+// collapsed to ((id)) again, so the referencing block is unchanged. Text
+// edited inside a transclusion is discarded with it.
+var (
+	renderedLinkPattern = regexp.MustCompile(`\[[^\]\n]*\]\([^)\s]*\s"\(\(([0-9a-fA-F]+)\)\)"\)`)
+	transclusionPattern = regexp.MustCompile(`(?s)<!-- notes:ref ([0-9a-fA-F]+) -->.*?<!-- /notes:ref -->`)
+)
+
+func isReferenceMode(mode string) bool {
+	return slices.Contains(referenceModes, mode)
+}
+
+// ExtractBlockRefs returns the identifiers content references, in order.
+func ExtractBlockRefs(content string) []string {
+	var refs []string
+	for _, match := range blockRefPattern.FindAllStringSubmatch(content, -1) {
+		refs = append(refs, match[1])
+	}
+	return refs
+}
+
+// resolveBlockRef returns the block identifier refers to, or nil if there
+// is none or it is ambiguous.
+func resolveBlockRef(db *Database, identifier string) (*Block, error) {
+	block, err := db.GetBlockByIDPrefix(identifier)
+	var ambiguous *AmbiguousIdentifierError
+	if errors.As(err, &ambiguous) {
+		return nil, nil
+	}
+	return block, err
+}
+
+// expandBlockRefs renders the references in markdown generated for
+// filePath according to mode. References to missing blocks, or to blocks
+// filter hides, are left as written. Transcluded content is inserted as is,
+// so references inside it are not expanded in turn.
+func expandBlockRefs(db *Database, config *Config, filter *VisibilityFilter, markdown, filePath, mode string) (string, error) {
+	if mode == ReferencesNone || !strings.Contains(markdown, "((") {
+		return markdown, nil
+	}
+
+	var expandErr error
+	expanded := blockRefPattern.ReplaceAllStringFunc(markdown, func(ref string) string {
+		identifier := blockRefPattern.FindStringSubmatch(ref)[1]
+		target, err := resolveBlockRef(db, identifier)
+		if err != nil {
+			expandErr = err
+		}
+		if target == nil || !filter.Allows(target) {
+			return ref
+		}
+
+		if mode == ReferencesTransclude {
+			return fmt.Sprintf("<!-- notes:ref %s -->%s<!-- /notes:ref -->", identifier, target.Content)
+		}
+
+		home, err := primaryBlockFile(db, config, target)
+		if err != nil {
+			expandErr = err
+			return ref
+		}
+		link, err := filepath.Rel(filepath.Dir(filePath), home)
+		if err != nil {
+			link = home
+		}
+		return fmt.Sprintf("[%s](%s \"((%s))\")", referenceTitle(target), filepath.ToSlash(link), identifier)
+	})
+	return expanded, expandErr
+}
+
+// referenceTitle is the link text for a reference to block: its first
+// line, without heading marks or brackets that would end the link early.
+func referenceTitle(block *Block) string {
+	title := strings.TrimSpace(strings.TrimLeft(block.FirstLine(), "# "))
+	return strings.NewReplacer("[", "", "]", "").Replace(title)
+}
+
+// collapseBlockRefs turns references rendered by expandBlockRefs back into
+// ((id)).
+func collapseBlockRefs(content string) string {
+	if !strings.Contains(content, "<!-- notes:ref ") && !strings.Contains(content, "\"((") {
+		return content
+	}
+	content = transclusionPattern.ReplaceAllString(content, "((${1}))")
+	return renderedLinkPattern.ReplaceAllString(content, "((${1}))")
+}
+
+// RebuildBlockLinks recomputes the link graph stored in block_links from
+// the references in every block.
+func RebuildBlockLinks(db *Database) error {
+	links := make(map[string][]string)
+	err := db.IterateBlocks(func(block *Block) error {
+		for _, identifier := range ExtractBlockRefs(block.Content) {
+			target, err := resolveBlockRef(db, identifier)
+			if err != nil {
+				return err
+			}
+			if target != nil {
+				links[block.ContentHash] = append(links[block.ContentHash], target.ContentHash)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return db.ReplaceBlockLinks(links)
+}
+
+// printLinkedBlocks prints the blocks with the given hashes, one line each.
+func printLinkedBlocks(heading string, hashes []string) {
+	fmt.Println(heading)
+	if len(hashes) == 0 {
+		fmt.Println("  (none)")
+		return
+	}
+	blocks, err := db.GetBlocksByHashes(hashes)
+	if err != nil {
+		log.Fatalf("Failed to get linked blocks: %v", err)
+	}
+	for _, hash := range hashes {
+		if block := blocks[hash]; block != nil {
+			fmt.Printf("  %d: %s\n", block.ID, block.FirstLine())
+		}
+	}
+}
+
+func handleLinks() {
+	fs := flag.NewFlagSet("links", flag.ExitOnError)
+	args := parseArgs(fs, os.Args[2:])
+
+	if len(args) != 1 {
+		fmt.Println("Error: links command requires one block ID or hash")
+		fmt.Println("Usage: notes links <id>")
+		os.Exit(1)
+	}
+
+	block, err := db.LookupBlock(args[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := RebuildBlockLinks(db); err != nil {
+		log.Fatalf("Failed to update block links: %v", err)
+	}
+	references, err := db.GetLinkedHashes(block.ContentHash)
+	if err != nil {
+		log.Fatalf("Failed to get block links: %v", err)
+	}
+	backlinks, err := db.GetBacklinkHashes(block.ContentHash)
+	if err != nil {
+		log.Fatalf("Failed to get block links: %v", err)
+	}
+
+	printLinkedBlocks("References:", references)
+	printLinkedBlocks("Referenced by:", backlinks)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of problems `notes lint` reports.
+const (
+	LintMissingReference    = "missing-reference"
+	LintStaleReference      = "stale-reference"
+	LintAmbiguousReference  = "ambiguous-reference"
+	LintEmptyTag            = "empty-tag"
+	LintMalformedAnnotation = "malformed-annotation"
+)
+
+var (
+	// emptyTagPattern matches a # standing alone after other text. A # at the
+	// start of a line is a markdown heading.
+	emptyTagPattern = regexp.MustCompile(`[ \t]#(?:[ \t]|$)`)
+
+	// unclosedAnnotationPattern matches an annotation whose parenthesis isn't
+	// closed on the same line, which the annotation patterns don't see.
+	unclosedAnnotationPattern = regexp.MustCompile(`(?m)@(?:due|remind|every)\([^)\n]*$`)
+)
+
+// LintIssue is a problem found in a block. Blocks linted from a file are
+// located by file and line, stored blocks by ID.
+type LintIssue struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	BlockID int    `json:"block_id,omitempty"`
+	Hash    string `json:"hash"`
+}
+
+func (i LintIssue) String() string {
+	location := fmt.Sprintf("block %d", i.BlockID)
+	if i.File != "" {
+		location = fmt.Sprintf("%s:%d", i.File, i.Line)
+	}
+	return fmt.Sprintf("%s: %s: %s", location, i.Kind, i.Message)
+}
+
+// formerBlock is a block that no longer exists: one that was deleted, or
+// an earlier version of block successor.
+type formerBlock struct {
+	ID        int
+	Hash      string
+	Successor int
+}
+
+// Linter checks blocks against the store: their references must resolve,
+// and references to blocks that are gone are told apart from ones that
+// never existed using the operations journal and the trash.
+type Linter struct {
+	db     *Database
+	former []formerBlock
+}
+
+func NewLinter(db *Database) (*Linter, error) {
+	l := &Linter{db: db}
+	operations, err := db.GetOperationsAfter(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	for _, operation := range operations {
+		for _, block := range operation.Changes.Deleted {
+			l.former = append(l.former, formerBlock{ID: block.ID, Hash: block.ContentHash})
+		}
+		for i, block := range operation.Changes.Updated {
+			if i < len(operation.Changes.Previous) {
+				l.former = append(l.former, formerBlock{Hash: operation.Changes.Previous[i].ContentHash, Successor: block.ID})
+			}
+		}
+	}
+
+	trashed, err := db.GetTrash(0, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range trashed {
+		l.former = append(l.former, formerBlock{Hash: block.ContentHash})
+	}
+	return l, nil
+}
+
+// formerTarget returns what a reference to a block that is gone referred
+// to, newest first, or nil if nothing known ever matched it.
+func (l *Linter) formerTarget(identifier string) *formerBlock {
+	identifier = strings.ToLower(identifier)
+	id, err := strconv.Atoi(identifier)
+	isID := err == nil
+	for i := len(l.former) - 1; i >= 0; i-- {
+		former := &l.former[i]
+		if isID && former.ID == id {
+			return former
+		}
+		if len(identifier) >= minHashPrefixLength && strings.HasPrefix(former.Hash, identifier) {
+			return former
+		}
+	}
+	return nil
+}
+
+// Lint returns the problems in block.
+func (l *Linter) Lint(block *Block) ([]LintIssue, error) {
+	var issues []LintIssue
+	report := func(kind, format string, args ...any) {
+		issues = append(issues, LintIssue{Kind: kind, Message: fmt.Sprintf(format, args...), BlockID: block.ID, Hash: block.ContentHash})
+	}
+
+	seen := make(map[string]bool)
+	for _, identifier := range ExtractBlockRefs(block.Content) {
+		if seen[identifier] {
+			continue
+		}
+		seen[identifier] = true
+
+		target, err := l.db.GetBlockByIDPrefix(identifier)
+		var ambiguous *AmbiguousIdentifierError
+		switch {
+		case errors.As(err, &ambiguous):
+			report(LintAmbiguousReference, "((%s)) matches %d blocks; use a longer hash or the ID", identifier, len(ambiguous.Candidates))
+		case err != nil:
+			return nil, err
+		case target != nil:
+		default:
+			former := l.formerTarget(identifier)
+			switch {
+			case former == nil:
+				report(LintMissingReference, "((%s)) refers to a block that doesn't exist", identifier)
+			case former.Successor != 0:
+				report(LintStaleReference, "((%s)) refers to an earlier version of block %d", identifier, former.Successor)
+			default:
+				report(LintStaleReference, "((%s)) refers to a deleted block", identifier)
+			}
+		}
+	}
+
+	if emptyTagPattern.MatchString(block.Content) {
+		report(LintEmptyTag, "# without a tag name")
+	}
+	for _, tag := range ExtractTags(block.Content) {
+		if strings.HasSuffix(tag, "/") || strings.Contains(tag, "//") {
+			report(LintEmptyTag, "#%s has an empty level", tag)
+		}
+	}
+
+	_, scheduleErrs := ParseScheduleItems(block)
+	for _, err := range scheduleErrs {
+		report(LintMalformedAnnotation, "%v", err)
+	}
+	for _, match := range recurrencePattern.FindAllStringSubmatch(block.Content, -1) {
+		if _, err := ParseRecurrence(match[1]); err != nil {
+			report(LintMalformedAnnotation, "%s: %v", match[0], err)
+		}
+	}
+	for _, match := range unclosedAnnotationPattern.FindAllString(block.Content, -1) {
+		report(LintMalformedAnnotation, "%s is missing its closing parenthesis", match)
+	}
+	return issues, nil
+}
+
+// LintStore lints every stored block.
+func (l *Linter) LintStore() ([]LintIssue, error) {
+	issues := []LintIssue{}
+	err := l.db.IterateBlocks(func(block *Block) error {
+		found, err := l.Lint(block)
+		issues = append(issues, found...)
+		return err
+	})
+	return issues, err
+}
+
+// LintFile lints the blocks of a markdown file as reconciling it would read
+// them, locating problems by the line each block starts on.
+func (l *Linter) LintFile(filePath string) ([]LintIssue, error) {
+	content, err := NewFileManager(filePath).ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	reconciler := NewReconciler(l.db, NewFileManager(filePath), config)
+
+	issues := []LintIssue{}
+	for _, section := range reconciler.settings.Layout.sectionSpans(content) {
+		for _, block := range reconciler.parseFileBlocks(section.Text) {
+			found, err := l.Lint(block)
+			if err != nil {
+				return nil, err
+			}
+			for _, issue := range found {
+				issue.File, issue.Line, issue.BlockID = filePath, section.Start, 0
+				issues = append(issues, issue)
+			}
+		}
+	}
+	return issues, nil
+}
+
+func handleLint() {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "print the problems as JSON")
+	files := parseArgs(fs, os.Args[2:])
+
+	linter, err := NewLinter(db)
+	if err != nil {
+		log.Fatalf("Failed to read the operations journal: %v", err)
+	}
+
+	var issues []LintIssue
+	if len(files) == 0 {
+		if issues, err = linter.LintStore(); err != nil {
+			log.Fatalf("Failed to lint blocks: %v", err)
+		}
+	}
+	for _, filePath := range files {
+		found, err := linter.LintFile(CanonicalPath(expandHome(filePath)))
+		if err != nil {
+			log.Fatalf("Failed to lint %s: %v", filePath, err)
+		}
+		// Report files as given, like compilers do, so hooks can match them
+		for _, issue := range found {
+			issue.File = filePath
+			issues = append(issues, issue)
+		}
+	}
+
+	if *jsonOutput {
+		if issues == nil {
+			issues = []LintIssue{}
+		}
+		printJSON(issues)
+	} else {
+		for _, issue := range issues {
+			fmt.Println(issue)
+		}
+		if len(issues) > 0 {
+			fmt.Printf("%d problem(s) found\n", len(issues))
+		}
+	}
+	if len(issues) > 0 {
+		os.Exit(1)
+	}
+}
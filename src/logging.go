@@ -0,0 +1,25 @@
+package main
+
+import "log"
+
+// Set by the global --quiet and --verbose options. Errors and warnings are
+// logged with log directly and always printed.
+var (
+	quietLogging   bool
+	verboseLogging bool
+)
+
+// infof logs a progress message, such as a regenerated file or a new
+// block. --quiet suppresses these.
+func infof(format string, args ...any) {
+	if !quietLogging {
+		log.Printf(format, args...)
+	}
+}
+
+// debugf logs detail that is only wanted with --verbose.
+func debugf(format string, args ...any) {
+	if verboseLogging {
+		log.Printf("debug: "+format, args...)
+	}
+}
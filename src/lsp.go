@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	lspMaxCompletions = 50
+
+	// LSP completion item and markup kinds.
+	lspKindReference = 18
+	lspKindKeyword   = 14
+	lspMarkdown      = "markdown"
+
+	// lspSyncFull asks clients to send whole documents on every change.
+	lspSyncFull = 1
+)
+
+var (
+	// Text before the cursor that completion answers: a #tag, or a block
+	// being picked by title after [[ or ((.
+	lspTagPrefix   = regexp.MustCompile(`(?:^|\s)#([\p{L}\p{N}_][\p{L}\p{N}_/\-]*)?$`)
+	lspBlockPrefix = regexp.MustCompile(`(\[\[|\(\()([^\[\]()]*)$`)
+
+	// transclusionStartPattern matches the start of a transcluded block.
+	transclusionStartPattern = regexp.MustCompile(`<!-- notes:ref ([0-9a-fA-F]+) -->`)
+)
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"` // in UTF-16 code units
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type lspCompletionItem struct {
+	Label         string       `json:"label"`
+	Kind          int          `json:"kind"`
+	Detail        string       `json:"detail,omitempty"`
+	Documentation any          `json:"documentation,omitempty"`
+	FilterText    string       `json:"filterText,omitempty"`
+	TextEdit      *lspTextEdit `json:"textEdit,omitempty"`
+}
+
+type lspMarkupContent struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+// lspDocumentPosition is the params of completion, hover and definition.
+type lspDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+// LSPServer gives editors tag and block completion, hover previews of
+// referenced blocks and go-to-definition for ((id)) references, speaking the
+// Language Server Protocol on stdin/stdout.
+type LSPServer struct {
+	db     *Database
+	config *Config
+
+	// documents holds the text of the documents the editor has open, which
+	// may differ from the files on disk.
+	documents map[string]string
+}
+
+func NewLSPServer(db *Database, config *Config) *LSPServer {
+	return &LSPServer{db: db, config: config, documents: make(map[string]string)}
+}
+
+// Serve answers messages until the client sends exit or closes stdin.
+func (s *LSPServer) Serve(in io.Reader, out io.Writer) error {
+	reader := bufio.NewReader(in)
+	for {
+		message, err := readLSPMessage(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var request rpcRequest
+		if err := json.Unmarshal(message, &request); err != nil {
+			if err := writeLSPMessage(out, &rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{rpcParseError, err.Error()}}); err != nil {
+				return err
+			}
+			continue
+		}
+		if request.Method == "exit" {
+			return nil
+		}
+
+		result, rpcErr := s.dispatch(request)
+		if len(request.ID) == 0 {
+			continue
+		}
+		response := &rpcResponse{JSONRPC: "2.0", ID: request.ID, Result: result, Error: rpcErr}
+		if rpcErr == nil && result == nil {
+			// LSP results are null rather than absent
+			response.Result = json.RawMessage("null")
+		}
+		if err := writeLSPMessage(out, response); err != nil {
+			return err
+		}
+	}
+}
+
+// readLSPMessage reads one message framed by a Content-Length header.
+func readLSPMessage(reader *bufio.Reader) ([]byte, error) {
+	header, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil {
+		if err == io.EOF || len(header) == 0 && err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("failed to read message header: %w", err)
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("invalid Content-Length %q", header.Get("Content-Length"))
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(reader, message); err != nil {
+		return nil, fmt.Errorf("failed to read message: %w", err)
+	}
+	return message, nil
+}
+
+func writeLSPMessage(out io.Writer, message any) error {
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+	if _, err := fmt.Fprintf(out, "Content-Length: %d\r\n\r\n%s", len(encoded), encoded); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	return nil
+}
+
+func (s *LSPServer) dispatch(request rpcRequest) (any, *rpcError) {
+	switch request.Method {
+	case "initialize":
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":   lspSyncFull,
+				"completionProvider": map[string]any{"triggerCharacters": []string{"#", "[", "("}},
+				"hoverProvider":      true,
+				"definitionProvider": true,
+			},
+			"serverInfo": map[string]any{"name": mcpServerName, "version": mcpServerVersion},
+		}, nil
+
+	case "initialized", "shutdown", "$/cancelRequest", "$/setTrace", "workspace/didChangeConfiguration", "textDocument/didSave":
+		return nil, nil
+
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		s.documents[params.TextDocument.URI] = params.TextDocument.Text
+		return nil, nil
+
+	case "textDocument/didChange":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		if n := len(params.ContentChanges); n > 0 {
+			s.documents[params.TextDocument.URI] = params.ContentChanges[n-1].Text
+		}
+		return nil, nil
+
+	case "textDocument/didClose":
+		var params lspDocumentPosition
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		delete(s.documents, params.TextDocument.URI)
+		return nil, nil
+
+	case "textDocument/completion", "textDocument/hover", "textDocument/definition":
+		var params lspDocumentPosition
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		line := s.line(params.TextDocument.URI, params.Position.Line)
+		cursor := utf16ToByteOffset(line, params.Position.Character)
+
+		var result any
+		var err error
+		switch request.Method {
+		case "textDocument/completion":
+			result, err = s.complete(line, cursor, params.Position)
+		case "textDocument/hover":
+			result, err = s.hover(line, cursor, params.Position.Line)
+		default:
+			result, err = s.definition(line, cursor)
+		}
+		if err != nil {
+			// Editors show errors from these requests in the way, so a
+			// failed lookup just answers nothing
+			log.Printf("Failed to answer %s: %v", request.Method, err)
+			return nil, nil
+		}
+		return result, nil
+
+	case "":
+		return nil, &rpcError{rpcInvalidRequest, "missing method"}
+
+	default:
+		return nil, &rpcError{rpcMethodNotFound, "method not found: " + request.Method}
+	}
+}
+
+// line returns line n of the document at uri, from the editor if it has the
+// document open and from disk otherwise.
+func (s *LSPServer) line(uri string, n int) string {
+	content, ok := s.documents[uri]
+	if !ok {
+		path, err := uriToPath(uri)
+		if err != nil {
+			return ""
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return ""
+		}
+		content = string(data)
+	}
+	lines := strings.Split(content, "\n")
+	if n < 0 || n >= len(lines) {
+		return ""
+	}
+	return strings.TrimSuffix(lines[n], "\r")
+}
+
+// complete offers tags after # and blocks by title after [[ or ((, which
+// are inserted as ((id)) references.
+func (s *LSPServer) complete(line string, cursor int, position lspPosition) (any, error) {
+	before := line[:cursor]
+	items := []lspCompletionItem{}
+
+	if match := lspTagPrefix.FindStringSubmatchIndex(before); match != nil {
+		prefix := ""
+		if match[2] >= 0 {
+			prefix = before[match[2]:match[3]]
+		}
+		blocks, err := s.db.GetAllBlocks()
+		if err != nil {
+			return nil, err
+		}
+		start := lspPosition{Line: position.Line, Character: position.Character - utf16Length(prefix)}
+		for _, tag := range countTags(blocks) {
+			if !strings.HasPrefix(strings.ToLower(tag.Tag), strings.ToLower(prefix)) {
+				continue
+			}
+			items = append(items, lspCompletionItem{
+				Label:    tag.Tag,
+				Kind:     lspKindKeyword,
+				Detail:   fmt.Sprintf("%d block(s)", tag.Blocks),
+				TextEdit: &lspTextEdit{Range: lspRange{Start: start, End: position}, NewText: tag.Tag},
+			})
+			if len(items) == lspMaxCompletions {
+				break
+			}
+		}
+		return map[string]any{"isIncomplete": len(items) == lspMaxCompletions, "items": items}, nil
+	}
+
+	match := lspBlockPrefix.FindStringSubmatch(before)
+	if match == nil {
+		return map[string]any{"isIncomplete": false, "items": items}, nil
+	}
+	opener, query := match[1], match[2]
+	// Replace the closing brackets an editor inserted along with the opening ones
+	end := position
+	closer := "]]"
+	if opener == "((" {
+		closer = "))"
+	}
+	if strings.HasPrefix(line[cursor:], closer) {
+		end.Character += 2
+	}
+	start := lspPosition{Line: position.Line, Character: position.Character - utf16Length(opener+query)}
+
+	blocks, err := s.db.GetAllBlocks()
+	if err != nil {
+		return nil, err
+	}
+	RecencyOrderer{}.Order(blocks)
+	query = strings.ToLower(strings.TrimSpace(query))
+	for _, block := range blocks {
+		title := block.Title()
+		if query != "" && !strings.Contains(strings.ToLower(title), query) && !strings.HasPrefix(strconv.Itoa(block.ID), query) {
+			continue
+		}
+		items = append(items, lspCompletionItem{
+			Label:         title,
+			Kind:          lspKindReference,
+			Detail:        fmt.Sprintf("#%d", block.ID),
+			Documentation: lspMarkupContent{Kind: lspMarkdown, Value: block.Content},
+			FilterText:    opener + title,
+			TextEdit:      &lspTextEdit{Range: lspRange{Start: start, End: end}, NewText: fmt.Sprintf("((%d))", block.ID)},
+		})
+		if len(items) == lspMaxCompletions {
+			break
+		}
+	}
+	return map[string]any{"isIncomplete": true, "items": items}, nil
+}
+
+// referenceAt returns the block referenced at byte offset cursor of line,
+// by ((id)) or the start of a transclusion, and the reference's span.
+func (s *LSPServer) referenceAt(line string, cursor int) (*Block, int, int, error) {
+	for _, pattern := range []*regexp.Regexp{blockRefPattern, transclusionStartPattern} {
+		for _, match := range pattern.FindAllStringSubmatchIndex(line, -1) {
+			if cursor < match[0] || cursor > match[1] {
+				continue
+			}
+			block, err := resolveBlockRef(s.db, line[match[2]:match[3]])
+			return block, match[0], match[1], err
+		}
+	}
+	return nil, 0, 0, nil
+}
+
+// hover previews the block referenced under the cursor.
+func (s *LSPServer) hover(line string, cursor, lineNumber int) (any, error) {
+	block, start, end, err := s.referenceAt(line, cursor)
+	if err != nil || block == nil {
+		return nil, err
+	}
+	return map[string]any{
+		"contents": lspMarkupContent{Kind: lspMarkdown, Value: fmt.Sprintf("%s\n\n---\n#%d, updated %s", block.Content, block.ID, output.Time(block.UpdatedAt, time.Now()))},
+		"range": lspRange{
+			Start: lspPosition{Line: lineNumber, Character: utf16Length(line[:start])},
+			End:   lspPosition{Line: lineNumber, Character: utf16Length(line[:end])},
+		},
+	}, nil
+}
+
+// definition locates the block referenced under the cursor in the file
+// `notes open` would open it in.
+func (s *LSPServer) definition(line string, cursor int) (any, error) {
+	block, _, _, err := s.referenceAt(line, cursor)
+	if err != nil || block == nil {
+		return nil, err
+	}
+	filePath, err := primaryBlockFile(s.db, s.config, block)
+	if err != nil {
+		return nil, err
+	}
+
+	content, ok := s.documents[pathToURI(filePath)]
+	if !ok {
+		if content, err = NewFileManager(filePath).ReadFile(filePath); err != nil {
+			return nil, err
+		}
+	}
+	position := lspPosition{}
+	if line := blockLine(content, block); line > 0 {
+		position.Line = line - 1
+	}
+	return lspLocation{URI: pathToURI(filePath), Range: lspRange{Start: position, End: position}}, nil
+}
+
+// utf16ToByteOffset converts a position in UTF-16 code units, as LSP
+// counts them, to a byte offset in line.
+func utf16ToByteOffset(line string, units int) int {
+	offset := 0
+	for offset < len(line) && units > 0 {
+		r, size := utf8.DecodeRuneInString(line[offset:])
+		units -= len(utf16.Encode([]rune{r}))
+		offset += size
+	}
+	return offset
+}
+
+func utf16Length(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+func uriToPath(uri string) (string, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme != "file" {
+		return "", fmt.Errorf("not a file URI: %s", uri)
+	}
+	path := parsed.Path
+	if runtime.GOOS == "windows" {
+		path = strings.TrimPrefix(path, "/")
+	}
+	return filepath.FromSlash(path), nil
+}
+
+func pathToURI(path string) string {
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
+
+func handleLSP() {
+	fs := flag.NewFlagSet("lsp", flag.ExitOnError)
+	// Editors commonly pass --stdio; it is the only transport
+	fs.Bool("stdio", true, "speak the protocol on stdin/stdout")
+	parseArgs(fs, os.Args[2:])
+
+	if err := NewLSPServer(db, config).Serve(os.Stdin, os.Stdout); err != nil {
+		log.Fatalf("Language server failed: %v", err)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// DefaultMailTag is added to blocks captured with `notes mail-ingest`.
+const DefaultMailTag = "email"
+
+// Metadata keys recording where a mailed block came from.
+const (
+	MetaMailFrom      = "mail_from"
+	MetaMailMessageID = "mail_message_id"
+)
+
+// maxMailPartDepth bounds how deeply nested multipart bodies are read.
+const maxMailPartDepth = 8
+
+// blankLinesPattern matches runs of blank lines, which mail bodies are
+// full of.
+var blankLinesPattern = regexp.MustCompile(`\n{3,}`)
+
+// MailConfig holds the settings of `notes mail-ingest`. AllowedSenders
+// lists the addresses, or @domains, whose mail is turned into blocks; mail
+// from anyone else is refused. Tag defaults to DefaultMailTag.
+type MailConfig struct {
+	AllowedSenders []string `json:"allowed_senders"`
+	Tag            string   `json:"tag,omitempty"`
+}
+
+func (c *MailConfig) validate() error {
+	for _, sender := range c.AllowedSenders {
+		if strings.HasPrefix(sender, "@") && len(sender) > 1 && !strings.Contains(sender[1:], "@") {
+			continue
+		}
+		if _, err := mail.ParseAddress(sender); err != nil {
+			return fmt.Errorf("allowed_senders: %q is neither an address nor an @domain", sender)
+		}
+	}
+	return nil
+}
+
+// allows reports whether mail from address is accepted.
+func (c *MailConfig) allows(address string) bool {
+	address = strings.ToLower(address)
+	for _, sender := range c.AllowedSenders {
+		sender = strings.ToLower(strings.TrimSpace(sender))
+		if address == sender || strings.HasPrefix(sender, "@") && strings.HasSuffix(address, sender) {
+			return true
+		}
+	}
+	return false
+}
+
+// MailMessage is the part of an e-mail that becomes a block.
+type MailMessage struct {
+	Subject     string
+	From        string // the sender's address alone
+	MessageID   string
+	Text        string
+	Attachments []MailAttachment
+
+	plain []string
+	html  []string
+}
+
+type MailAttachment struct {
+	Name string
+	Data []byte
+}
+
+// ParseMail reads an RFC 822 message. The body is taken from its text/plain
+// parts, or from its text/html parts when it has none; parts with a file
+// name, and parts that aren't text, are attachments.
+func ParseMail(r io.Reader) (*MailMessage, error) {
+	message, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message: %w", err)
+	}
+
+	decoder := &mime.WordDecoder{CharsetReader: charset.NewReaderLabel}
+	parsed := &MailMessage{MessageID: strings.Trim(message.Header.Get("Message-Id"), "<> ")}
+	if parsed.Subject, err = decoder.DecodeHeader(message.Header.Get("Subject")); err != nil {
+		parsed.Subject = message.Header.Get("Subject")
+	}
+	parsed.Subject = collapseWhitespace(parsed.Subject)
+
+	parser := &mail.AddressParser{WordDecoder: decoder}
+	from, err := parser.Parse(message.Header.Get("From"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sender: %w", err)
+	}
+	parsed.From = strings.ToLower(from.Address)
+
+	if err := parsed.readPart(textproto.MIMEHeader(message.Header), message.Body, 0); err != nil {
+		return nil, err
+	}
+	parsed.Text = mailBodyText(parsed.plain, parsed.html)
+	return parsed, nil
+}
+
+// readPart reads one part of the message body, descending into multipart
+// parts.
+func (m *MailMessage) readPart(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxMailPartDepth {
+			return fmt.Errorf("message parts are nested too deeply")
+		}
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read message part: %w", err)
+			}
+			if err := m.readPart(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	content, err := io.ReadAll(transferDecoder(header, body))
+	if err != nil {
+		return fmt.Errorf("failed to decode message part: %w", err)
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	name := dispositionParams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	isText := mediaType == "text/plain" || mediaType == "text/html"
+	if name != "" || disposition == "attachment" || !isText {
+		if len(content) > 0 {
+			m.Attachments = append(m.Attachments, MailAttachment{Name: attachmentName(name, mediaType, len(m.Attachments)), Data: content})
+		}
+		return nil
+	}
+
+	text := decodeCharset(content, params["charset"])
+	if mediaType == "text/html" {
+		m.html = append(m.html, text)
+	} else {
+		m.plain = append(m.plain, text)
+	}
+	return nil
+}
+
+// transferDecoder undoes the part's Content-Transfer-Encoding. Parts read
+// through multipart already have quoted-printable decoded.
+func transferDecoder(header textproto.MIMEHeader, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+// decodeCharset converts text in the named charset to UTF-8, leaving it as
+// it is if the charset is unknown.
+func decodeCharset(content []byte, name string) string {
+	if name == "" || strings.EqualFold(name, "utf-8") || strings.EqualFold(name, "us-ascii") {
+		return string(content)
+	}
+	reader, err := charset.NewReaderLabel(name, bytes.NewReader(content))
+	if err != nil {
+		return string(content)
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return string(content)
+	}
+	return string(decoded)
+}
+
+// attachmentName makes a safe file name for an attachment, naming unnamed
+// ones after their position and type.
+func attachmentName(name, mediaType string, index int) string {
+	name = strings.TrimSpace(filepath.Base(strings.ReplaceAll(name, `\`, "/")))
+	if name != "" && name != "." && name != "/" {
+		return name
+	}
+	name = fmt.Sprintf("attachment-%d", index+1)
+	if extensions, _ := mime.ExtensionsByType(mediaType); len(extensions) > 0 {
+		name += extensions[0]
+	}
+	return name
+}
+
+// mailBodyText joins the plain text parts of a body, or the paragraphs of
+// its HTML parts when there are none, dropping the signature and runs of
+// blank lines.
+func mailBodyText(plain, htmlParts []string) string {
+	text := strings.Join(plain, "\n\n")
+	if len(plain) == 0 {
+		var paragraphs []string
+		for _, part := range htmlParts {
+			if doc, err := html.Parse(strings.NewReader(part)); err == nil {
+				paragraphs = append(paragraphs, collectParagraphs(doc)...)
+			}
+		}
+		text = strings.Join(paragraphs, "\n\n")
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		// "-- " on its own line starts the signature
+		if line == "-- " {
+			break
+		}
+		lines = append(lines, strings.TrimRight(line, " \t"))
+	}
+	return strings.TrimSpace(blankLinesPattern.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+// mailContent renders message as a block: the subject as its first line,
+// then the body, links to the attachments and #tag.
+func mailContent(message *MailMessage, attachments []*Attachment, tag string) string {
+	var lines []string
+	if message.Subject != "" {
+		lines = append(lines, message.Subject)
+	}
+	if message.Text != "" {
+		lines = append(lines, message.Text)
+	}
+	for _, attachment := range attachments {
+		lines = append(lines, attachment.MarkdownLink())
+	}
+
+	content := strings.Join(lines, "\n")
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "#")
+	if content != "" && tag != "" && !NewBlock(content).HasTag(tag) {
+		content += "\n#" + tag
+	}
+	return normalizeWhitespace(content)
+}
+
+func handleMailIngest() {
+	fs := flag.NewFlagSet("mail-ingest", flag.ExitOnError)
+	tag := fs.String("tag", "", "tag to append to the captured block (default mail.tag, or \""+DefaultMailTag+"\")")
+	parseArgs(fs, os.Args[2:])
+
+	if remote != nil {
+		fmt.Println("Error: mail-ingest stores attachments, which the remote server doesn't accept; run it on the server's repository")
+		os.Exit(1)
+	}
+	if config.Mail == nil || len(config.Mail.AllowedSenders) == 0 {
+		fmt.Println("Error: set mail.allowed_senders in .notes/config.json to the addresses mail may be captured from")
+		os.Exit(1)
+	}
+	if *tag == "" {
+		*tag = config.Mail.Tag
+	}
+	if *tag == "" {
+		*tag = DefaultMailTag
+	}
+
+	limit := fileLimits.maxFileBytes()
+	raw, err := io.ReadAll(io.LimitReader(os.Stdin, limit+1))
+	if err != nil {
+		log.Fatalf("Failed to read from stdin: %v", err)
+	}
+	if int64(len(raw)) > limit {
+		fmt.Printf("Error: message is over the %d MB limit (raise limits.max_file_mb to capture it)\n", limit>>20)
+		os.Exit(1)
+	}
+
+	message, err := ParseMail(bytes.NewReader(raw))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	// The From header is only as trustworthy as the mail server that
+	// delivered the message, which should check SPF and DKIM
+	if !config.Mail.allows(message.From) {
+		fmt.Printf("Error: %s is not in mail.allowed_senders\n", message.From)
+		os.Exit(1)
+	}
+	if message.Subject == "" && message.Text == "" && len(message.Attachments) == 0 {
+		fmt.Println("Error: message is empty")
+		os.Exit(1)
+	}
+
+	var attachments []*Attachment
+	for _, mailed := range message.Attachments {
+		attachment, err := storeAttachment(config.AssetsDir(), mailed.Name, bytes.NewReader(mailed.Data))
+		if err != nil {
+			log.Fatalf("Failed to store attachment: %v", err)
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	block := NewBlock(mailContent(message, attachments, *tag))
+	if _, err := newMainReconciler().AddBlocks([]*Block{block}); err != nil {
+		log.Fatalf("Failed to add note: %v", err)
+	}
+	for _, attachment := range attachments {
+		attachment.BlockHash = block.ContentHash
+		if err := db.AddAttachment(attachment); err != nil {
+			log.Fatalf("Failed to record attachment: %v", err)
+		}
+	}
+	meta := map[string]string{MetaMailFrom: message.From, MetaMailMessageID: message.MessageID}
+	for _, key := range sortedKeys(meta) {
+		if err := db.SetBlockMeta(block.ContentHash, key, meta[key]); err != nil {
+			log.Fatalf("Failed to set metadata: %v", err)
+		}
+	}
+	fmt.Printf("Captured mail from %s: %s\n", message.From, block.FirstLine())
+}
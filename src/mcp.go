@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	mcpProtocolVersion = "2024-11-05"
+	mcpServerName      = "gravitynotes"
+	mcpServerVersion   = "0.1.0"
+	mcpDefaultLimit    = 20
+
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type mcpTool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema map[string]any `json:"inputSchema"`
+}
+
+type mcpContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type mcpToolResult struct {
+	Content []mcpContent `json:"content"`
+	IsError bool         `json:"isError,omitempty"`
+}
+
+var mcpTools = []mcpTool{
+	{
+		Name:        "search_blocks",
+		Description: "Search note blocks. Matches blocks containing any of the terms and none of the excluded terms, most recently touched first.",
+		InputSchema: objectSchema(map[string]any{
+			"terms":   arraySchema("Terms to match (any of them)"),
+			"exclude": arraySchema("Terms that must not appear"),
+			"limit":   map[string]any{"type": "integer", "description": "Maximum number of blocks to return"},
+		}),
+	},
+	{
+		Name:        "add_block",
+		Description: "Add a note block. It goes to the top of the notes; identical content is deduplicated.",
+		InputSchema: objectSchema(map[string]any{
+			"content": map[string]any{"type": "string", "description": "Markdown content of the block"},
+		}, "content"),
+	},
+	{
+		Name:        "get_block",
+		Description: "Get a single block by numeric ID, content hash, unique hash prefix or title (its first line).",
+		InputSchema: objectSchema(map[string]any{
+			"id": map[string]any{"type": "string", "description": "Block ID, content hash, hash prefix or title prefix"},
+		}, "id"),
+	},
+	{
+		Name:        "list_recent",
+		Description: "List the most recently touched blocks, optionally only those with a tag.",
+		InputSchema: objectSchema(map[string]any{
+			"limit": map[string]any{"type": "integer", "description": "Maximum number of blocks to return"},
+			"tag":   map[string]any{"type": "string", "description": "Only blocks with this tag or one nested under it, without the #"},
+		}),
+	},
+	{
+		Name:        "list_tags",
+		Description: "List the tags in use with the number of blocks carrying each, most used first.",
+		InputSchema: objectSchema(map[string]any{}),
+	},
+}
+
+func objectSchema(properties map[string]any, required ...string) map[string]any {
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func arraySchema(description string) map[string]any {
+	return map[string]any{"type": "array", "items": map[string]any{"type": "string"}, "description": description}
+}
+
+// MCPServer exposes the notes store to LLM assistants over the Model Context
+// Protocol, speaking newline-delimited JSON-RPC on stdin/stdout.
+type MCPServer struct {
+	db         *Database
+	reconciler *Reconciler
+
+	// audience limits the blocks returned to those visible to it, see
+	// visibility.go. Empty means all blocks.
+	audience string
+}
+
+func NewMCPServer(db *Database, reconciler *Reconciler) *MCPServer {
+	return &MCPServer{db: db, reconciler: reconciler}
+}
+
+func (s *MCPServer) Serve(in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	encoder := json.NewEncoder(out)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		response := s.handleMessage([]byte(line))
+		if response == nil {
+			continue
+		}
+		if err := encoder.Encode(response); err != nil {
+			return fmt.Errorf("failed to write response: %w", err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// handleMessage processes one JSON-RPC message. Notifications get no response.
+func (s *MCPServer) handleMessage(message []byte) *rpcResponse {
+	var request rpcRequest
+	if err := json.Unmarshal(message, &request); err != nil {
+		return &rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{rpcParseError, err.Error()}}
+	}
+
+	isNotification := len(request.ID) == 0
+	result, rpcErr := s.dispatch(request)
+	if isNotification {
+		return nil
+	}
+
+	response := &rpcResponse{JSONRPC: "2.0", ID: request.ID}
+	if rpcErr != nil {
+		response.Error = rpcErr
+	} else {
+		response.Result = result
+	}
+	return response
+}
+
+func (s *MCPServer) dispatch(request rpcRequest) (any, *rpcError) {
+	switch request.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		json.Unmarshal(request.Params, &params)
+
+		version := params.ProtocolVersion
+		if version == "" {
+			version = mcpProtocolVersion
+		}
+		return map[string]any{
+			"protocolVersion": version,
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]any{"name": mcpServerName, "version": mcpServerVersion},
+		}, nil
+
+	case "notifications/initialized", "notifications/cancelled":
+		return nil, nil
+
+	case "ping":
+		return map[string]any{}, nil
+
+	case "tools/list":
+		return map[string]any{"tools": mcpTools}, nil
+
+	case "tools/call":
+		var params struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		if len(params.Arguments) == 0 {
+			params.Arguments = json.RawMessage("{}")
+		}
+
+		text, err := s.callTool(params.Name, params.Arguments)
+		if err != nil {
+			return mcpToolResult{Content: []mcpContent{{Type: "text", Text: err.Error()}}, IsError: true}, nil
+		}
+		return mcpToolResult{Content: []mcpContent{{Type: "text", Text: text}}}, nil
+
+	case "":
+		return nil, &rpcError{rpcInvalidRequest, "missing method"}
+
+	default:
+		return nil, &rpcError{rpcMethodNotFound, "method not found: " + request.Method}
+	}
+}
+
+func (s *MCPServer) callTool(name string, arguments json.RawMessage) (string, error) {
+	switch name {
+	case "search_blocks":
+		var args struct {
+			Terms   []string `json:"terms"`
+			Exclude []string `json:"exclude"`
+			Limit   int      `json:"limit"`
+		}
+		if err := json.Unmarshal(arguments, &args); err != nil {
+			return "", fmt.Errorf("invalid arguments: %w", err)
+		}
+		blocks, err := s.db.SearchBlocks(args.Terms, args.Exclude)
+		if err != nil {
+			return "", err
+		}
+		if blocks, err = s.visibleBlocks(blocks); err != nil {
+			return "", err
+		}
+		return formatBlocksJSON(limitBlocks(blocks, args.Limit))
+
+	case "add_block":
+		var args struct {
+			Content string `json:"content"`
+		}
+		if err := json.Unmarshal(arguments, &args); err != nil {
+			return "", fmt.Errorf("invalid arguments: %w", err)
+		}
+		block := NewBlock(args.Content)
+		if block.IsEmpty() {
+			return "", fmt.Errorf("content cannot be empty")
+		}
+		if _, err := s.reconciler.AddBlocks([]*Block{block}); err != nil {
+			return "", err
+		}
+		stored, err := s.db.GetBlockByHash(block.ContentHash)
+		if err != nil {
+			return "", err
+		}
+		return formatBlocksJSON([]*Block{stored})
+
+	case "get_block":
+		var args struct {
+			ID json.RawMessage `json:"id"`
+		}
+		if err := json.Unmarshal(arguments, &args); err != nil {
+			return "", fmt.Errorf("invalid arguments: %w", err)
+		}
+		identifier := strings.Trim(string(args.ID), `"`)
+		block, err := s.db.LookupBlock(identifier)
+		var ambiguous *AmbiguousIdentifierError
+		if errors.As(err, &ambiguous) {
+			// Blocks outside the audience mustn't show up among the candidates
+			if ambiguous.Candidates, err = s.visibleBlocks(ambiguous.Candidates); err != nil {
+				return "", err
+			}
+			switch len(ambiguous.Candidates) {
+			case 0:
+				return "", fmt.Errorf("no block found for %q", identifier)
+			case 1:
+				block = ambiguous.Candidates[0]
+			default:
+				return "", ambiguous
+			}
+		} else if err != nil {
+			return "", err
+		}
+		visible, err := s.visibleBlocks([]*Block{block})
+		if err != nil {
+			return "", err
+		}
+		if len(visible) == 0 {
+			return "", fmt.Errorf("no block found for %q", identifier)
+		}
+		return formatBlocksJSON(visible)
+
+	case "list_recent":
+		var args struct {
+			Limit int    `json:"limit"`
+			Tag   string `json:"tag"`
+		}
+		if err := json.Unmarshal(arguments, &args); err != nil {
+			return "", fmt.Errorf("invalid arguments: %w", err)
+		}
+		blocks, err := s.db.GetAllBlocks()
+		if err != nil {
+			return "", err
+		}
+		if blocks, err = s.visibleBlocks(blocks); err != nil {
+			return "", err
+		}
+		if tag := strings.TrimPrefix(args.Tag, "#"); tag != "" {
+			var tagged []*Block
+			for _, block := range blocks {
+				if hasTagOrChild(block, tag) {
+					tagged = append(tagged, block)
+				}
+			}
+			blocks = tagged
+		}
+		RecencyOrderer{}.Order(blocks)
+		if args.Limit <= 0 {
+			args.Limit = mcpDefaultLimit
+		}
+		return formatBlocksJSON(limitBlocks(blocks, args.Limit))
+
+	case "list_tags":
+		blocks, err := s.db.GetAllBlocks()
+		if err != nil {
+			return "", err
+		}
+		if blocks, err = s.visibleBlocks(blocks); err != nil {
+			return "", err
+		}
+		encoded, err := json.MarshalIndent(countTags(blocks), "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("failed to encode tags: %w", err)
+		}
+		return string(encoded), nil
+
+	default:
+		return "", fmt.Errorf("unknown tool: %s", name)
+	}
+}
+
+// visibleBlocks drops the blocks the server's audience may not see.
+func (s *MCPServer) visibleBlocks(blocks []*Block) ([]*Block, error) {
+	if s.audience == "" {
+		return blocks, nil
+	}
+	filter, err := LoadVisibilityFilter(s.db, config, s.audience)
+	if err != nil {
+		return nil, err
+	}
+	return filter.Filter(blocks), nil
+}
+
+func limitBlocks(blocks []*Block, limit int) []*Block {
+	if limit > 0 && len(blocks) > limit {
+		return blocks[:limit]
+	}
+	return blocks
+}
+
+func formatBlocksJSON(blocks []*Block) (string, error) {
+	if blocks == nil {
+		blocks = []*Block{}
+	}
+	encoded, err := json.MarshalIndent(blocks, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode blocks: %w", err)
+	}
+	return string(encoded), nil
+}
+
+func handleMCP() {
+	fs := flag.NewFlagSet("mcp", flag.ExitOnError)
+	audience := fs.String("audience", VisibilityPrivate, "only expose blocks visible to this level: private (all), shared or public")
+	parseArgs(fs, os.Args[2:])
+	db.audit.SetSource(AuditSourceAPI)
+
+	if !isVisibilityLevel(*audience) {
+		fmt.Printf("Error: unknown audience %q (available: %s)\n", *audience, strings.Join(visibilityLevels, ", "))
+		os.Exit(1)
+	}
+
+	server := NewMCPServer(db, newMainReconciler())
+	server.audience = *audience
+	if err := server.Serve(os.Stdin, os.Stdout); err != nil {
+		log.Fatalf("MCP server failed: %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// mentionPattern matches @mentions of people. Like a tag, a mention starts
+// at the beginning of the content or after whitespace or an opening
+// bracket, so e-mail addresses aren't mistaken for mentions. The second
+// group catches the parenthesis of annotations such as @due(...), which are
+// not mentions.
+var mentionPattern = regexp.MustCompile(`(?:^|[\s(\[])@([\p{L}\p{N}_][\p{L}\p{N}_\-]*)(\()?`)
+
+// ExtractMentions returns the distinct people mentioned in content, lower
+// case and without the leading '@', in order of first appearance.
+func ExtractMentions(content string) []string {
+	var mentions []string
+	seen := make(map[string]bool)
+
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		name := strings.ToLower(match[1])
+		if match[2] != "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		mentions = append(mentions, name)
+	}
+	return mentions
+}
+
+// Mentions reports whether the block mentions person.
+func (b *Block) Mentions(person string) bool {
+	person = strings.ToLower(strings.TrimPrefix(person, "@"))
+	for _, name := range ExtractMentions(b.Content) {
+		if name == person {
+			return true
+		}
+	}
+	return false
+}
+
+// PersonCount is how often a person is mentioned, for `notes people`.
+type PersonCount struct {
+	Name          string    `json:"name"`
+	Blocks        int       `json:"blocks"`
+	LastMentioned time.Time `json:"last_mentioned"`
+}
+
+// countPeople returns everyone mentioned in blocks with the number of
+// blocks mentioning them, most mentioned first.
+func countPeople(blocks []*Block) []PersonCount {
+	people := make(map[string]*PersonCount)
+	for _, block := range blocks {
+		for _, name := range ExtractMentions(block.Content) {
+			person := people[name]
+			if person == nil {
+				person = &PersonCount{Name: name}
+				people[name] = person
+			}
+			person.Blocks++
+			if block.UpdatedAt.After(person.LastMentioned) {
+				person.LastMentioned = block.UpdatedAt
+			}
+		}
+	}
+
+	counts := []PersonCount{}
+	for _, person := range people {
+		counts = append(counts, *person)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Blocks != counts[j].Blocks {
+			return counts[i].Blocks > counts[j].Blocks
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	return counts
+}
+
+// GetMentioningBlocks returns the blocks created within timeRange that
+// mention person, most recently updated first.
+func GetMentioningBlocks(db *Database, person string, timeRange TimeRange) ([]*Block, error) {
+	blocks := []*Block{}
+	err := db.IterateBlocks(func(block *Block) error {
+		if timeRange.Contains(block.CreatedAt) && block.Mentions(person) {
+			blocks = append(blocks, block)
+		}
+		return nil
+	})
+	sort.SliceStable(blocks, func(i, j int) bool { return blocks[i].UpdatedAt.After(blocks[j].UpdatedAt) })
+	return blocks, err
+}
+
+func handleMentions() {
+	fs := flag.NewFlagSet("mentions", flag.ExitOnError)
+	full := fs.Bool("full", false, "print whole blocks rather than their first line")
+	jsonOutput := fs.Bool("json", false, "print the blocks as JSON")
+	parseTimeRange := timeRangeFlags(fs)
+	args := parseArgs(fs, os.Args[2:])
+
+	if len(args) != 1 || strings.TrimPrefix(args[0], "@") == "" {
+		fmt.Println("Error: mentions command requires a person")
+		fmt.Println("Usage: notes mentions [--full] [--json] [--since t] [--until t] <person>")
+		os.Exit(1)
+	}
+
+	now := time.Now()
+	timeRange, err := parseTimeRange(now)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	blocks, err := GetMentioningBlocks(db, args[0], timeRange)
+	if err != nil {
+		log.Fatalf("Failed to get blocks: %v", err)
+	}
+
+	if *jsonOutput {
+		printJSON(blocks)
+		return
+	}
+	if len(blocks) == 0 {
+		fmt.Printf("No blocks mention @%s\n", strings.ToLower(strings.TrimPrefix(args[0], "@")))
+		return
+	}
+	for i, block := range blocks {
+		if !*full {
+			fmt.Printf("%s  %s  %s\n", output.ID(block.ID, 5), output.Style("timestamp", fmt.Sprintf("%-8s", output.Time(block.UpdatedAt, now))), block.Title())
+			continue
+		}
+		if i > 0 {
+			fmt.Println(output.Separator())
+		}
+		fmt.Printf("%s\n%s\n", output.Style("timestamp", fmt.Sprintf("#%d, %s", block.ID, output.FullTime(block.UpdatedAt, now))), block.Content)
+	}
+}
+
+func handlePeople() {
+	fs := flag.NewFlagSet("people", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "print the people as JSON")
+	parseArgs(fs, os.Args[2:])
+
+	blocks, err := db.GetAllBlocks()
+	if err != nil {
+		log.Fatalf("Failed to get blocks: %v", err)
+	}
+	people := countPeople(blocks)
+
+	if *jsonOutput {
+		printJSON(people)
+		return
+	}
+	if len(people) == 0 {
+		fmt.Println("No one is mentioned yet; mention people in blocks as @name")
+		return
+	}
+	now := time.Now()
+	for _, person := range people {
+		fmt.Printf("  %4d  %-20s  last %s\n", person.Blocks, "@"+person.Name, relativeTime(person.LastMentioned, now))
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"strings"
+)
+
+const (
+	conflictFileMarker = "<<<<<<< file"
+	conflictSeparator  = "======="
+	conflictDBMarker   = ">>>>>>> notes.db"
+
+	// conflictSimilarity is the minimum word overlap for an edited block to
+	// count as a version of a snapshot block.
+	conflictSimilarity = 0.3
+)
+
+// Conflict is a snapshot block that was edited differently in the file and in
+// the database since the file was last generated.
+type Conflict struct {
+	Base *Block
+	File *Block
+	DB   *Block
+}
+
+// Content renders the conflict as a single block with git-style markers, so
+// both versions survive until the user resolves it by editing the file.
+func (c Conflict) Content() string {
+	return strings.Join([]string{
+		conflictFileMarker,
+		c.File.Content,
+		conflictSeparator,
+		c.DB.Content,
+		conflictDBMarker,
+	}, "\n")
+}
+
+// MergeResult is the outcome of merging a file with the database.
+type MergeResult struct {
+	// Keep holds file blocks that should exist and be associated with the file.
+	Keep []*Block
+	// Delete holds hashes of blocks the user removed from the file.
+	Delete []string
+	// Conflicts holds blocks edited on both sides.
+	Conflicts []Conflict
+}
+
+// ThreeWayMerge compares the blocks currently in a file with the blocks the
+// database associates with it, using the last generated snapshot of the file
+// as the common ancestor:
+//
+//   - a block in the file but not the snapshot was added by the user
+//   - a block in the snapshot but not the file was removed by the user
+//   - a block in the database but not the snapshot was added elsewhere (CLI)
+//   - a block in the snapshot but not the database was removed elsewhere
+//
+// A snapshot block that disappeared from both sides while each side gained a
+// similar block is reported as a conflict instead of keeping both silently.
+func ThreeWayMerge(snapshot, file, database []*Block) MergeResult {
+	inSnapshot := blockSet(snapshot)
+	inFile := blockSet(file)
+	inDB := blockSet(database)
+
+	var fileAdded, dbAdded []*Block
+	for _, block := range file {
+		if !inSnapshot[block.ContentHash] && !inDB[block.ContentHash] {
+			fileAdded = append(fileAdded, block)
+		}
+	}
+	for _, block := range database {
+		if !inSnapshot[block.ContentHash] && !inFile[block.ContentHash] {
+			dbAdded = append(dbAdded, block)
+		}
+	}
+
+	var result MergeResult
+	inConflict := make(map[string]bool)
+	for _, base := range snapshot {
+		if inFile[base.ContentHash] || inDB[base.ContentHash] {
+			continue
+		}
+
+		fileVersion := mostSimilarBlock(base, fileAdded, inConflict)
+		dbVersion := mostSimilarBlock(base, dbAdded, inConflict)
+		if fileVersion == nil || dbVersion == nil {
+			continue
+		}
+
+		inConflict[fileVersion.ContentHash] = true
+		inConflict[dbVersion.ContentHash] = true
+		result.Conflicts = append(result.Conflicts, Conflict{Base: base, File: fileVersion, DB: dbVersion})
+	}
+
+	for _, block := range file {
+		if inConflict[block.ContentHash] {
+			continue
+		}
+		// Removed from the database since the file was generated
+		if inSnapshot[block.ContentHash] && !inDB[block.ContentHash] {
+			continue
+		}
+		result.Keep = append(result.Keep, block)
+	}
+
+	for _, block := range database {
+		if inFile[block.ContentHash] || inConflict[block.ContentHash] {
+			continue
+		}
+		// Only blocks the file has already seen can have been removed from it
+		if inSnapshot[block.ContentHash] {
+			result.Delete = append(result.Delete, block.ContentHash)
+		}
+	}
+
+	return result
+}
+
+func blockSet(blocks []*Block) map[string]bool {
+	set := make(map[string]bool, len(blocks))
+	for _, block := range blocks {
+		set[block.ContentHash] = true
+	}
+	return set
+}
+
+func mostSimilarBlock(base *Block, candidates []*Block, taken map[string]bool) *Block {
+	var best *Block
+	bestScore := conflictSimilarity
+	for _, candidate := range candidates {
+		if taken[candidate.ContentHash] {
+			continue
+		}
+		if score := wordSimilarity(base.Content, candidate.Content); score >= bestScore {
+			best, bestScore = candidate, score
+		}
+	}
+	return best
+}
+
+// wordSimilarity is the Jaccard index of the words of a and b.
+func wordSimilarity(a, b string) float64 {
+	wordsA := make(map[string]bool)
+	for _, word := range strings.Fields(a) {
+		wordsA[word] = true
+	}
+	wordsB := make(map[string]bool)
+	for _, word := range strings.Fields(b) {
+		wordsB[word] = true
+	}
+
+	shared := 0
+	for word := range wordsA {
+		if wordsB[word] {
+			shared++
+		}
+	}
+
+	union := len(wordsA) + len(wordsB) - shared
+	if union == 0 {
+		return 0
+	}
+	return float64(shared) / float64(union)
+}
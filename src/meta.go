@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// metaKeyPattern matches the keys metadata may be set under, such as
+// "project" or "source_url". Keys are stored lower case.
+var metaKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+// MetaFilter is a key:value search term, matching blocks whose metadata has
+// key set to value, or excluding them.
+type MetaFilter struct {
+	Key     string
+	Value   string
+	Exclude bool
+}
+
+// parseMetaFilter reads term as key:value, reporting whether it has that
+// form.
+func parseMetaFilter(term string, exclude bool) (MetaFilter, bool) {
+	key, value, ok := strings.Cut(term, ":")
+	key = strings.ToLower(key)
+	if !ok || value == "" || !metaKeyPattern.MatchString(key) {
+		return MetaFilter{}, false
+	}
+	return MetaFilter{Key: key, Value: value, Exclude: exclude}, true
+}
+
+func isMetaTerm(term string) bool {
+	_, ok := parseMetaFilter(term, false)
+	return ok
+}
+
+// parseMetaAssignment reads a key=value argument to `notes meta set`.
+func parseMetaAssignment(arg string) (key, value string, err error) {
+	key, value, ok := strings.Cut(arg, "=")
+	key = strings.ToLower(strings.TrimSpace(key))
+	value = strings.TrimSpace(value)
+	if !ok || value == "" {
+		return "", "", fmt.Errorf("%q is not key=value", arg)
+	}
+	if !metaKeyPattern.MatchString(key) {
+		return "", "", fmt.Errorf("%q is not a valid key (use letters, digits, - and _)", key)
+	}
+	return key, value, nil
+}
+
+// printBlockMeta prints the metadata on block, one key per line.
+func printBlockMeta(block *Block) {
+	meta, err := db.GetBlockMeta(block.ContentHash)
+	if err != nil {
+		log.Fatalf("Failed to get block metadata: %v", err)
+	}
+	if len(meta) == 0 {
+		fmt.Printf("%s: no metadata\n", block.FirstLine())
+		return
+	}
+	fmt.Printf("%s:\n", block.FirstLine())
+	for _, key := range sortedKeys(meta) {
+		fmt.Printf("  %s=%s\n", key, meta[key])
+	}
+}
+
+func handleMeta() {
+	fs := flag.NewFlagSet("meta", flag.ExitOnError)
+	args := parseArgs(fs, os.Args[2:])
+
+	usage := func() {
+		fmt.Println("Usage: notes meta <id>")
+		fmt.Println("       notes meta set <id> key=value...")
+		fmt.Println("       notes meta unset <id> key...")
+		fmt.Println("       notes meta keys")
+		os.Exit(1)
+	}
+
+	if len(args) == 1 && args[0] == "keys" {
+		keys, err := db.GetMetaKeys()
+		if err != nil {
+			log.Fatalf("Failed to get metadata keys: %v", err)
+		}
+		for _, key := range keys {
+			fmt.Println(key)
+		}
+		return
+	}
+
+	subcommand := ""
+	if len(args) > 0 && (args[0] == "set" || args[0] == "unset") {
+		subcommand, args = args[0], args[1:]
+	}
+	if len(args) == 0 || (subcommand == "" && len(args) != 1) || (subcommand != "" && len(args) < 2) {
+		fmt.Println("Error: meta command requires a block ID, and keys to set or unset")
+		usage()
+	}
+
+	block, err := db.LookupBlock(args[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if subcommand != "" {
+		requireWritable("notes meta " + subcommand)
+	}
+
+	switch subcommand {
+	case "set":
+		// Check every assignment before storing any of them
+		values := make(map[string]string)
+		for _, arg := range args[1:] {
+			key, value, err := parseMetaAssignment(arg)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			values[key] = value
+		}
+		for key, value := range values {
+			if err := db.SetBlockMeta(block.ContentHash, key, value); err != nil {
+				log.Fatalf("Failed to set metadata: %v", err)
+			}
+		}
+	case "unset":
+		for _, key := range args[1:] {
+			if err := db.SetBlockMeta(block.ContentHash, strings.ToLower(key), ""); err != nil {
+				log.Fatalf("Failed to unset metadata: %v", err)
+			}
+		}
+	}
+
+	printBlockMeta(block)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WatcherMetricsKey holds the watcher daemon's metrics as JSON in the
+// metadata table. The daemon writes them after every reconcile and on its
+// reminder tick; `notes status` and the /metrics endpoint of `notes serve`
+// read them from there.
+const WatcherMetricsKey = "watcher_metrics"
+
+// WatcherMetrics counts what the watcher daemon has done since it started.
+// Per-file times carry over from the previous run, so a file that has been
+// failing across restarts still shows when it last reconciled.
+type WatcherMetrics struct {
+	StartedAt          time.Time               `json:"started_at"`
+	UpdatedAt          time.Time               `json:"updated_at"`
+	Events             int64                   `json:"events"`
+	Reconciles         int64                   `json:"reconciles"`
+	ReconcileErrors    int64                   `json:"reconcile_errors"`
+	Errors             int64                   `json:"errors"`
+	DebounceSuppressed int64                   `json:"debounce_suppressed"`
+	Files              map[string]*FileMetrics `json:"files"`
+}
+
+// FileMetrics records the outcome of the latest reconciles of one file.
+type FileMetrics struct {
+	LastSuccess time.Time `json:"last_success"`
+	LastError   time.Time `json:"last_error"`
+}
+
+// Failing reports whether the file's latest reconcile failed.
+func (f *FileMetrics) Failing() bool {
+	return f.LastError.After(f.LastSuccess)
+}
+
+// watcherMetrics is the daemon's live copy of its metrics, updated from the
+// event, timer and worker goroutines.
+type watcherMetrics struct {
+	mu      sync.Mutex
+	metrics WatcherMetrics
+	dirty   bool
+}
+
+// newWatcherMetrics starts a run's metrics, keeping the per-file times of
+// previous.
+func newWatcherMetrics(previous *WatcherMetrics, now time.Time) *watcherMetrics {
+	files := make(map[string]*FileMetrics)
+	if previous != nil {
+		for filePath, file := range previous.Files {
+			files[filePath] = file
+		}
+	}
+	return &watcherMetrics{metrics: WatcherMetrics{StartedAt: now, Files: files}, dirty: true}
+}
+
+func (m *watcherMetrics) update(fn func(*WatcherMetrics)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fn(&m.metrics)
+	m.dirty = true
+}
+
+func (m *watcherMetrics) file(filePath string) *FileMetrics {
+	if m.metrics.Files[filePath] == nil {
+		m.metrics.Files[filePath] = &FileMetrics{}
+	}
+	return m.metrics.Files[filePath]
+}
+
+// recordReconcile counts a reconcile of filePath and its outcome.
+func (m *watcherMetrics) recordReconcile(filePath string, err error, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metrics.Reconciles++
+	if err != nil {
+		m.metrics.ReconcileErrors++
+		m.file(filePath).LastError = now
+	} else {
+		m.file(filePath).LastSuccess = now
+	}
+	m.dirty = true
+}
+
+// save writes the metrics to the database if they changed, or regardless
+// when heartbeat is set so readers can tell the daemon is alive.
+func (m *watcherMetrics) save(db *Database, now time.Time, heartbeat bool) error {
+	m.mu.Lock()
+	if !m.dirty && !heartbeat {
+		m.mu.Unlock()
+		return nil
+	}
+	m.metrics.UpdatedAt = now
+	encoded, err := json.Marshal(m.metrics)
+	m.dirty = false
+	m.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("failed to encode watcher metrics: %w", err)
+	}
+	return db.SetMetadata(WatcherMetricsKey, string(encoded))
+}
+
+// LoadWatcherMetrics returns the metrics the daemon last saved, or nil if it
+// never has.
+func LoadWatcherMetrics(db *Database) (*WatcherMetrics, error) {
+	encoded, err := db.GetMetadata(WatcherMetricsKey)
+	if err != nil || encoded == "" {
+		return nil, err
+	}
+	var metrics WatcherMetrics
+	if err := json.Unmarshal([]byte(encoded), &metrics); err != nil {
+		return nil, fmt.Errorf("failed to parse watcher metrics: %w", err)
+	}
+	return &metrics, nil
+}
+
+// printWatcherMetrics prints the metrics section of `notes status`.
+func printWatcherMetrics(metrics *WatcherMetrics, now time.Time) {
+	fmt.Printf("\nDaemon metrics (since %s, saved %s ago):\n",
+		metrics.StartedAt.Local().Format("2006-01-02 15:04:05"), formatAge(now.Sub(metrics.UpdatedAt)))
+	fmt.Printf("  %d events, %d debounced, %d reconciles (%d failed), %d errors\n",
+		metrics.Events, metrics.DebounceSuppressed, metrics.Reconciles, metrics.ReconcileErrors, metrics.Errors)
+	for _, filePath := range sortedKeys(metrics.Files) {
+		file := metrics.Files[filePath]
+		lastSuccess := "never"
+		if !file.LastSuccess.IsZero() {
+			lastSuccess = formatAge(now.Sub(file.LastSuccess)) + " ago"
+		}
+		state := "ok"
+		if file.Failing() {
+			state = "failing"
+		}
+		fmt.Printf("  %-7s  last success %-10s  %s\n", state, lastSuccess, filePath)
+	}
+}
+
+// writePrometheusMetrics writes the daemon's metrics in the Prometheus text
+// format.
+func writePrometheusMetrics(w io.Writer, metrics *WatcherMetrics, running bool, blocks int) {
+	metric := func(name, kind, help string, value any) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+
+	up := 0
+	if running {
+		up = 1
+	}
+	metric("notes_watcher_up", "gauge", "Whether the watcher daemon is running.", up)
+	metric("notes_blocks", "gauge", "Number of blocks in the store.", blocks)
+	if metrics == nil {
+		return
+	}
+
+	metric("notes_watcher_start_time_seconds", "gauge", "When the watcher daemon started.", metrics.StartedAt.Unix())
+	metric("notes_watcher_metrics_updated_timestamp_seconds", "gauge", "When the watcher daemon last saved its metrics.", metrics.UpdatedAt.Unix())
+	metric("notes_watcher_events_total", "counter", "File change events handled.", metrics.Events)
+	metric("notes_watcher_debounce_suppressed_total", "counter", "Changes folded into a pending reconcile.", metrics.DebounceSuppressed)
+	metric("notes_watcher_reconciles_total", "counter", "Watched file reconciles run.", metrics.Reconciles)
+	metric("notes_watcher_reconcile_errors_total", "counter", "Watched file reconciles that failed.", metrics.ReconcileErrors)
+	metric("notes_watcher_errors_total", "counter", "Errors recorded by the daemon.", metrics.Errors)
+
+	labels := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for _, series := range []struct {
+		name, help string
+		value      func(*FileMetrics) time.Time
+	}{
+		{"notes_watcher_file_last_success_timestamp_seconds", "When a watched file last reconciled successfully.", func(f *FileMetrics) time.Time { return f.LastSuccess }},
+		{"notes_watcher_file_last_error_timestamp_seconds", "When reconciling a watched file last failed.", func(f *FileMetrics) time.Time { return f.LastError }},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", series.name, series.help, series.name)
+		for _, filePath := range sortedKeys(metrics.Files) {
+			if t := series.value(metrics.Files[filePath]); !t.IsZero() {
+				fmt.Fprintf(w, "%s{file=\"%s\"} %d\n", series.name, labels.Replace(filePath), t.Unix())
+			}
+		}
+	}
+}
+
+// metricsHandler serves /metrics for `notes serve --metrics`. Scrapers send
+// GET requests, with the same bearer token as other clients.
+type metricsHandler struct {
+	auth *Authenticator
+}
+
+func (h metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.auth.Request(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	metrics, err := LoadWatcherMetrics(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blocks, err := db.CountBlocks()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, running := daemonPID(config.PIDFile())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writePrometheusMetrics(w, metrics, running, blocks)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// MirrorFiles returns the absolute paths of the files configured as mirrors.
+func (c *Config) MirrorFiles() []string {
+	var paths []string
+	for key, fileConfig := range c.Files {
+		if !fileConfig.Mirror {
+			continue
+		}
+		paths = append(paths, c.resolvePath(key))
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// mirrorBlocks returns the blocks of a mirror file: every block but those
+// local to a watched file, or only those with the file's tag, in the file's
+// order, cut to its limit.
+func (r *Reconciler) mirrorBlocks(orderer BlockOrderer) ([]*Block, error) {
+	blocks, err := r.db.GetGlobalBlocks()
+	if err != nil {
+		return nil, err
+	}
+
+	if tag := r.settings.Tag; tag != "" {
+		tagged := blocks[:0]
+		for _, block := range blocks {
+			if hasTagOrChild(block, tag) {
+				tagged = append(tagged, block)
+			}
+		}
+		blocks = tagged
+	}
+
+	orderer.Order(blocks)
+	if r.settings.Limit > 0 && len(blocks) > r.settings.Limit {
+		blocks = blocks[:r.settings.Limit]
+	}
+	return blocks, nil
+}
+
+// regenerateMirrors rewrites every mirror file from the database. Mirrors
+// whose directory doesn't exist, such as an unmounted sync folder, are
+// skipped.
+func regenerateMirrors(db *Database, config *Config) error {
+	for _, path := range config.MirrorFiles() {
+		if _, err := os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+			continue
+		}
+		if err := NewReconciler(db, NewFileManager(path), config).RegenerateSpecificFile(); err != nil {
+			return fmt.Errorf("failed to regenerate mirror %s: %w", path, err)
+		}
+	}
+	return nil
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,37 +16,160 @@ import (
 type MultiFileWatcher struct {
 	watcher             *fsnotify.Watcher
 	db                  *Database
+	config              *Config
 	respondToFileChange map[string]bool
 	stopCh              chan bool
 	mu                  sync.RWMutex
 	IsRunning           bool // Made public
 	debounceTimers      map[string]*time.Timer
+	debounceStates      map[string]*debounceState
 	reconcilers         map[string]*Reconciler
+	pollInterval        time.Duration        // polls instead of using fsnotify when > 0
+	fileStates          map[string]fileState // last seen state of each file in polling mode
+	polled              map[string]bool      // files polled because fsnotify can't watch them
+	missing             map[string]bool      // deleted files waiting to be recreated
+	confirmedEmpty      map[string]bool      // empty files whose truncation grace period has passed
+	failures            map[string]int       // consecutive failed reconciles of each file
+	notifier            *Notifier
+	metrics             *watcherMetrics
+
+	// Reconciliations and regenerations all run on one worker goroutine, in
+	// the order they were queued, so they never race on the database or on
+	// the files. queued holds the files with a reconcile job in jobs.
+	jobs   chan watcherJob
+	queued map[string]bool
+	done   chan struct{} // closed by Stop
 }
 
-func NewMultiFileWatcher(db *Database) (*MultiFileWatcher, error) {
+// watcherJob is a unit of work for the watcher's worker. file is set for
+// reconcile jobs so a file is queued at most once.
+type watcherJob struct {
+	file string
+	run  func()
+}
+
+const (
+	// recreateGracePeriod is how long a deleted watched file is actively
+	// checked for re-creation, as sync tools and editors that save by
+	// renaming do. Later re-creation is still picked up by SyncWithDatabase.
+	recreateGracePeriod = 30 * time.Second
+	recreateCheckPeriod = 250 * time.Millisecond
+
+	// truncationGracePeriod is how long a watched file that became empty is
+	// given to be rewritten before its blocks are treated as deleted.
+	truncationGracePeriod = 2 * time.Second
+
+	jobQueueSize = 64
+
+	// DefaultDebounce is how long a watched file has to stay unchanged
+	// before it is reconciled, unless configured otherwise.
+	DefaultDebounce = 200 * time.Millisecond
+
+	// DefaultMaxDebounce bounds how far the debounce backs off for a file
+	// that keeps changing.
+	DefaultMaxDebounce = 5 * time.Second
+
+	// fallbackPollInterval is how often files fsnotify can't watch are
+	// polled when the rest use fsnotify.
+	fallbackPollInterval = 2 * time.Second
+
+	// quarantineAfter is how many reconciles of a file have to fail in a
+	// row before the daemon stops reconciling it.
+	quarantineAfter = 5
+)
+
+// debounceState tracks how often a watched file changes, to back off from
+// files another program writes continuously.
+type debounceState struct {
+	window        time.Duration // current debounce window
+	pendingSince  time.Time     // first change not yet reconciled
+	lastReconcile time.Time
+}
+
+// fileState is what polling mode compares to detect changes. The content hash
+// is only computed when size or mtime differ.
+type fileState struct {
+	modTime time.Time
+	size    int64
+	hash    string
+}
+
+func NewMultiFileWatcher(db *Database, config *Config) (*MultiFileWatcher, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create file watcher: %w", err)
 	}
 
+	previous, err := LoadWatcherMetrics(db)
+	if err != nil {
+		log.Printf("Failed to load previous watcher metrics: %v", err)
+	}
+
 	return &MultiFileWatcher{
 		watcher:             watcher,
 		db:                  db,
+		config:              config,
 		respondToFileChange: make(map[string]bool),
 		stopCh:              make(chan bool),
 		debounceTimers:      make(map[string]*time.Timer),
+		debounceStates:      make(map[string]*debounceState),
 		reconcilers:         make(map[string]*Reconciler),
+		fileStates:          make(map[string]fileState),
+		polled:              make(map[string]bool),
+		missing:             make(map[string]bool),
+		confirmedEmpty:      make(map[string]bool),
+		failures:            make(map[string]int),
+		notifier:            NewNotifier(config.NotifyEvents()),
+		metrics:             newWatcherMetrics(previous, time.Now()),
+		jobs:                make(chan watcherJob, jobQueueSize),
+		queued:              make(map[string]bool),
+		done:                make(chan struct{}),
 	}, nil
 }
 
-func (mfw *MultiFileWatcher) AddFile(filePath string) error {
+// EnablePolling makes the watcher stat watched files every interval instead
+// of relying on fsnotify, for filesystems where change events never arrive
+// (NFS, SSHFS, some container volumes). Must be called before Start.
+func (mfw *MultiFileWatcher) EnablePolling(interval time.Duration) {
+	mfw.pollInterval = interval
+}
 
-	// Resolve to absolute path
-	absPath, err := ResolveAbsolutePath(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to resolve file path: %w", err)
+// polling reports whether filePath is polled rather than watched through
+// fsnotify. Callers must hold mfw.mu.
+func (mfw *MultiFileWatcher) polling(filePath string) bool {
+	return mfw.pollInterval > 0 || mfw.polled[filePath]
+}
+
+// watchFile adds filePath to fsnotify, or polls it if it is on a network
+// share or fsnotify refuses it. Callers must hold mfw.mu.
+func (mfw *MultiFileWatcher) watchFile(filePath string) {
+	if mfw.polling(filePath) {
+		return
+	}
+	if isNetworkPath(filePath) {
+		infof("Polling %s every %s, as it is on a network share", filePath, fallbackPollInterval)
+		mfw.polled[filePath] = true
+		return
+	}
+	if err := mfw.watcher.Add(filePath); err != nil {
+		log.Printf("Can't watch %s for changes (%v); polling it every %s instead", filePath, err, fallbackPollInterval)
+		mfw.polled[filePath] = true
 	}
+}
+
+// unwatchFile removes filePath from fsnotify if it was added there.
+// Callers must hold mfw.mu.
+func (mfw *MultiFileWatcher) unwatchFile(filePath string) {
+	if !mfw.polling(filePath) {
+		if err := mfw.watcher.Remove(filePath); err != nil {
+			log.Printf("Warning: failed to remove file from watcher: %s: %v", filePath, err)
+		}
+	}
+	delete(mfw.polled, filePath)
+}
+
+func (mfw *MultiFileWatcher) AddFile(filePath string) error {
+	absPath := CanonicalPath(filePath)
 
 	// Check if file exists
 	if !fileExists(absPath) {
@@ -54,22 +181,29 @@ func (mfw *MultiFileWatcher) AddFile(filePath string) error {
 		return fmt.Errorf("failed to add watched file to database: %w", err)
 	}
 
-	// Add to fsnotify watcher
-	if err := mfw.watcher.Add(absPath); err != nil {
-		return fmt.Errorf("failed to add file to watcher: %w", err)
-	}
+	mfw.watchFile(absPath)
 
 	newFileManager := NewFileManager(absPath)
-	newReconciler := NewReconciler(mfw.db, newFileManager)
+	newReconciler := NewReconciler(mfw.db, newFileManager, mfw.config)
+	newReconciler.backupBeforeDeleting = true
 
 	mfw.reconcilers[absPath] = newReconciler
 	mfw.respondToFileChange[absPath] = true
 
-	log.Printf("Started watching file: %s", absPath)
+	infof("Started watching file: %s", absPath)
 
 	// Perform initial reconciliation
-	if err := mfw.reconcilers[absPath].ReconcileFromSpecificFile(); err != nil {
+	if mfw.quarantined(absPath) {
+		log.Printf("Not reconciling %s: it is quarantined; run `notes reconcile %s` once it is fixed", absPath, absPath)
+	} else if changes, err := mfw.reconcilers[absPath].ReconcileFromSpecificFile(); err != nil {
 		log.Printf("Failed initial reconciliation for %s: %v", absPath, err)
+		mfw.recordError(absPath, err)
+	} else {
+		mfw.notifyChanges(changes)
+	}
+
+	if mfw.polling(absPath) {
+		mfw.recordFileState(absPath)
 	}
 
 	return nil
@@ -79,16 +213,8 @@ func (mfw *MultiFileWatcher) RemoveFile(filePath string) error {
 	mfw.mu.Lock()
 	defer mfw.mu.Unlock()
 
-	// Resolve to absolute path
-	absPath, err := ResolveAbsolutePath(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to resolve file path: %w", err)
-	}
-
-	// Remove from fsnotify watcher
-	if err := mfw.watcher.Remove(absPath); err != nil {
-		log.Printf("Warning: failed to remove file from watcher: %v", err)
-	}
+	absPath := CanonicalPath(filePath)
+	mfw.unwatchFile(absPath)
 
 	// Remove from database (this will cascade delete file_blocks)
 	if err := mfw.db.RemoveWatchedFile(absPath); err != nil {
@@ -97,6 +223,11 @@ func (mfw *MultiFileWatcher) RemoveFile(filePath string) error {
 
 	delete(mfw.respondToFileChange, absPath)
 	delete(mfw.reconcilers, absPath)
+	delete(mfw.fileStates, absPath)
+	delete(mfw.missing, absPath)
+	delete(mfw.confirmedEmpty, absPath)
+	delete(mfw.debounceStates, absPath)
+	delete(mfw.failures, absPath)
 
 	// Clean up debounce timer if exists
 	if timer, exists := mfw.debounceTimers[absPath]; exists {
@@ -104,7 +235,7 @@ func (mfw *MultiFileWatcher) RemoveFile(filePath string) error {
 		delete(mfw.debounceTimers, absPath)
 	}
 
-	log.Printf("Stopped watching file: %s", absPath)
+	infof("Stopped watching file: %s", absPath)
 	return nil
 }
 
@@ -117,6 +248,10 @@ func (mfw *MultiFileWatcher) Start() error {
 	mfw.mu.Lock()
 	defer mfw.mu.Unlock()
 
+	if err := CanonicalizeWatchedFiles(mfw.db); err != nil {
+		return err
+	}
+
 	// Load existing watched files from database
 	watchedFiles, err := mfw.db.GetWatchedFiles()
 	if err != nil {
@@ -129,7 +264,12 @@ func (mfw *MultiFileWatcher) Start() error {
 	}
 
 	mfw.IsRunning = true
-	go mfw.watchLoop()
+	go mfw.runJobs()
+	if mfw.pollInterval > 0 {
+		go mfw.pollLoop()
+	} else {
+		go mfw.watchLoop()
+	}
 	return nil
 }
 
@@ -141,7 +281,10 @@ func (mfw *MultiFileWatcher) Stop() error {
 		return nil
 	}
 
-	mfw.stopCh <- true
+	// Closed rather than sent on: the loops may be waiting for mfw.mu, which
+	// is held here
+	close(mfw.stopCh)
+	close(mfw.done)
 	mfw.IsRunning = false
 
 	// Stop all debounce timers
@@ -153,12 +296,62 @@ func (mfw *MultiFileWatcher) Stop() error {
 	if err := mfw.watcher.Close(); err != nil {
 		return fmt.Errorf("failed to close file watcher: %w", err)
 	}
+	mfw.saveMetrics(false)
 
 	log.Println("Multi-file watcher stopped")
 	return nil
 }
 
+// Submit queues run on the watcher's worker, after any reconciliations
+// already queued. It is dropped if the watcher stops first.
+func (mfw *MultiFileWatcher) Submit(run func()) {
+	select {
+	case mfw.jobs <- watcherJob{run: run}:
+	case <-mfw.done:
+	}
+}
+
+// queueChange queues filePath for reconciliation unless it already is. A
+// change arriving while the file is being reconciled queues it again.
+func (mfw *MultiFileWatcher) queueChange(filePath string) {
+	mfw.mu.Lock()
+	if mfw.queued[filePath] {
+		mfw.mu.Unlock()
+		mfw.metrics.update(func(m *WatcherMetrics) { m.DebounceSuppressed++ })
+		return
+	}
+	mfw.queued[filePath] = true
+	mfw.mu.Unlock()
+
+	select {
+	case mfw.jobs <- watcherJob{file: filePath, run: func() { mfw.processChange(filePath) }}:
+	case <-mfw.done:
+	}
+}
+
+// runJobs runs queued jobs one at a time until the watcher stops.
+func (mfw *MultiFileWatcher) runJobs() {
+	for {
+		select {
+		case job := <-mfw.jobs:
+			if job.file != "" {
+				mfw.mu.Lock()
+				delete(mfw.queued, job.file)
+				mfw.mu.Unlock()
+			}
+			job.run()
+
+		case <-mfw.done:
+			return
+		}
+	}
+}
+
 func (mfw *MultiFileWatcher) watchLoop() {
+	// Files fsnotify couldn't watch are polled alongside
+	fallbackPoll := time.NewTicker(fallbackPollInterval)
+	defer fallbackPoll.Stop()
+
 	for {
 		select {
 		case event, ok := <-mfw.watcher.Events:
@@ -176,7 +369,18 @@ func (mfw *MultiFileWatcher) watchLoop() {
 				log.Println("File watcher errors channel closed")
 				return
 			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// Events were dropped, as ReadDirectoryChangesW does when its
+				// buffer fills, so any watched file may have changed
+				log.Printf("File watcher missed events; reconciling all watched files")
+				mfw.reconcileAll()
+				continue
+			}
 			log.Printf("File watcher error: %v", err)
+			mfw.recordError("", err)
+
+		case <-fallbackPoll.C:
+			mfw.pollFiles()
 
 		case <-mfw.stopCh:
 			log.Println("Multi-file watcher stop signal received")
@@ -185,41 +389,194 @@ func (mfw *MultiFileWatcher) watchLoop() {
 	}
 }
 
-func (mfw *MultiFileWatcher) shouldProcessEvent(event fsnotify.Event) bool {
+func (mfw *MultiFileWatcher) pollLoop() {
+	ticker := time.NewTicker(mfw.pollInterval)
+	defer ticker.Stop()
+
+	infof("Polling watched files every %s", mfw.pollInterval)
+	for {
+		select {
+		case <-ticker.C:
+			mfw.pollFiles()
+
+		case <-mfw.stopCh:
+			log.Println("Multi-file watcher stop signal received")
+			return
+		}
+	}
+}
+
+// reconcileAll schedules reconciliation of every watched file that exists.
+func (mfw *MultiFileWatcher) reconcileAll() {
+	mfw.mu.RLock()
+	var filePaths []string
+	for filePath := range mfw.reconcilers {
+		if !mfw.missing[filePath] {
+			filePaths = append(filePaths, filePath)
+		}
+	}
+	mfw.mu.RUnlock()
+
+	for _, filePath := range filePaths {
+		mfw.debounceEvent(filePath)
+	}
+}
+
+// pollFiles checks every polled file for changes since the last poll and
+// schedules reconciliation for those that changed.
+func (mfw *MultiFileWatcher) pollFiles() {
 	mfw.mu.Lock()
-	defer mfw.mu.Unlock()
+	var changed, deleted []string
+	for filePath := range mfw.reconcilers {
+		if mfw.missing[filePath] || !mfw.polling(filePath) {
+			continue
+		}
+		info, err := os.Stat(filePath)
+		if os.IsNotExist(err) {
+			deleted = append(deleted, filePath)
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to stat %s: %v", filePath, err)
+			continue
+		}
+
+		previous := mfw.fileStates[filePath]
+		if info.ModTime().Equal(previous.modTime) && info.Size() == previous.size {
+			continue
+		}
+
+		current, err := readFileState(filePath)
+		if err != nil {
+			log.Printf("Failed to read %s: %v", filePath, err)
+			continue
+		}
+		mfw.fileStates[filePath] = current
+
+		if current.hash != previous.hash {
+			infof("File change detected: %s", filePath)
+			changed = append(changed, filePath)
+		}
+	}
+	mfw.mu.Unlock()
+
+	for _, filePath := range deleted {
+		infof("Watched file deleted: %s", filePath)
+		mfw.mu.Lock()
+		mfw.detachFile(filePath)
+		mfw.mu.Unlock()
+	}
+
+	for _, filePath := range changed {
+		mfw.debounceEvent(filePath)
+	}
+}
+
+// recordError stores err in the database so `notes status` can report it,
+// and raises a desktop notification.
+func (mfw *MultiFileWatcher) recordError(filePath string, err error) {
+	mfw.metrics.update(func(m *WatcherMetrics) { m.Errors++ })
+	if recordErr := mfw.db.RecordWatcherError(filePath, err); recordErr != nil {
+		log.Printf("Failed to record error: %v", recordErr)
+	}
 
-	absPath, err := ResolveAbsolutePath(event.Name)
+	title := "notes: watcher error"
+	if filePath != "" {
+		title = "notes: error in " + filepath.Base(filePath)
+	}
+	mfw.notifier.Notify(NotifyErrors, title, err.Error())
+}
 
+// notifyChanges raises desktop notifications for conflicts and new blocks
+// picked up from a watched file.
+func (mfw *MultiFileWatcher) notifyChanges(changes *ChangeSet) {
+	name := filepath.Base(changes.File)
+	conflicts := make(map[string]bool)
+	for _, block := range changes.Conflicts {
+		conflicts[block.ContentHash] = true
+	}
+	if len(conflicts) > 0 {
+		mfw.notifier.Notify(NotifyConflicts, "notes: conflict in "+name,
+			fmt.Sprintf("%d block(s) were edited in both the file and the database", len(changes.Conflicts)))
+	}
+	added := 0
+	for _, block := range changes.Added {
+		if !conflicts[block.ContentHash] {
+			added++
+		}
+	}
+	if added > 0 {
+		mfw.notifier.Notify(NotifyNewBlocks, "notes", fmt.Sprintf("%d new block(s) ingested from %s", added, name))
+	}
+}
+
+// recordFileState remembers the current state of filePath so polling doesn't
+// mistake our own writes for user edits. Callers must hold mfw.mu or be the
+// only goroutine touching fileStates.
+func (mfw *MultiFileWatcher) recordFileState(filePath string) {
+	state, err := readFileState(filePath)
 	if err != nil {
-		log.Println("Error resolving absolute path of event: %v ", err)
-		return false
+		log.Printf("Failed to read %s: %v", filePath, err)
+		return
 	}
+	mfw.fileStates[filePath] = state
+}
 
-	if !mfw.respondToFileChange[absPath] {
-		// don't ignore the next
-		mfw.respondToFileChange[absPath] = true
-		return false
+func readFileState(filePath string) (fileState, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return fileState{}, err
 	}
 
-	// Handle file deletion
-	if event.Op&fsnotify.Remove == fsnotify.Remove {
-		log.Printf("Watched file deleted: %s", absPath)
-		go func() {
-			if err := mfw.RemoveFile(absPath); err != nil {
-				log.Printf("Error removing deleted file: %v", err)
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return fileState{}, err
+	}
+
+	return fileState{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		hash:    sha256Hex(string(content)),
+	}, nil
+}
+
+func (mfw *MultiFileWatcher) shouldProcessEvent(event fsnotify.Event) bool {
+	mfw.mu.Lock()
+	defer mfw.mu.Unlock()
+
+	// Events may name the file through a symlink
+	absPath := CanonicalPath(event.Name)
+
+	// Handle file deletion, including editors and sync tools that replace
+	// the file by renaming a new one over it. The watch goes away with the
+	// old file, so wait for a new one instead of dropping its blocks.
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		if _, watched := mfw.reconcilers[absPath]; watched && !mfw.missing[absPath] {
+			// Regenerating the file replaces it the same way; follow the
+			// new file without reconciling what we just wrote
+			if !mfw.respondToFileChange[absPath] && fileExists(absPath) {
+				mfw.respondToFileChange[absPath] = true
+				mfw.watcher.Remove(absPath)
+				mfw.watchFile(absPath)
+				return false
 			}
-		}()
+			infof("Watched file deleted: %s", absPath)
+			mfw.detachFile(absPath)
+		}
 		return false
 	}
 
 	// Process write and create events
-	if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
-		log.Printf("File change detected: %s", absPath)
-		return true
+	if event.Op&fsnotify.Write != fsnotify.Write && event.Op&fsnotify.Create != fsnotify.Create {
+		return false
 	}
-
-	return false
+	if !mfw.respondToFileChange[absPath] {
+		// don't ignore the next
+		mfw.respondToFileChange[absPath] = true
+		return false
+	}
+	infof("File change detected: %s", absPath)
+	return true
 }
 
 func (mfw *MultiFileWatcher) debounceEvent(filePath string) {
@@ -227,37 +584,317 @@ func (mfw *MultiFileWatcher) debounceEvent(filePath string) {
 	defer mfw.mu.Unlock()
 
 	// Stop existing timer for this file
+	suppressed := false
 	if timer, exists := mfw.debounceTimers[filePath]; exists {
-		timer.Stop()
+		suppressed = timer.Stop()
 	}
+	mfw.metrics.update(func(m *WatcherMetrics) {
+		m.Events++
+		if suppressed {
+			m.DebounceSuppressed++
+		}
+	})
+
+	// A new change restarts the truncation grace period
+	delete(mfw.confirmedEmpty, filePath)
 
 	// Create new timer
-	mfw.debounceTimers[filePath] = time.AfterFunc(200*time.Millisecond, func() {
-		if err := mfw.reconcilers[filePath].ReconcileFromSpecificFile(); err != nil {
-			log.Printf("Reconciliation failed for %s: %v", filePath, err)
-		} else {
-			log.Printf("Reconciliation completed for %s", filePath)
+	mfw.debounceTimers[filePath] = time.AfterFunc(mfw.debounceDelay(filePath, time.Now()), func() {
+		mfw.queueChange(filePath)
+	})
+}
+
+// debounceDelay returns how long to wait before reconciling filePath after
+// a change at now. A file that changes again soon after being reconciled
+// has its window doubled, up to the configured maximum, and goes back to
+// the base window once it has been quiet for that long. Reconciles of a
+// file are at least a window apart, and a file that never stops changing
+// is still reconciled every maximum window. Callers must hold mfw.mu.
+func (mfw *MultiFileWatcher) debounceDelay(filePath string, now time.Time) time.Duration {
+	base, maxWindow := mfw.config.DebounceWindow(filePath)
+	state := mfw.debounceStates[filePath]
+	if state == nil {
+		state = &debounceState{window: base}
+		mfw.debounceStates[filePath] = state
+	}
+
+	if state.pendingSince.IsZero() {
+		state.pendingSince = now
+		sinceReconcile := now.Sub(state.lastReconcile)
+		switch {
+		case sinceReconcile < 2*state.window && state.window < maxWindow:
+			state.window = min(2*state.window, maxWindow)
+			infof("%s keeps changing; waiting %s before reconciling it", filePath, state.window)
+		case sinceReconcile > maxWindow:
+			state.window = base
+		}
+	}
+
+	delay := state.window
+	if deadline := state.pendingSince.Add(maxWindow); now.Add(delay).After(deadline) {
+		delay = max(deadline.Sub(now), 0)
+	}
+	if next := state.lastReconcile.Add(state.window); now.Add(delay).Before(next) {
+		delay = next.Sub(now)
+	}
+	return delay
+}
+
+// processChange reconciles a changed file and regenerates it. It runs on
+// the worker goroutine.
+func (mfw *MultiFileWatcher) processChange(filePath string) {
+	if mfw.quarantined(filePath) {
+		log.Printf("Skipping change to quarantined %s; run `notes reconcile %s` once it is fixed", filePath, filePath)
+		return
+	}
+	if mfw.awaitingContent(filePath) {
+		return
+	}
+
+	mfw.mu.Lock()
+	reconciler := mfw.reconcilers[filePath]
+	if state := mfw.debounceStates[filePath]; state != nil {
+		state.pendingSince = time.Time{}
+		state.lastReconcile = time.Now()
+	}
+	mfw.mu.Unlock()
+	if reconciler == nil {
+		return // unwatched while the change was pending
+	}
+
+	changes, err := reconcileRecovering(reconciler)
+	mfw.metrics.recordReconcile(filePath, err, time.Now())
+	mfw.countFailure(filePath, err)
+	if err != nil {
+		log.Printf("Reconciliation failed for %s: %v", filePath, err)
+		mfw.recordError(filePath, err)
+	} else {
+		infof("Reconciliation completed for %s", filePath)
+		mfw.notifyChanges(changes)
+		if !changes.IsEmpty() {
+			if err := regenerateMirrors(mfw.db, mfw.config); err != nil {
+				log.Printf("Mirror regeneration failed: %v", err)
+				mfw.recordError("", err)
+			}
+		}
+	}
+
+	// A file refused by the deletion guard is left as it is, so the user
+	// can inspect it and force it through with `notes reconcile --force`,
+	// and so is one just quarantined
+	if !errors.Is(err, ErrTooManyDeletions) && (err == nil || !mfw.quarantined(filePath)) {
+		// make sure we don't run an infinite loop by ignoring the event
+		// regenerating causes. It is expected before regenerating, since
+		// the event can arrive before RegenerateSpecificFile returns, and
+		// no longer once the file turns out not to have been replaced.
+		before, _ := os.Stat(filePath)
+		mfw.mu.Lock()
+		if !mfw.polling(filePath) {
+			mfw.respondToFileChange[filePath] = false
 		}
+		mfw.mu.Unlock()
 
-		if err := mfw.reconcilers[filePath].RegenerateSpecificFile(); err != nil {
+		if err := reconciler.RegenerateSpecificFile(); err != nil {
 			log.Printf("Regeneration failed for %s: %v", filePath, err)
+			mfw.recordError(filePath, err)
 		} else {
-			log.Printf("Regenerated %s successfully", filePath)
+			infof("Regenerated %s successfully", filePath)
 		}
 
-		mfw.mu.Lock()
-		// make sure we don't run an infinite loop
-		// - by ignoring the write event we have caused by regenerating
-		mfw.respondToFileChange[filePath] = false
-		delete(mfw.debounceTimers, filePath)
+		if after, err := os.Stat(filePath); before != nil && err == nil && os.SameFile(before, after) {
+			mfw.mu.Lock()
+			mfw.respondToFileChange[filePath] = true
+			mfw.mu.Unlock()
+		}
+	}
+
+	mfw.mu.Lock()
+	if mfw.polling(filePath) {
+		mfw.recordFileState(filePath)
+	}
+	// debounceTimers is left alone: a change made during the reconcile has
+	// armed a new timer there, which later changes must still be able to stop
+	delete(mfw.confirmedEmpty, filePath)
+	mfw.mu.Unlock()
+
+	mfw.saveMetrics(false)
+}
+
+// reconcileRecovering reconciles like reconciler.ReconcileFromSpecificFile,
+// turning a panic into an error so one bad file can't take the daemon down.
+func reconcileRecovering(reconciler *Reconciler) (changes *ChangeSet, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			changes, err = nil, fmt.Errorf("reconcile panicked: %v", r)
+		}
+	}()
+	return reconciler.ReconcileFromSpecificFile()
+}
+
+// countFailure tracks consecutive failed reconciles of filePath and
+// quarantines it after quarantineAfter of them. Refusals of the deletion
+// guard are left out, as those wait for the user rather than fail. It runs
+// on the worker goroutine.
+func (mfw *MultiFileWatcher) countFailure(filePath string, err error) {
+	mfw.mu.Lock()
+	if err == nil {
+		delete(mfw.failures, filePath)
+		mfw.mu.Unlock()
+		return
+	}
+	if errors.Is(err, ErrTooManyDeletions) {
 		mfw.mu.Unlock()
+		return
+	}
+	mfw.failures[filePath]++
+	failures := mfw.failures[filePath]
+	if failures >= quarantineAfter {
+		delete(mfw.failures, filePath)
+	}
+	mfw.mu.Unlock()
+	if failures < quarantineAfter {
+		return
+	}
+
+	log.Printf("Quarantining %s after %d failed reconciles; run `notes reconcile %s` once it is fixed", filePath, failures, filePath)
+	if err := mfw.db.QuarantineWatchedFile(filePath, err.Error()); err != nil {
+		log.Printf("Failed to quarantine %s: %v", filePath, err)
+		return
+	}
+	mfw.recordError(filePath, fmt.Errorf("quarantined after %d failed reconciles", failures))
+}
+
+// quarantined reports whether filePath is quarantined. The quarantine is
+// read from the database each time, so `notes reconcile` can lift it while
+// the daemon runs.
+func (mfw *MultiFileWatcher) quarantined(filePath string) bool {
+	quarantine, err := mfw.db.GetFileQuarantine(filePath)
+	if err != nil {
+		log.Printf("Failed to check quarantine of %s: %v", filePath, err)
+		return false
+	}
+	return quarantine != nil
+}
+
+// saveMetrics writes the daemon's metrics to the database, if they changed
+// or when heartbeat is set.
+func (mfw *MultiFileWatcher) saveMetrics(heartbeat bool) {
+	if err := mfw.metrics.save(mfw.db, time.Now(), heartbeat); err != nil {
+		log.Printf("Failed to save watcher metrics: %v", err)
+	}
+}
+
+// awaitingContent reports whether filePath was just truncated to nothing
+// while it still has blocks, in which case reconciliation is postponed by
+// truncationGracePeriod to give whoever truncated it time to write the new
+// content. A file still empty after that is reconciled as cleared.
+func (mfw *MultiFileWatcher) awaitingContent(filePath string) bool {
+	content, err := os.ReadFile(filePath)
+	if err != nil || strings.TrimSpace(string(content)) != "" {
+		return false
+	}
+
+	hashes, err := mfw.db.GetFileBlockHashes(filePath)
+	if err != nil || len(hashes) == 0 {
+		return false
+	}
+
+	mfw.mu.Lock()
+	defer mfw.mu.Unlock()
+
+	if mfw.confirmedEmpty[filePath] {
+		return false
+	}
+	mfw.confirmedEmpty[filePath] = true
+	mfw.debounceTimers[filePath] = time.AfterFunc(truncationGracePeriod, func() {
+		mfw.queueChange(filePath)
 	})
+	infof("%s was emptied, waiting %s before removing its blocks", filePath, truncationGracePeriod)
+	return true
+}
+
+// detachFile stops reacting to a watched file that was deleted, keeping its
+// database state, and waits for it to be recreated. Callers must hold mfw.mu.
+func (mfw *MultiFileWatcher) detachFile(filePath string) {
+	if !mfw.polling(filePath) {
+		// fsnotify usually drops the watch itself; ignore the error if so
+		mfw.watcher.Remove(filePath)
+	}
+
+	if timer, exists := mfw.debounceTimers[filePath]; exists {
+		timer.Stop()
+		delete(mfw.debounceTimers, filePath)
+	}
+	mfw.missing[filePath] = true
+
+	go mfw.awaitRecreation(filePath)
+}
+
+// awaitRecreation re-attaches filePath as soon as it exists again, for up to
+// recreateGracePeriod.
+func (mfw *MultiFileWatcher) awaitRecreation(filePath string) {
+	deadline := time.Now().Add(recreateGracePeriod)
+	for time.Now().Before(deadline) {
+		time.Sleep(recreateCheckPeriod)
+
+		mfw.mu.Lock()
+		if !mfw.missing[filePath] {
+			mfw.mu.Unlock()
+			return // re-attached elsewhere or unwatched
+		}
+		if fileExists(filePath) {
+			mfw.reattachFile(filePath)
+			mfw.mu.Unlock()
+			return
+		}
+		mfw.mu.Unlock()
+	}
+
+	log.Printf("Watched file %s is still missing; its blocks are kept until it reappears or is unwatched", filePath)
+	mfw.recordError(filePath, fmt.Errorf("watched file deleted and not recreated within %s", recreateGracePeriod))
+}
+
+// reattachFile resumes watching a recreated file and reconciles it against
+// its last snapshot. Callers must hold mfw.mu.
+func (mfw *MultiFileWatcher) reattachFile(filePath string) {
+	mfw.watchFile(filePath)
+
+	delete(mfw.missing, filePath)
+	mfw.respondToFileChange[filePath] = true
+	infof("Watched file recreated: %s", filePath)
+
+	// debounceEvent takes the lock itself
+	go mfw.debounceEvent(filePath)
+}
+
+// CanonicalizeWatchedFiles renames watched files stored under a path that
+// isn't canonical, merging entries that turn out to name the same file.
+func CanonicalizeWatchedFiles(db *Database) error {
+	watchedFiles, err := db.GetWatchedFiles()
+	if err != nil {
+		return fmt.Errorf("failed to get watched files: %w", err)
+	}
+	for _, filePath := range watchedFiles {
+		if canonical := CanonicalPath(filePath); canonical != filePath {
+			infof("Watching %s as %s", filePath, canonical)
+			if err := db.RenameWatchedFile(filePath, canonical); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (mfw *MultiFileWatcher) SyncWithDatabase() error {
 	mfw.mu.Lock()
 	defer mfw.mu.Unlock()
 
+	// `notes watch` stores canonical paths, but entries from older versions
+	// or made before a symlink was set up may not be
+	if err := CanonicalizeWatchedFiles(mfw.db); err != nil {
+		return err
+	}
+
 	watchedFiles, err := mfw.db.GetWatchedFiles()
 	if err != nil {
 		return fmt.Errorf("failed to get watched files from database: %w", err)
@@ -269,6 +906,13 @@ func (mfw *MultiFileWatcher) SyncWithDatabase() error {
 		dbFileSet[file] = true
 	}
 
+	// Re-attach deleted files that have reappeared since their grace period
+	for file := range mfw.missing {
+		if fileExists(file) {
+			mfw.reattachFile(file)
+		}
+	}
+
 	// Add files from database that we're not currently watching
 	for _, file := range watchedFiles {
 		_, ok := mfw.reconcilers[file]
@@ -280,13 +924,12 @@ func (mfw *MultiFileWatcher) SyncWithDatabase() error {
 	// Remove files that are no longer in the database
 	for file := range mfw.respondToFileChange {
 		if !dbFileSet[file] {
-			// Remove from fsnotify watcher
-			if err := mfw.watcher.Remove(file); err != nil {
-				log.Printf("Warning: failed to remove file from watcher: %s: %v", file, err)
-			}
-
+			mfw.unwatchFile(file)
 			delete(mfw.respondToFileChange, file)
 			delete(mfw.reconcilers, file)
+			delete(mfw.fileStates, file)
+			delete(mfw.missing, file)
+			delete(mfw.confirmedEmpty, file)
 
 			// Clean up debounce timer if exists
 			if timer, exists := mfw.debounceTimers[file]; exists {
@@ -294,7 +937,7 @@ func (mfw *MultiFileWatcher) SyncWithDatabase() error {
 				delete(mfw.debounceTimers, file)
 			}
 
-			log.Printf("Stopped watching file: %s", file)
+			infof("Stopped watching file: %s", file)
 		}
 	}
 
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// isNetworkPath reports false: inotify and kqueue can't tell network
+// filesystems apart, so `notes watcher --poll` selects polling there.
+func isNetworkPath(path string) bool {
+	return false
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Hash normalization steps, applied in this order whichever order they are
+// configured in.
+const (
+	NormalizeNFC        = "nfc"
+	NormalizeAccents    = "accents"
+	NormalizeLowercase  = "lowercase"
+	NormalizeWhitespace = "whitespace"
+)
+
+var normalizationSteps = []string{NormalizeNFC, NormalizeAccents, NormalizeLowercase, NormalizeWhitespace}
+
+// hashNormalization holds the steps enabled by the repository config. Block
+// content is stored as written; only the hash is computed from the
+// normalized form, so blocks that differ only in the enabled respects are
+// the same block.
+var hashNormalization map[string]bool
+
+// SetHashNormalization enables the named normalization steps for all
+// content hashes computed from now on. Names are checked when the config
+// is loaded.
+func SetHashNormalization(steps []string) {
+	hashNormalization = make(map[string]bool)
+	for _, step := range steps {
+		hashNormalization[step] = true
+	}
+}
+
+func isNormalizationStep(name string) bool {
+	for _, step := range normalizationSteps {
+		if step == name {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeForHash returns the form of content that is hashed.
+func normalizeForHash(content string) string {
+	if hashNormalization[NormalizeNFC] {
+		content = norm.NFC.String(content)
+	}
+	if hashNormalization[NormalizeAccents] {
+		stripped, _, err := transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), content)
+		if err == nil {
+			content = stripped
+		}
+	}
+	if hashNormalization[NormalizeLowercase] {
+		content = strings.ToLower(content)
+	}
+	if hashNormalization[NormalizeWhitespace] {
+		lines := strings.Split(content, "\n")
+		for i, line := range lines {
+			lines[i] = strings.Join(strings.Fields(line), " ")
+		}
+		content = strings.Join(lines, "\n")
+	}
+	return content
+}
+
+// RehashBlocks recomputes the hash of every block under the current
+// normalization. Blocks that now share a hash are merged into whichever
+// already has it, or else the oldest. It returns the number of blocks
+// rehashed and how many of those were merged away.
+func RehashBlocks(db *Database) (rehashed, merged int, err error) {
+	blocks, err := db.GetAllBlocks()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, block := range blocks {
+		if generateContentHash(block.Content) == block.ContentHash {
+			continue
+		}
+		duplicate, err := db.RepairBlockHash(block)
+		if err != nil {
+			return rehashed, merged, err
+		}
+		rehashed++
+		if duplicate {
+			merged++
+		}
+	}
+	return rehashed, merged, nil
+}
+
+func handleRehash() {
+	fs := flag.NewFlagSet("rehash", flag.ExitOnError)
+	parseArgs(fs, os.Args[2:])
+
+	rehashed, merged, err := RehashBlocks(db)
+	if err != nil {
+		log.Fatalf("Failed to rehash blocks: %v", err)
+	}
+	if rehashed == 0 {
+		fmt.Println("All block hashes are up to date")
+		return
+	}
+
+	if err := regenerateAllFiles(); err != nil {
+		log.Fatalf("Failed to regenerate files: %v", err)
+	}
+	fmt.Printf("Rehashed %d block(s), merged %d duplicate(s)\n", rehashed, merged)
+}
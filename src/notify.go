@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Daemon events that can raise a desktop notification.
+const (
+	NotifyErrors    = "errors"
+	NotifyConflicts = "conflicts"
+	NotifyNewBlocks = "new_blocks"
+)
+
+var notifyEvents = []string{NotifyErrors, NotifyConflicts, NotifyNewBlocks}
+
+// defaultNotifyEvents applies when the config doesn't set "notify".
+var defaultNotifyEvents = []string{NotifyErrors, NotifyConflicts}
+
+// notifyRepeatInterval suppresses identical notifications, so a file that
+// keeps failing to reconcile doesn't raise a notification on every save.
+const notifyRepeatInterval = 10 * time.Minute
+
+// Notifier sends desktop notifications for the events enabled in the config.
+type Notifier struct {
+	enabled  map[string]bool
+	mu       sync.Mutex
+	lastSent map[string]time.Time
+}
+
+func NewNotifier(events []string) *Notifier {
+	enabled := make(map[string]bool)
+	for _, event := range events {
+		enabled[event] = true
+	}
+	return &Notifier{enabled: enabled, lastSent: make(map[string]time.Time)}
+}
+
+// Notify shows a notification if event is enabled and the same message
+// wasn't shown within notifyRepeatInterval. Delivery failures are logged.
+func (n *Notifier) Notify(event, title, body string) {
+	if !n.enabled[event] {
+		return
+	}
+
+	key := event + "\x00" + title + "\x00" + body
+	n.mu.Lock()
+	if last, ok := n.lastSent[key]; ok && time.Since(last) < notifyRepeatInterval {
+		n.mu.Unlock()
+		return
+	}
+	n.lastSent[key] = time.Now()
+	n.mu.Unlock()
+
+	if err := sendDesktopNotification(title, body); err != nil {
+		log.Printf("Failed to send desktop notification: %v", err)
+	}
+}
+
+// sendDesktopNotification uses notify-send on Linux and BSDs, osascript on
+// macOS and a PowerShell toast on Windows.
+func sendDesktopNotification(title, body string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", strconv.Quote(body), strconv.Quote(title))
+		cmd = exec.Command("osascript", "-e", script)
+	case "windows":
+		cmd = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", windowsToastScript(title, body))
+	default:
+		cmd = exec.Command("notify-send", title, body)
+	}
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %w: %s", cmd.Path, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func windowsToastScript(title, body string) string {
+	quote := func(s string) string { return "'" + strings.ReplaceAll(s, "'", "''") + "'" }
+	return `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$xml = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $xml.GetElementsByTagName('text')
+$text.Item(0).AppendChild($xml.CreateTextNode(` + quote(title) + `)) > $null
+$text.Item(1).AppendChild($xml.CreateTextNode(` + quote(body) + `)) > $null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('notes').Show([Windows.UI.Notifications.ToastNotification]::new($xml))`
+}
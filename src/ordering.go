@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultOrder puts the newest blocks first, as notes.md always has been.
+const DefaultOrder = "created"
+
+// frecencyHalfLife is the age at which a block's frecency weight has halved.
+const frecencyHalfLife = 14 * 24 * time.Hour
+
+// BlockOrderer decides the order in which blocks appear in a generated file.
+// Order sorts the slice in place.
+type BlockOrderer interface {
+	Order(blocks []*Block)
+}
+
+// SQLOrderer is implemented by orders the database can produce itself, so
+// notes.md can be streamed from it rather than sorted in memory. OrderBy
+// returns an ORDER BY clause over the blocks table equivalent to Order on
+// every block in ID order.
+type SQLOrderer interface {
+	OrderBy() string
+}
+
+// RecencyOrderer puts the most recently touched blocks first (topic gravity).
+type RecencyOrderer struct{}
+
+func (RecencyOrderer) OrderBy() string { return "updated_at DESC, created_at DESC, id" }
+
+func (RecencyOrderer) Order(blocks []*Block) {
+	slices.SortStableFunc(blocks, func(a, b *Block) int {
+		if c := b.UpdatedAt.Compare(a.UpdatedAt); c != 0 {
+			return c
+		}
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+}
+
+// FrecencyOrderer weighs how often a block has been touched against how long
+// ago it was last touched, so frequently revisited blocks sink more slowly.
+type FrecencyOrderer struct{}
+
+func (FrecencyOrderer) Order(blocks []*Block) {
+	now := time.Now()
+	score := func(b *Block) float64 {
+		age := now.Sub(b.UpdatedAt)
+		if age < 0 {
+			age = 0
+		}
+		decay := math.Exp2(-float64(age) / float64(frecencyHalfLife))
+		return float64(b.TouchCount+1) * decay
+	}
+
+	slices.SortStableFunc(blocks, func(a, b *Block) int {
+		sa, sb := score(a), score(b)
+		switch {
+		case sa > sb:
+			return -1
+		case sa < sb:
+			return 1
+		}
+		return b.UpdatedAt.Compare(a.UpdatedAt)
+	})
+}
+
+// CreatedAtOrderer puts the newest blocks first, ignoring later touches.
+type CreatedAtOrderer struct{}
+
+func (CreatedAtOrderer) OrderBy() string { return "created_at DESC, id" }
+
+func (CreatedAtOrderer) Order(blocks []*Block) {
+	slices.SortStableFunc(blocks, func(a, b *Block) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+}
+
+// OldestOrderer puts the oldest blocks first, so new blocks are appended to
+// the end and touching a block never moves it. It suits files under version
+// control, whose diffs then only show real changes.
+type OldestOrderer struct{}
+
+func (OldestOrderer) OrderBy() string { return "created_at, id" }
+
+func (OldestOrderer) Order(blocks []*Block) {
+	slices.SortStableFunc(blocks, func(a, b *Block) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+}
+
+// ManualOrderer keeps blocks in the order they were given.
+type ManualOrderer struct{}
+
+func (ManualOrderer) OrderBy() string { return "id" }
+
+func (ManualOrderer) Order(blocks []*Block) {}
+
+// AlphabeticalOrderer sorts blocks by their first line, case-insensitively.
+type AlphabeticalOrderer struct{}
+
+func (AlphabeticalOrderer) Order(blocks []*Block) {
+	slices.SortStableFunc(blocks, func(a, b *Block) int {
+		return strings.Compare(strings.ToLower(a.FirstLine()), strings.ToLower(b.FirstLine()))
+	})
+}
+
+var orderers = map[string]BlockOrderer{
+	"recency":      RecencyOrderer{},
+	"frecency":     FrecencyOrderer{},
+	"created":      CreatedAtOrderer{},
+	"oldest":       OldestOrderer{},
+	"manual":       ManualOrderer{},
+	"alphabetical": AlphabeticalOrderer{},
+}
+
+// GetOrderer returns the ordering strategy registered under name. An empty
+// name selects DefaultOrder.
+func GetOrderer(name string) (BlockOrderer, error) {
+	if name == "" {
+		name = DefaultOrder
+	}
+
+	orderer, ok := orderers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown block order %q (available: %s)", name, strings.Join(OrdererNames(), ", "))
+	}
+	return orderer, nil
+}
+
+func OrdererNames() []string {
+	names := make([]string, 0, len(orderers))
+	for name := range orderers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
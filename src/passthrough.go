@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	IgnoreStartMarker = "<!-- notes:ignore-start -->"
+	IgnoreEndMarker   = "<!-- notes:ignore-end -->"
+
+	// IgnoreFileName lists patterns for sections that are never turned into
+	// blocks. It lives next to notes.db.
+	IgnoreFileName = ".notesignore"
+)
+
+// IgnoreRules holds the regular expressions from .notesignore. A section
+// (text between blank lines) whose first line matches any of them is passed
+// through verbatim. A nil *IgnoreRules matches nothing.
+type IgnoreRules struct {
+	patterns []*regexp.Regexp
+}
+
+// LoadIgnoreRules reads one regular expression per line from path. Blank
+// lines and lines starting with '#' are skipped; use "\#" or "^#" to match a
+// leading '#'. A missing file yields empty rules.
+func LoadIgnoreRules(path string) (*IgnoreRules, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &IgnoreRules{}, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer file.Close()
+
+	rules := &IgnoreRules{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pattern, err := regexp.Compile(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		rules.patterns = append(rules.patterns, pattern)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// Matches reports whether section should be passed through verbatim.
+func (r *IgnoreRules) Matches(section string) bool {
+	if r == nil {
+		return false
+	}
+
+	firstLine, _, _ := strings.Cut(section, "\n")
+	for _, pattern := range r.patterns {
+		if pattern.MatchString(firstLine) {
+			return true
+		}
+	}
+	return false
+}
+
+// FileLayout separates a markdown file into the text that becomes blocks and
+// the passthrough regions around it: YAML front matter, ignore-marker regions
+// and sections matching the ignore rules. Passthrough text before the first
+// block is the header; all other passthrough text is collected, in order,
+// into the footer.
+type FileLayout struct {
+	FrontMatter string
+	Header      string
+	Body        string
+	Footer      string
+}
+
+// SplitFrontMatter splits YAML front matter, delimited by "---" lines at the
+// very start of content, from the rest. frontMatter includes the delimiters
+// and is empty if content has none.
+func SplitFrontMatter(content string) (frontMatter, rest string) {
+	if !strings.HasPrefix(content, "---\n") && !strings.HasPrefix(content, "---\r\n") {
+		return "", content
+	}
+
+	lines := strings.SplitAfter(content, "\n")
+	for i := 1; i < len(lines); i++ {
+		delimiter := strings.TrimRight(lines[i], "\r\n")
+		if delimiter == "---" || delimiter == "..." {
+			frontMatter = strings.Join(lines[:i+1], "")
+			return strings.TrimRight(frontMatter, "\r\n"), strings.Join(lines[i+1:], "")
+		}
+	}
+	return "", content
+}
+
+// SplitPassthrough computes the layout of content. Text written by layout,
+// which may be nil, is dropped: it is regenerated rather than passed through.
+func SplitPassthrough(content string, rules *IgnoreRules, layout *Layout) FileLayout {
+	frontMatter, content := SplitFrontMatter(content)
+
+	var header, body, footer []string
+	addPassthrough := func(text string) {
+		if len(body) == 0 {
+			header = append(header, text)
+		} else {
+			footer = append(footer, text)
+		}
+	}
+
+	var pending []string
+	flush := func() {
+		for _, section := range layout.sections(strings.Join(pending, "\n")) {
+			section = stripBlockIDs(strings.Trim(section, "\n"))
+			if strings.TrimSpace(section) == "" || layout.IsDecoration(section) {
+				continue
+			}
+			if rules.Matches(section) {
+				addPassthrough(section)
+			} else {
+				body = append(body, section)
+			}
+		}
+		pending = nil
+	}
+
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		marker := strings.TrimSpace(lines[i])
+		if marker == GeneratedStartMarker {
+			flush()
+			for i < len(lines)-1 && strings.TrimSpace(lines[i]) != GeneratedEndMarker {
+				i++
+			}
+			continue
+		}
+		if marker != IgnoreStartMarker {
+			pending = append(pending, lines[i])
+			continue
+		}
+
+		flush()
+		start := i
+		for i < len(lines)-1 && strings.TrimSpace(lines[i]) != IgnoreEndMarker {
+			i++
+		}
+		addPassthrough(strings.TrimRight(strings.Join(lines[start:i+1], "\n"), "\n"))
+	}
+	flush()
+
+	return FileLayout{
+		FrontMatter: frontMatter,
+		Header:      strings.Join(header, "\n\n"),
+		Body:        layout.joinSections(body),
+		Footer:      strings.Join(footer, "\n\n"),
+	}
+}
+
+// Wrap places generated block markdown between the layout's front matter and
+// header and its footer. The result ends in exactly one newline, so files
+// under version control don't flip between endings.
+func (l FileLayout) Wrap(blocksMarkdown string) string {
+	var parts []string
+	for _, part := range []string{l.FrontMatter, l.Header, blocksMarkdown, l.Footer} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	content := strings.TrimRight(strings.Join(parts, "\n\n"), "\n")
+	if content == "" {
+		return ""
+	}
+	return content + "\n"
+}
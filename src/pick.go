@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// pickListLimit is how many matches the built-in picker lists at a time.
+const pickListLimit = 20
+
+// fuzzyScore reports whether the characters of pattern appear in text in
+// order, ignoring case, and scores the match the way fzf does: runs of
+// consecutive characters and characters starting a word score higher, gaps
+// lower, and the pattern appearing as a whole scores highest.
+func fuzzyScore(pattern, text string) (int, bool) {
+	pattern, text = strings.ToLower(pattern), strings.ToLower(text)
+	p, t := []rune(pattern), []rune(text)
+
+	score, pi, last := 0, 0, -1
+	for ti := 0; ti < len(t) && pi < len(p); ti++ {
+		if t[ti] != p[pi] {
+			continue
+		}
+		score++
+		if last >= 0 && ti == last+1 {
+			score += 4
+		} else if last >= 0 {
+			score -= min(ti-last-1, 3)
+		}
+		if ti == 0 || !unicode.IsLetter(t[ti-1]) && !unicode.IsDigit(t[ti-1]) {
+			score += 3
+		}
+		last = ti
+		pi++
+	}
+	if pi < len(p) {
+		return 0, false
+	}
+	if strings.Contains(text, pattern) {
+		score += 2 * len(p)
+	}
+	return score, true
+}
+
+// fuzzyMatch scores text against each space-separated term of query, all of
+// which have to match.
+func fuzzyMatch(query, text string) (int, bool) {
+	total := 0
+	for _, term := range strings.Fields(query) {
+		score, ok := fuzzyScore(term, text)
+		if !ok {
+			return 0, false
+		}
+		total += score
+	}
+	return total, true
+}
+
+// fuzzyFilter returns the blocks whose title matches query, best match
+// first. Equal scores keep the order of blocks.
+func fuzzyFilter(blocks []*Block, query string) []*Block {
+	type match struct {
+		block *Block
+		score int
+	}
+	var matches []match
+	for _, block := range blocks {
+		if score, ok := fuzzyMatch(query, block.Title()); ok {
+			matches = append(matches, match{block, score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+
+	filtered := make([]*Block, len(matches))
+	for i, m := range matches {
+		filtered[i] = m.block
+	}
+	return filtered
+}
+
+// shellQuote quotes s for the shell fzf runs its preview command with.
+func shellQuote(s string) string {
+	if runtime.GOOS == "windows" {
+		return `"` + s + `"`
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// pickWithFzf lets the user choose one of blocks in fzf, previewing each
+// with `notes cat`. It returns nil if they cancelled or nothing matched.
+func pickWithFzf(fzf string, blocks []*Block, query string) (*Block, error) {
+	args := []string{"--delimiter=\t", "--with-nth=2..", "--tiebreak=index", "--prompt=notes> ", "--query=" + query}
+	if query != "" {
+		args = append(args, "--select-1")
+	}
+	// The preview runs in a new process, which can't prompt for the
+	// passphrase of an encrypted repository
+	if encrypted, err := db.IsEncrypted(); err == nil && (!encrypted || os.Getenv("NOTES_PASSPHRASE") != "") {
+		if executable, err := os.Executable(); err == nil {
+			args = append(args, "--preview="+shellQuote(executable)+" --db "+shellQuote(dbPath)+" cat {1}", "--preview-window=wrap")
+		}
+	}
+
+	var input strings.Builder
+	byID := make(map[string]*Block, len(blocks))
+	for _, block := range blocks {
+		id := strconv.Itoa(block.ID)
+		byID[id] = block
+		fmt.Fprintf(&input, "%s\t%s\n", id, block.Title())
+	}
+
+	cmd := exec.Command(fzf, args...)
+	cmd.Stdin = strings.NewReader(input.String())
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && (exitErr.ExitCode() == 1 || exitErr.ExitCode() == 130) {
+		return nil, nil // no match, or cancelled with Esc or Ctrl+C
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to run fzf: %w", err)
+	}
+
+	id, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\t")
+	return byID[id], nil
+}
+
+// pickBuiltin is the picker used without fzf: it lists the blocks matching
+// a query and reads either a number to pick or a new query, until the user
+// picks one or quits. It talks on stderr, so the picked block can be piped.
+func pickBuiltin(blocks []*Block, query string) *Block {
+	input := bufio.NewScanner(os.Stdin)
+	for {
+		matches := fuzzyFilter(blocks, query)
+		if len(matches) == 0 {
+			fmt.Fprintln(os.Stderr, "No matches")
+		}
+		for i, block := range matches[:min(len(matches), pickListLimit)] {
+			fmt.Fprintf(os.Stderr, "%4d  %s\n", i+1, block.Title())
+		}
+		if len(matches) > pickListLimit {
+			fmt.Fprintf(os.Stderr, "      ... %d more, type to narrow down\n", len(matches)-pickListLimit)
+		}
+
+		fmt.Fprintf(os.Stderr, "Number to pick (Enter for 1), text to filter, q to quit [%s]: ", query)
+		if !input.Scan() {
+			fmt.Fprintln(os.Stderr)
+			return nil
+		}
+
+		answer := strings.TrimSpace(input.Text())
+		switch {
+		case answer == "q":
+			return nil
+		case answer == "" && len(matches) > 0:
+			return matches[0]
+		case answer == "":
+			continue
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= min(len(matches), pickListLimit) {
+			return matches[n-1]
+		}
+		query = answer
+	}
+}
+
+func handlePick() {
+	fs := flag.NewFlagSet("pick", flag.ExitOnError)
+	edit := fs.Bool("edit", false, "edit the picked block instead of printing it")
+	copyBlock := fs.Bool("copy", false, "copy the picked block to the clipboard instead of printing it")
+	render := fs.Bool("render", false, "style the printed block as markdown")
+	noFzf := fs.Bool("no-fzf", false, "use the built-in picker even if fzf is installed")
+	args := parseArgs(fs, os.Args[2:])
+
+	if *edit && *copyBlock {
+		fmt.Println("Error: --edit and --copy can't be combined")
+		os.Exit(1)
+	}
+
+	blocks, err := db.GetAllBlocks()
+	if err != nil {
+		log.Fatalf("Failed to get blocks: %v", err)
+	}
+	if len(blocks) == 0 {
+		fmt.Println("No blocks found")
+		return
+	}
+	// Most recently updated first, which is also how ties rank
+	sort.SliceStable(blocks, func(i, j int) bool { return blocks[i].UpdatedAt.After(blocks[j].UpdatedAt) })
+
+	query := strings.Join(args, " ")
+	var block *Block
+	if fzf, err := exec.LookPath("fzf"); err == nil && !*noFzf {
+		if block, err = pickWithFzf(fzf, blocks, query); err != nil {
+			log.Fatalf("Failed to pick a block: %v", err)
+		}
+	} else {
+		block = pickBuiltin(blocks, query)
+	}
+	if block == nil {
+		os.Exit(1)
+	}
+
+	switch {
+	case *edit:
+		editSearchResult(block)
+	case *copyBlock:
+		if err := copyToClipboard(block.Content); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Copied block %d to clipboard\n", block.ID)
+	default:
+		fmt.Println(displayContent(block.Content, *render))
+	}
+}
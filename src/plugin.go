@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Commands for editor plugins: they take file positions and hashes and print
+// plain values or JSON, so a plugin can act on the block under the cursor
+// without parsing the usual output.
+
+// BlockPosition is a stored block found in a file, with the 1-based lines it
+// spans.
+type BlockPosition struct {
+	ID        int    `json:"id"`
+	Hash      string `json:"hash"`
+	File      string `json:"file"`
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+}
+
+// BlockContext is what `notes context` reports about a block.
+type BlockContext struct {
+	Block        *Block            `json:"block"`
+	Title        string            `json:"title"`
+	Tags         []string          `json:"tags"`
+	Files        []string          `json:"files"`
+	Meta         map[string]string `json:"meta"`
+	Visibility   string            `json:"visibility"`
+	References   []LinkedBlock     `json:"references"`
+	ReferencedBy []LinkedBlock     `json:"referenced_by"`
+}
+
+// LinkedBlock identifies a block on the other end of a ((id)) reference.
+type LinkedBlock struct {
+	ID    int    `json:"id"`
+	Hash  string `json:"hash"`
+	Title string `json:"title"`
+}
+
+// BlockAt finds the stored block covering line in filePath. The section is
+// parsed the way reconciling the file would, so rendered references and
+// asset links still match the stored block.
+func BlockAt(db *Database, config *Config, filePath string, line int) (*BlockPosition, error) {
+	content, err := NewFileManager(filePath).ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	reconciler := NewReconciler(db, NewFileManager(filePath), config)
+	section, start, end := reconciler.settings.Layout.sectionAt(content, line)
+	if section == "" {
+		return nil, fmt.Errorf("no block at line %d of %s", line, filePath)
+	}
+
+	parsed := reconciler.parseFileBlocks(section)
+	if len(parsed) != 1 {
+		return nil, fmt.Errorf("line %d of %s isn't in a block", line, filePath)
+	}
+	stored, err := db.GetBlocksByHashes([]string{parsed[0].ContentHash})
+	if err != nil {
+		return nil, err
+	}
+	block := stored[parsed[0].ContentHash]
+	if block == nil {
+		return nil, fmt.Errorf("the block at line %d of %s isn't stored yet; it is once the file is reconciled", line, filePath)
+	}
+	return &BlockPosition{ID: block.ID, Hash: block.ContentHash, File: filePath, StartLine: start, EndLine: end}, nil
+}
+
+// linkedBlocks looks up the blocks with hashes, skipping any that are gone.
+func linkedBlocks(db *Database, hashes []string) ([]LinkedBlock, error) {
+	blocks, err := db.GetBlocksByHashes(hashes)
+	if err != nil {
+		return nil, err
+	}
+	linked := []LinkedBlock{}
+	for _, hash := range hashes {
+		if block := blocks[hash]; block != nil {
+			linked = append(linked, LinkedBlock{ID: block.ID, Hash: block.ContentHash, Title: block.Title()})
+		}
+	}
+	return linked, nil
+}
+
+// GetBlockContext gathers the files, tags, metadata, visibility and links of
+// block.
+func GetBlockContext(db *Database, config *Config, block *Block) (*BlockContext, error) {
+	context := &BlockContext{Block: block, Title: block.Title(), Tags: ExtractTags(block.Content)}
+	if context.Tags == nil {
+		context.Tags = []string{}
+	}
+
+	var err error
+	if context.Files, err = db.GetBlockFiles(block.ContentHash); err != nil {
+		return nil, err
+	}
+	if context.Files == nil {
+		context.Files = []string{}
+	}
+	if context.Meta, err = db.GetBlockMeta(block.ContentHash); err != nil {
+		return nil, err
+	}
+	if context.Meta == nil {
+		context.Meta = map[string]string{}
+	}
+
+	filter, err := LoadVisibilityFilter(db, config, VisibilityPrivate)
+	if err != nil {
+		return nil, err
+	}
+	context.Visibility = filter.Visibility(block)
+
+	references, err := db.GetLinkedHashes(block.ContentHash)
+	if err != nil {
+		return nil, err
+	}
+	if context.References, err = linkedBlocks(db, references); err != nil {
+		return nil, err
+	}
+	backlinks, err := db.GetBacklinkHashes(block.ContentHash)
+	if err != nil {
+		return nil, err
+	}
+	if context.ReferencedBy, err = linkedBlocks(db, backlinks); err != nil {
+		return nil, err
+	}
+	return context, nil
+}
+
+func printJSON(value any) {
+	encoded, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode JSON: %v", err)
+	}
+	fmt.Println(string(encoded))
+}
+
+func handleBlockAt() {
+	fs := flag.NewFlagSet("block-at", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "print the block's ID, hash and lines as JSON")
+	args := parseArgs(fs, os.Args[2:])
+
+	line := 0
+	if len(args) == 2 {
+		line, _ = strconv.Atoi(args[1])
+	}
+	if line < 1 {
+		fmt.Println("Error: block-at requires a file and a line number")
+		fmt.Println("Usage: notes block-at [--json] <file> <line>")
+		os.Exit(1)
+	}
+
+	position, err := BlockAt(db, config, CanonicalPath(expandHome(args[0])), line)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *jsonOutput {
+		printJSON(position)
+		return
+	}
+	fmt.Println(position.Hash)
+}
+
+func handleTouch() {
+	fs := flag.NewFlagSet("touch", flag.ExitOnError)
+	args := parseArgs(fs, os.Args[2:])
+
+	if len(args) == 0 {
+		fmt.Println("Error: touch command requires at least one block ID or hash")
+		fmt.Println("Usage: notes touch <id>...")
+		os.Exit(1)
+	}
+
+	var blocks []*Block
+	for _, arg := range args {
+		block, err := db.LookupBlock(arg)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		blocks = append(blocks, block)
+	}
+
+	if _, err := newMainReconciler().TouchBlocks(blocks); err != nil {
+		log.Fatalf("Failed to touch blocks: %v", err)
+	}
+	for _, block := range blocks {
+		fmt.Printf("Touched block %d\n", block.ID)
+	}
+}
+
+func handleContext() {
+	fs := flag.NewFlagSet("context", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "print the context as JSON")
+	args := parseArgs(fs, os.Args[2:])
+
+	if len(args) != 1 {
+		fmt.Println("Error: context command requires one block ID or hash")
+		fmt.Println("Usage: notes context [--json] <id>")
+		os.Exit(1)
+	}
+
+	block, err := db.LookupBlock(args[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	context, err := GetBlockContext(db, config, block)
+	if err != nil {
+		log.Fatalf("Failed to get block context: %v", err)
+	}
+
+	if *jsonOutput {
+		printJSON(context)
+		return
+	}
+
+	now := time.Now()
+	fmt.Printf("Block %d: %s\n", block.ID, context.Title)
+	fmt.Printf("  hash:       %s\n", block.ContentHash)
+	fmt.Printf("  created:    %s\n", output.FullTime(block.CreatedAt, now))
+	fmt.Printf("  updated:    %s\n", output.FullTime(block.UpdatedAt, now))
+	fmt.Printf("  touched:    %d time(s)\n", block.TouchCount)
+	fmt.Printf("  visibility: %s\n", context.Visibility)
+	if len(context.Tags) > 0 {
+		fmt.Printf("  tags:       %s\n", "#"+strings.Join(context.Tags, " #"))
+	}
+	for _, filePath := range context.Files {
+		fmt.Printf("  file:       %s\n", filePath)
+	}
+	for _, key := range sortedKeys(context.Meta) {
+		fmt.Printf("  %s=%s\n", key, context.Meta[key])
+	}
+	for _, linked := range context.References {
+		fmt.Printf("  references:    %d: %s\n", linked.ID, linked.Title)
+	}
+	for _, linked := range context.ReferencedBy {
+		fmt.Printf("  referenced by: %d: %s\n", linked.ID, linked.Title)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const userConfigDirName = "gravitynotes"
+
+// UserConfig is the per-user configuration in
+// $XDG_CONFIG_HOME/gravitynotes/config.json. It names repositories so they can
+// be selected with -r/--repo or NOTES_PROFILE from any directory.
+type UserConfig struct {
+	DefaultProfile string              `json:"default_profile,omitempty"`
+	Profiles       map[string]Profile  `json:"profiles,omitempty"`
+	Aliases        map[string][]string `json:"aliases,omitempty"`
+}
+
+// Profile locates one repository. DB and Notes default to notes.db and
+// notes.md inside Path.
+type Profile struct {
+	Path  string `json:"path"`
+	DB    string `json:"db,omitempty"`
+	Notes string `json:"notes,omitempty"`
+}
+
+func userConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate user config directory: %w", err)
+	}
+	return filepath.Join(dir, userConfigDirName, ConfigFileName), nil
+}
+
+// LoadUserConfig reads the user config. A missing file is an empty config.
+func LoadUserConfig() (*UserConfig, error) {
+	userConfig := &UserConfig{}
+
+	configPath, err := userConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	if !fileExists(configPath) {
+		return userConfig, nil
+	}
+
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user config %s: %w", configPath, err)
+	}
+	if err := json.Unmarshal(content, userConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse user config %s: %w", configPath, err)
+	}
+
+	return userConfig, nil
+}
+
+// Profile returns the named profile with its paths expanded and defaulted.
+func (u *UserConfig) Profile(name string) (Profile, error) {
+	profile, ok := u.Profiles[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("unknown profile %q (available: %s)", name, strings.Join(u.ProfileNames(), ", "))
+	}
+	if profile.Path == "" {
+		return Profile{}, fmt.Errorf("profile %q has no path", name)
+	}
+
+	profile.Path = expandHome(profile.Path)
+	if profile.DB == "" {
+		profile.DB = filepath.Join(profile.Path, "notes.db")
+	}
+	if profile.Notes == "" {
+		profile.Notes = filepath.Join(profile.Path, "notes.md")
+	}
+	profile.DB = resolveAgainst(profile.Path, expandHome(profile.DB))
+	profile.Notes = resolveAgainst(profile.Path, expandHome(profile.Notes))
+
+	return profile, nil
+}
+
+func (u *UserConfig) ProfileNames() []string {
+	names := make([]string, 0, len(u.Profiles))
+	for name := range u.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") && !strings.HasPrefix(path, "~"+string(filepath.Separator)) {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
+
+func resolveAgainst(base, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(base, path)
+}
+
+func handleProfiles() {
+	userConfig, err := LoadUserConfig()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(userConfig.Profiles) == 0 {
+		configPath, _ := userConfigPath()
+		fmt.Printf("No profiles configured. Add them to %s\n", configPath)
+		return
+	}
+
+	for _, name := range userConfig.ProfileNames() {
+		profile, err := userConfig.Profile(name)
+		if err != nil {
+			fmt.Printf("  %s: %v\n", name, err)
+			continue
+		}
+
+		marker := " "
+		if name == userConfig.DefaultProfile {
+			marker = "*"
+		}
+		fmt.Printf("%s %-12s %s\n", marker, name, profile.Path)
+	}
+}
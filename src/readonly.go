@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+var (
+	// readOnly is set by --read-only, or when the database can't be
+	// written, e.g. in a snapshot or on a mounted backup. The database is
+	// then opened so SQLite refuses writes, and generated files are left
+	// alone.
+	readOnly       bool
+	readOnlyReason = "opened with --read-only"
+)
+
+// mutatingCommands always change the repository, so read-only mode refuses
+// them before opening it. Commands that only change it with some arguments
+// check with requireWritable.
+var mutatingCommands = map[string]bool{
+	"add": true, "clip": true, "web": true, "mail-ingest": true, "bot": true, "daily": true, "review": true, "log-work": true, "edit": true, "append": true,
+	"watch": true, "unwatch": true, "watcher": true, "ingest": true, "import-dir": true, "import-roam": true,
+	"retag": true, "tag": true, "bulkedit": true, "split": true, "dedupe": true, "merge": true,
+	"undo": true, "touch": true, "regenerate": true, "reconcile": true, "sync": true,
+	"restore-backup": true, "rehash": true, "encrypt": true, "decrypt": true,
+}
+
+// databaseWritable reports whether the database file can be opened for
+// writing. Errors other than missing permission, such as the file being
+// busy, are left for opening it to report.
+func databaseWritable(path string) bool {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return !os.IsPermission(err) && !errors.Is(err, syscall.EROFS)
+	}
+	file.Close()
+	return true
+}
+
+// requireWritable exits with an error naming action if the repository is
+// read-only.
+func requireWritable(action string) {
+	if !readOnly {
+		return
+	}
+	fmt.Printf("Error: the repository is read-only (%s), so %s can't change it\n", readOnlyReason, action)
+	os.Exit(1)
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 const LastReconciliationTimeKey = "last_reconciliation_time"
@@ -10,118 +15,933 @@ const LastReconciliationTimeKey = "last_reconciliation_time"
 type Reconciler struct {
 	db          *Database
 	fileManager *FileManager
+	settings    FileConfig
+	hooks       *HookRunner
+	repoDir     string
+	assetPrefix string // how asset links are written in this file
+	ignoreRules *IgnoreRules
+	config      *Config
+
+	// backupBeforeDeleting makes a reconcile deleting more blocks than
+	// backup.delete_threshold take a backup first. The watcher daemon sets
+	// it, as a safety net against bad syncs it runs unattended.
+	backupBeforeDeleting bool
+
+	// force lets a reconcile through the deletion guard in limits.go.
+	force bool
+
+	// preserveDates dates the blocks an ingest or a file's first reconcile
+	// creates by the file's SourceTime instead of now, so imported archives
+	// don't crowd the top of recency ordering.
+	preserveDates bool
 }
 
-func NewReconciler(db *Database, fileManager *FileManager) *Reconciler {
+func NewReconciler(db *Database, fileManager *FileManager, config *Config) *Reconciler {
+	fileManager.skipUnchanged = config.SkipUnchanged
 	return &Reconciler{
 		db:          db,
 		fileManager: fileManager,
+		settings:    config.FileConfig(fileManager.GetNotesPath()),
+		hooks:       NewHookRunner(config.HooksDir()),
+		repoDir:     config.basePath,
+		assetPrefix: assetLinkPrefix(config.basePath, filepath.Dir(fileManager.GetNotesPath())),
+		ignoreRules: config.ignoreRules,
+		config:      config,
 	}
 }
 
 func (r *Reconciler) RegenerateMarkdownFile() error {
-	blocks, err := r.db.GetAllBlocks()
+	if skipRegeneration {
+		debugf("skipping regeneration of %s", r.fileManager.GetNotesPath())
+		return nil
+	}
+
+	orderer, err := GetOrderer(r.settings.Order)
 	if err != nil {
-		return fmt.Errorf("failed to get blocks from database: %w", err)
+		return err
 	}
 
-	content := BlocksToMarkdown(blocks)
+	var count int
+	for attempt := 1; ; attempt++ {
+		if ok, err := r.reconcilePendingEdits(); err != nil || !ok {
+			return err
+		}
+
+		// Orders the database can produce are streamed from it, so large
+		// stores aren't held in memory; the rest, and workspaces, need every
+		// block
+		if sqlOrderer, ok := orderer.(SQLOrderer); ok && !r.settings.Layout.hasWorkspaces() {
+			count, err = r.streamMarkdownFile(sqlOrderer.OrderBy())
+		} else {
+			count, err = r.renderMarkdownFile(orderer)
+		}
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrFileChanged) {
+			return err
+		}
+		if attempt == maxRegenerateAttempts {
+			log.Printf("Warning: left %s alone, it kept changing while it was regenerated", r.fileManager.GetNotesPath())
+			return nil
+		}
+		infof("%s was saved while it was regenerated, starting over", r.fileManager.GetNotesPath())
+	}
+
+	// A watched notes.md is merged against what was written, like other
+	// watched files
+	if watched, err := r.isWatched(); err != nil {
+		return err
+	} else if watched {
+		content, err := r.fileManager.ReadMarkdownFile()
+		if err != nil {
+			return err
+		}
+		if err := r.db.SetFileSnapshot(r.fileManager.GetNotesPath(), content); err != nil {
+			return err
+		}
+	}
+
+	infof("Regenerated markdown file with %d blocks", count)
+	return regenerateMirrors(r.db, r.config)
+}
+
+// renderMarkdownFile builds notes.md in memory and writes it.
+func (r *Reconciler) renderMarkdownFile(orderer BlockOrderer) (int, error) {
+	content, count, err := r.markdownFileContent(orderer, nil)
+	if err != nil {
+		return 0, err
+	}
 
 	if err := r.fileManager.WriteMarkdownFile(content); err != nil {
-		return fmt.Errorf("failed to write markdown file: %w", err)
+		return 0, fmt.Errorf("failed to write markdown file: %w", err)
+	}
+	return count, nil
+}
+
+// markdownFileContent returns the content of notes.md and the number of
+// blocks in it, leaving out those a non-nil filter hides.
+func (r *Reconciler) markdownFileContent(orderer BlockOrderer, filter *VisibilityFilter) (string, int, error) {
+	blocks, err := r.db.GetGlobalBlocks()
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to get blocks from database: %w", err)
+	}
+	blocks = filter.Filter(blocks)
+
+	blocksMarkdown, err := r.settings.Layout.Render(blocks, orderer, r.fileManager.GetNotesPath(), time.Now())
+	if err != nil {
+		return "", 0, err
+	}
+	blocksMarkdown, err = expandBlockRefs(r.db, r.config, filter, blocksMarkdown, r.fileManager.GetNotesPath(), r.settings.References)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to expand block references: %w", err)
+	}
+	content, err := r.wrapPassthrough(blocksMarkdown)
+	if err != nil {
+		return "", 0, err
+	}
+	return content, len(blocks), nil
+}
+
+// ExportMarkdownFile returns notes.md with only the blocks filter allows.
+func (r *Reconciler) ExportMarkdownFile(filter *VisibilityFilter) (string, error) {
+	orderer, err := GetOrderer(r.settings.Order)
+	if err != nil {
+		return "", err
+	}
+	content, _, err := r.markdownFileContent(orderer, filter)
+	return content, err
+}
+
+// IsMarkdownFileInSync reports whether notes.md on disk matches what would
+// be generated from the database.
+func (r *Reconciler) IsMarkdownFileInSync() (bool, error) {
+	orderer, err := GetOrderer(r.settings.Order)
+	if err != nil {
+		return false, err
+	}
+	expected, _, err := r.markdownFileContent(orderer, nil)
+	if err != nil {
+		return false, err
 	}
 
-	log.Printf("Regenerated markdown file with %d blocks", len(blocks))
+	actual, err := r.fileManager.ReadMarkdownFile()
+	if err != nil {
+		return false, err
+	}
+	return actual == expected, nil
+}
+
+// streamMarkdownFile writes notes.md one block at a time as the database
+// returns them in orderBy order. It produces the same file as
+// renderMarkdownFile.
+func (r *Reconciler) streamMarkdownFile(orderBy string) (int, error) {
+	filePath := r.fileManager.GetNotesPath()
+	now := time.Now()
+
+	layout, err := r.passthroughLayout()
+	if err != nil {
+		return 0, err
+	}
+	total, err := r.db.CountGlobalBlocks()
+	if err != nil {
+		return 0, err
+	}
+	header, footer, err := r.settings.Layout.decorations(total, filePath, now)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = r.fileManager.StreamMarkdownFile(func(w io.Writer) error {
+		file := &finalNewlineWriter{w: w}
+		sections := &sectionWriter{w: file}
+		for _, section := range []string{layout.FrontMatter, layout.Header, header} {
+			if err := sections.Write(section); err != nil {
+				return err
+			}
+		}
+
+		blocks := r.settings.Layout.newBlockWriter(sections, now)
+		err := r.db.IterateGlobalBlocks(orderBy, func(block *Block) error {
+			content, err := expandBlockRefs(r.db, r.config, nil, block.Content, filePath, r.settings.References)
+			if err != nil {
+				return fmt.Errorf("failed to expand block references: %w", err)
+			}
+			return blocks.WriteBlock(block, content)
+		})
+		if err != nil {
+			return err
+		}
+		count = blocks.count
+
+		for _, section := range []string{footer, layout.Footer} {
+			if err := sections.Write(section); err != nil {
+				return err
+			}
+		}
+		return file.Close()
+	})
+	return count, err
+}
+
+// AddBlocks stores blocks created outside of any file (CLI, bots) and
+// regenerates the markdown file. Blocks whose content already exists are
+// deduplicated by marking the existing block touched.
+func (r *Reconciler) AddBlocks(blocks []*Block) (*ChangeSet, error) {
+	changes := NewChangeSet("")
+	for _, block := range blocks {
+		if block.IsEmpty() {
+			continue
+		}
+
+		existing, err := r.db.GetBlockByHash(block.ContentHash)
+		if err != nil {
+			return changes, fmt.Errorf("failed to get block by hash: %w", err)
+		}
+
+		if existing != nil {
+			if err := r.db.UpdateBlockTimestamp(block.ContentHash, block.UpdatedAt); err != nil {
+				return changes, err
+			}
+			bumped := *existing
+			bumped.UpdatedAt = block.UpdatedAt
+			bumped.TouchCount++
+			changes.AddUpdate(existing, &bumped)
+			continue
+		}
+
+		if err := r.db.CreateBlock(block); err != nil {
+			return changes, fmt.Errorf("failed to create block: %w", err)
+		}
+		changes.Added = append(changes.Added, block)
+	}
+
+	if err := r.RegenerateMarkdownFile(); err != nil {
+		return changes, err
+	}
+
+	r.recordOperation(OperationAdd, changes)
+	r.hooks.RunPost(HookPostAdd, changes)
+	return changes, nil
+}
+
+// TouchBlocks bumps existing blocks to the top of recency-ordered files as if
+// they had just been edited, and regenerates the markdown file.
+func (r *Reconciler) TouchBlocks(blocks []*Block) (*ChangeSet, error) {
+	changes := NewChangeSet("")
+	now := time.Now()
+	for _, block := range blocks {
+		if err := r.db.UpdateBlockTimestamp(block.ContentHash, now); err != nil {
+			return changes, err
+		}
+		touched := *block
+		touched.UpdatedAt = now
+		touched.TouchCount++
+		changes.AddUpdate(block, &touched)
+	}
+
+	if err := r.RegenerateMarkdownFile(); err != nil {
+		return changes, err
+	}
+
+	r.recordOperation(OperationUpdate, changes)
+	return changes, nil
+}
+
+// IngestTaggedBlocks imports the blocks of a markdown file that isn't watched,
+// appending #tag to each block that doesn't already carry it. Blocks already
+// in the store, with or without the tag, are skipped. It returns the change
+// set and the number of skipped blocks.
+func (r *Reconciler) IngestTaggedBlocks(filePath, tag string) (*ChangeSet, int, error) {
+	changes := NewChangeSet(filePath)
+
+	added, skipped, err := r.taggedBlocksToIngest(filePath, tag, make(map[string]bool))
+	if err != nil {
+		return changes, skipped, err
+	}
+	changes.Added = added
+
+	if err := r.storeIngestedBlocks(changes); err != nil {
+		return changes, skipped, err
+	}
+	return changes, skipped, nil
+}
+
+// taggedBlocksToIngest reads the blocks IngestTaggedBlocks would add from
+// filePath, skipping blocks already in the store or in seen, which it adds
+// the new blocks to.
+func (r *Reconciler) taggedBlocksToIngest(filePath, tag string, seen map[string]bool) ([]*Block, int, error) {
+	content, err := r.fileManager.ReadExternalMarkdownFile(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	parsedBlocks := ParseBlocksFromMarkdown(content)
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "#")
+
+	var candidates []*Block
+	var hashes []string
+	for _, block := range parsedBlocks {
+		hashes = append(hashes, block.ContentHash)
+		if tag != "" && !block.HasTag(tag) {
+			tagged := NewBlock(block.Content + "\n#" + tag)
+			candidates = append(candidates, tagged)
+			hashes = append(hashes, tagged.ContentHash)
+		} else {
+			candidates = append(candidates, block)
+		}
+	}
+
+	existing, err := r.db.GetBlocksByHashes(hashes)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to look up existing blocks: %w", err)
+	}
+
+	var added []*Block
+	skipped := 0
+	for i, block := range candidates {
+		original := parsedBlocks[i]
+		if existing[original.ContentHash] != nil || existing[block.ContentHash] != nil || seen[block.ContentHash] {
+			skipped++
+			continue
+		}
+		seen[block.ContentHash] = true
+		added = append(added, block)
+	}
+
+	if r.preserveDates {
+		if err := dateFromSource(added, filePath, content); err != nil {
+			return nil, skipped, err
+		}
+	}
+	return added, skipped, nil
+}
+
+// storeIngestedBlocks creates the blocks added by an ingest, regenerates the
+// markdown file and records the operation.
+func (r *Reconciler) storeIngestedBlocks(changes *ChangeSet) error {
+	if err := r.db.CreateBlocks(changes.Added); err != nil {
+		return fmt.Errorf("failed to create blocks: %w", err)
+	}
+
+	if err := r.RegenerateMarkdownFile(); err != nil {
+		return err
+	}
+
+	r.recordOperation(OperationIngest, changes)
+	r.hooks.RunPost(HookPostAdd, changes)
 	return nil
 }
 
-func (r *Reconciler) ReconcileFromSpecificFile() error {
+// UpdateBlock replaces the content of an existing block and regenerates the
+// markdown file.
+func (r *Reconciler) UpdateBlock(oldHash, content string) (*ChangeSet, error) {
+	return r.UpdateBlocks([]BlockEdit{{Hash: oldHash, Content: content}})
+}
+
+// BlockEdit is new content for the block with Hash.
+type BlockEdit struct {
+	Hash    string
+	Content string
+}
+
+// UpdateBlocks applies edits as one operation and regenerates the markdown
+// file once.
+func (r *Reconciler) UpdateBlocks(edits []BlockEdit) (*ChangeSet, error) {
+	changes := NewChangeSet("")
+
+	for _, edit := range edits {
+		before, err := r.db.GetBlockByHash(edit.Hash)
+		if err != nil {
+			return changes, err
+		}
+		if before == nil {
+			return changes, fmt.Errorf("block %.12s not found", edit.Hash)
+		}
+
+		// If the new content already exists the old block is merged into it
+		mergeTarget, err := r.db.GetBlockByHash(NewBlock(edit.Content).ContentHash)
+		if err != nil {
+			return changes, err
+		}
+
+		after, err := r.db.UpdateBlockContent(edit.Hash, edit.Content)
+		if err != nil {
+			return changes, err
+		}
+
+		switch {
+		case after == nil || after.ContentHash == edit.Hash:
+		case mergeTarget != nil:
+			changes.Deleted = append(changes.Deleted, before)
+			changes.AddUpdate(mergeTarget, after)
+		default:
+			changes.AddUpdate(before, after)
+		}
+	}
+
+	if err := r.RegenerateMarkdownFile(); err != nil {
+		return changes, err
+	}
+
+	r.recordOperation(OperationUpdate, changes)
+	r.hooks.RunPost(HookPostUpdate, changes)
+	return changes, nil
+}
+
+// DeleteBlocks removes blocks from the database and every file they are in.
+// Files are not regenerated.
+func (r *Reconciler) DeleteBlocks(blocks []*Block) (*ChangeSet, error) {
+	changes := NewChangeSet("")
+	changes.Files = make(map[string][]string)
+
+	var hashes []string
+	for _, block := range blocks {
+		files, err := r.db.GetBlockFiles(block.ContentHash)
+		if err != nil {
+			return changes, err
+		}
+		if len(files) > 0 {
+			changes.Files[block.ContentHash] = files
+		}
+		hashes = append(hashes, block.ContentHash)
+	}
+
+	if err := r.db.DeleteBlocksByHashes(hashes); err != nil {
+		return changes, err
+	}
+	changes.Deleted = append(changes.Deleted, blocks...)
+
+	r.recordOperation(OperationDelete, changes)
+	return changes, nil
+}
+
+func (r *Reconciler) ReconcileFromSpecificFile() (*ChangeSet, error) {
+	filePath := r.fileManager.GetNotesPath()
+	changes := NewChangeSet(filePath)
+
+	// Edits to a mirror are overwritten, never read back
+	if r.settings.Mirror {
+		return changes, nil
+	}
+
+	if err := r.hooks.Run(HookPreReconcile, NewChangeSet(filePath)); err != nil {
+		return changes, fmt.Errorf("reconciliation vetoed: %w", err)
+	}
+
 	// Read the file content
 	content, err := r.fileManager.ReadMarkdownFile()
 	if err != nil {
-		return fmt.Errorf("failed to read file %s: %w", r.fileManager.notesPath, err)
+		return changes, fmt.Errorf("failed to read file %s: %w", filePath, err)
 	}
 
-	// Parse blocks from the file
-	parsedFileBlocks := ParseBlocksFromMarkdown(content)
+	// Parse blocks from the file, with asset links relative to the repository
+	parsedFileBlocks := r.settings.Layout.sectionBlocks(r.parseFileSections(content), true)
 
-	// Get current block hashes associated with this file
-	currentlyAssociatedHashes, err := r.db.GetFileBlockHashes(r.fileManager.notesPath)
+	// Get current blocks associated with this file
+	associatedBlocks, err := r.db.GetFileBlocks(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to get current file blocks: %w", err)
+		return changes, fmt.Errorf("failed to get current file blocks: %w", err)
 	}
 
-	// Process blocks from file
-	newAssociatedHashes := make(map[string]bool)
-	for _, parsedBlock := range parsedFileBlocks {
-		if parsedBlock.IsEmpty() {
-			continue
+	// The last generated version of the file is the common ancestor of the
+	// file and the database. Without one, assume the file was in sync.
+	snapshotBlocks := associatedBlocks
+	snapshot, hasSnapshot, err := r.db.GetFileSnapshot(filePath)
+	if err != nil {
+		return changes, err
+	}
+	if hasSnapshot {
+		snapshotBlocks = r.parseFileBlocks(snapshot)
+	}
+
+	merge := ThreeWayMerge(snapshotBlocks, parsedFileBlocks, associatedBlocks)
+	debugf("%s: %d blocks in file, %d in database, %d in snapshot: keeping %d, deleting %d, %d conflicts",
+		filePath, len(parsedFileBlocks), len(associatedBlocks), len(snapshotBlocks), len(merge.Keep), len(merge.Delete), len(merge.Conflicts))
+
+	// Leave the database alone if the file lost suspiciously many blocks
+	if !r.force {
+		if err := checkDeletions(filePath, len(merge.Delete), len(associatedBlocks)); err != nil {
+			return changes, err
 		}
+	}
+
+	// A file that was never reconciled before may be an archive
+	if r.preserveDates && !hasSnapshot {
+		if err := dateFromSource(merge.Keep, filePath, content); err != nil {
+			return changes, err
+		}
+	}
 
-		newAssociatedHashes[parsedBlock.ContentHash] = true
+	// Work out every change before making any, so they are made in one
+	// transaction
+	created, hashes, err := r.newFileBlocks(merge.Keep)
+	if err != nil {
+		return changes, err
+	}
+	changes.Added = append(changes.Added, created...)
+
+	// Remember where each block sits in the file so regeneration can keep
+	// the author's order
+	var positions []string
+	positionOf := make(map[string]int)
+	for _, block := range parsedFileBlocks {
+		if _, seen := positionOf[block.ContentHash]; !seen && !block.IsEmpty() {
+			positionOf[block.ContentHash] = len(positions)
+			positions = append(positions, block.ContentHash)
+		}
+	}
 
-		// Check if identical block already exists in database
-		preexistingBlock, err := r.db.GetBlockByHash(parsedBlock.ContentHash)
+	// Keep both sides of blocks edited in the file and the database
+	var replaced []string
+	stored := make(map[string]bool)
+	for _, block := range created {
+		stored[block.ContentHash] = true
+	}
+	for _, conflict := range merge.Conflicts {
+		conflictBlock := NewBlock(conflict.Content())
+		existing, err := r.db.GetBlockByHash(conflictBlock.ContentHash)
 		if err != nil {
-			return fmt.Errorf("failed to get block by hash: %w", err)
+			return changes, fmt.Errorf("failed to get block by hash: %w", err)
+		}
+		if existing == nil && !stored[conflictBlock.ContentHash] {
+			stored[conflictBlock.ContentHash] = true
+			created = append(created, conflictBlock)
+			changes.Added = append(changes.Added, conflictBlock)
 		}
+		hashes = append(hashes, conflictBlock.ContentHash)
+		changes.Conflicts = append(changes.Conflicts, conflictBlock)
 
-		if preexistingBlock == nil {
-			// if not, we add it
-			if err := r.db.CreateBlock(parsedBlock); err != nil {
-				return fmt.Errorf("failed to create new block: %w", err)
-			}
-			log.Printf("Created new block with hash: %s", parsedBlock.ContentHash)
+		replaced = append(replaced, conflict.DB.ContentHash)
+		changes.Deleted = append(changes.Deleted, conflict.DB)
+		if i, ok := positionOf[conflict.File.ContentHash]; ok {
+			positions[i] = conflictBlock.ContentHash
 		}
+	}
 
-		// Add file-block association - ignores duplicates automatically
-		if err := r.db.AddFileBlockAssociation(r.fileManager.notesPath, parsedBlock.ContentHash); err != nil {
-			return fmt.Errorf("failed to add file-block association: %w", err)
+	// Remove blocks that are no longer in the file. This deletes them
+	// entirely from the database (global deletion), except where a local
+	// file is involved and only the association goes.
+	deleted, detached, err := r.splitDeletions(merge.Delete)
+	if err != nil {
+		return changes, err
+	}
+	if threshold := r.config.BackupDeleteThreshold(); r.backupBeforeDeleting && threshold > 0 && len(deleted) > threshold {
+		reason := fmt.Sprintf("%d blocks about to be deleted by %s", len(deleted), filePath)
+		if err := AutoBackup(r.db, r.config, time.Now(), reason); err != nil {
+			return changes, fmt.Errorf("failed to back up before deleting %d blocks: %w", len(deleted), err)
+		}
+	}
+	var deletedBlocks map[string]*Block
+	if len(deleted) > 0 {
+		if deletedBlocks, err = r.db.GetBlocksByHashes(deleted); err != nil {
+			return changes, fmt.Errorf("failed to get deleted blocks: %w", err)
 		}
 	}
 
-	// Remove blocks that are no longer in the file
-	// This will delete them entirely from the database (global deletion)
-	for _, hash := range currentlyAssociatedHashes {
-		if !newAssociatedHashes[hash] {
-			// Block was deleted from this file - delete it entirely from database
-			if err := r.db.DeleteBlockByHash(hash); err != nil {
-				return fmt.Errorf("failed to delete block: %w", err)
-			}
-			log.Printf("Deleted block with hash: %s (removed from %s)", hash, r.fileManager.notesPath)
+	// Keep a copy for `notes deleted` before anything is lost
+	var trashed []*Block
+	for _, hash := range deleted {
+		if deletedBlock := deletedBlocks[hash]; deletedBlock != nil {
+			trashed = append(trashed, deletedBlock)
+		}
+	}
+
+	err = r.db.ApplyFileBlockChanges(&FileBlockChanges{
+		FilePath:   filePath,
+		Created:    created,
+		Local:      r.settings.Local,
+		Associated: hashes,
+		Positions:  positions,
+		Detached:   detached,
+		Trashed:    trashed,
+		Deleted:    append(replaced, deleted...),
+	})
+	if err != nil {
+		return changes, err
+	}
+
+	for _, block := range created {
+		infof("Created new block with hash: %s", block.ContentHash)
+	}
+	for _, conflictBlock := range changes.Conflicts {
+		log.Printf("Conflict in %s: block edited in both file and database, wrote conflict block %s",
+			filePath, conflictBlock.ContentHash)
+	}
+	for _, hash := range detached {
+		infof("Detached block with hash: %s from %s", hash, filePath)
+	}
+	for _, hash := range deleted {
+		if deletedBlock := deletedBlocks[hash]; deletedBlock != nil {
+			changes.Deleted = append(changes.Deleted, deletedBlock)
 		}
+		infof("Deleted block with hash: %s (removed from %s)", hash, filePath)
 	}
 
+	if err := r.db.SetFileSnapshot(filePath, content); err != nil {
+		return changes, err
+	}
+
+	frontMatter, _ := SplitFrontMatter(content)
+	if err := r.db.SetFileFrontMatter(filePath, frontMatter); err != nil {
+		return changes, err
+	}
+
+	r.recordOperation(OperationReconcile, changes)
+	r.hooks.RunPost(HookPostReconcile, changes)
+	return changes, nil
+}
+
+// dateFromSource sets the creation and update time of blocks to the
+// SourceTime of the file at path.
+func dateFromSource(blocks []*Block, path, content string) error {
+	sourceTime, err := SourceTime(path, content)
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		block.CreatedAt, block.UpdatedAt = sourceTime, sourceTime
+	}
 	return nil
 }
 
-func (r *Reconciler) RegenerateSpecificFile() error {
-	// Get block hashes for this file
-	hashes, err := r.db.GetFileBlockHashes(r.fileManager.notesPath)
+// newFileBlocks returns the blocks that don't exist yet and the hashes of
+// all of them, to be associated with the reconciler's file, using one
+// lookup regardless of file size.
+func (r *Reconciler) newFileBlocks(blocks []*Block) (created []*Block, hashes []string, err error) {
+	unique := make(map[string]*Block)
+	for _, block := range blocks {
+		if block.IsEmpty() || unique[block.ContentHash] != nil {
+			continue
+		}
+		unique[block.ContentHash] = block
+		hashes = append(hashes, block.ContentHash)
+	}
+
+	// Check which blocks already exist in database
+	existing, err := r.db.GetBlocksByHashes(hashes)
 	if err != nil {
-		return fmt.Errorf("failed to get file block hashes: %w", err)
+		return nil, nil, fmt.Errorf("failed to get blocks by hash: %w", err)
+	}
+
+	for _, hash := range hashes {
+		if existing[hash] == nil {
+			created = append(created, unique[hash])
+		}
+	}
+	if err := checkNewBlockCount(r.fileManager.GetNotesPath(), len(created)); err != nil {
+		return nil, nil, err
+	}
+	return created, hashes, nil
+}
+
+// splitDeletions sorts the blocks removed from the file into those to
+// delete everywhere and those to only detach from the file. A local file
+// detaches its blocks, deleting only its own blocks that no other file
+// holds; other files detach blocks that a local file still holds.
+func (r *Reconciler) splitDeletions(hashes []string) (deleted, detached []string, err error) {
+	if len(hashes) == 0 {
+		return nil, nil, nil
+	}
+	filePath := r.fileManager.GetNotesPath()
+
+	var localFiles map[string]string
+	if r.settings.Local {
+		if localFiles, err = r.db.GetLocalBlockFiles(); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	// Get actual blocks for these hashes
-	var blocks []*Block
 	for _, hash := range hashes {
-		block, err := r.db.GetBlockByHash(hash)
+		files, err := r.db.GetBlockFiles(hash)
 		if err != nil {
-			return fmt.Errorf("failed to get block by hash: %w", err)
+			return nil, nil, err
+		}
+
+		held := false
+		for _, other := range files {
+			if other != filePath && (r.settings.Local || r.config.FileConfig(other).Local) {
+				held = true
+				break
+			}
 		}
-		if block != nil {
-			blocks = append(blocks, block)
+		if r.settings.Local && localFiles[hash] != filePath {
+			held = true
+		}
+
+		if held {
+			detached = append(detached, hash)
+		} else {
+			deleted = append(deleted, hash)
 		}
 	}
+	return deleted, detached, nil
+}
 
-	// Convert to markdown
-	content := BlocksToMarkdown(blocks)
+// parseFileBlocks parses the blocks of content read from the file, leaving
+// out passthrough regions and workspace headings and rewriting block
+// references and asset links back to the form stored in blocks.
+func (r *Reconciler) parseFileBlocks(content string) []*Block {
+	return r.settings.Layout.sectionBlocks(r.parseFileSections(content), false)
+}
 
-	// Write to file
-	if err := r.fileManager.WriteMarkdownFile(content); err != nil {
-		return fmt.Errorf("failed to write file: %w", err)
+// parseFileSections is parseFileBlocks with workspace headings left in, for
+// tagging the blocks under them.
+func (r *Reconciler) parseFileSections(content string) []*Block {
+	body := SplitPassthrough(collapseBlockRefs(content), r.ignoreRules, r.settings.Layout).Body
+	return r.settings.Layout.ParseBlocks(relinkAssets(body, r.assetPrefix, AssetsDirName+"/"))
+}
+
+// wrapPassthrough surrounds generated block markdown with the front matter
+// stored for the file and the passthrough regions of the file as it
+// currently is on disk.
+func (r *Reconciler) wrapPassthrough(blocksMarkdown string) (string, error) {
+	layout, err := r.passthroughLayout()
+	if err != nil {
+		return "", err
+	}
+	return layout.Wrap(blocksMarkdown), nil
+}
+
+// passthroughLayout returns the front matter stored for the file and the
+// passthrough regions of the file as it currently is on disk. Files whose
+// front matter was never stored keep the front matter they have on disk.
+func (r *Reconciler) passthroughLayout() (FileLayout, error) {
+	current, err := r.fileManager.ReadMarkdownFile()
+	if err != nil {
+		return FileLayout{}, err
+	}
+
+	layout := SplitPassthrough(collapseBlockRefs(current), r.ignoreRules, r.settings.Layout)
+	stored, err := r.db.GetFileFrontMatter(r.fileManager.GetNotesPath())
+	if err != nil {
+		return FileLayout{}, err
+	}
+	if stored != "" {
+		layout.FrontMatter = stored
+	}
+	return layout, nil
+}
+
+// maxRegenerateAttempts bounds how often regenerating a file starts over
+// because it was saved again meanwhile.
+const maxRegenerateAttempts = 3
+
+// isWatched reports whether the file is watched, so edits to it are read
+// back. Edits to mirrors are overwritten.
+func (r *Reconciler) isWatched() (bool, error) {
+	if r.settings.Mirror {
+		return false, nil
+	}
+	return r.db.IsFileWatched(CanonicalPath(r.fileManager.GetNotesPath()))
+}
+
+// hasPendingEdits reports whether the watched file was edited since it was
+// last reconciled or generated: its reconcile is still pending, or was
+// running when the file was saved again. Regenerating the file now would
+// overwrite those edits.
+func (r *Reconciler) hasPendingEdits() (bool, error) {
+	filePath := r.fileManager.GetNotesPath()
+	if !fileExists(filePath) {
+		return false, nil
+	}
+	if watched, err := r.isWatched(); err != nil || !watched {
+		return false, err
+	}
+
+	current, err := r.fileManager.ReadMarkdownFile()
+	if err != nil {
+		return false, err
+	}
+	snapshot, ok, err := r.db.GetFileSnapshot(filePath)
+	if err != nil {
+		return false, err
+	}
+	// A file that was never reconciled is only in sync while it is empty
+	if !ok {
+		return len(r.parseFileBlocks(current)) > 0, nil
+	}
+	return current != snapshot, nil
+}
+
+// reconcilePendingEdits reconciles the file before it is regenerated if it
+// has edits that weren't read back yet, so they are merged instead of
+// overwritten. Blocks edited both there and in the database become
+// conflict blocks with both versions between git-style markers. It reports
+// false, after logging why, if the file should be left alone because the
+// edits couldn't be reconciled.
+func (r *Reconciler) reconcilePendingEdits() (bool, error) {
+	pending, err := r.hasPendingEdits()
+	if err != nil || !pending {
+		return err == nil, err
+	}
+
+	filePath := r.fileManager.GetNotesPath()
+	infof("%s was edited since it was last read, reconciling it before regenerating it", filePath)
+	if _, err := r.ReconcileFromSpecificFile(); err != nil {
+		log.Printf("Warning: left %s alone, its edits couldn't be reconciled: %v", filePath, err)
+		return false, nil
+	}
+	return true, nil
+}
+
+// recordOperation journals changes so they can be undone and refreshes the
+// block link graph. Failures don't undo the operation itself, so they are
+// only logged.
+func (r *Reconciler) recordOperation(kind string, changes *ChangeSet) {
+	if changes.IsEmpty() {
+		return
+	}
+	if err := r.db.RecordOperation(kind, changes); err != nil {
+		log.Printf("Warning: failed to record %s operation: %v", kind, err)
+	}
+	if err := RebuildBlockLinks(r.db); err != nil {
+		log.Printf("Warning: failed to update block links: %v", err)
+	}
+}
+
+// renderSpecificFile returns the content RegenerateSpecificFile would write
+// and the number of blocks in it.
+func (r *Reconciler) renderSpecificFile() (string, int, error) {
+	orderer, err := GetOrderer(r.settings.Order)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// Get blocks associated with this file, or all of them for a mirror
+	var blocks []*Block
+	if r.settings.Mirror {
+		blocks, err = r.mirrorBlocks(orderer)
+	} else {
+		blocks, err = r.db.GetFileBlocks(r.fileManager.GetNotesPath())
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to get file blocks: %w", err)
+	}
+
+	// Convert to markdown, pointing asset links at the repository's assets
+	blocksMarkdown, err := r.settings.Layout.Render(blocks, orderer, r.fileManager.GetNotesPath(), time.Now())
+	if err != nil {
+		return "", 0, err
+	}
+	blocksMarkdown, err = expandBlockRefs(r.db, r.config, nil, blocksMarkdown, r.fileManager.GetNotesPath(), r.settings.References)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to expand block references: %w", err)
+	}
+	content, err := r.wrapPassthrough(relinkAssets(blocksMarkdown, AssetsDirName+"/", r.assetPrefix))
+	if err != nil {
+		return "", 0, err
+	}
+	return content, len(blocks), nil
+}
+
+// IsFileInSync reports whether the file on disk matches what would be
+// generated from the database.
+func (r *Reconciler) IsFileInSync() (bool, error) {
+	expected, _, err := r.renderSpecificFile()
+	if err != nil {
+		return false, err
+	}
+
+	actual, err := r.fileManager.ReadMarkdownFile()
+	if err != nil {
+		return false, err
+	}
+
+	return actual == expected, nil
+}
+
+func (r *Reconciler) RegenerateSpecificFile() error {
+	if skipRegeneration {
+		debugf("skipping regeneration of %s", r.fileManager.GetNotesPath())
+		return nil
+	}
+
+	var content string
+	var blockCount int
+	for attempt := 1; ; attempt++ {
+		if ok, err := r.reconcilePendingEdits(); err != nil || !ok {
+			return err
+		}
+
+		var err error
+		content, blockCount, err = r.renderSpecificFile()
+		if err != nil {
+			return err
+		}
+
+		// The file may have been saved again while it was reconciled or
+		// rendered, or just before it is written, which the file manager
+		// refuses; start over so that edit is merged too
+		pending, err := r.hasPendingEdits()
+		if err != nil {
+			return err
+		}
+		if !pending {
+			if r.settings.ReadOnly {
+				err = r.fileManager.WriteReadOnlyMarkdownFile(content)
+			} else {
+				err = r.fileManager.WriteMarkdownFile(content)
+			}
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, ErrFileChanged) {
+				return fmt.Errorf("failed to write file: %w", err)
+			}
+		}
+		if attempt == maxRegenerateAttempts {
+			log.Printf("Warning: left %s alone, it kept changing while it was regenerated", r.fileManager.GetNotesPath())
+			return nil
+		}
+	}
+
+	// Remember what we wrote as the base for the next three-way merge
+	if err := r.db.SetFileSnapshot(r.fileManager.GetNotesPath(), content); err != nil {
+		return err
 	}
 
-	log.Printf("Regenerated file %s with %d blocks", r.fileManager.notesPath, len(blocks))
+	infof("Regenerated file %s with %d blocks", r.fileManager.notesPath, blockCount)
 	return nil
 }
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var recurrencePattern = regexp.MustCompile(`@every\(([^)]*)\)`)
+
+// recurrenceLookback bounds how far back and ahead occurrences are searched
+// for; every recurrence occurs at least once a month.
+const recurrenceLookback = 31
+
+var weekdayNames = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+	"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Recurrence is a parsed @every(...) annotation: the days a template is
+// cloned on and the time of day.
+type Recurrence struct {
+	Expression string
+	Weekdays   [7]bool
+	Monthly    bool // on the first of every month
+	Hour       int
+	Minute     int
+}
+
+// ParseRecurrence parses expressions like "monday", "mon,thu 8am", "day",
+// "weekday", "weekend", "week" (Mondays) or "month" (the first of the
+// month). Without a time, occurrences are at midnight.
+func ParseRecurrence(expression string) (*Recurrence, error) {
+	fields := strings.Fields(strings.ToLower(expression))
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("expected days and optional time, got %q", expression)
+	}
+
+	r := &Recurrence{Expression: strings.Join(fields, " ")}
+	for _, day := range strings.Split(fields[0], ",") {
+		switch day {
+		case "day", "daily":
+			r.Weekdays = [7]bool{true, true, true, true, true, true, true}
+		case "weekday", "weekdays":
+			for d := time.Monday; d <= time.Friday; d++ {
+				r.Weekdays[d] = true
+			}
+		case "weekend", "weekends":
+			r.Weekdays[time.Saturday], r.Weekdays[time.Sunday] = true, true
+		case "week", "weekly":
+			r.Weekdays[time.Monday] = true
+		case "month", "monthly":
+			r.Monthly = true
+		default:
+			weekday, ok := weekdayNames[day]
+			if !ok {
+				return nil, fmt.Errorf("unrecognised day %q", day)
+			}
+			r.Weekdays[weekday] = true
+		}
+	}
+
+	if len(fields) == 2 {
+		var err error
+		if r.Hour, r.Minute, err = parseClock(fields[1]); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *Recurrence) occursOn(day time.Time) bool {
+	return r.Weekdays[day.Weekday()] || r.Monthly && day.Day() == 1
+}
+
+func (r *Recurrence) at(day time.Time) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), r.Hour, r.Minute, 0, 0, day.Location())
+}
+
+// Latest returns the most recent occurrence at or before now.
+func (r *Recurrence) Latest(now time.Time) (time.Time, bool) {
+	for offset := 0; offset <= recurrenceLookback; offset++ {
+		day := now.AddDate(0, 0, -offset)
+		if t := r.at(day); r.occursOn(day) && !t.After(now) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Next returns the first occurrence after now.
+func (r *Recurrence) Next(now time.Time) (time.Time, bool) {
+	for offset := 0; offset <= recurrenceLookback; offset++ {
+		day := now.AddDate(0, 0, offset)
+		if t := r.at(day); r.occursOn(day) && t.After(now) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// RecurringTemplate is a block with an @every(...) annotation.
+type RecurringTemplate struct {
+	Block      *Block
+	Recurrence *Recurrence
+}
+
+// FindRecurringTemplates returns the blocks among blocks with an @every(...)
+// annotation. Only a block's first annotation counts. Annotations that can't
+// be parsed are returned as errors.
+func FindRecurringTemplates(blocks []*Block) ([]*RecurringTemplate, []error) {
+	var templates []*RecurringTemplate
+	var errs []error
+	for _, block := range blocks {
+		match := recurrencePattern.FindStringSubmatch(block.Content)
+		if match == nil {
+			continue
+		}
+		recurrence, err := ParseRecurrence(match[1])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("block %.12s: %s: %w", block.ContentHash, match[0], err))
+			continue
+		}
+		templates = append(templates, &RecurringTemplate{Block: block, Recurrence: recurrence})
+	}
+	return templates, errs
+}
+
+// stripRecurrence returns template content without its @every(...)
+// annotations, dropping lines left empty, so clones don't recur themselves.
+func stripRecurrence(content string) string {
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		stripped := recurrencePattern.ReplaceAllString(line, "")
+		if stripped != line {
+			stripped = strings.Join(strings.Fields(stripped), " ")
+			if stripped == "" {
+				continue
+			}
+		}
+		lines = append(lines, stripped)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// RunRecurrences clones every template whose latest occurrence at or before
+// now hasn't been cloned yet to the top of notes.md. Occurrences before a
+// template was written are skipped, so a new template first clones on its
+// next occurrence. It returns the clones.
+func RunRecurrences(now time.Time) ([]*Block, error) {
+	blocks, err := db.GetAllBlocks()
+	if err != nil {
+		return nil, err
+	}
+	templates, _ := FindRecurringTemplates(blocks)
+	runs, err := db.GetRecurrenceRuns()
+	if err != nil {
+		return nil, err
+	}
+
+	var clones []*Block
+	ran := make(map[string]time.Time)
+	for _, template := range templates {
+		occurrence, ok := template.Recurrence.Latest(now)
+		if !ok {
+			continue
+		}
+		since, ok := runs[template.Block.ContentHash]
+		if !ok {
+			since = template.Block.CreatedAt
+		}
+		if !occurrence.After(since) {
+			continue
+		}
+
+		ran[template.Block.ContentHash] = occurrence
+		if content := stripRecurrence(template.Block.Content); content != "" {
+			clones = append(clones, NewBlock(content))
+		}
+	}
+
+	if len(clones) > 0 {
+		if _, err := newMainReconciler().AddBlocks(clones); err != nil {
+			return nil, err
+		}
+	}
+	for hash, occurrence := range ran {
+		if err := db.SetRecurrenceRun(hash, occurrence); err != nil {
+			return nil, err
+		}
+	}
+
+	// Forget templates that were deleted or lost their annotation
+	current := make(map[string]bool)
+	for _, template := range templates {
+		current[template.Block.ContentHash] = true
+	}
+	for hash := range runs {
+		if !current[hash] {
+			if err := db.DeleteRecurrence(hash); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return clones, nil
+}
+
+// recurIfDue runs recurrences from the watcher daemon.
+func recurIfDue(now time.Time) error {
+	clones, err := RunRecurrences(now)
+	if err != nil {
+		return err
+	}
+	if len(clones) > 0 {
+		infof("Cloned %d recurring block(s)", len(clones))
+	}
+	return nil
+}
+
+func handleRecur() {
+	fs := flag.NewFlagSet("recur", flag.ExitOnError)
+	run := fs.Bool("run", false, "clone templates that are due now instead of waiting for the watcher daemon")
+	parseArgs(fs, os.Args[2:])
+
+	if *run {
+		requireWritable("notes recur --run")
+		clones, err := RunRecurrences(time.Now())
+		if err != nil {
+			log.Fatalf("Failed to run recurrences: %v", err)
+		}
+		for _, clone := range clones {
+			fmt.Printf("Cloned: %s\n", clone.FirstLine())
+		}
+		fmt.Printf("Added %d recurring block(s) to the top of notes.md\n", len(clones))
+		return
+	}
+
+	blocks, err := db.GetAllBlocks()
+	if err != nil {
+		log.Fatalf("Failed to get blocks: %v", err)
+	}
+	templates, parseErrs := FindRecurringTemplates(blocks)
+	for _, parseErr := range parseErrs {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", parseErr)
+	}
+	if len(templates) == 0 {
+		fmt.Println("No recurring blocks. Add @every(monday) or similar to a block to make it a template.")
+		return
+	}
+	runs, err := db.GetRecurrenceRuns()
+	if err != nil {
+		log.Fatalf("Failed to get recurrences: %v", err)
+	}
+
+	now := time.Now()
+	for _, template := range templates {
+		next := "-"
+		if t, ok := template.Recurrence.Next(now); ok {
+			next = t.Format("2006-01-02 15:04")
+		}
+		last := "never"
+		if t, ok := runs[template.Block.ContentHash]; ok {
+			last = t.Format("2006-01-02 15:04")
+		}
+		fmt.Printf("%s  %-16s  next %s  last %-16s  %s\n", output.ID(template.Block.ID, 5),
+			template.Recurrence.Expression, next, last, template.Block.FirstLine())
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultServeAddr = "127.0.0.1:8377"
+	rpcPath          = "/rpc"
+	maxRPCBodySize   = 64 * 1024 * 1024
+	remoteTimeout    = 30 * time.Second
+)
+
+// remote is set when NOTES_REMOTE points the CLI at a `notes serve` instance
+// instead of a local repository.
+var remote *RemoteClient
+
+// RPCHandler serves the MCP tool set as JSON-RPC over HTTP.
+type RPCHandler struct {
+	server *MCPServer
+}
+
+func (h *RPCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRPCBodySize))
+	if err != nil {
+		http.Error(w, "failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	response := h.server.handleMessage(body)
+
+	if response == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// authenticated wraps every handler of `notes serve`: it only accepts POST
+// requests carrying an allowed bearer token, and handles them one at a time
+// since writes regenerate notes.md.
+func authenticated(auth *Authenticator, next http.Handler) http.Handler {
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !auth.Request(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleServe() {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", defaultServeAddr, "address to listen on")
+	token := fs.String("token", os.Getenv("NOTES_TOKEN"), "token clients must send (default $NOTES_TOKEN)")
+	certFile := fs.String("tls-cert", "", "TLS certificate file")
+	keyFile := fs.String("tls-key", "", "TLS key file")
+	selfSigned := fs.Bool("tls", false, "serve HTTPS with a self-signed certificate kept in .notes/tls, unless --tls-cert and --tls-key are given")
+	rateLimit := fs.Int("rate-limit", 0, "requests a client address may make per minute; 0 means no limit")
+	audience := fs.String("audience", VisibilityShared, "only serve blocks visible to this level: private (all), shared or public")
+	serveMetrics := fs.Bool("metrics", false, "serve the watcher daemon's metrics for Prometheus at /metrics")
+	serveUI := fs.Bool("ui", false, "serve a web interface for adding and finding notes at /")
+	parseArgs(fs, os.Args[2:])
+	db.audit.SetSource(AuditSourceAPI)
+
+	tokens, err := db.GetAPITokens()
+	if err != nil {
+		log.Fatalf("Failed to get tokens: %v", err)
+	}
+	if *token == "" && len(tokens) == 0 {
+		fmt.Println("Error: serve requires a token; create one with 'notes token create <name>' or set --token or NOTES_TOKEN")
+		os.Exit(1)
+	}
+	if *rateLimit < 0 {
+		fmt.Println("Error: --rate-limit must not be negative")
+		os.Exit(1)
+	}
+	if (*certFile == "") != (*keyFile == "") {
+		fmt.Println("Error: --tls-cert and --tls-key must be given together")
+		os.Exit(1)
+	}
+	if !isVisibilityLevel(*audience) {
+		fmt.Printf("Error: unknown audience %q (available: %s)\n", *audience, strings.Join(visibilityLevels, ", "))
+		os.Exit(1)
+	}
+
+	mcpServer := NewMCPServer(db, newMainReconciler())
+	mcpServer.audience = *audience
+
+	auth := &Authenticator{token: *token, db: db}
+	mux := http.NewServeMux()
+	mux.Handle(rpcPath, authenticated(auth, &RPCHandler{server: mcpServer}))
+	mux.Handle("/sync/pull", authenticated(auth, syncHandler{audience: *audience}))
+	mux.Handle("/sync/push", authenticated(auth, syncHandler{push: true, audience: *audience}))
+	mux.Handle(eventsPath, eventsHandler{auth: auth, audience: *audience})
+	if *serveMetrics {
+		mux.Handle("/metrics", metricsHandler{auth: auth})
+	}
+	path := rpcPath
+	if *serveUI {
+		mux.Handle("/", uiHandler())
+		path = "/"
+	}
+	var handler http.Handler = mux
+	if *rateLimit > 0 {
+		handler = newRateLimiter(*rateLimit, mux)
+	}
+	server := &http.Server{Addr: *addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+
+	if *selfSigned && *certFile == "" {
+		if *certFile, *keyFile, err = selfSignedCertificate(config.TLSDir(), *addr); err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+		fingerprint, err := certificateFingerprint(*certFile, *keyFile)
+		if err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+		log.Printf("Self-signed certificate fingerprint (for NOTES_TLS_FINGERPRINT): %s", fingerprint)
+	}
+	if *certFile != "" {
+		log.Printf("Serving notes on https://%s%s", *addr, path)
+		err = server.ListenAndServeTLS(*certFile, *keyFile)
+	} else {
+		log.Printf("Serving notes on http://%s%s", *addr, path)
+		err = server.ListenAndServe()
+	}
+	log.Fatalf("Server failed: %v", err)
+}
+
+// RemoteClient calls the tools of a `notes serve` instance.
+type RemoteClient struct {
+	baseURL string
+	token   string
+	client  *http.Client
+	nextID  int
+}
+
+// NewRemoteClient returns a client of the server at baseURL. If
+// NOTES_TLS_FINGERPRINT is set, it only trusts the server certificate with
+// that SHA-256 fingerprint, as for a server started with --tls.
+func NewRemoteClient(baseURL, token string) *RemoteClient {
+	client := &http.Client{Timeout: remoteTimeout}
+	if fingerprint := os.Getenv("NOTES_TLS_FINGERPRINT"); fingerprint != "" {
+		client.Transport = &http.Transport{TLSClientConfig: pinnedTLSConfig(fingerprint)}
+	}
+	return &RemoteClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		token:   token,
+		client:  client,
+	}
+}
+
+// CallTool invokes a tool and returns its text result. Tool failures are
+// returned as errors.
+func (c *RemoteClient) CallTool(name string, arguments any) (string, error) {
+	c.nextID++
+	params, err := json.Marshal(map[string]any{"name": name, "arguments": arguments})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode arguments: %w", err)
+	}
+	request := rpcRequest{
+		JSONRPC: "2.0",
+		ID:      json.RawMessage(fmt.Sprint(c.nextID)),
+		Method:  "tools/call",
+		Params:  params,
+	}
+
+	var rpcResult struct {
+		Result *mcpToolResult `json:"result"`
+		Error  *rpcError      `json:"error"`
+	}
+	if err := c.post(rpcPath, request, &rpcResult); err != nil {
+		return "", err
+	}
+	if rpcResult.Error != nil {
+		return "", fmt.Errorf("remote error %d: %s", rpcResult.Error.Code, rpcResult.Error.Message)
+	}
+	if rpcResult.Result == nil || len(rpcResult.Result.Content) == 0 {
+		return "", fmt.Errorf("remote returned an empty result")
+	}
+
+	text := rpcResult.Result.Content[0].Text
+	if rpcResult.Result.IsError {
+		return "", fmt.Errorf("%s", text)
+	}
+	return text, nil
+}
+
+// post sends payload as JSON to path on the remote and decodes the response
+// into result.
+func (c *RemoteClient) post(path string, payload, result any) error {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, c.baseURL+path, bytes.NewReader(encoded))
+	if err != nil {
+		return fmt.Errorf("invalid remote %s: %w", c.baseURL, err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+c.token)
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to reach remote: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("remote returned %s: %s", response.Status, bytes.TrimSpace(body))
+	}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to decode remote response: %w", err)
+	}
+	return nil
+}
+
+// AddBlocks adds each block on the remote.
+func (c *RemoteClient) AddBlocks(blocks []*Block) error {
+	for _, block := range blocks {
+		if _, err := c.CallTool("add_block", map[string]any{"content": block.Content}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SearchBlocks runs a search on the remote.
+func (c *RemoteClient) SearchBlocks(includeKeywords, excludeKeywords []string) ([]*Block, error) {
+	text, err := c.CallTool("search_blocks", map[string]any{"terms": includeKeywords, "exclude": excludeKeywords})
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []*Block
+	if err := json.Unmarshal([]byte(text), &blocks); err != nil {
+		return nil, fmt.Errorf("failed to decode blocks: %w", err)
+	}
+	return blocks, nil
+}
+
+// runRemote executes command against NOTES_REMOTE. Only commands that work
+// through the remote tool set are available.
+func runRemote(command, remoteURL string) {
+	remote = NewRemoteClient(remoteURL, os.Getenv("NOTES_TOKEN"))
+
+	switch command {
+	case "add":
+		handleAdd()
+	case "grep":
+		handleGrep()
+	case "clip":
+		handleClip()
+	default:
+		fmt.Printf("Error: '%s' is not available with NOTES_REMOTE (supported: add, grep, clip)\n", command)
+		os.Exit(1)
+	}
+}
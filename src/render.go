@@ -0,0 +1,161 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/glamour"
+	"github.com/charmbracelet/glamour/ansi"
+	"github.com/muesli/termenv"
+)
+
+// markdownRenderer is built on first use, once the theme is loaded.
+var markdownRenderer *glamour.TermRenderer
+
+// renderedPaddingPattern matches the styled spaces glamour pads lines with
+// to the wrap width.
+var renderedPaddingPattern = regexp.MustCompile(`(?:\x1b\[[0-9;]*m| )+$`)
+
+// displayContent renders content for the terminal when render is set and
+// output is coloured, so piped output stays raw markdown.
+func displayContent(content string, render bool) string {
+	if render && output.Color() {
+		return renderMarkdown(content)
+	}
+	return content
+}
+
+// renderMarkdown styles block content for a terminal with glamour, in the
+// theme's styles: headings, emphasis, lists, tables, links and tags, with
+// fenced code highlighted for its language. Content that can't be rendered
+// is returned as it is.
+func renderMarkdown(content string) string {
+	if markdownRenderer == nil {
+		renderer, err := glamour.NewTermRenderer(glamour.WithStyles(markdownStyles(output)), glamour.WithWordWrap(80))
+		if err != nil {
+			log.Printf("Warning: failed to set up the markdown renderer: %v", err)
+			return content
+		}
+		markdownRenderer = renderer
+	}
+
+	rendered, err := markdownRenderer.Render(content)
+	if err != nil {
+		log.Printf("Warning: failed to render markdown: %v", err)
+		return content
+	}
+	// Padding would wrap on narrower terminals
+	lines := strings.Split(strings.Trim(rendered, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = renderedPaddingPattern.ReplaceAllString(line, ansiReset)
+	}
+	return tagPattern.ReplaceAllStringFunc(strings.Join(lines, "\n"), func(match string) string {
+		tag := strings.TrimLeft(match, " \t\n")
+		return match[:len(match)-len(tag)] + output.Style("tag", tag)
+	})
+}
+
+// markdownStyles returns glamour's standard style with the theme's roles
+// applied to the elements they name. Plain text keeps the terminal's colour
+// rather than glamour's, which is made for dark backgrounds, so asking the
+// terminal for its background isn't needed.
+func markdownStyles(f *Formatter) ansi.StyleConfig {
+	styles := glamour.DarkStyleConfig
+	// The blank lines around the document would stand out between blocks
+	styles.Document.BlockPrefix, styles.Document.BlockSuffix = "", ""
+	styles.Document.Color = nil
+
+	applyStyle(&styles.H1.StylePrimitive, f.styleSpecs["title"])
+	for _, heading := range []*ansi.StyleBlock{&styles.Heading, &styles.H2, &styles.H3, &styles.H4, &styles.H5, &styles.H6} {
+		applyStyle(&heading.StylePrimitive, f.styleSpecs["heading"])
+	}
+	applyStyle(&styles.Strong, f.styleSpecs["strong"])
+	applyStyle(&styles.Code.StylePrimitive, f.styleSpecs["code"])
+	applyStyle(&styles.LinkText, f.styleSpecs["link"])
+	applyStyle(&styles.Link, f.styleSpecs["muted"])
+
+	chroma := *styles.CodeBlock.Chroma
+	chroma.Text.Color = nil
+	for style, role := range map[*ansi.StylePrimitive]string{
+		&chroma.Keyword: "keyword", &chroma.KeywordReserved: "keyword", &chroma.KeywordNamespace: "keyword", &chroma.KeywordType: "keyword",
+		&chroma.LiteralString: "string", &chroma.LiteralNumber: "number",
+		&chroma.Comment: "comment", &chroma.CommentPreproc: "comment",
+	} {
+		applyStyle(style, f.styleSpecs[role])
+		// Chroma only takes #rrggbb
+		style.Color, style.BackgroundColor = hexColor(style.Color), hexColor(style.BackgroundColor)
+	}
+	styles.CodeBlock.Chroma = &chroma
+	return styles
+}
+
+// applyStyle replaces the colours and attributes of p with those of a theme
+// style such as "bold red on #202020", leaving its prefixes and format.
+// Styles are validated when the config is loaded, so unknown words are
+// skipped.
+func applyStyle(p *ansi.StylePrimitive, style string) {
+	p.Color, p.BackgroundColor = nil, nil
+	p.Bold, p.Faint, p.Italic, p.Underline, p.Inverse = nil, nil, nil, nil, nil
+
+	enabled := true
+	background := false
+	for _, word := range strings.Fields(strings.ToLower(style)) {
+		switch word {
+		case "none":
+			continue
+		case "on":
+			background = true
+			continue
+		case "bold":
+			p.Bold = &enabled
+		case "dim":
+			p.Faint = &enabled
+		case "italic":
+			p.Italic = &enabled
+		case "underline":
+			p.Underline = &enabled
+		case "reverse":
+			p.Inverse = &enabled
+		default:
+			color := glamourColor(word)
+			if background {
+				p.BackgroundColor = color
+			} else {
+				p.Color = color
+			}
+		}
+		background = false
+	}
+}
+
+// glamourColor converts a theme colour to the 256-colour number or #rrggbb
+// glamour takes.
+func glamourColor(color string) *string {
+	if name, bright := strings.CutPrefix(color, "bright-"); bright {
+		if n, ok := ansiColorNames[name]; ok {
+			code := strconv.Itoa(n + 8)
+			return &code
+		}
+	}
+	if n, ok := ansiColorNames[color]; ok {
+		code := strconv.Itoa(n)
+		return &code
+	}
+	return &color
+}
+
+// hexColor converts a colour returned by glamourColor to #rrggbb.
+func hexColor(color *string) *string {
+	if color == nil || strings.HasPrefix(*color, "#") {
+		return color
+	}
+	n, _ := strconv.Atoi(*color)
+	var c termenv.Color = termenv.ANSI256Color(n)
+	if n < 16 {
+		c = termenv.ANSIColor(n)
+	}
+	hex := termenv.ConvertToRGB(c).Hex()
+	return &hex
+}
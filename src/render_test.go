@@ -0,0 +1,59 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const renderTestContent = "# Standup\n\n## Blockers\n\nwaiting on go as in the echo of it #work\n\n```go\nfunc main() {\n\treturn\n}\n```"
+
+// useColor makes output styled, as on a terminal, until the test ends.
+func useColor(t *testing.T) {
+	saved, savedRenderer := output, markdownRenderer
+	output = NewFormatter(nil)
+	output.color = true
+	markdownRenderer = nil
+	t.Cleanup(func() { output, markdownRenderer = saved, savedRenderer })
+}
+
+// Output that isn't a terminal, like a pipe, gets the markdown as written.
+func TestRenderKeepsPipedOutputRaw(t *testing.T) {
+	saved := output
+	output = NewFormatter(nil)
+	defer func() { output = saved }()
+
+	if output.Color() {
+		t.Skip("test output is a terminal")
+	}
+	if got := displayContent(renderTestContent, true); got != renderTestContent {
+		t.Errorf("piped output was rendered:\n%q", got)
+	}
+}
+
+func TestRenderStylesHeadingsAndFences(t *testing.T) {
+	useColor(t)
+	rendered := displayContent(renderTestContent, true)
+	styled := func(word string) bool {
+		return regexp.MustCompile(`\x1b\[[0-9;]*m` + word + `\b`).MatchString(rendered)
+	}
+
+	if strings.Contains(rendered, "# Standup") || !styled("Standup") {
+		t.Errorf("title wasn't styled:\n%q", rendered)
+	}
+	if !styled("Blockers") {
+		t.Errorf("heading wasn't styled:\n%q", rendered)
+	}
+	if strings.Contains(rendered, "```") {
+		t.Errorf("code fence was printed:\n%q", rendered)
+	}
+	if !styled("func") || !styled("return") {
+		t.Errorf("Go keywords weren't highlighted:\n%q", rendered)
+	}
+	if !strings.Contains(rendered, "waiting on go as in the echo of it ") {
+		t.Errorf("words in prose were highlighted as code:\n%q", rendered)
+	}
+	if !strings.Contains(rendered, output.Style("tag", "#work")) {
+		t.Errorf("tag wasn't styled:\n%q", rendered)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+)
+
+const (
+	// LastResurfaceTimeKey records when the watcher daemon last resurfaced
+	// blocks.
+	LastResurfaceTimeKey = "last_resurface_time"
+
+	// resurfaceMinAge keeps recently touched blocks out of the draw as long
+	// as enough older ones exist.
+	resurfaceMinAge = 7 * 24 * time.Hour
+)
+
+// PickResurfaceBlocks draws up to n distinct blocks at random, weighted by
+// how long each has gone untouched so the most forgotten notes come up most.
+func PickResurfaceBlocks(blocks []*Block, n int, now time.Time, rng *rand.Rand) []*Block {
+	var candidates []*Block
+	for _, block := range blocks {
+		if now.Sub(block.UpdatedAt) >= resurfaceMinAge {
+			candidates = append(candidates, block)
+		}
+	}
+	if len(candidates) < n {
+		candidates = append([]*Block(nil), blocks...)
+	}
+
+	weights := make([]float64, len(candidates))
+	for i, block := range candidates {
+		// +1 hour so blocks touched just now still have a chance
+		weights[i] = now.Sub(block.UpdatedAt).Hours() + 1
+	}
+
+	var picked []*Block
+	for len(picked) < n && len(candidates) > 0 {
+		total := 0.0
+		for _, weight := range weights {
+			total += weight
+		}
+
+		target := rng.Float64() * total
+		index := 0
+		for ; index < len(weights)-1; index++ {
+			target -= weights[index]
+			if target < 0 {
+				break
+			}
+		}
+
+		picked = append(picked, candidates[index])
+		candidates = append(candidates[:index], candidates[index+1:]...)
+		weights = append(weights[:index], weights[index+1:]...)
+	}
+	return picked
+}
+
+// ResurfaceBlocks picks n forgotten blocks and marks them touched.
+func ResurfaceBlocks(n int) ([]*Block, error) {
+	blocks, err := db.GetAllBlocks()
+	if err != nil {
+		return nil, err
+	}
+
+	picked := PickResurfaceBlocks(blocks, n, time.Now(), rand.New(rand.NewSource(time.Now().UnixNano())))
+	if _, err := newMainReconciler().TouchBlocks(picked); err != nil {
+		return nil, err
+	}
+	return picked, nil
+}
+
+// resurfaceIfDue runs the configured periodic resurfacing from the watcher
+// daemon, at most once per configured interval.
+func resurfaceIfDue(now time.Time) error {
+	every, count := config.ResurfaceSchedule()
+	if every == 0 || count == 0 {
+		return nil
+	}
+
+	last, err := db.GetMetadata(LastResurfaceTimeKey)
+	if err != nil {
+		return err
+	}
+	if lastTime, err := time.Parse(time.RFC3339, last); err == nil && now.Sub(lastTime) < every {
+		return nil
+	}
+
+	picked, err := ResurfaceBlocks(count)
+	if err != nil {
+		return err
+	}
+	infof("Resurfaced %d block(s)", len(picked))
+	return db.SetMetadata(LastResurfaceTimeKey, now.Format(time.RFC3339))
+}
+
+func handleRandom() {
+	fs := flag.NewFlagSet("random", flag.ExitOnError)
+	count := fs.Int("n", 3, "number of blocks to pick")
+	bump := fs.Bool("bump", false, "mark the picked blocks touched as if they had just been edited")
+	parseArgs(fs, os.Args[2:])
+	if *bump {
+		requireWritable("notes random --bump")
+	}
+
+	if *count < 1 {
+		fmt.Println("Error: -n must be at least 1")
+		os.Exit(1)
+	}
+
+	var picked []*Block
+	var err error
+	if *bump {
+		picked, err = ResurfaceBlocks(*count)
+	} else {
+		var blocks []*Block
+		if blocks, err = db.GetAllBlocks(); err == nil {
+			picked = PickResurfaceBlocks(blocks, *count, time.Now(), rand.New(rand.NewSource(time.Now().UnixNano())))
+		}
+	}
+	if err != nil {
+		log.Fatalf("Failed to pick blocks: %v", err)
+	}
+
+	if len(picked) == 0 {
+		fmt.Println("No blocks found")
+		return
+	}
+
+	for i, block := range picked {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("--- untouched for %s ---\n%s\n", formatAge(time.Since(block.UpdatedAt)), block.Content)
+	}
+	if *bump {
+		fmt.Printf("\nMarked %d block(s) touched\n", len(picked))
+	}
+}
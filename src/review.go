@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ReviewTag marks blocks that take part in `notes review`.
+	ReviewTag = "review"
+
+	initialEase = 2.5
+	minimumEase = 1.3
+)
+
+// ReviewState is the SM-2 scheduling state of one block. Blocks without a
+// stored state are due immediately.
+type ReviewState struct {
+	BlockHash    string
+	IntervalDays int
+	Ease         float64
+	Repetitions  int
+	DueAt        time.Time
+}
+
+// NewReviewState returns the state of a block that has never been reviewed.
+func NewReviewState(blockHash string) *ReviewState {
+	return &ReviewState{BlockHash: blockHash, Ease: initialEase}
+}
+
+// Grade applies an SM-2 recall grade (0 = forgotten, 5 = perfect) and
+// schedules the next review relative to now.
+func (s *ReviewState) Grade(grade int, now time.Time) {
+	if grade < 3 {
+		s.Repetitions = 0
+		s.IntervalDays = 1
+	} else {
+		switch s.Repetitions {
+		case 0:
+			s.IntervalDays = 1
+		case 1:
+			s.IntervalDays = 6
+		default:
+			s.IntervalDays = int(math.Round(float64(s.IntervalDays) * s.Ease))
+		}
+		s.Repetitions++
+	}
+
+	miss := float64(5 - grade)
+	s.Ease = math.Max(minimumEase, s.Ease+0.1-miss*(0.08+miss*0.02))
+	s.DueAt = now.AddDate(0, 0, s.IntervalDays)
+}
+
+// DueReview is a block due for review with its scheduling state.
+type DueReview struct {
+	Block *Block
+	State *ReviewState
+}
+
+// DueReviews returns the blocks due for review at now, most overdue first.
+// Only blocks tagged #review are included unless all is set.
+func DueReviews(db *Database, now time.Time, all bool) ([]*DueReview, error) {
+	blocks, err := db.GetAllBlocks()
+	if err != nil {
+		return nil, err
+	}
+
+	states, err := db.GetReviewStates()
+	if err != nil {
+		return nil, err
+	}
+
+	var due []*DueReview
+	for _, block := range blocks {
+		if !all && !block.HasTag(ReviewTag) {
+			continue
+		}
+
+		state := states[block.ContentHash]
+		if state == nil {
+			state = NewReviewState(block.ContentHash)
+		}
+		if !state.DueAt.After(now) {
+			due = append(due, &DueReview{Block: block, State: state})
+		}
+	}
+
+	// Never-reviewed blocks have a zero due time and sort first
+	sort.SliceStable(due, func(i, j int) bool { return due[i].State.DueAt.Before(due[j].State.DueAt) })
+	return due, nil
+}
+
+func handleReview() {
+	fs := flag.NewFlagSet("review", flag.ExitOnError)
+	limit := fs.Int("limit", 20, "maximum number of blocks to review")
+	all := fs.Bool("all", false, "review every block, not just those tagged #"+ReviewTag)
+	render := fs.Bool("render", false, "style the markdown for the terminal")
+	parseArgs(fs, os.Args[2:])
+
+	due, err := DueReviews(db, time.Now(), *all)
+	if err != nil {
+		log.Fatalf("Failed to find blocks to review: %v", err)
+	}
+	if len(due) == 0 {
+		fmt.Println("Nothing to review")
+		return
+	}
+	if len(due) > *limit {
+		due = due[:*limit]
+	}
+
+	input := bufio.NewScanner(os.Stdin)
+	reviewed := 0
+	for i, review := range due {
+		fmt.Printf("\n--- %d/%d ---\n%s\n\n", i+1, len(due), displayContent(review.Block.Content, *render))
+
+		grade, ok := promptGrade(input)
+		if !ok {
+			break
+		}
+		if grade < 0 {
+			continue
+		}
+
+		state := review.State
+		state.Grade(grade, time.Now())
+		if err := db.SaveReviewState(state); err != nil {
+			log.Fatalf("Failed to save review: %v", err)
+		}
+		fmt.Printf("Next review in %d day(s)\n", state.IntervalDays)
+		reviewed++
+	}
+
+	fmt.Printf("\nReviewed %d block(s)\n", reviewed)
+}
+
+// promptGrade asks for a 0-5 grade until it gets one. It returns -1 when the
+// block is skipped and ok=false when the user quits or input ends.
+func promptGrade(input *bufio.Scanner) (grade int, ok bool) {
+	for {
+		fmt.Print("Recall 0-5 (0 = forgot, 5 = perfect), s to skip, q to quit: ")
+		if !input.Scan() {
+			fmt.Println()
+			return 0, false
+		}
+
+		answer := strings.TrimSpace(input.Text())
+		switch answer {
+		case "q":
+			return 0, false
+		case "s":
+			return -1, true
+		}
+
+		grade, err := strconv.Atoi(answer)
+		if err == nil && grade >= 0 && grade <= 5 {
+			return grade, true
+		}
+	}
+}
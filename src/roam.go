@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ExportFormatRoamJSON is the `notes export --format` that writes a Roam
+// Research JSON export, which Logseq imports as well.
+const ExportFormatRoamJSON = "roam-json"
+
+// roamDailyUIDLayout is how Roam names the UIDs of daily pages.
+const roamDailyUIDLayout = "01-02-2006"
+
+var (
+	// roamBlockRefPattern matches ((uid)) block references. Roam UIDs are
+	// nine characters of letters, digits, - and _; Logseq's are UUIDs.
+	roamBlockRefPattern = regexp.MustCompile(`\(\(([\w-]+)\)\)`)
+
+	// roamPageRefPattern matches [[Page]] and #[[Page]] page references.
+	roamPageRefPattern = regexp.MustCompile(`#?\[\[([^\[\]]+)\]\]`)
+
+	// roamDailyTitlePattern matches daily page titles such as "October 15th, 2026".
+	roamDailyTitlePattern = regexp.MustCompile(`^([A-Z][a-z]+) (\d{1,2})(?:st|nd|rd|th), (\d{4})$`)
+
+	// logseqPropertyPattern matches Logseq block property lines such as "id:: ...".
+	logseqPropertyPattern = regexp.MustCompile(`^[\w-]+:: `)
+
+	// roamBulletPattern matches a markdown bullet and its indentation.
+	roamBulletPattern = regexp.MustCompile(`^(\s*)[-*+] (.*)$`)
+)
+
+// roamNode is a page or block of a Roam or Logseq JSON export. Roam pages
+// have a title and blocks a string; Logseq uses page-name, content and id
+// instead. Times are Unix milliseconds.
+type roamNode struct {
+	Title      string      `json:"title,omitempty"`
+	PageName   string      `json:"page-name,omitempty"`
+	String     string      `json:"string,omitempty"`
+	Content    string      `json:"content,omitempty"`
+	UID        string      `json:"uid,omitempty"`
+	ID         string      `json:"id,omitempty"`
+	Heading    int         `json:"heading,omitempty"`
+	CreateTime int64       `json:"create-time,omitempty"`
+	EditTime   int64       `json:"edit-time,omitempty"`
+	Children   []*roamNode `json:"children,omitempty"`
+}
+
+func (n *roamNode) title() string {
+	if n.Title != "" {
+		return n.Title
+	}
+	return n.PageName
+}
+
+func (n *roamNode) uid() string {
+	if n.UID != "" {
+		return n.UID
+	}
+	return n.ID
+}
+
+// text returns the node's text without Logseq property lines.
+func (n *roamNode) text() string {
+	text := n.String
+	if text == "" {
+		text = n.Content
+	}
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if !logseqPropertyPattern.MatchString(strings.TrimSpace(line)) {
+			lines = append(lines, line)
+		}
+	}
+	text = strings.TrimSpace(strings.Join(lines, "\n"))
+	if n.Heading > 0 {
+		text = strings.Repeat("#", n.Heading) + " " + text
+	}
+	return text
+}
+
+// parseRoamExport reads the pages of a Roam export, a JSON array of pages,
+// or of a Logseq export, an object with the pages under "blocks".
+func parseRoamExport(content []byte) ([]*roamNode, error) {
+	content = bytes.TrimSpace(content)
+	var pages []*roamNode
+	if bytes.HasPrefix(content, []byte("[")) {
+		if err := json.Unmarshal(content, &pages); err != nil {
+			return nil, fmt.Errorf("failed to parse Roam export: %w", err)
+		}
+		return pages, nil
+	}
+
+	var logseq struct {
+		Blocks []*roamNode `json:"blocks"`
+	}
+	if err := json.Unmarshal(content, &logseq); err != nil {
+		return nil, fmt.Errorf("failed to parse Logseq export: %w", err)
+	}
+	return logseq.Blocks, nil
+}
+
+// roamDailyDate returns the day a daily page title names.
+func roamDailyDate(title string) (time.Time, bool) {
+	match := roamDailyTitlePattern.FindStringSubmatch(title)
+	if match == nil {
+		return time.Time{}, false
+	}
+	day, err := time.ParseInLocation("January 2, 2006", match[1]+" "+match[2]+", "+match[3], time.Local)
+	return day, err == nil
+}
+
+// roamDailyTitle is the title Roam gives the daily page of day.
+func roamDailyTitle(day time.Time) string {
+	suffix := "th"
+	switch day.Day() {
+	case 1, 21, 31:
+		suffix = "st"
+	case 2, 22:
+		suffix = "nd"
+	case 3, 23:
+		suffix = "rd"
+	}
+	return fmt.Sprintf("%s %d%s, %d", day.Format("January"), day.Day(), suffix, day.Year())
+}
+
+// roamPageTag turns a page title into a tag, e.g. "Project X" into
+// "project-x". It returns "" if nothing of the title can be kept.
+func roamPageTag(title string) string {
+	var tag strings.Builder
+	for _, r := range strings.ToLower(strings.TrimSpace(title)) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '/' || r == '-':
+			tag.WriteRune(r)
+		case unicode.IsSpace(r):
+			tag.WriteRune('-')
+		}
+	}
+	return strings.Trim(tag.String(), "-/")
+}
+
+// convertRoamPageRefs turns [[Page]] references into #tags. References to
+// daily pages become plain dates, so they don't look like journal blocks.
+func convertRoamPageRefs(text string) string {
+	return roamPageRefPattern.ReplaceAllStringFunc(text, func(ref string) string {
+		title := roamPageRefPattern.FindStringSubmatch(ref)[1]
+		if day, ok := roamDailyDate(title); ok {
+			return day.Format(dailyDateLayout)
+		}
+		if tag := roamPageTag(title); tag != "" {
+			return "#" + tag
+		}
+		return ref
+	})
+}
+
+// roamImportBlock is a top-level block of an export on its way in.
+type roamImportBlock struct {
+	content   string
+	refs      []string // UIDs referenced by content
+	createdAt time.Time
+	updatedAt time.Time
+	block     *Block // set once stored, or found to exist
+}
+
+// collectRoamBlock renders node and its children as one markdown block,
+// child bullets nested under the first line, and maps the UID of each of
+// them to index so references to a child point to its top-level block.
+func collectRoamBlock(node *roamNode, index int, uids map[string]int) string {
+	var out strings.Builder
+	out.WriteString(node.text())
+	var walk func(children []*roamNode, depth int)
+	walk = func(children []*roamNode, depth int) {
+		for _, child := range children {
+			if uid := child.uid(); uid != "" {
+				uids[uid] = index
+			}
+			indent := strings.Repeat("  ", depth)
+			lines := strings.Split(child.text(), "\n")
+			out.WriteString("\n" + indent + "- " + lines[0])
+			for _, line := range lines[1:] {
+				out.WriteString("\n" + indent + "  " + line)
+			}
+			walk(child.Children, depth+1)
+		}
+	}
+	if uid := node.uid(); uid != "" {
+		uids[uid] = index
+	}
+	walk(node.Children, 0)
+	return out.String()
+}
+
+// ImportRoam stores the blocks of a Roam or Logseq JSON export: each
+// top-level block of a page becomes a block, with its child bullets nested
+// in it. Page references become tags, blocks are tagged with their page
+// (and tag, if given) and blocks on daily pages are dated by the day.
+// Block references point to the imported blocks. It returns the changes
+// and the number of blocks that already existed.
+func (r *Reconciler) ImportRoam(path, tag string) (*ChangeSet, int, error) {
+	changes := NewChangeSet(path)
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return changes, 0, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	pages, err := parseRoamExport(content)
+	if err != nil {
+		return changes, 0, err
+	}
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "#")
+
+	var imports []*roamImportBlock
+	uids := make(map[string]int)
+	now := time.Now()
+	for _, page := range pages {
+		var tags []string
+		day, daily := roamDailyDate(page.title())
+		if pageTag := roamPageTag(page.title()); pageTag != "" && !daily {
+			tags = append(tags, pageTag)
+		}
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+
+		for _, node := range page.Children {
+			text := convertRoamPageRefs(collectRoamBlock(node, len(imports), uids))
+			if strings.TrimSpace(text) == "" {
+				continue
+			}
+			block := &Block{Content: text}
+			for _, t := range tags {
+				if !block.HasTag(t) {
+					text += "\n#" + t
+				}
+			}
+
+			imported := &roamImportBlock{content: text, createdAt: now, updatedAt: now}
+			if daily {
+				imported.createdAt, imported.updatedAt = day, day
+			}
+			if node.CreateTime > 0 {
+				imported.createdAt = time.UnixMilli(node.CreateTime)
+				imported.updatedAt = imported.createdAt
+			}
+			if node.EditTime > 0 {
+				imported.updatedAt = time.UnixMilli(node.EditTime)
+			}
+			for _, match := range roamBlockRefPattern.FindAllStringSubmatch(text, -1) {
+				imported.refs = append(imported.refs, match[1])
+			}
+			imports = append(imports, imported)
+		}
+	}
+
+	// A block is stored once the blocks it references are, so its
+	// references can name their IDs. A reference cycle is broken by storing
+	// one of its blocks with the references that can't be resolved left as
+	// written.
+	skipped := 0
+	seen := make(map[string]*Block)
+	for remaining := len(imports); remaining > 0; {
+		var wave []*roamImportBlock
+		for i, imported := range imports {
+			if imported.block == nil && roamRefsStored(imports, uids, i) {
+				wave = append(wave, imported)
+			}
+		}
+		if len(wave) == 0 {
+			for _, imported := range imports {
+				if imported.block == nil {
+					wave = append(wave, imported)
+					break
+				}
+			}
+		}
+
+		var hashes []string
+		for _, imported := range wave {
+			content := roamBlockRefPattern.ReplaceAllStringFunc(imported.content, func(ref string) string {
+				index, ok := uids[roamBlockRefPattern.FindStringSubmatch(ref)[1]]
+				if !ok || imports[index].block == nil || imports[index].block.ID == 0 {
+					return ref
+				}
+				return fmt.Sprintf("((%d))", imports[index].block.ID)
+			})
+			block := NewBlock(content)
+			block.CreatedAt, block.UpdatedAt = imported.createdAt, imported.updatedAt
+			imported.block = block
+			hashes = append(hashes, block.ContentHash)
+		}
+
+		existing, err := r.db.GetBlocksByHashes(hashes)
+		if err != nil {
+			return changes, skipped, fmt.Errorf("failed to look up existing blocks: %w", err)
+		}
+		var added []*Block
+		for _, imported := range wave {
+			hash := imported.block.ContentHash
+			switch {
+			case existing[hash] != nil:
+				imported.block = existing[hash]
+				skipped++
+			case seen[hash] != nil:
+				imported.block = seen[hash]
+				skipped++
+			default:
+				seen[hash] = imported.block
+				added = append(added, imported.block)
+			}
+		}
+		if err := r.db.CreateBlocks(added); err != nil {
+			return changes, skipped, fmt.Errorf("failed to create blocks: %w", err)
+		}
+		changes.Added = append(changes.Added, added...)
+		remaining -= len(wave)
+	}
+
+	if err := r.RegenerateMarkdownFile(); err != nil {
+		return changes, skipped, err
+	}
+
+	r.recordOperation(OperationImport, changes)
+	r.hooks.RunPost(HookPostAdd, changes)
+	return changes, skipped, nil
+}
+
+// roamRefsStored reports whether every block imports[i] references, other
+// than itself, has been stored.
+func roamRefsStored(imports []*roamImportBlock, uids map[string]int, i int) bool {
+	for _, uid := range imports[i].refs {
+		if index, ok := uids[uid]; ok && index != i && imports[index].block == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// roamBlockNode turns a block into a Roam block: its bullets become its
+// children by indentation, indented lines after a bullet continue it, and
+// the remaining lines are the block's string.
+func roamBlockNode(block *Block, text string) *roamNode {
+	node := &roamNode{
+		UID:        roamUID(block),
+		CreateTime: block.CreatedAt.UnixMilli(),
+		EditTime:   block.UpdatedAt.UnixMilli(),
+	}
+
+	type level struct {
+		indent int
+		node   *roamNode
+	}
+	stack := []level{{indent: -1, node: node}}
+	var head []string
+	for _, line := range strings.Split(text, "\n") {
+		match := roamBulletPattern.FindStringSubmatch(line)
+		if match == nil || len(head) == 0 && len(stack) == 1 {
+			if len(stack) > 1 && strings.TrimLeft(line, " \t") != line {
+				last := stack[len(stack)-1].node
+				last.String += "\n" + strings.TrimSpace(line)
+			} else {
+				head = append(head, line)
+			}
+			continue
+		}
+
+		indent := len(strings.ReplaceAll(match[1], "\t", "  "))
+		for len(stack) > 1 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		child := &roamNode{String: match[2], CreateTime: node.CreateTime, EditTime: node.EditTime}
+		parent := stack[len(stack)-1].node
+		child.UID = fmt.Sprintf("%s-%d", node.UID, countRoamNodes(node))
+		parent.Children = append(parent.Children, child)
+		stack = append(stack, level{indent: indent, node: child})
+	}
+	node.String = strings.TrimSpace(strings.Join(head, "\n"))
+	return node
+}
+
+func countRoamNodes(node *roamNode) int {
+	count := len(node.Children)
+	for _, child := range node.Children {
+		count += countRoamNodes(child)
+	}
+	return count
+}
+
+// roamUID is the UID a block is exported with, the first nine characters
+// of its hash, like the length of Roam's own.
+func roamUID(block *Block) string {
+	return block.ContentHash[:9]
+}
+
+// ExportRoam returns every block filter allows as a Roam JSON export. Blocks
+// go on the daily page of the day they were created, #daily/ tags become
+// daily page references and ((id)) references name the exported blocks.
+func ExportRoam(db *Database, filter *VisibilityFilter) ([]byte, error) {
+	blocks, err := db.GetAllBlocks()
+	if err != nil {
+		return nil, err
+	}
+	blocks = filter.Filter(blocks)
+	sort.SliceStable(blocks, func(i, j int) bool { return blocks[i].CreatedAt.Before(blocks[j].CreatedAt) })
+
+	dailyTagPattern := regexp.MustCompile(`(^|\s)#` + regexp.QuoteMeta(dailyTagPrefix) + `(\d{4}-\d{2}-\d{2})`)
+	pages := make(map[string]*roamNode)
+	var order []string
+	for _, block := range blocks {
+		text := blockRefPattern.ReplaceAllStringFunc(block.Content, func(ref string) string {
+			target, err := resolveBlockRef(db, blockRefPattern.FindStringSubmatch(ref)[1])
+			if err != nil || target == nil || !filter.Allows(target) {
+				return ref
+			}
+			return "((" + roamUID(target) + "))"
+		})
+		text = dailyTagPattern.ReplaceAllStringFunc(text, func(tag string) string {
+			match := dailyTagPattern.FindStringSubmatch(tag)
+			day, err := time.ParseInLocation(dailyDateLayout, match[2], time.Local)
+			if err != nil {
+				return tag
+			}
+			return match[1] + "[[" + roamDailyTitle(day) + "]]"
+		})
+
+		day := block.CreatedAt.Local()
+		uid := day.Format(roamDailyUIDLayout)
+		page, ok := pages[uid]
+		if !ok {
+			page = &roamNode{Title: roamDailyTitle(day), UID: uid, CreateTime: block.CreatedAt.UnixMilli()}
+			pages[uid] = page
+			order = append(order, uid)
+		}
+		page.Children = append(page.Children, roamBlockNode(block, text))
+		page.EditTime = max(page.EditTime, block.UpdatedAt.UnixMilli())
+	}
+
+	export := make([]*roamNode, 0, len(order))
+	for _, uid := range order {
+		export = append(export, pages[uid])
+	}
+	content, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode export: %w", err)
+	}
+	return append(content, '\n'), nil
+}
+
+// exportRoamFile writes the Roam export of the blocks filter allows to path,
+// or stdout if it's empty.
+func exportRoamFile(path string, filter *VisibilityFilter) {
+	content, err := ExportRoam(db, filter)
+	if err != nil {
+		log.Fatalf("Failed to export: %v", err)
+	}
+	if path == "" {
+		os.Stdout.Write(content)
+		return
+	}
+	if err := os.WriteFile(expandHome(path), content, 0644); err != nil {
+		log.Fatalf("Failed to write %s: %v", path, err)
+	}
+	fmt.Printf("Exported notes to %s\n", path)
+}
+
+func handleImportRoam() {
+	fs := flag.NewFlagSet("import-roam", flag.ExitOnError)
+	tag := fs.String("tag", "", "tag added to every imported block")
+	args := parseArgs(fs, os.Args[2:])
+
+	if len(args) != 1 {
+		fmt.Println("Error: import-roam requires an export file")
+		fmt.Println("Usage: notes import-roam [--tag imported/roam] <export.json>")
+		os.Exit(1)
+	}
+
+	changes, skipped, err := newMainReconciler().ImportRoam(args[0], *tag)
+	if err != nil {
+		log.Fatalf("Failed to import %s: %v", args[0], err)
+	}
+	fmt.Printf("Imported %d blocks from %s (%d duplicates skipped)\n", len(changes.Added), args[0], skipped)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Schedule annotation kinds.
+const (
+	ScheduleDue    = "due"
+	ScheduleRemind = "remind"
+)
+
+const (
+	// defaultReminderHour is used for @remind(...) expressions without a time.
+	defaultReminderHour = 9
+
+	// reminderInterval is how often the watcher daemon checks for due reminders.
+	reminderInterval = 30 * time.Second
+)
+
+var scheduleAnnotationPattern = regexp.MustCompile(`@(due|remind)\(([^)]*)\)`)
+
+// ScheduleItem is one @due or @remind annotation of a block.
+type ScheduleItem struct {
+	BlockHash string    `json:"block_hash"`
+	Kind      string    `json:"kind"`
+	At        time.Time `json:"at"`
+	Fired     bool      `json:"fired"`
+
+	// Content is filled in when items are listed, not stored.
+	Content string `json:"content"`
+}
+
+// ParseScheduleItems extracts the @due(...) and @remind(...) annotations of
+// block. Relative expressions such as "tomorrow" are resolved against the
+// block's creation time. Annotations that can't be parsed are returned as
+// errors and otherwise ignored.
+func ParseScheduleItems(block *Block) ([]*ScheduleItem, []error) {
+	var items []*ScheduleItem
+	var errs []error
+
+	for _, match := range scheduleAnnotationPattern.FindAllStringSubmatch(block.Content, -1) {
+		at, err := ParseScheduleTime(match[2], block.CreatedAt.Local(), match[1] == ScheduleRemind)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", match[0], err))
+			continue
+		}
+		items = append(items, &ScheduleItem{BlockHash: block.ContentHash, Kind: match[1], At: at})
+	}
+	return items, errs
+}
+
+// ParseScheduleTime parses a date and optional time in the future relative
+// to now, such as "2024-06-01 14:00", "tomorrow 9am", "next friday at 5pm"
+// or "june 3"; see ParseDateTime. Without a time, dates resolve to
+// midnight, or to defaultReminderHour if defaultToMorning is set.
+func ParseScheduleTime(expression string, now time.Time, defaultToMorning bool) (time.Time, error) {
+	hour := 0
+	if defaultToMorning {
+		hour = defaultReminderHour
+	}
+	return ParseDateTime(expression, now, true, hour)
+}
+
+// ParseSchedule returns the schedule items of all blocks, with their
+// content, and the annotations that couldn't be parsed.
+func ParseSchedule(db *Database) ([]*ScheduleItem, []error, error) {
+	blocks, err := db.GetAllBlocks()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var items []*ScheduleItem
+	var parseErrs []error
+	for _, block := range blocks {
+		blockItems, errs := ParseScheduleItems(block)
+		for _, item := range blockItems {
+			item.Content = block.Content
+		}
+		items = append(items, blockItems...)
+		for _, err := range errs {
+			parseErrs = append(parseErrs, fmt.Errorf("block %.12s: %w", block.ContentHash, err))
+		}
+	}
+	return items, parseErrs, nil
+}
+
+// SyncSchedule rebuilds the schedule table from the annotations in all
+// blocks, keeping the fired state of items that still exist. It returns the
+// annotations that couldn't be parsed.
+func SyncSchedule(db *Database) ([]error, error) {
+	items, parseErrs, err := ParseSchedule(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.ReplaceScheduleItems(items); err != nil {
+		return nil, err
+	}
+	return parseErrs, nil
+}
+
+// readOnlySchedule parses the schedule in memory for a read-only
+// repository, whose schedule table can't be brought up to date, taking the
+// fired state of reminders from the table where it has them.
+func readOnlySchedule(db *Database) ([]*ScheduleItem, []error, error) {
+	items, parseErrs, err := ParseSchedule(db)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A database too old to have the table has nothing fired
+	stored, _ := db.GetScheduleItems()
+	fired := make(map[string]bool)
+	for _, item := range stored {
+		if item.Fired {
+			fired[item.BlockHash+item.Kind+item.At.UTC().String()] = true
+		}
+	}
+	for _, item := range items {
+		item.Fired = fired[item.BlockHash+item.Kind+item.At.UTC().String()]
+	}
+	return items, parseErrs, nil
+}
+
+// FireDueReminders notifies about every unfired reminder that has come due
+// and marks it fired. The reminder hook is used if present, otherwise a
+// desktop notification is shown.
+func FireDueReminders(db *Database, hooks *HookRunner, now time.Time) error {
+	items, err := db.GetScheduleItems()
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if item.Kind != ScheduleRemind || item.Fired || item.At.After(now) {
+			continue
+		}
+
+		if err := notifyReminder(hooks, item); err != nil {
+			log.Printf("Failed to deliver reminder for block %.12s: %v", item.BlockHash, err)
+			continue
+		}
+		if err := db.MarkScheduleItemFired(item); err != nil {
+			return err
+		}
+		infof("Reminder fired for block %.12s", item.BlockHash)
+	}
+	return nil
+}
+
+func notifyReminder(hooks *HookRunner, item *ScheduleItem) error {
+	payload, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("failed to encode reminder: %w", err)
+	}
+	if ran, err := hooks.run(HookReminder, payload, "NOTES_BLOCK="+item.BlockHash); ran {
+		return err
+	}
+
+	return sendDesktopNotification("Reminder", NewBlock(item.Content).FirstLine())
+}
+
+func handleAgenda() {
+	fs := flag.NewFlagSet("agenda", flag.ExitOnError)
+	days := fs.Int("days", 7, "show items due within this many days")
+	all := fs.Bool("all", false, "include reminders that have already fired")
+	parseArgs(fs, os.Args[2:])
+
+	var items []*ScheduleItem
+	var parseErrs []error
+	var err error
+	if readOnly {
+		if items, parseErrs, err = readOnlySchedule(db); err != nil {
+			log.Fatalf("Failed to get schedule: %v", err)
+		}
+	} else {
+		if parseErrs, err = SyncSchedule(db); err != nil {
+			log.Fatalf("Failed to update schedule: %v", err)
+		}
+		if items, err = db.GetScheduleItems(); err != nil {
+			log.Fatalf("Failed to get schedule: %v", err)
+		}
+	}
+	for _, parseErr := range parseErrs {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", parseErr)
+	}
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	horizon := today.AddDate(0, 0, *days+1)
+
+	var shown []*ScheduleItem
+	for _, item := range items {
+		if !item.At.Before(horizon) {
+			continue
+		}
+		// Overdue items stay on the agenda until they fire or are removed
+		if item.Fired && !*all {
+			continue
+		}
+		shown = append(shown, item)
+	}
+
+	if len(shown) == 0 {
+		fmt.Printf("Nothing scheduled in the next %d days\n", *days)
+		return
+	}
+
+	sort.SliceStable(shown, func(i, j int) bool { return shown[i].At.Before(shown[j].At) })
+	for _, item := range shown {
+		when := item.At.Format("2006-01-02")
+		if item.Kind == ScheduleRemind || item.At.Hour() != 0 || item.At.Minute() != 0 {
+			when = item.At.Format("2006-01-02 15:04")
+		}
+
+		marker := ""
+		if item.Kind == ScheduleDue && item.At.Before(today) || item.Kind == ScheduleRemind && item.At.Before(now) && !item.Fired {
+			marker = " (overdue)"
+		}
+		fmt.Printf("%-16s  %-6s  %s%s\n", when, item.Kind, NewBlock(item.Content).FirstLine(), marker)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ansiReset = "\033[0m"
+)
+
+// Orders grep results can be sorted in with --sort. Each sorts the most
+// first: newest, most matches, longest. Ties go to the most recently
+// updated block.
+const (
+	SearchSortUpdated   = "updated"
+	SearchSortCreated   = "created"
+	SearchSortRelevance = "relevance"
+	SearchSortLength    = "length"
+)
+
+var searchSorts = []string{SearchSortUpdated, SearchSortCreated, SearchSortRelevance, SearchSortLength}
+
+// SearchOptions narrow and order a search. The zero value returns every
+// match, most recently updated first.
+type SearchOptions struct {
+	Range   TimeRange
+	Words   WordRange
+	Sort    string
+	Reverse bool
+	Limit   int
+}
+
+// orderSearchResults sorts blocks as SQL orders them for opts, for
+// searches that are filtered in memory.
+func orderSearchResults(blocks []*Block, includeKeywords []string, opts SearchOptions) {
+	relevance := func(block *Block) int {
+		content := strings.ToLower(block.Content)
+		count := 0
+		for _, keyword := range includeKeywords {
+			count += strings.Count(content, strings.ToLower(keyword))
+		}
+		return count
+	}
+
+	slices.SortStableFunc(blocks, func(a, b *Block) int {
+		c := 0
+		switch opts.Sort {
+		case SearchSortCreated:
+			c = b.CreatedAt.Compare(a.CreatedAt)
+		case SearchSortLength:
+			c = cmp.Compare(len(b.Content), len(a.Content))
+		case SearchSortRelevance:
+			c = cmp.Compare(relevance(b), relevance(a))
+		}
+		if c == 0 {
+			c = b.UpdatedAt.Compare(a.UpdatedAt)
+		}
+		if c == 0 {
+			c = cmp.Compare(b.ID, a.ID)
+		}
+		if opts.Reverse {
+			return -c
+		}
+		return c
+	})
+}
+
+// SearchResult is the JSON representation of a grep hit.
+type SearchResult struct {
+	*Block
+	Files []string `json:"files"`
+}
+
+// parseSearchTerms splits grep arguments into include and exclude keywords.
+// Arguments prefixed with '-' are excluded.
+func parseSearchTerms(args []string) (includeKeywords, excludeKeywords []string) {
+	for _, arg := range args {
+		if arg == "" {
+			continue
+		}
+		if arg[0] == '-' {
+			// Remove the - prefix for exclude keywords
+			if len(arg) > 1 {
+				excludeKeywords = append(excludeKeywords, arg[1:])
+			}
+		} else {
+			includeKeywords = append(includeKeywords, arg)
+		}
+	}
+	return includeKeywords, excludeKeywords
+}
+
+// highlightTerms styles case-insensitive occurrences of terms with the
+// theme's highlight.
+func highlightTerms(content string, terms []string) string {
+	if len(terms) == 0 {
+		return content
+	}
+
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	pattern := regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+
+	return pattern.ReplaceAllStringFunc(content, func(match string) string {
+		return output.Style("highlight", match)
+	})
+}
+
+// stdoutIsTerminal reports whether output is going to an interactive
+// terminal. Whether to colour it is up to the Formatter.
+func stdoutIsTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func handleGrep() {
+	fs := flag.NewFlagSet("grep", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "print results as JSON")
+	countOnly := fs.Bool("count", false, "print only the number of matching blocks")
+	byFile := fs.Bool("files", false, "list the watched files containing matches")
+	firstLine := fs.Bool("first-line", false, "print only the first line of each block")
+	interactive := fs.Bool("interactive", false, "number the results and pick one to print, edit, delete or copy")
+	noPager := fs.Bool("no-pager", false, "don't page long output")
+	render := fs.Bool("render", false, "style the markdown for the terminal")
+	sortBy := fs.String("sort", SearchSortUpdated, "order results by "+strings.Join(searchSorts, ", "))
+	reverse := fs.Bool("reverse", false, "reverse the order of the results")
+	limit := fs.Int("limit", 0, "show at most this many results; 0 shows all")
+	parseTimeRange := timeRangeFlags(fs)
+	parseWordRange := wordRangeFlags(fs)
+	args := parseLongArgs(fs, os.Args[2:])
+
+	if len(args) == 0 {
+		fmt.Println("Error: grep command requires search term(s)")
+		fmt.Println("Usage: notes grep \"term1\" \"term2\" -\"excluded\"")
+		os.Exit(1)
+	}
+
+	includeKeywords, excludeKeywords := parseSearchTerms(args)
+	if len(includeKeywords) == 0 && len(excludeKeywords) == 0 {
+		fmt.Println("Error: at least one search term is required")
+		os.Exit(1)
+	}
+
+	if !slices.Contains(searchSorts, *sortBy) {
+		fmt.Printf("Error: unknown sort %q (available: %s)\n", *sortBy, strings.Join(searchSorts, ", "))
+		os.Exit(1)
+	}
+	if *limit < 0 {
+		fmt.Println("Error: --limit must not be negative")
+		os.Exit(1)
+	}
+
+	timeRange, err := parseTimeRange(time.Now())
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	wordRange, err := parseWordRange()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	opts := SearchOptions{Range: timeRange, Words: wordRange, Sort: *sortBy, Reverse: *reverse, Limit: *limit}
+
+	if remote != nil && (*jsonOutput || *byFile || *interactive || opts != SearchOptions{Sort: SearchSortUpdated}) {
+		fmt.Println("Error: --json, --files, --interactive, --since, --until, --min-words, --max-words, --sort, --reverse and --limit are not available with NOTES_REMOTE")
+		os.Exit(1)
+	}
+
+	var blocks []*Block
+	if remote != nil {
+		blocks, err = remote.SearchBlocks(includeKeywords, excludeKeywords)
+	} else {
+		blocks, err = db.SearchBlocksWith(includeKeywords, excludeKeywords, opts)
+	}
+	if err != nil {
+		log.Fatalf("Failed to search: %v", err)
+	}
+
+	switch {
+	case *countOnly:
+		fmt.Println(len(blocks))
+	case *jsonOutput:
+		printSearchJSON(blocks)
+	case *byFile:
+		printSearchFiles(blocks)
+	case *interactive:
+		selectSearchResult(blocks)
+	default:
+		var out io.Writer = os.Stdout
+		wait := func() {}
+		if !*noPager {
+			out, wait = startPager()
+		}
+		printSearchBlocks(out, blocks, includeKeywords, *firstLine, *render)
+		wait()
+	}
+}
+
+func printSearchJSON(blocks []*Block) {
+	results := make([]SearchResult, 0, len(blocks))
+	for _, block := range blocks {
+		files, err := db.GetBlockFiles(block.ContentHash)
+		if err != nil {
+			log.Fatalf("Failed to get block files: %v", err)
+		}
+		if files == nil {
+			files = []string{}
+		}
+		results = append(results, SearchResult{Block: block, Files: files})
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(results); err != nil {
+		log.Fatalf("Failed to encode results: %v", err)
+	}
+}
+
+func printSearchFiles(blocks []*Block) {
+	hits := make(map[string]int)
+	for _, block := range blocks {
+		files, err := db.GetBlockFiles(block.ContentHash)
+		if err != nil {
+			log.Fatalf("Failed to get block files: %v", err)
+		}
+		for _, filePath := range files {
+			hits[filePath]++
+		}
+	}
+
+	if len(hits) == 0 {
+		fmt.Println("No watched files contain matching blocks")
+		return
+	}
+
+	files := make([]string, 0, len(hits))
+	for filePath := range hits {
+		files = append(files, filePath)
+	}
+	sort.Strings(files)
+
+	for _, filePath := range files {
+		fmt.Printf("%s (%d)\n", filePath, hits[filePath])
+	}
+}
+
+// printSearchBlocks prints blocks with the search terms highlighted, or
+// styled as markdown when render is set; escape codes from one would be
+// mangled by the other.
+func printSearchBlocks(out io.Writer, blocks []*Block, includeKeywords []string, firstLineOnly, render bool) {
+	if len(blocks) == 0 {
+		fmt.Fprintln(out, "No blocks found matching the specified criteria")
+		return
+	}
+
+	highlight := output.Color()
+	for i, block := range blocks {
+		content := block.Content
+		if firstLineOnly {
+			content = block.FirstLine()
+		}
+		switch {
+		case render && highlight:
+			content = renderMarkdown(content)
+		case highlight:
+			content = highlightTerms(content, includeKeywords)
+		}
+
+		fmt.Fprintln(out, content)
+		if !firstLineOnly && i < len(blocks)-1 {
+			fmt.Fprintln(out, output.Separator())
+		}
+	}
+}
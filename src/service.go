@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// WatcherService describes the user-level service that runs `notes watcher`
+// for one repository.
+type WatcherService struct {
+	Name    string   // unit or launchd label
+	Args    []string // command line, starting with the notes binary
+	Env     []string // KEY=value pairs
+	LogPath string   // launchd only; systemd logs to the journal
+}
+
+// serviceName names the service after the profile, or the repository
+// directory if none was used, so several repositories can each have one.
+func serviceName(basePath string) string {
+	if repoProfile != "" {
+		return "notes-watcher-" + repoProfile
+	}
+	return "notes-watcher-" + sha256Hex(basePath)[:8]
+}
+
+// newWatcherService builds the service for the repository in basePath.
+// extraArgs are appended to `notes watcher`.
+func newWatcherService(basePath string, extraArgs []string) (*WatcherService, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate notes binary: %w", err)
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return nil, fmt.Errorf("failed to resolve notes binary: %w", err)
+	}
+
+	// The profile name is enough when one was used; otherwise pin the
+	// repository directory.
+	env := []string{"NOTES_PATH=" + basePath}
+	if repoProfile != "" {
+		env = []string{"NOTES_PROFILE=" + repoProfile}
+	}
+
+	return &WatcherService{
+		Name:    serviceName(basePath),
+		Args:    append([]string{executable, "watcher"}, extraArgs...),
+		Env:     env,
+		LogPath: filepath.Join(basePath, ConfigDirName, "watcher.log"),
+	}, nil
+}
+
+// SystemdUnit renders a systemd user unit.
+func (s *WatcherService) SystemdUnit() string {
+	var quoted []string
+	for _, arg := range s.Args {
+		quoted = append(quoted, systemdQuote(arg))
+	}
+
+	var unit strings.Builder
+	fmt.Fprintf(&unit, "[Unit]\nDescription=notes watcher (%s)\n\n", s.Name)
+	unit.WriteString("[Service]\n")
+	for _, env := range s.Env {
+		fmt.Fprintf(&unit, "Environment=%s\n", systemdQuote(env))
+	}
+	fmt.Fprintf(&unit, "ExecStart=%s\n", strings.Join(quoted, " "))
+	unit.WriteString("Restart=on-failure\nRestartSec=5\n\n")
+	unit.WriteString("[Install]\nWantedBy=default.target\n")
+	return unit.String()
+}
+
+func systemdQuote(value string) string {
+	if !strings.ContainsAny(value, " \t\"'\\%$") {
+		return value
+	}
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(value)
+	return `"` + value + `"`
+}
+
+// LaunchdPlist renders a launchd agent property list.
+func (s *WatcherService) LaunchdPlist() string {
+	var plist strings.Builder
+	plist.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+`)
+	fmt.Fprintf(&plist, "\t<key>Label</key>\n\t<string>%s</string>\n", xmlEscape(s.Name))
+
+	plist.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range s.Args {
+		fmt.Fprintf(&plist, "\t\t<string>%s</string>\n", xmlEscape(arg))
+	}
+	plist.WriteString("\t</array>\n")
+
+	plist.WriteString("\t<key>EnvironmentVariables</key>\n\t<dict>\n")
+	for _, env := range s.Env {
+		key, value, _ := strings.Cut(env, "=")
+		fmt.Fprintf(&plist, "\t\t<key>%s</key>\n\t\t<string>%s</string>\n", xmlEscape(key), xmlEscape(value))
+	}
+	plist.WriteString("\t</dict>\n")
+
+	plist.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n\t<key>KeepAlive</key>\n\t<true/>\n")
+	fmt.Fprintf(&plist, "\t<key>StandardOutPath</key>\n\t<string>%s</string>\n", xmlEscape(s.LogPath))
+	fmt.Fprintf(&plist, "\t<key>StandardErrorPath</key>\n\t<string>%s</string>\n", xmlEscape(s.LogPath))
+	plist.WriteString("</dict>\n</plist>\n")
+	return plist.String()
+}
+
+func xmlEscape(value string) string {
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(value))
+	return escaped.String()
+}
+
+// servicePath is where the service definition for name is installed.
+func servicePath(name string) (string, error) {
+	switch runtime.GOOS {
+	case "linux":
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to locate config directory: %w", err)
+		}
+		return filepath.Join(configDir, "systemd", "user", name+".service"), nil
+	case "darwin":
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to locate home directory: %w", err)
+		}
+		return filepath.Join(home, "Library", "LaunchAgents", name+".plist"), nil
+	default:
+		return "", fmt.Errorf("installing a service is not supported on %s", runtime.GOOS)
+	}
+}
+
+func runServiceCommand(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s failed: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func handleInstallService() {
+	fs := flag.NewFlagSet("watcher install-service", flag.ExitOnError)
+	pollInterval := fs.Duration("poll", 0, "run the watcher in polling mode at this interval")
+	noStart := fs.Bool("no-start", false, "only write the service file")
+	parseArgs(fs, os.Args[3:])
+
+	var extraArgs []string
+	if *pollInterval > 0 {
+		extraArgs = append(extraArgs, "--poll", pollInterval.String())
+	}
+
+	basePath, err := filepath.Abs(config.basePath)
+	if err != nil {
+		log.Fatalf("Failed to resolve repository path: %v", err)
+	}
+	service, err := newWatcherService(basePath, extraArgs)
+	if err != nil {
+		log.Fatalf("Failed to prepare service: %v", err)
+	}
+	path, err := servicePath(service.Name)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	content := service.SystemdUnit()
+	if runtime.GOOS == "darwin" {
+		content = service.LaunchdPlist()
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Fatalf("Failed to create %s: %v", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		log.Fatalf("Failed to write %s: %v", path, err)
+	}
+	fmt.Printf("Wrote %s\n", path)
+
+	if *noStart {
+		return
+	}
+
+	if runtime.GOOS == "darwin" {
+		err = runServiceCommand("launchctl", "load", "-w", path)
+	} else if err = runServiceCommand("systemctl", "--user", "daemon-reload"); err == nil {
+		err = runServiceCommand("systemctl", "--user", "enable", "--now", service.Name+".service")
+	}
+	if err != nil {
+		log.Fatalf("Failed to start service: %v", err)
+	}
+	fmt.Printf("Service %s installed and started\n", service.Name)
+}
+
+func handleUninstallService() {
+	fs := flag.NewFlagSet("watcher uninstall-service", flag.ExitOnError)
+	parseArgs(fs, os.Args[3:])
+
+	basePath, err := filepath.Abs(config.basePath)
+	if err != nil {
+		log.Fatalf("Failed to resolve repository path: %v", err)
+	}
+	name := serviceName(basePath)
+	path, err := servicePath(name)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if !fileExists(path) {
+		fmt.Printf("Error: no service installed for this repository (%s not found)\n", path)
+		os.Exit(1)
+	}
+
+	// Stopping fails harmlessly if the service isn't loaded
+	if runtime.GOOS == "darwin" {
+		err = runServiceCommand("launchctl", "unload", "-w", path)
+	} else {
+		err = runServiceCommand("systemctl", "--user", "disable", "--now", name+".service")
+	}
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		log.Fatalf("Failed to remove %s: %v", path, err)
+	}
+	if runtime.GOOS == "linux" {
+		if err := runServiceCommand("systemctl", "--user", "daemon-reload"); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	fmt.Printf("Service %s removed\n", name)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// primaryBlockFile returns the file `notes open` shows a block in: the
+// first watched file holding it, or notes.md for blocks only found there.
+// Mirrors are skipped since edits to them are overwritten.
+func primaryBlockFile(db *Database, config *Config, block *Block) (string, error) {
+	files, err := db.GetBlockFiles(block.ContentHash)
+	if err != nil {
+		return "", err
+	}
+	for _, filePath := range files {
+		if !config.FileConfig(filePath).Mirror && fileExists(filePath) {
+			return filePath, nil
+		}
+	}
+	return config.notesPath, nil
+}
+
+// blockLine returns the 1-based line block starts on in content, or 0 if
+// it isn't there. Only matches starting a line count, so a block isn't
+// found inside a longer one.
+func blockLine(content string, block *Block) int {
+	offset := 0
+	for {
+		index := strings.Index(content[offset:], block.Content)
+		if index < 0 {
+			return 0
+		}
+		index += offset
+		if index == 0 || content[index-1] == '\n' {
+			return strings.Count(content[:index], "\n") + 1
+		}
+		offset = index + 1
+	}
+}
+
+func handleCat() {
+	fs := flag.NewFlagSet("cat", flag.ExitOnError)
+	render := fs.Bool("render", false, "style the markdown for the terminal")
+	args := parseArgs(fs, os.Args[2:])
+
+	if len(args) != 1 {
+		fmt.Println("Error: cat command requires one block ID or hash")
+		fmt.Println("Usage: notes cat [--render] <id>")
+		os.Exit(1)
+	}
+
+	block, err := db.LookupBlock(args[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(displayContent(block.Content, *render))
+}
+
+// warnSameTitle warns when other blocks have the same title as block,
+// since the title then no longer addresses it.
+func warnSameTitle(block *Block) {
+	title := block.Title()
+	if title == "" {
+		return
+	}
+	matches, err := db.GetBlocksByTitlePrefix(title)
+	if err != nil {
+		log.Printf("Failed to check for blocks with the same title: %v", err)
+		return
+	}
+	for _, other := range matches {
+		if other.ID != block.ID && strings.EqualFold(other.Title(), title) {
+			fmt.Printf("Warning: block %d has the same title as block %d (%q); use their IDs to address them\n", block.ID, other.ID, title)
+		}
+	}
+}
+
+func handleEdit() {
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	args := parseArgs(fs, os.Args[2:])
+
+	if len(args) != 1 {
+		fmt.Println("Error: edit command requires one block ID, hash or title")
+		fmt.Println("Usage: notes edit <id|title>")
+		os.Exit(1)
+	}
+
+	block, err := db.LookupBlock(args[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	editSearchResult(block)
+}
+
+func handleOpen() {
+	fs := flag.NewFlagSet("open", flag.ExitOnError)
+	args := parseArgs(fs, os.Args[2:])
+
+	if len(args) != 1 {
+		fmt.Println("Error: open command requires one block ID or hash")
+		fmt.Println("Usage: notes open <id>")
+		os.Exit(1)
+	}
+
+	block, err := db.LookupBlock(args[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	filePath, err := primaryBlockFile(db, config, block)
+	if err != nil {
+		log.Fatalf("Failed to find the block's file: %v", err)
+	}
+
+	content, err := NewFileManager(filePath).ReadFile(filePath)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", filePath, err)
+	}
+	line := blockLine(content, block)
+	if line == 0 {
+		fmt.Printf("Warning: block not found in %s, it may not have been regenerated yet\n", filePath)
+	}
+
+	if err := runEditor(filePath, line); err != nil {
+		log.Fatalf("Failed to open editor: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// SplitBlock replaces the block identified by hash with one block per
+// blank-line-separated section of content. The new blocks keep the
+// original's creation time and take its place in every file it was in.
+func (r *Reconciler) SplitBlock(hash, content string) (*ChangeSet, error) {
+	changes := NewChangeSet("")
+
+	original, err := r.db.GetBlockByHash(hash)
+	if err != nil {
+		return changes, err
+	}
+	if original == nil {
+		return changes, fmt.Errorf("block %.12s not found", hash)
+	}
+
+	now := time.Now()
+	parts := ParseBlocksFromMarkdown(content)
+	if len(parts) == 0 {
+		return changes, fmt.Errorf("split would leave no content")
+	}
+	if len(parts) == 1 && parts[0].ContentHash == hash {
+		return changes, nil
+	}
+	for _, part := range parts {
+		part.CreatedAt = original.CreatedAt
+		part.UpdatedAt = now
+		part.TouchCount = original.TouchCount
+	}
+
+	return changes, r.replaceBlocks(changes, OperationSplit, []*Block{original}, parts)
+}
+
+// MergeBlocks replaces blocks with a single block holding their contents in
+// the given order, one after another. The merged block keeps the earliest
+// creation time and takes the place of the first block in every file.
+func (r *Reconciler) MergeBlocks(blocks []*Block) (*ChangeSet, error) {
+	changes := NewChangeSet("")
+
+	var contents []string
+	createdAt := blocks[0].CreatedAt
+	touchCount := 0
+	for _, block := range blocks {
+		contents = append(contents, block.Content)
+		if block.CreatedAt.Before(createdAt) {
+			createdAt = block.CreatedAt
+		}
+		touchCount += block.TouchCount
+	}
+
+	// A blank line would split the block again when a file is reconciled
+	merged := NewBlock(strings.Join(contents, "\n"))
+	merged.CreatedAt = createdAt
+	merged.TouchCount = touchCount
+
+	return changes, r.replaceBlocks(changes, OperationMerge, blocks, []*Block{merged})
+}
+
+// replaceBlocks swaps old for replacements in the database and records the
+// change. Replacements that already existed are recorded as bumped.
+func (r *Reconciler) replaceBlocks(changes *ChangeSet, kind string, old, replacements []*Block) error {
+	var hashes, oldHashes []string
+	for _, block := range replacements {
+		hashes = append(hashes, block.ContentHash)
+	}
+	for _, block := range old {
+		oldHashes = append(oldHashes, block.ContentHash)
+	}
+
+	existing, err := r.db.GetBlocksByHashes(hashes)
+	if err != nil {
+		return fmt.Errorf("failed to look up existing blocks: %w", err)
+	}
+
+	if err := r.db.ReplaceBlocks(oldHashes, replacements); err != nil {
+		return err
+	}
+
+	replaced := make(map[string]bool)
+	for _, block := range old {
+		replaced[block.ContentHash] = true
+	}
+	for _, block := range replacements {
+		if previous := existing[block.ContentHash]; previous != nil && !replaced[block.ContentHash] {
+			bumped := *previous
+			bumped.UpdatedAt = block.UpdatedAt
+			bumped.TouchCount++
+			changes.AddUpdate(previous, &bumped)
+		} else {
+			changes.Added = append(changes.Added, block)
+		}
+	}
+	changes.Deleted = append(changes.Deleted, old...)
+
+	r.recordOperation(kind, changes)
+	r.hooks.RunPost(HookPostUpdate, changes)
+	return nil
+}
+
+func handleSplit() {
+	fs := flag.NewFlagSet("split", flag.ExitOnError)
+	args := parseArgs(fs, os.Args[2:])
+
+	if len(args) != 1 {
+		fmt.Println("Error: split command requires one block ID or hash")
+		fmt.Println("Usage: notes split <id>")
+		os.Exit(1)
+	}
+
+	block, err := db.LookupBlock(args[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	content, err := editInEditor(block.Content+"\n", 0)
+	if err != nil {
+		log.Fatalf("Failed to edit block: %v", err)
+	}
+
+	changes, err := newMainReconciler().SplitBlock(block.ContentHash, content)
+	if err != nil {
+		log.Fatalf("Failed to split block: %v", err)
+	}
+	if changes.IsEmpty() {
+		fmt.Println("Block unchanged")
+		return
+	}
+
+	if err := regenerateAllFiles(); err != nil {
+		log.Fatalf("Failed to regenerate files: %v", err)
+	}
+	fmt.Printf("Split block into %d blocks\n", len(changes.Added)+len(changes.Updated))
+}
+
+func handleMerge() {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	args := parseArgs(fs, os.Args[2:])
+
+	var blocks []*Block
+	seen := make(map[string]bool)
+	for _, identifier := range args {
+		block, err := db.LookupBlock(identifier)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if !seen[block.ContentHash] {
+			seen[block.ContentHash] = true
+			blocks = append(blocks, block)
+		}
+	}
+
+	if len(blocks) < 2 {
+		fmt.Println("Error: merge command requires at least two different blocks")
+		fmt.Println("Usage: notes merge <id1> <id2> ...")
+		os.Exit(1)
+	}
+
+	changes, err := newMainReconciler().MergeBlocks(blocks)
+	if err != nil {
+		log.Fatalf("Failed to merge blocks: %v", err)
+	}
+
+	if err := regenerateAllFiles(); err != nil {
+		log.Fatalf("Failed to regenerate files: %v", err)
+	}
+	fmt.Printf("Merged %d blocks\n", len(changes.Deleted))
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Stats summarises how the repository is used, for `notes stats`.
+type Stats struct {
+	TotalBlocks      int          `json:"total_blocks"`
+	TotalBytes       int          `json:"total_bytes"`
+	AverageBlockSize int          `json:"average_block_size"`
+	TotalWords       int          `json:"total_words"`
+	AverageWords     int          `json:"average_words"`
+	ReadingMinutes   int          `json:"reading_minutes"`
+	DatabaseBytes    int64        `json:"database_bytes"`
+	Weeks            []WeekStats  `json:"weeks"`
+	Tags             []TagCount   `json:"tags"`
+	Untouched        []*Block     `json:"untouched"`
+	Longest          []*Block     `json:"longest"`
+	SizeHistory      []SizeSample `json:"size_history"`
+
+	// Daily holds the number of blocks created on each day of the covered
+	// weeks, keyed by YYYY-MM-DD.
+	Daily map[string]int `json:"daily"`
+}
+
+// WeekStats counts the blocks created in the week starting on Monday Start.
+type WeekStats struct {
+	Start string `json:"start"`
+	Added int    `json:"added"`
+	Total int    `json:"total"` // blocks existing at the end of the week
+}
+
+type TagCount struct {
+	Tag    string `json:"tag"`
+	Blocks int    `json:"blocks"`
+}
+
+// countTags returns how many blocks carry each tag, most used first.
+func countTags(blocks []*Block) []TagCount {
+	counts := make(map[string]int)
+	for _, block := range blocks {
+		for _, tag := range ExtractTags(block.Content) {
+			counts[tag]++
+		}
+	}
+
+	tags := []TagCount{}
+	for tag, count := range counts {
+		tags = append(tags, TagCount{Tag: tag, Blocks: count})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Blocks != tags[j].Blocks {
+			return tags[i].Blocks > tags[j].Blocks
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+	return tags
+}
+
+// ComputeStats gathers statistics over blocks for the weeks up to now. The
+// database size fields are filled in by the caller.
+func ComputeStats(blocks []*Block, now time.Time, weeks, top int) *Stats {
+	stats := &Stats{
+		TotalBlocks: len(blocks),
+		Weeks:       []WeekStats{},
+		Tags:        []TagCount{},
+		Untouched:   []*Block{},
+		Longest:     []*Block{},
+		Daily:       make(map[string]int),
+	}
+
+	firstWeek := startOfWeek(now).AddDate(0, 0, -7*(weeks-1))
+	added := make([]int, weeks)
+	before := 0
+
+	for _, block := range blocks {
+		stats.TotalBytes += len(block.Content)
+		stats.TotalWords += block.Words
+
+		created := block.CreatedAt.Local()
+		if created.Before(firstWeek) {
+			before++
+			continue
+		}
+		if week := daysBetween(firstWeek, created) / 7; week < weeks {
+			added[week]++
+			stats.Daily[created.Format("2006-01-02")]++
+		}
+	}
+	if len(blocks) > 0 {
+		stats.AverageBlockSize = stats.TotalBytes / len(blocks)
+		stats.AverageWords = stats.TotalWords / len(blocks)
+	}
+	stats.ReadingMinutes = readingMinutes(stats.TotalWords)
+
+	total := before
+	for i, count := range added {
+		total += count
+		stats.Weeks = append(stats.Weeks, WeekStats{
+			Start: firstWeek.AddDate(0, 0, 7*i).Format("2006-01-02"),
+			Added: count,
+			Total: total,
+		})
+	}
+
+	stats.Tags = countTags(blocks)
+	if len(stats.Tags) > top {
+		stats.Tags = stats.Tags[:top]
+	}
+
+	untouched := append([]*Block(nil), blocks...)
+	sort.SliceStable(untouched, func(i, j int) bool { return untouched[i].UpdatedAt.Before(untouched[j].UpdatedAt) })
+	stats.Untouched = append(stats.Untouched, untouched[:min(top, len(untouched))]...)
+
+	longest := append([]*Block(nil), blocks...)
+	sort.SliceStable(longest, func(i, j int) bool { return longest[i].Words > longest[j].Words })
+	stats.Longest = append(stats.Longest, longest[:min(top, len(longest))]...)
+
+	return stats
+}
+
+// startOfWeek returns midnight of the Monday of t's week.
+func startOfWeek(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+// daysBetween returns the number of calendar days from from to to in their
+// own location. Days aren't always 24 hours long across a daylight saving
+// change, so the dates are compared as if in UTC.
+func daysBetween(from, to time.Time) int {
+	fromDay := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	toDay := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+	return int(toDay.Sub(fromDay).Hours() / 24)
+}
+
+// databaseSize returns the size of the database file including its
+// write-ahead log.
+func databaseSize(path string) int64 {
+	var size int64
+	for _, name := range []string{path, path + "-wal"} {
+		if info, err := os.Stat(name); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// recordDatabaseSize stores today's database size so `notes stats` can show
+// its growth over time.
+func recordDatabaseSize(now time.Time) error {
+	if db.ReadOnly() {
+		return nil
+	}
+	return db.RecordSizeSample(now.Format("2006-01-02"), databaseSize(dbPath))
+}
+
+func formatBytes(bytes int64) string {
+	switch {
+	case bytes < 1024:
+		return fmt.Sprintf("%d B", bytes)
+	case bytes < 1024*1024:
+		return fmt.Sprintf("%.1f KB", float64(bytes)/1024)
+	default:
+		return fmt.Sprintf("%.1f MB", float64(bytes)/(1024*1024))
+	}
+}
+
+func handleStats() {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	weeks := fs.Int("weeks", 12, "number of weeks to cover")
+	top := fs.Int("top", 10, "number of tags and untouched blocks to list")
+	heatmap := fs.Bool("heatmap", false, "show blocks created per day as a text heatmap")
+	jsonOutput := fs.Bool("json", false, "print statistics as JSON")
+	parseArgs(fs, os.Args[2:])
+
+	if *weeks < 1 {
+		fmt.Println("Error: --weeks must be at least 1")
+		os.Exit(1)
+	}
+
+	now := time.Now()
+	if err := recordDatabaseSize(now); err != nil {
+		log.Fatalf("Failed to record database size: %v", err)
+	}
+
+	blocks, err := db.GetAllBlocks()
+	if err != nil {
+		log.Fatalf("Failed to get blocks: %v", err)
+	}
+
+	stats := ComputeStats(blocks, now, *weeks, *top)
+	stats.DatabaseBytes = databaseSize(dbPath)
+	if stats.SizeHistory, err = db.GetSizeSamples(); err != nil {
+		log.Fatalf("Failed to get database size history: %v", err)
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(stats); err != nil {
+			log.Fatalf("Failed to encode statistics: %v", err)
+		}
+		return
+	}
+
+	printStats(stats, now)
+	if *heatmap {
+		fmt.Println()
+		printHeatmap(stats, now, *weeks)
+	}
+}
+
+func printStats(stats *Stats, now time.Time) {
+	fmt.Printf("Blocks:             %d\n", stats.TotalBlocks)
+	fmt.Printf("Average block size: %d bytes, %d words\n", stats.AverageBlockSize, stats.AverageWords)
+	fmt.Printf("Words:              %d (%s to read)\n", stats.TotalWords, formatReadingTime(stats.ReadingMinutes))
+	fmt.Printf("Database size:      %s\n", formatBytes(stats.DatabaseBytes))
+
+	fmt.Println("\nBlocks added per week:")
+	maxAdded := 0
+	for _, week := range stats.Weeks {
+		maxAdded = max(maxAdded, week.Added)
+	}
+	for _, week := range stats.Weeks {
+		bar := ""
+		if maxAdded > 0 {
+			bar = strings.Repeat("#", week.Added*30/maxAdded)
+		}
+		fmt.Printf("  %s  %4d  %-30s  (total %d)\n", week.Start, week.Added, bar, week.Total)
+	}
+
+	if len(stats.SizeHistory) > 1 {
+		first, last := stats.SizeHistory[0], stats.SizeHistory[len(stats.SizeHistory)-1]
+		fmt.Printf("\nDatabase growth: %s on %s to %s on %s\n",
+			formatBytes(first.Bytes), first.Day, formatBytes(last.Bytes), last.Day)
+	}
+
+	if len(stats.Tags) > 0 {
+		fmt.Println("\nMost used tags:")
+		for _, tag := range stats.Tags {
+			fmt.Printf("  %4d  #%s\n", tag.Blocks, tag.Tag)
+		}
+	}
+
+	if len(stats.Longest) > 0 && stats.Longest[0].Words > 0 {
+		fmt.Println("\nLongest blocks:")
+		for _, block := range stats.Longest {
+			fmt.Printf("  %5dw  %s\n", block.Words, block.FirstLine())
+		}
+	}
+
+	if len(stats.Untouched) > 0 {
+		fmt.Println("\nLongest untouched:")
+		for _, block := range stats.Untouched {
+			fmt.Printf("  %5s  %s\n", formatAge(now.Sub(block.UpdatedAt)), block.FirstLine())
+		}
+	}
+}
+
+var heatmapShades = []rune{'·', '░', '▒', '▓', '█'}
+
+// printHeatmap draws one row per weekday and one column per week, shaded by
+// the number of blocks created that day relative to the busiest day.
+func printHeatmap(stats *Stats, now time.Time, weeks int) {
+	busiest := 0
+	for _, count := range stats.Daily {
+		busiest = max(busiest, count)
+	}
+
+	firstWeek := startOfWeek(now).AddDate(0, 0, -7*(weeks-1))
+	fmt.Printf("Blocks created per day since %s:\n", firstWeek.Format("2006-01-02"))
+	for weekday := 0; weekday < 7; weekday++ {
+		var row strings.Builder
+		for week := 0; week < weeks; week++ {
+			day := firstWeek.AddDate(0, 0, 7*week+weekday)
+			if day.After(now) {
+				break
+			}
+			shade := 0
+			if count := stats.Daily[day.Format("2006-01-02")]; count > 0 {
+				shade = 1 + (count-1)*(len(heatmapShades)-2)/max(busiest-1, 1)
+			}
+			row.WriteRune(heatmapShades[shade])
+		}
+		fmt.Printf("  %s  %s\n", firstWeek.AddDate(0, 0, weekday).Format("Mon"), row.String())
+	}
+}
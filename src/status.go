@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statusErrorLimit is how many recent watcher errors `notes status` shows.
+const statusErrorLimit = 5
+
+const (
+	// daemonStopCheckPeriod is how often the daemon looks for a stop request.
+	daemonStopCheckPeriod = time.Second
+
+	// daemonStopTimeout is how long `notes watcher stop` waits for the
+	// daemon to exit.
+	daemonStopTimeout = 15 * time.Second
+
+	// daemonLockAttempts and daemonLockRetryDelay bound how long a starting
+	// daemon waits for the PID file lock before deciding another daemon
+	// holds it.
+	daemonLockAttempts   = 5
+	daemonLockRetryDelay = 50 * time.Millisecond
+)
+
+// acquireDaemonLock makes the current process the watcher daemon of the
+// repository by locking the PID file and writing its PID into it. It fails if
+// another daemon holds the lock. The returned file must stay open while the
+// daemon runs; releaseDaemonLock gives it up.
+func acquireDaemonLock(path string) (*os.File, error) {
+	if pid, running := daemonPID(path); running {
+		return nil, fmt.Errorf("watcher daemon already running (pid %d)", pid)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", path, err)
+		}
+
+		locked, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		// A lock on a file since removed or replaced guards nothing, as
+		// the next daemon locks the file now at path
+		if locked && isFileAt(file, path) {
+			if err := file.Truncate(0); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("failed to write %s: %w", path, err)
+			}
+			if _, err := file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("failed to write %s: %w", path, err)
+			}
+			return file, nil
+		}
+		file.Close()
+
+		// daemonPID holds the lock for a moment to see whether a daemon
+		// does, so only give up once it has been held for a while
+		if attempt == daemonLockAttempts {
+			pid, _ := readPIDFile(path)
+			return nil, fmt.Errorf("watcher daemon already running (pid %d)", pid)
+		}
+		if !locked {
+			time.Sleep(daemonLockRetryDelay)
+		}
+	}
+}
+
+// isFileAt reports whether file is still the file at path.
+func isFileAt(file *os.File, path string) bool {
+	opened, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	return err == nil && os.SameFile(opened, current)
+}
+
+// releaseDaemonLock empties the PID file and drops the lock. The file itself
+// is kept: removing it would let a daemon starting meanwhile lock the removed
+// file while another locks a new one.
+func releaseDaemonLock(file *os.File) {
+	file.Truncate(0)
+	file.Close()
+}
+
+// daemonPID reads the PID file and reports whether that process is alive and
+// still holds the lock. A stale PID file left by a crashed daemon reports not
+// running, even if its PID has since been reused.
+func daemonPID(path string) (int, bool) {
+	pid, ok := readPIDFile(path)
+	if !ok {
+		return 0, false
+	}
+
+	if !processAlive(pid) {
+		return pid, false
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return pid, false
+	}
+	defer file.Close()
+	locked, err := tryLockFile(file)
+	return pid, err == nil && !locked
+}
+
+// stopRequested reports whether `notes watcher stop` has asked this process
+// to exit. A request left for an earlier daemon names another PID.
+func stopRequested(path string) bool {
+	pid, ok := readPIDFile(path)
+	return ok && pid == os.Getpid()
+}
+
+// handleWatcherStop asks the running daemon to shut down through the stop
+// file and waits for it to exit. Unlike SIGTERM this works on Windows too.
+func handleWatcherStop() {
+	pid, running := daemonPID(config.PIDFile())
+	if !running {
+		fmt.Println("Watcher daemon is not running")
+		return
+	}
+	if err := os.WriteFile(config.StopFile(), []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		log.Fatalf("Failed to request daemon stop: %v", err)
+	}
+
+	deadline := time.Now().Add(daemonStopTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		if _, running := daemonPID(config.PIDFile()); !running {
+			fmt.Printf("Watcher daemon (pid %d) stopped\n", pid)
+			return
+		}
+	}
+	fmt.Printf("Error: watcher daemon (pid %d) did not stop within %s\n", pid, daemonStopTimeout)
+	os.Exit(1)
+}
+
+func readPIDFile(path string) (int, bool) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	return pid, true
+}
+
+func handleStatus() {
+	fmt.Printf("Repository: %s\n", filepath.Dir(dbPath))
+	fmt.Printf("Notes file: %s\n", notesPath)
+
+	count, err := db.CountBlocks()
+	if err != nil {
+		log.Fatalf("Failed to count blocks: %v", err)
+	}
+	fmt.Printf("Blocks:     %d\n", count)
+
+	if pid, running := daemonPID(config.PIDFile()); running {
+		fmt.Printf("Daemon:     running (pid %d)\n", pid)
+	} else {
+		fmt.Println("Daemon:     not running")
+	}
+
+	watchedFiles, err := db.GetWatchedFiles()
+	if err != nil {
+		log.Fatalf("Failed to get watched files: %v", err)
+	}
+
+	fmt.Printf("\nWatched files (%d):\n", len(watchedFiles))
+	for _, filePath := range watchedFiles {
+		fmt.Printf("  %s  %s\n", fileStatus(filePath), filePath)
+		quarantine, err := db.GetFileQuarantine(filePath)
+		if err != nil {
+			log.Fatalf("Failed to get quarantine: %v", err)
+		}
+		if quarantine != nil {
+			fmt.Printf("    quarantined %s ago: %s\n", formatAge(time.Since(quarantine.Since)), quarantine.Reason)
+			fmt.Printf("    the daemon skips it until `notes reconcile %s` succeeds\n", filePath)
+		}
+	}
+
+	metrics, err := LoadWatcherMetrics(db)
+	if err != nil {
+		log.Fatalf("Failed to get watcher metrics: %v", err)
+	}
+	if metrics != nil {
+		printWatcherMetrics(metrics, time.Now())
+	}
+
+	watcherErrors, err := db.GetRecentWatcherErrors(statusErrorLimit)
+	if err != nil {
+		log.Fatalf("Failed to get watcher errors: %v", err)
+	}
+	if len(watcherErrors) == 0 {
+		return
+	}
+
+	fmt.Println("\nRecent errors:")
+	for _, watcherError := range watcherErrors {
+		location := ""
+		if watcherError.FilePath != "" {
+			location = watcherError.FilePath + ": "
+		}
+		fmt.Printf("  %s  %s%s\n", watcherError.CreatedAt.Local().Format("2006-01-02 15:04:05"), location, watcherError.Message)
+	}
+}
+
+// fileStatus summarises a watched file as "<state>  <last reconcile>", where
+// state is "ok", "pending" (file and database differ) or "missing".
+func fileStatus(filePath string) string {
+	lastReconcile := "never reconciled"
+	if updatedAt, ok, err := db.GetFileSnapshotTime(filePath); err != nil {
+		lastReconcile = "unknown"
+	} else if ok {
+		lastReconcile = formatAge(time.Since(updatedAt)) + " ago"
+	}
+
+	state := "ok"
+	if !fileExists(filePath) {
+		state = "missing"
+	} else {
+		inSync, err := NewReconciler(db, NewFileManager(filePath), config).IsFileInSync()
+		if err != nil {
+			state = "error"
+		} else if !inSync {
+			state = "pending"
+		}
+	}
+
+	return fmt.Sprintf("%-7s  %-18s", state, lastReconcile)
+}
+
+// formatAge renders d at a human granularity, e.g. "42s", "5m", "3h", "2d".
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// DefaultSummaryTag is added to blocks written by `notes summarize`. Blocks
+// carrying it are left out of later summaries.
+const DefaultSummaryTag = "summary"
+
+const summarizeInstructions = `You summarize a person's notes for them. Write a concise summary in markdown: the main points, decisions made, open questions and next steps, as a bulleted list under short headings where it helps. Use only what the notes say, and don't add a title. Notes are given oldest first, each headed by its ID and date.`
+
+// summaryInput selects the blocks to summarize, newest first, within
+// maxChars of content. It returns them oldest first along with how many
+// older blocks didn't fit.
+func summaryInput(blocks []*Block, maxChars int) ([]*Block, int) {
+	total := 0
+	var selected []*Block
+	for i := len(blocks) - 1; i >= 0; i-- {
+		total += len(blocks[i].Content)
+		if total > maxChars && len(selected) > 0 {
+			return selected, i + 1
+		}
+		selected = append([]*Block{blocks[i]}, selected...)
+	}
+	return selected, 0
+}
+
+// summaryPrompt lays out blocks for the model, oldest first.
+func summaryPrompt(blocks []*Block, instructions string) string {
+	var prompt strings.Builder
+	for _, block := range blocks {
+		fmt.Fprintf(&prompt, "--- note %d, %s ---\n%s\n\n", block.ID, block.CreatedAt.Local().Format("2006-01-02"), block.Content)
+	}
+	if instructions != "" {
+		fmt.Fprintf(&prompt, "%s\n", instructions)
+	}
+	return prompt.String()
+}
+
+// summaryContent is the block storing summary: a heading saying what was
+// summarized, the summary without blank lines, which would split the block,
+// and its tags.
+func summaryContent(summary, heading string, tags []string) string {
+	lines := []string{heading}
+	for _, line := range strings.Split(strings.ReplaceAll(summary, "\r\n", "\n"), "\n") {
+		if line = strings.TrimRight(line, " \t"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	var tagLine []string
+	for _, tag := range tags {
+		if tag != "" {
+			tagLine = append(tagLine, "#"+tag)
+		}
+	}
+	return strings.Join(append(lines, strings.Join(tagLine, " ")), "\n")
+}
+
+func handleSummarize() {
+	fs := flag.NewFlagSet("summarize", flag.ExitOnError)
+	tag := fs.String("tag", "", "summarize blocks with this tag")
+	summaryTag := fs.String("summary-tag", DefaultSummaryTag, "tag to add to the summary block")
+	audience := fs.String("audience", "", "only send blocks visible to this level (default from the ai config, else shared)")
+	instructions := fs.String("prompt", "", "extra instructions for the model, e.g. \"focus on risks\"")
+	dryRun := fs.Bool("dry-run", false, "print the prompt instead of sending it")
+	parseTimeRange := timeRangeFlags(fs)
+	args := parseArgs(fs, os.Args[2:])
+
+	now := time.Now()
+	timeRange, err := parseTimeRange(now)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	*tag = strings.TrimPrefix(strings.TrimSpace(*tag), "#")
+	*summaryTag = strings.TrimPrefix(strings.TrimSpace(*summaryTag), "#")
+	if *tag == "" && len(args) == 0 && timeRange.IsZero() {
+		fmt.Println("Error: summarize command requires --tag, --since/--until or search terms")
+		fmt.Println("Usage: notes summarize [--tag t] [--since \"1 month ago\"] [--until t] [--prompt text] [--dry-run] [terms...]")
+		os.Exit(1)
+	}
+
+	aiConfig := config.AI
+	if aiConfig == nil {
+		aiConfig = &AIConfig{}
+	}
+	if *audience == "" {
+		*audience = aiConfig.audience()
+	}
+	if !isVisibilityLevel(*audience) {
+		fmt.Printf("Error: unknown audience %q (available: %s)\n", *audience, strings.Join(visibilityLevels, ", "))
+		os.Exit(1)
+	}
+
+	include := args
+	if *tag != "" {
+		include = append(include, "#"+*tag)
+	}
+	found, err := db.SearchBlocksWith(include, nil, SearchOptions{Range: timeRange, Sort: SearchSortCreated, Reverse: true})
+	if err != nil {
+		log.Fatalf("Failed to search blocks: %v", err)
+	}
+
+	filter, err := LoadVisibilityFilter(db, config, *audience)
+	if err != nil {
+		log.Fatalf("Failed to load block visibility: %v", err)
+	}
+	var blocks []*Block
+	hidden := 0
+	for _, block := range found {
+		// The search matches tag prefixes too, e.g. #project-x in #project-xy
+		if (*tag != "" && !block.HasTag(*tag)) || (*summaryTag != "" && block.HasTag(*summaryTag)) {
+			continue
+		}
+		if !filter.Allows(block) {
+			hidden++
+			continue
+		}
+		blocks = append(blocks, block)
+	}
+	if hidden > 0 {
+		infof("Leaving out %d block(s) not visible to %s", hidden, *audience)
+	}
+	if len(blocks) == 0 {
+		fmt.Println("No blocks to summarize")
+		return
+	}
+
+	blocks, omitted := summaryInput(blocks, aiConfig.maxInputChars())
+	if omitted > 0 {
+		fmt.Printf("Summarizing the newest %d blocks; %d older ones exceed max_input_chars\n", len(blocks), omitted)
+	}
+	prompt := summaryPrompt(blocks, *instructions)
+	if *dryRun {
+		fmt.Printf("%s\n\n%s", summarizeInstructions, prompt)
+		return
+	}
+	requireWritable("notes summarize")
+
+	provider, err := NewProvider(config.AI)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	infof("Summarizing %d block(s) with %s", len(blocks), config.AI.Model)
+	summary, err := provider.Complete(ctx, summarizeInstructions, prompt)
+	if err != nil {
+		fmt.Printf("Error: summarizing failed: %v\n", err)
+		os.Exit(1)
+	}
+	if strings.TrimSpace(summary) == "" {
+		fmt.Println("Error: the model returned an empty summary")
+		os.Exit(1)
+	}
+
+	subject := "notes"
+	if *tag != "" {
+		subject = *tag
+	}
+	count := fmt.Sprintf("%d notes", len(blocks))
+	if len(blocks) == 1 {
+		count = "1 note"
+	}
+	first, last := blocks[0].CreatedAt.Local(), blocks[len(blocks)-1].CreatedAt.Local()
+	heading := fmt.Sprintf("Summary of %s, %s to %s (%s)", subject, first.Format("2006-01-02"), last.Format("2006-01-02"), count)
+	block := NewBlock(summaryContent(summary, heading, []string{*summaryTag, *tag}))
+	if _, err := newMainReconciler().AddBlocks([]*Block{block}); err != nil {
+		log.Fatalf("Failed to add summary: %v", err)
+	}
+
+	fmt.Println(block.Content)
+}
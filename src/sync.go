@@ -0,0 +1,388 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// SyncClockKey holds the repository's Lamport clock. Every change to a block
+// row advances it and stamps the row (or the tombstone of a deleted block)
+// with the new value, so changes can be listed "since" a clock value.
+const SyncClockKey = "sync_clock"
+
+// syncTriggers keep blocks.clock and the tombstones table up to date for
+// every write path, including ones that bypass the Go code such as undo.
+var syncTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS blocks_sync_insert AFTER INSERT ON blocks BEGIN
+		UPDATE metadata SET value = CAST(value AS INTEGER) + 1 WHERE key = 'sync_clock';
+		UPDATE blocks SET clock = (SELECT CAST(value AS INTEGER) FROM metadata WHERE key = 'sync_clock') WHERE id = new.id;
+		DELETE FROM tombstones WHERE content_hash = new.content_hash;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS blocks_sync_update AFTER UPDATE OF content_hash, updated_at, touch_count ON blocks
+	WHEN old.content_hash IS NOT new.content_hash OR old.updated_at IS NOT new.updated_at OR old.touch_count IS NOT new.touch_count
+	BEGIN
+		UPDATE metadata SET value = CAST(value AS INTEGER) + 1 WHERE key = 'sync_clock';
+		UPDATE blocks SET clock = (SELECT CAST(value AS INTEGER) FROM metadata WHERE key = 'sync_clock') WHERE id = new.id;
+		INSERT OR REPLACE INTO tombstones (content_hash, clock)
+			SELECT old.content_hash, CAST(value AS INTEGER) FROM metadata
+			WHERE key = 'sync_clock' AND old.content_hash IS NOT new.content_hash;
+		DELETE FROM tombstones WHERE content_hash = new.content_hash;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS blocks_sync_delete AFTER DELETE ON blocks BEGIN
+		UPDATE metadata SET value = CAST(value AS INTEGER) + 1 WHERE key = 'sync_clock';
+		INSERT OR REPLACE INTO tombstones (content_hash, clock)
+			SELECT old.content_hash, CAST(value AS INTEGER) FROM metadata WHERE key = 'sync_clock';
+	END`,
+}
+
+func (d *Database) createSyncTriggers() error {
+	if _, err := d.db.Exec(`INSERT OR IGNORE INTO metadata (key, value) VALUES (?, '0')`, SyncClockKey); err != nil {
+		return fmt.Errorf("failed to initialise sync clock: %w", err)
+	}
+	for _, trigger := range syncTriggers {
+		if _, err := d.db.Exec(trigger); err != nil {
+			return fmt.Errorf("failed to create sync trigger: %w", err)
+		}
+	}
+	return nil
+}
+
+// SyncBlock is a block as exchanged between repositories.
+type SyncBlock struct {
+	*Block
+	Clock int64 `json:"clock"`
+}
+
+// Tombstone records that a block was deleted at a clock value.
+type Tombstone struct {
+	ContentHash string `json:"content_hash"`
+	Clock       int64  `json:"clock"`
+}
+
+// SyncChanges is the payload of /sync/pull responses and /sync/push requests.
+// Clock is the sender's clock when the changes were collected.
+type SyncChanges struct {
+	Clock      int64        `json:"clock"`
+	Blocks     []*SyncBlock `json:"blocks"`
+	Tombstones []*Tombstone `json:"tombstones"`
+}
+
+// SyncClock returns the repository's current Lamport clock.
+func (d *Database) SyncClock() (int64, error) {
+	value, err := d.GetMetadata(SyncClockKey)
+	if err != nil {
+		return 0, err
+	}
+	clock, _ := strconv.ParseInt(value, 10, 64)
+	return clock, nil
+}
+
+// SyncChangesSince returns the blocks and tombstones stamped after since.
+// Pass -1 to get everything.
+func (d *Database) SyncChangesSince(since int64) (*SyncChanges, error) {
+	clock, err := d.SyncClock()
+	if err != nil {
+		return nil, err
+	}
+	changes := &SyncChanges{Clock: clock, Blocks: []*SyncBlock{}, Tombstones: []*Tombstone{}}
+
+	rows, err := d.db.Query(`SELECT `+blockColumns+`, clock FROM blocks WHERE clock > ? ORDER BY clock`, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query changed blocks: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var block Block
+		var blockClock int64
+		var words, chars sql.NullInt64
+		if err := rows.Scan(&block.ID, &block.Content, &block.ContentHash,
+			&block.CreatedAt, &block.UpdatedAt, &block.TouchCount, &words, &chars, &blockClock); err != nil {
+			return nil, fmt.Errorf("failed to scan changed block: %w", err)
+		}
+		if d.cipher != nil {
+			if block.Content, err = d.cipher.Decrypt(block.Content); err != nil {
+				return nil, fmt.Errorf("block %d: %w", block.ID, err)
+			}
+		}
+		block.setCounts(words, chars)
+		changes.Blocks = append(changes.Blocks, &SyncBlock{Block: &block, Clock: blockClock})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query changed blocks: %w", err)
+	}
+
+	tombstoneRows, err := d.db.Query(`SELECT content_hash, clock FROM tombstones WHERE clock > ? ORDER BY clock`, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tombstones: %w", err)
+	}
+	defer tombstoneRows.Close()
+
+	for tombstoneRows.Next() {
+		tombstone := &Tombstone{}
+		if err := tombstoneRows.Scan(&tombstone.ContentHash, &tombstone.Clock); err != nil {
+			return nil, fmt.Errorf("failed to scan tombstone: %w", err)
+		}
+		changes.Tombstones = append(changes.Tombstones, tombstone)
+	}
+	return changes, tombstoneRows.Err()
+}
+
+// ApplySyncChanges merges changes from another repository and returns how
+// many local rows changed. Blocks are content-addressed, so concurrent edits
+// of the same block arrive as different hashes and are all kept. For a single
+// hash the newest event by clock wins, with additions winning ties; merged
+// blocks keep the latest updated_at and highest touch_count of both sides.
+func (d *Database) ApplySyncChanges(changes *SyncChanges) (int, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Lamport receive rule: local events from now on order after the sender's
+	if _, err := tx.Exec(`UPDATE metadata SET value = MAX(CAST(value AS INTEGER), ?) WHERE key = ?`,
+		changes.Clock, SyncClockKey); err != nil {
+		return 0, fmt.Errorf("failed to advance sync clock: %w", err)
+	}
+
+	var entries []AuditEntry
+	for _, tombstone := range changes.Tombstones {
+		var localClock int64
+		err := tx.QueryRow(`SELECT clock FROM blocks WHERE content_hash = ?`, tombstone.ContentHash).Scan(&localClock)
+		if err == sql.ErrNoRows || (err == nil && localClock > tombstone.Clock) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to look up block: %w", err)
+		}
+		if err := deleteBlockTx(tx, tombstone.ContentHash); err != nil {
+			return 0, err
+		}
+		entries = append(entries, AuditEntry{Op: "sync", Action: EventDeleted, Hash: tombstone.ContentHash})
+	}
+
+	for _, remoteBlock := range changes.Blocks {
+		action, err := d.mergeSyncBlockTx(tx, remoteBlock)
+		if err != nil {
+			return 0, err
+		}
+		if action != "" {
+			entry := AuditEntry{Op: "sync", Action: action, Hash: remoteBlock.ContentHash}
+			if d.cipher == nil {
+				entry.Title = remoteBlock.Title()
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit sync: %w", err)
+	}
+	d.audit.Append(entries)
+	return len(entries), nil
+}
+
+// mergeSyncBlockTx merges a block from another repository, returning
+// EventCreated or EventUpdated if that changed the local row and "" if not.
+func (d *Database) mergeSyncBlockTx(tx *sql.Tx, remoteBlock *SyncBlock) (string, error) {
+	if generateContentHash(remoteBlock.Content) != remoteBlock.ContentHash {
+		return "", fmt.Errorf("block %.12s: content does not match its hash", remoteBlock.ContentHash)
+	}
+
+	var updatedAt time.Time
+	var touchCount int
+	err := tx.QueryRow(`SELECT updated_at, touch_count FROM blocks WHERE content_hash = ?`, remoteBlock.ContentHash).
+		Scan(&updatedAt, &touchCount)
+	switch {
+	case err == sql.ErrNoRows:
+		var tombstoneClock int64
+		err := tx.QueryRow(`SELECT clock FROM tombstones WHERE content_hash = ?`, remoteBlock.ContentHash).Scan(&tombstoneClock)
+		if err == nil && tombstoneClock > remoteBlock.Clock {
+			return "", nil // deleted here after the remote last touched it
+		}
+		if err != nil && err != sql.ErrNoRows {
+			return "", fmt.Errorf("failed to look up tombstone: %w", err)
+		}
+		return EventCreated, d.restoreBlockTx(tx, remoteBlock.Block)
+
+	case err != nil:
+		return "", fmt.Errorf("failed to look up block: %w", err)
+	}
+
+	if !remoteBlock.UpdatedAt.After(updatedAt) && remoteBlock.TouchCount <= touchCount {
+		return "", nil
+	}
+	if remoteBlock.UpdatedAt.After(updatedAt) {
+		updatedAt = remoteBlock.UpdatedAt
+	}
+	if remoteBlock.TouchCount > touchCount {
+		touchCount = remoteBlock.TouchCount
+	}
+	if _, err := tx.Exec(`UPDATE blocks SET updated_at = ?, touch_count = ? WHERE content_hash = ?`,
+		updatedAt, touchCount, remoteBlock.ContentHash); err != nil {
+		return "", fmt.Errorf("failed to merge block: %w", err)
+	}
+	return EventUpdated, nil
+}
+
+// syncHandler serves /sync/pull and /sync/push for `notes serve`.
+type syncHandler struct {
+	push     bool
+	audience string // blocks not visible to it are left out of pulls
+}
+
+func (h syncHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRPCBodySize))
+	if err != nil {
+		http.Error(w, "failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	var response any
+	if h.push {
+		var changes SyncChanges
+		if err := json.Unmarshal(body, &changes); err != nil {
+			http.Error(w, "invalid changes: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		applied, err := db.ApplySyncChanges(&changes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if applied > 0 {
+			if err := regenerateAllFiles(); err != nil {
+				log.Printf("Failed to regenerate files after sync: %v", err)
+			}
+		}
+		clock, err := db.SyncClock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response = map[string]int64{"clock": clock, "applied": int64(applied)}
+	} else {
+		var request struct {
+			Since int64 `json:"since"`
+		}
+		if err := json.Unmarshal(body, &request); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		changes, err := db.SyncChangesSince(request.Since)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if changes.Blocks, err = h.visibleSyncBlocks(changes.Blocks); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response = changes
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+func (h syncHandler) visibleSyncBlocks(blocks []*SyncBlock) ([]*SyncBlock, error) {
+	if h.audience == "" || h.audience == VisibilityPrivate {
+		return blocks, nil
+	}
+	filter, err := LoadVisibilityFilter(db, config, h.audience)
+	if err != nil {
+		return nil, err
+	}
+	visible := []*SyncBlock{}
+	for _, block := range blocks {
+		if filter.Allows(block.Block) {
+			visible = append(visible, block)
+		}
+	}
+	return visible, nil
+}
+
+// Sync pulls the remote's changes since the last sync, merges them, then
+// pushes local changes the remote hasn't seen. It returns the number of rows
+// changed locally and remotely.
+func (c *RemoteClient) Sync(db *Database) (pulled, pushed int, err error) {
+	pulledKey := "sync_pulled:" + c.baseURL
+	pushedKey := "sync_pushed:" + c.baseURL
+
+	since := int64(-1)
+	if value, err := db.GetMetadata(pulledKey); err == nil && value != "" {
+		since, _ = strconv.ParseInt(value, 10, 64)
+	}
+
+	var remoteChanges SyncChanges
+	if err := c.post("/sync/pull", map[string]int64{"since": since}, &remoteChanges); err != nil {
+		return 0, 0, err
+	}
+	if pulled, err = db.ApplySyncChanges(&remoteChanges); err != nil {
+		return 0, 0, err
+	}
+	// Only what this pull returned has been seen: another device may push
+	// before we do, and its changes must still be pulled next time. Our own
+	// pushed changes come back with them, and merging them again changes
+	// nothing.
+	if err := db.SetMetadata(pulledKey, strconv.FormatInt(remoteChanges.Clock, 10)); err != nil {
+		return pulled, 0, err
+	}
+
+	pushedSince := int64(-1)
+	if value, err := db.GetMetadata(pushedKey); err == nil && value != "" {
+		pushedSince, _ = strconv.ParseInt(value, 10, 64)
+	}
+	localChanges, err := db.SyncChangesSince(pushedSince)
+	if err != nil {
+		return pulled, 0, err
+	}
+
+	var pushResult struct {
+		Clock   int64 `json:"clock"`
+		Applied int   `json:"applied"`
+	}
+	if err := c.post("/sync/push", localChanges, &pushResult); err != nil {
+		return pulled, 0, err
+	}
+
+	if err := db.SetMetadata(pushedKey, strconv.FormatInt(localChanges.Clock, 10)); err != nil {
+		return pulled, pushResult.Applied, err
+	}
+	return pulled, pushResult.Applied, nil
+}
+
+func handleSync() {
+	remoteURL := os.Getenv("NOTES_REMOTE")
+	if len(os.Args) > 2 {
+		remoteURL = os.Args[2]
+	}
+	if remoteURL == "" {
+		fmt.Println("Error: sync requires a server URL")
+		fmt.Println("Usage: notes sync <url>  (or set NOTES_REMOTE)")
+		os.Exit(1)
+	}
+
+	client := NewRemoteClient(remoteURL, os.Getenv("NOTES_TOKEN"))
+	pulled, pushed, err := client.Sync(db)
+	if err != nil {
+		log.Fatalf("Sync failed: %v", err)
+	}
+
+	if pulled > 0 {
+		if err := regenerateAllFiles(); err != nil {
+			log.Fatalf("Failed to regenerate files: %v", err)
+		}
+	}
+	fmt.Printf("Synced with %s: %d change(s) pulled, %d pushed\n", remoteURL, pulled, pushed)
+}
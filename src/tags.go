@@ -0,0 +1,39 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// tagPattern matches inline #tags. A tag must start at the beginning of the
+// content or after whitespace, so markdown headings ("# Title") and anchors
+// inside links are not mistaken for tags.
+var tagPattern = regexp.MustCompile(`(?:^|\s)#([\p{L}\p{N}_][\p{L}\p{N}_/\-]*)`)
+
+// ExtractTags returns the distinct tags in content, without the leading '#',
+// in order of first appearance.
+func ExtractTags(content string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+
+	for _, match := range tagPattern.FindAllStringSubmatch(content, -1) {
+		tag := match[1]
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+// HasTag reports whether the block carries tag exactly.
+func (b *Block) HasTag(tag string) bool {
+	tag = strings.TrimPrefix(tag, "#")
+	for _, candidate := range ExtractTags(b.Content) {
+		if candidate == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	templateExtension = ".md"
+	cursorPlaceholder = "{{cursor}}"
+)
+
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_\-]+)\s*\}\}`)
+
+// TemplateVars holds placeholder values. Built-in values ({{date}}, {{time}},
+// {{datetime}}, {{weekday}}) are added by RenderTemplate unless overridden.
+type TemplateVars map[string]string
+
+// RenderTemplate substitutes {{name}} placeholders in body. {{cursor}} is
+// removed and its line number (1-based) returned, or 0 if absent. Any
+// placeholder without a value is an error naming the missing variables.
+func RenderTemplate(body string, vars TemplateVars, now time.Time) (string, int, error) {
+	values := TemplateVars{
+		"date":     now.Format("2006-01-02"),
+		"time":     now.Format("15:04"),
+		"datetime": now.Format("2006-01-02 15:04"),
+		"weekday":  now.Format("Monday"),
+	}
+	for name, value := range vars {
+		values[name] = value
+	}
+
+	cursorLine := 0
+	if index := strings.Index(body, cursorPlaceholder); index >= 0 {
+		cursorLine = strings.Count(body[:index], "\n") + 1
+		body = strings.Replace(body, cursorPlaceholder, "", 1)
+	}
+
+	var missing []string
+	rendered := placeholderPattern.ReplaceAllStringFunc(body, func(match string) string {
+		name := placeholderPattern.FindStringSubmatch(match)[1]
+		value, ok := values[name]
+		if !ok {
+			missing = append(missing, name)
+			return match
+		}
+		return value
+	})
+
+	if len(missing) > 0 {
+		return "", 0, fmt.Errorf("missing template variables: %s (set them with --var name=value)", strings.Join(missing, ", "))
+	}
+	return rendered, cursorLine, nil
+}
+
+// InsertAtCursor places text where {{cursor}} was (cursorLine), or appends it
+// when the template has no cursor.
+func InsertAtCursor(rendered string, cursorLine int, text string) string {
+	if text == "" {
+		return rendered
+	}
+	if cursorLine == 0 {
+		return strings.TrimRight(rendered, "\n") + "\n" + text
+	}
+
+	lines := strings.Split(rendered, "\n")
+	lines[cursorLine-1] += text
+	return strings.Join(lines, "\n")
+}
+
+// LoadTemplate reads the named template from dir.
+func LoadTemplate(dir, name string) (string, error) {
+	if strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid template name %q", name)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, name+templateExtension))
+	if err != nil {
+		if os.IsNotExist(err) {
+			available, _ := ListTemplates(dir)
+			return "", fmt.Errorf("template %q not found in %s (available: %s)", name, dir, strings.Join(available, ", "))
+		}
+		return "", fmt.Errorf("failed to read template %s: %w", name, err)
+	}
+	return string(content), nil
+}
+
+// ListTemplates returns the names of the templates in dir.
+func ListTemplates(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list templates: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), templateExtension) {
+			names = append(names, strings.TrimSuffix(entry.Name(), templateExtension))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// parseTemplateVars turns repeated --var name=value flags into TemplateVars.
+func parseTemplateVars(assignments []string) (TemplateVars, error) {
+	vars := TemplateVars{}
+	for _, assignment := range assignments {
+		name, value, ok := strings.Cut(assignment, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid --var %q, expected name=value", assignment)
+		}
+		vars[name] = value
+	}
+	return vars, nil
+}
+
+// stringList is a flag.Value collecting repeated string flags.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func handleTemplates() {
+	names, err := ListTemplates(config.TemplatesDir())
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(names) == 0 {
+		fmt.Printf("No templates found. Add markdown files to %s\n", config.TemplatesDir())
+		return
+	}
+
+	for _, name := range names {
+		fmt.Println(name)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// plainOutput is set by --plain: no colour or styling whatever the theme.
+var plainOutput bool
+
+// Style roles the theme can colour. Each maps to its default style.
+var defaultStyles = map[string]string{
+	"highlight": "bold red",       // search terms in grep results
+	"id":        "yellow",         // block IDs in listings
+	"timestamp": "dim",            // ages and dates in listings
+	"tag":       "magenta",        // #tags in rendered markdown
+	"title":     "bold underline", // top-level headings
+	"heading":   "bold",           // other headings
+	"strong":    "bold",           // **bold** text
+	"code":      "cyan",           // `code` spans
+	"link":      "underline",      // link text
+	"muted":     "dim",            // link targets
+	"keyword":   "blue",           // keywords in fenced code
+	"string":    "green",          // string literals in fenced code
+	"number":    "yellow",         // numbers in fenced code
+	"comment":   "dim",            // comments in fenced code
+}
+
+// TimeFormatRelative shows listing timestamps as ages, e.g. "3h ago", and
+// as dates after a week. It is the default time_format.
+const TimeFormatRelative = "relative"
+
+// ThemeConfig customises terminal output, e.g.
+// {"colors": {"highlight": "black on yellow", "tag": "#ff8800"},
+// "time_format": "2006-01-02 15:04", "separator": "---"}.
+type ThemeConfig struct {
+	// Colors overrides the style of roles in defaultStyles. A style is a
+	// space-separated list of attributes (bold, dim, italic, underline),
+	// a foreground colour and optionally "on" and a background colour.
+	// Colours are names (red, bright-blue), 256-colour numbers or #rrggbb.
+	// "none" removes the style.
+	Colors map[string]string `json:"colors,omitempty"`
+
+	// TimeFormat is "relative" or a Go time layout for timestamps in
+	// listings such as `notes log`.
+	TimeFormat string `json:"time_format,omitempty"`
+
+	// Separator is printed on its own line between whole blocks in `notes
+	// grep` and `notes log --full`, instead of a blank line.
+	Separator string `json:"separator,omitempty"`
+}
+
+func (c *ThemeConfig) validate() error {
+	for role, style := range c.Colors {
+		if _, ok := defaultStyles[role]; !ok {
+			return fmt.Errorf("colors: unknown role %q (available: %s)", role, strings.Join(sortedKeys(defaultStyles), ", "))
+		}
+		if _, err := parseStyle(style); err != nil {
+			return fmt.Errorf("colors.%s: %w", role, err)
+		}
+	}
+	return nil
+}
+
+var ansiColorNames = map[string]int{
+	"black": 0, "red": 1, "green": 2, "yellow": 3, "blue": 4, "magenta": 5, "cyan": 6, "white": 7,
+}
+
+var ansiAttributes = map[string]string{
+	"bold": "1", "dim": "2", "italic": "3", "underline": "4", "reverse": "7",
+}
+
+// parseStyle turns a style such as "bold red on #202020" into the SGR escape
+// sequence that starts it, or "" for "none".
+func parseStyle(style string) (string, error) {
+	var codes []string
+	background := false
+	for _, word := range strings.Fields(strings.ToLower(style)) {
+		if word == "none" {
+			continue
+		}
+		if word == "on" {
+			background = true
+			continue
+		}
+		if code, ok := ansiAttributes[word]; ok && !background {
+			codes = append(codes, code)
+			continue
+		}
+		code, err := colorCode(word, background)
+		if err != nil {
+			return "", err
+		}
+		codes = append(codes, code)
+		background = false
+	}
+	if background {
+		return "", fmt.Errorf("%q: missing colour after \"on\"", style)
+	}
+	if len(codes) == 0 {
+		return "", nil
+	}
+	return "\033[" + strings.Join(codes, ";") + "m", nil
+}
+
+// colorCode returns the SGR parameters selecting a colour in the
+// foreground or background.
+func colorCode(color string, background bool) (string, error) {
+	base := 30
+	if background {
+		base = 40
+	}
+	if name, bright := strings.CutPrefix(color, "bright-"); bright {
+		if n, ok := ansiColorNames[name]; ok {
+			return strconv.Itoa(base + 60 + n), nil
+		}
+	}
+	if n, ok := ansiColorNames[color]; ok {
+		return strconv.Itoa(base + n), nil
+	}
+	if n, err := strconv.Atoi(color); err == nil && n >= 0 && n <= 255 {
+		return fmt.Sprintf("%d;5;%d", base+8, n), nil
+	}
+	if hex, ok := strings.CutPrefix(color, "#"); ok && len(hex) == 6 {
+		if rgb, err := strconv.ParseUint(hex, 16, 32); err == nil {
+			return fmt.Sprintf("%d;2;%d;%d;%d", base+8, rgb>>16, rgb>>8&0xff, rgb&0xff), nil
+		}
+	}
+	return "", fmt.Errorf("unknown colour or attribute %q", color)
+}
+
+// Formatter styles user-facing output according to the theme. Without
+// colour, as when output isn't a terminal, NO_COLOR is set or --plain is
+// given, Style returns text unchanged.
+type Formatter struct {
+	color      bool
+	styles     map[string]string
+	styleSpecs map[string]string // styles as written, for the markdown renderer
+	timeFormat string
+	separator  string
+}
+
+// output is the formatter for the current command. It starts out with the
+// default theme, so it can be used before the config is loaded.
+var output = NewFormatter(nil)
+
+// NewFormatter returns a formatter for theme, which may be nil.
+func NewFormatter(theme *ThemeConfig) *Formatter {
+	f := &Formatter{
+		color:      !plainOutput && os.Getenv("NO_COLOR") == "" && stdoutIsTerminal(),
+		styles:     make(map[string]string),
+		styleSpecs: make(map[string]string),
+		timeFormat: TimeFormatRelative,
+	}
+	for role, style := range defaultStyles {
+		f.styles[role], _ = parseStyle(style)
+		f.styleSpecs[role] = style
+	}
+	if theme == nil {
+		return f
+	}
+	for role, style := range theme.Colors {
+		f.styles[role], _ = parseStyle(style)
+		f.styleSpecs[role] = style
+	}
+	if theme.TimeFormat != "" {
+		f.timeFormat = theme.TimeFormat
+	}
+	f.separator = theme.Separator
+	return f
+}
+
+// Color reports whether the formatter styles its output.
+func (f *Formatter) Color() bool {
+	return f.color
+}
+
+// Style returns text in the style of role.
+func (f *Formatter) Style(role, text string) string {
+	if !f.color || f.styles[role] == "" || text == "" {
+		return text
+	}
+	return f.styles[role] + text + ansiReset
+}
+
+// ID formats a block ID for listings, padded to width.
+func (f *Formatter) ID(id, width int) string {
+	return f.Style("id", fmt.Sprintf("%*d", width, id))
+}
+
+// Time formats a timestamp for listings in the theme's time format.
+func (f *Formatter) Time(t, now time.Time) string {
+	if f.timeFormat == TimeFormatRelative {
+		return relativeTime(t, now)
+	}
+	return t.Local().Format(f.timeFormat)
+}
+
+// FullTime is Time with the exact date and time added to relative times.
+func (f *Formatter) FullTime(t, now time.Time) string {
+	if f.timeFormat == TimeFormatRelative {
+		return fmt.Sprintf("%s (%s)", relativeTime(t, now), t.Local().Format("2006-01-02 15:04"))
+	}
+	return f.Time(t, now)
+}
+
+// Separator returns what goes between whole blocks: an empty line, or the
+// theme's separator.
+func (f *Formatter) Separator() string {
+	return f.Style("muted", f.separator)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// relativeTimePattern matches expressions like "2 weeks ago", "1 day ago"
+// or "1month".
+var relativeTimePattern = regexp.MustCompile(`^(\d+)\s*(minute|hour|day|week|month|year)s?(\s+ago)?$`)
+
+// TimeRange bounds block creation times for --since and --until. A zero
+// bound is open.
+type TimeRange struct {
+	Since time.Time
+	Until time.Time
+}
+
+// IsZero reports whether the range lets every block through.
+func (r TimeRange) IsZero() bool {
+	return r.Since.IsZero() && r.Until.IsZero()
+}
+
+// Contains reports whether t falls within the range. Since is inclusive,
+// Until exclusive.
+func (r TimeRange) Contains(t time.Time) bool {
+	return (r.Since.IsZero() || !t.Before(r.Since)) && (r.Until.IsZero() || t.Before(r.Until))
+}
+
+// timeRangeFlags registers --since and --until on fs. The returned function
+// parses them once fs has been parsed.
+func timeRangeFlags(fs *flag.FlagSet) func(now time.Time) (TimeRange, error) {
+	since := fs.String("since", "", "only blocks created at or after this time, e.g. \"2 weeks ago\" or 2024-06-01")
+	until := fs.String("until", "", "only blocks created before this time")
+	return func(now time.Time) (TimeRange, error) {
+		var r TimeRange
+		var err error
+		if *since != "" {
+			if r.Since, err = ParseTimeExpression(*since, now); err != nil {
+				return r, fmt.Errorf("--since: %w", err)
+			}
+		}
+		if *until != "" {
+			if r.Until, err = ParseTimeExpression(*until, now); err != nil {
+				return r, fmt.Errorf("--until: %w", err)
+			}
+		}
+		if !r.Since.IsZero() && !r.Until.IsZero() && !r.Since.Before(r.Until) {
+			return r, fmt.Errorf("--since must be before --until")
+		}
+		return r, nil
+	}
+}
+
+// ParseTimeExpression parses a point in time, by default in the past,
+// relative to now: "2 weeks ago", a Go duration such as "36h" meaning that
+// long ago, or a date and optional time as ParseDateTime takes them, such as
+// "yesterday", "last friday", "june 3 14:00" or "2024-06-01". Days resolve
+// to midnight.
+func ParseTimeExpression(expression string, now time.Time) (time.Time, error) {
+	expression = strings.TrimSpace(expression)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	switch strings.ToLower(expression) {
+	case "now":
+		return now, nil
+	case "today":
+		return midnight, nil
+	case "yesterday":
+		return midnight.AddDate(0, 0, -1), nil
+	}
+
+	if match := relativeTimePattern.FindStringSubmatch(strings.ToLower(expression)); match != nil {
+		n, _ := strconv.Atoi(match[1])
+		switch match[2] {
+		case "minute":
+			return now.Add(-time.Duration(n) * time.Minute), nil
+		case "hour":
+			return now.Add(-time.Duration(n) * time.Hour), nil
+		case "day":
+			return now.AddDate(0, 0, -n), nil
+		case "week":
+			return now.AddDate(0, 0, -7*n), nil
+		case "month":
+			return now.AddDate(0, -n, 0), nil
+		default:
+			return now.AddDate(-n, 0, 0), nil
+		}
+	}
+
+	if duration, err := time.ParseDuration(expression); err == nil {
+		return now.Add(-duration), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, expression); err == nil {
+		return t, nil
+	}
+	if t, err := ParseDateTime(expression, now, false, 0); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("unrecognised time %q (try \"2 weeks ago\", \"last friday\", \"june 3\" or 2024-06-01)", expression)
+}
+
+// relativeTime describes t as an age for recent times and as a date after
+// a week.
+func relativeTime(t, now time.Time) string {
+	if age := now.Sub(t); age < 7*24*time.Hour {
+		return formatAge(max(age, 0)) + " ago"
+	}
+	return t.Local().Format("2006-01-02")
+}
+
+func handleLog() {
+	fs := flag.NewFlagSet("log", flag.ExitOnError)
+	limit := fs.Int("n", 20, "number of blocks to show; 0 shows all")
+	full := fs.Bool("full", false, "print whole blocks rather than their first line")
+	render := fs.Bool("render", false, "print whole blocks styled as markdown for the terminal")
+	noPager := fs.Bool("no-pager", false, "don't page long output")
+	parseTimeRange := timeRangeFlags(fs)
+	parseWordRange := wordRangeFlags(fs)
+	parseArgs(fs, os.Args[2:])
+
+	if *limit < 0 {
+		fmt.Println("Error: -n must not be negative")
+		os.Exit(1)
+	}
+	wordRange, err := parseWordRange()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	now := time.Now()
+	timeRange, err := parseTimeRange(now)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	blocks, err := db.GetBlocksInRange(timeRange, wordRange, *limit)
+	if err != nil {
+		log.Fatalf("Failed to get blocks: %v", err)
+	}
+	if len(blocks) == 0 {
+		fmt.Println("No blocks found")
+		return
+	}
+
+	var out io.Writer = os.Stdout
+	wait := func() {}
+	if !*noPager {
+		out, wait = startPager()
+	}
+	for i, block := range blocks {
+		if !*full && !*render {
+			fmt.Fprintf(out, "%s  %s  %5dw  %s\n", output.ID(block.ID, 5), output.Style("timestamp", fmt.Sprintf("%-8s", output.Time(block.CreatedAt, now))),
+				block.Words, block.Title())
+			continue
+		}
+		if i > 0 {
+			fmt.Fprintln(out, output.Separator())
+		}
+		header := fmt.Sprintf("#%d, %s, %d words, %s read", block.ID, output.FullTime(block.CreatedAt, now),
+			block.Words, formatReadingTime(block.ReadingMinutes()))
+		fmt.Fprintf(out, "%s\n%s\n", output.Style("timestamp", header), displayContent(block.Content, *render))
+	}
+	wait()
+}
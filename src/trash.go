@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// TrashedBlock is a copy of a block a reconcile deleted because it was
+// removed from a watched file. Blocks deleted by the same reconcile share
+// a run.
+type TrashedBlock struct {
+	ID          int
+	Run         int
+	FilePath    string
+	Content     string
+	ContentHash string
+	CreatedAt   time.Time
+	DeletedAt   time.Time
+}
+
+// restoreTrashedBlock adds the content of trashed back with its original
+// creation time, and takes it out of the trash.
+func restoreTrashedBlock(trashed *TrashedBlock) (*ChangeSet, error) {
+	block := NewBlock(trashed.Content)
+	block.CreatedAt = trashed.CreatedAt
+
+	changes, err := newMainReconciler().AddBlocks([]*Block{block})
+	if err != nil {
+		return changes, err
+	}
+	return changes, db.DeleteTrashedBlock(trashed.ID)
+}
+
+func handleDeleted() {
+	fs := flag.NewFlagSet("deleted", flag.ExitOnError)
+	last := fs.Bool("last", false, "only show what the last reconcile removed")
+	limit := fs.Int("n", 20, "number of blocks to show; 0 shows all")
+	restore := fs.Int("restore", 0, "restore the block with this trash ID to notes.md")
+	parseArgs(fs, os.Args[2:])
+
+	if *restore > 0 {
+		requireWritable("notes deleted --restore")
+		trashed, err := db.GetTrashedBlock(*restore)
+		if err != nil {
+			log.Fatalf("Failed to get trashed block: %v", err)
+		}
+		if trashed == nil {
+			fmt.Printf("Error: no deleted block with ID %d\n", *restore)
+			os.Exit(1)
+		}
+		if _, err := restoreTrashedBlock(trashed); err != nil {
+			log.Fatalf("Failed to restore block: %v", err)
+		}
+		fmt.Printf("Restored: %s\n", NewBlock(trashed.Content).FirstLine())
+		return
+	}
+
+	if *limit < 0 {
+		fmt.Println("Error: -n must not be negative")
+		os.Exit(1)
+	}
+	trashed, err := db.GetTrash(*limit, *last)
+	if err != nil {
+		log.Fatalf("Failed to get deleted blocks: %v", err)
+	}
+	if len(trashed) == 0 {
+		fmt.Println("No blocks have been deleted by a reconcile")
+		return
+	}
+
+	now := time.Now()
+	run := 0
+	for _, t := range trashed {
+		if t.Run != run {
+			if run != 0 {
+				fmt.Println()
+			}
+			run = t.Run
+			fmt.Printf("Removed from %s %s:\n", t.FilePath, output.Style("timestamp", output.Time(t.DeletedAt, now)))
+		}
+		fmt.Printf("  %s  %s\n", output.ID(t.ID, 5), NewBlock(t.Content).FirstLine())
+	}
+	fmt.Println("\nRestore one with: notes deleted --restore <id>")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Block visibility levels, from least to most exposed. A block's level is
+// set explicitly with `notes visibility`, or else by a #private, #shared or
+// #public tag in its content, or else by the config's default_visibility.
+const (
+	VisibilityPrivate = "private"
+	VisibilityShared  = "shared"
+	VisibilityPublic  = "public"
+
+	DefaultVisibility = VisibilityShared
+)
+
+var visibilityLevels = []string{VisibilityPrivate, VisibilityShared, VisibilityPublic}
+
+func isVisibilityLevel(level string) bool {
+	return slices.Contains(visibilityLevels, level)
+}
+
+// VisibilityFilter decides which blocks an audience may see. The audience is
+// itself a level: "private" sees everything, "shared" sees shared and public
+// blocks, "public" only public ones.
+type VisibilityFilter struct {
+	audience          string
+	overrides         map[string]string
+	defaultVisibility string
+}
+
+// LoadVisibilityFilter reads the explicit visibility of blocks for a filter
+// showing blocks to audience.
+func LoadVisibilityFilter(db *Database, config *Config, audience string) (*VisibilityFilter, error) {
+	overrides, err := db.GetVisibilityOverrides()
+	if err != nil {
+		return nil, err
+	}
+	return &VisibilityFilter{audience: audience, overrides: overrides, defaultVisibility: config.BlockVisibility()}, nil
+}
+
+// Visibility returns the visibility level of block. When content carries
+// several visibility tags the most restrictive one wins.
+func (f *VisibilityFilter) Visibility(block *Block) string {
+	if level, ok := f.overrides[block.ContentHash]; ok {
+		return level
+	}
+	for _, level := range visibilityLevels {
+		if block.HasTag(level) {
+			return level
+		}
+	}
+	return f.defaultVisibility
+}
+
+// Allows reports whether the audience may see block. A nil filter allows
+// everything.
+func (f *VisibilityFilter) Allows(block *Block) bool {
+	if f == nil {
+		return true
+	}
+	return slices.Index(visibilityLevels, f.Visibility(block)) >= slices.Index(visibilityLevels, f.audience)
+}
+
+// Filter returns the blocks the audience may see, in their original order.
+func (f *VisibilityFilter) Filter(blocks []*Block) []*Block {
+	if f == nil {
+		return blocks
+	}
+	visible := []*Block{}
+	for _, block := range blocks {
+		if f.Allows(block) {
+			visible = append(visible, block)
+		}
+	}
+	return visible
+}
+
+func handleVisibility() {
+	fs := flag.NewFlagSet("visibility", flag.ExitOnError)
+	args := parseArgs(fs, os.Args[2:])
+
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Println("Error: visibility command requires a block ID and an optional level")
+		fmt.Println("Usage: notes visibility <id> [private|shared|public|default]")
+		os.Exit(1)
+	}
+
+	block, err := db.LookupBlock(args[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(args) == 2 {
+		requireWritable("notes visibility")
+		level := strings.ToLower(args[1])
+		if level != "default" && !isVisibilityLevel(level) {
+			fmt.Printf("Error: unknown visibility %q (available: %s, default)\n", args[1], strings.Join(visibilityLevels, ", "))
+			os.Exit(1)
+		}
+		if level == "default" {
+			level = ""
+		}
+		if err := db.SetVisibilityOverride(block.ContentHash, level); err != nil {
+			log.Fatalf("Failed to set visibility: %v", err)
+		}
+	}
+
+	filter, err := LoadVisibilityFilter(db, config, VisibilityPrivate)
+	if err != nil {
+		log.Fatalf("Failed to load block visibility: %v", err)
+	}
+	source := "from tags or default_visibility"
+	if _, explicit := filter.overrides[block.ContentHash]; explicit {
+		source = "set explicitly"
+	}
+	fmt.Printf("%s: %s (%s)\n", block.FirstLine(), filter.Visibility(block), source)
+}
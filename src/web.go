@@ -0,0 +1,350 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+)
+
+// DefaultWebTag is added to blocks captured with `notes web`.
+const DefaultWebTag = "web"
+
+const (
+	webFetchTimeout = 30 * time.Second
+	maxWebPageBytes = 5 << 20
+	maxWebTextBytes = 20000
+)
+
+// WebPage is the readable part of a fetched page.
+type WebPage struct {
+	URL   string
+	Title string
+	Text  []string // paragraphs, in page order
+}
+
+// skippedElements never hold the readable text of a page.
+var skippedElements = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Template: true,
+	atom.Nav: true, atom.Header: true, atom.Footer: true, atom.Aside: true,
+	atom.Form: true, atom.Button: true, atom.Svg: true, atom.Iframe: true,
+}
+
+// paragraphElements become one line each of the captured text.
+var paragraphElements = map[atom.Atom]bool{
+	atom.P: true, atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true,
+	atom.H5: true, atom.H6: true, atom.Li: true, atom.Pre: true, atom.Blockquote: true,
+}
+
+// canonicalURL normalizes rawURL so the same page captured twice is
+// recognised: the scheme defaults to https, the host is lowercased and the
+// fragment dropped.
+func canonicalURL(rawURL string) (string, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %q: %w", rawURL, err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", fmt.Errorf("invalid URL %q: only http and https pages can be captured", rawURL)
+	}
+	parsed.Host = strings.ToLower(parsed.Host)
+	parsed.Fragment = ""
+	parsed.RawFragment = ""
+	return parsed.String(), nil
+}
+
+// FetchWebPage downloads pageURL and extracts its title and readable text.
+// Pages that aren't HTML are captured by URL alone.
+func FetchWebPage(pageURL string) (*WebPage, error) {
+	client := &http.Client{Timeout: webFetchTimeout}
+	request, err := http.NewRequest(http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	request.Header.Set("User-Agent", "notes/1.0 (+https://github.com/torbjornjohannsen/gravitynotes)")
+	request.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9,*/*;q=0.5")
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", pageURL, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: %s", pageURL, response.Status)
+	}
+
+	page := &WebPage{URL: pageURL}
+	contentType := response.Header.Get("Content-Type")
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "" && mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return page, nil
+	}
+
+	body, err := charset.NewReader(io.LimitReader(response.Body, maxWebPageBytes), contentType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", pageURL, err)
+	}
+	doc, err := html.Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", pageURL, err)
+	}
+
+	page.Title = pageTitle(doc)
+	if root := readableRoot(doc); root != nil {
+		page.Text = collectParagraphs(root)
+	}
+	return page, nil
+}
+
+// pageTitle prefers the Open Graph title, which usually lacks the site name
+// suffix of <title>.
+func pageTitle(doc *html.Node) string {
+	var ogTitle, title, heading string
+	walkElements(doc, func(n *html.Node) bool {
+		switch n.DataAtom {
+		case atom.Meta:
+			if attribute(n, "property") == "og:title" && ogTitle == "" {
+				ogTitle = collapseWhitespace(attribute(n, "content"))
+			}
+		case atom.Title:
+			if title == "" {
+				title = nodeText(n)
+			}
+		case atom.H1:
+			if heading == "" {
+				heading = nodeText(n)
+			}
+		}
+		return !skippedElements[n.DataAtom]
+	})
+
+	for _, candidate := range []string{ogTitle, title, heading} {
+		if candidate != "" {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// readableRoot finds the element holding the main text: an <article> or
+// <main> if the page has one, otherwise the element whose own paragraphs
+// hold the most text.
+func readableRoot(doc *html.Node) *html.Node {
+	var article, mainElement, best, body *html.Node
+	bestScore := 0
+	walkElements(doc, func(n *html.Node) bool {
+		if skippedElements[n.DataAtom] {
+			return false
+		}
+		switch n.DataAtom {
+		case atom.Article:
+			if article == nil {
+				article = n
+			}
+		case atom.Main:
+			if mainElement == nil {
+				mainElement = n
+			}
+		case atom.Body:
+			body = n
+		}
+
+		score := 0
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type == html.ElementNode && child.DataAtom == atom.P {
+				score += len(nodeText(child))
+			}
+		}
+		if score > bestScore {
+			best, bestScore = n, score
+		}
+		return true
+	})
+
+	for _, candidate := range []*html.Node{article, mainElement, best, body} {
+		if candidate != nil {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// collectParagraphs returns the text of each paragraph-like element under
+// root, up to maxWebTextBytes in total.
+func collectParagraphs(root *html.Node) []string {
+	var paragraphs []string
+	size := 0
+	walkElements(root, func(n *html.Node) bool {
+		if skippedElements[n.DataAtom] || size >= maxWebTextBytes {
+			return false
+		}
+		if !paragraphElements[n.DataAtom] {
+			return true
+		}
+		if text := nodeText(n); text != "" {
+			paragraphs = append(paragraphs, text)
+			size += len(text)
+		}
+		return false
+	})
+	return paragraphs
+}
+
+// walkElements calls visit for each element under n in document order,
+// descending into an element only if visit returns true.
+func walkElements(n *html.Node, visit func(*html.Node) bool) {
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type != html.ElementNode {
+			walkElements(child, visit)
+			continue
+		}
+		if visit(child) {
+			walkElements(child, visit)
+		}
+	}
+}
+
+func nodeText(n *html.Node) string {
+	var text strings.Builder
+	var collect func(*html.Node)
+	collect = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			text.WriteString(n.Data)
+			return
+		}
+		if n.Type == html.ElementNode && n.DataAtom == atom.Br {
+			text.WriteString(" ")
+		}
+		if n.Type == html.ElementNode && skippedElements[n.DataAtom] {
+			return
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			collect(child)
+		}
+	}
+	collect(n)
+	return collapseWhitespace(text.String())
+}
+
+func attribute(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+func collapseWhitespace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// webContent renders page as a block: a link titled after the page, the
+// readable text unless linkOnly, and #tag. Paragraphs are kept on separate
+// lines without blank lines between them, which would split the block.
+func webContent(page *WebPage, tag string, linkOnly bool) string {
+	title := page.Title
+	if title == "" {
+		title = page.URL
+	}
+	title = strings.NewReplacer(`[`, `\[`, `]`, `\]`).Replace(title)
+
+	lines := []string{fmt.Sprintf("[%s](%s)", title, page.URL)}
+	if !linkOnly {
+		for _, paragraph := range page.Text {
+			if paragraph != page.Title {
+				lines = append(lines, paragraph)
+			}
+		}
+	}
+
+	content := strings.Join(lines, "\n")
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "#")
+	if tag != "" && !NewBlock(content).HasTag(tag) {
+		content += "\n#" + tag
+	}
+	return content
+}
+
+// capturedBlock returns the block a page was captured into, or nil. Blocks
+// edited outside notes lose the link from web_sources, so fall back to any
+// block that still contains the URL.
+func capturedBlock(pageURL string) (*Block, error) {
+	source, err := db.GetWebSource(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	if source != nil {
+		block, err := db.GetBlockByHash(source.BlockHash)
+		if err != nil || block != nil {
+			return block, err
+		}
+	}
+
+	blocks, err := db.SearchBlocks([]string{"(" + pageURL + ")"}, nil)
+	if err != nil || len(blocks) == 0 {
+		return nil, err
+	}
+	return blocks[0], nil
+}
+
+func handleWeb() {
+	fs := flag.NewFlagSet("web", flag.ExitOnError)
+	tag := fs.String("tag", DefaultWebTag, "tag to append to the captured block")
+	linkOnly := fs.Bool("link-only", false, "store only the page title and link")
+	args := parseArgs(fs, os.Args[2:])
+
+	if len(args) != 1 {
+		fmt.Println("Error: web command requires a URL")
+		fmt.Println("Usage: notes web [--tag t] [--link-only] <url>")
+		os.Exit(1)
+	}
+
+	pageURL, err := canonicalURL(args[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	existing, err := capturedBlock(pageURL)
+	if err != nil {
+		log.Fatalf("Failed to look up captured page: %v", err)
+	}
+	if existing != nil {
+		if _, err := newMainReconciler().TouchBlocks([]*Block{existing}); err != nil {
+			log.Fatalf("Failed to bump block: %v", err)
+		}
+		fmt.Printf("Already present, marked touched: %s\n", existing.FirstLine())
+		return
+	}
+
+	page, err := FetchWebPage(pageURL)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	block := NewBlock(webContent(page, *tag, *linkOnly))
+	if _, err := newMainReconciler().AddBlocks([]*Block{block}); err != nil {
+		log.Fatalf("Failed to add note: %v", err)
+	}
+	source := &WebSource{URL: pageURL, BlockHash: block.ContentHash, Title: page.Title, FetchedAt: time.Now()}
+	if err := db.SaveWebSource(source); err != nil {
+		log.Fatalf("Failed to record web source: %v", err)
+	}
+
+	fmt.Printf("Captured %s\n", block.FirstLine())
+}
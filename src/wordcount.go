@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// readingWordsPerMinute is the reading speed reading times assume.
+const readingWordsPerMinute = 200
+
+// CountWords returns the number of whitespace-separated words in content,
+// tags included.
+func CountWords(content string) int {
+	return len(strings.Fields(content))
+}
+
+// CountChars returns the number of characters, not bytes, in content.
+func CountChars(content string) int {
+	return utf8.RuneCountInString(content)
+}
+
+// ReadingMinutes returns how long the block takes to read, rounded to whole
+// minutes.
+func (b *Block) ReadingMinutes() int {
+	return readingMinutes(b.Words)
+}
+
+func readingMinutes(words int) int {
+	return (words + readingWordsPerMinute/2) / readingWordsPerMinute
+}
+
+// formatReadingTime describes a reading time of minutes.
+func formatReadingTime(minutes int) string {
+	if minutes < 1 {
+		return "<1 min"
+	}
+	if minutes < 60 {
+		return fmt.Sprintf("%d min", minutes)
+	}
+	return fmt.Sprintf("%dh %02dmin", minutes/60, minutes%60)
+}
+
+// WordRange bounds block word counts for --min-words and --max-words. A
+// zero bound is open.
+type WordRange struct {
+	Min int
+	Max int
+}
+
+// IsZero reports whether the range lets every block through.
+func (r WordRange) IsZero() bool {
+	return r.Min == 0 && r.Max == 0
+}
+
+// Contains reports whether words falls within the range, both bounds
+// inclusive.
+func (r WordRange) Contains(words int) bool {
+	return words >= r.Min && (r.Max == 0 || words <= r.Max)
+}
+
+// wordRangeFlags registers --min-words and --max-words on fs. The returned
+// function checks them once fs has been parsed.
+func wordRangeFlags(fs *flag.FlagSet) func() (WordRange, error) {
+	minWords := fs.Int("min-words", 0, "only blocks with at least this many words")
+	maxWords := fs.Int("max-words", 0, "only blocks with at most this many words")
+	return func() (WordRange, error) {
+		r := WordRange{Min: *minWords, Max: *maxWords}
+		if r.Min < 0 || r.Max < 0 {
+			return r, fmt.Errorf("--min-words and --max-words must not be negative")
+		}
+		if r.Max > 0 && r.Min > r.Max {
+			return r, fmt.Errorf("--min-words must not exceed --max-words")
+		}
+		return r, nil
+	}
+}
+
+// setCounts sets the stored word and character counts, counting the content
+// where they haven't been stored yet.
+func (b *Block) setCounts(words, chars sql.NullInt64) {
+	b.Words, b.Chars = int(words.Int64), int(chars.Int64)
+	if !words.Valid {
+		b.Words = CountWords(b.Content)
+	}
+	if !chars.Valid {
+		b.Chars = CountChars(b.Content)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Worklog entries are ordinary blocks tagged #worklog, with what the
+// timesheet needs kept as metadata so editing the text doesn't lose it.
+const (
+	WorklogTag = "worklog"
+
+	MetaWorklogProject = "project"
+	MetaWorklogMinutes = "minutes"
+	MetaWorklogStarted = "started"
+
+	// DefaultWorkDuration is one pomodoro.
+	DefaultWorkDuration = 25 * time.Minute
+)
+
+// noProject is what the timesheet files entries without a project under.
+const noProject = "(no project)"
+
+// worklogPrefixPattern matches the date, times and project log-work puts
+// before the text of an entry.
+var worklogPrefixPattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}-\d{2}:\d{2} (?:[^\s:]+: )?`)
+
+// WorklogEntry is a block logged with `notes log-work`.
+type WorklogEntry struct {
+	ID      int       `json:"id"`
+	Hash    string    `json:"hash"`
+	Project string    `json:"project"`
+	Started time.Time `json:"started"`
+	Minutes int       `json:"minutes"`
+	Text    string    `json:"text"`
+}
+
+// Timesheet is the time logged between Since and Until, per project and day.
+type Timesheet struct {
+	Since    time.Time     `json:"since"`
+	Until    time.Time     `json:"until"`
+	Minutes  int           `json:"minutes"`
+	Projects []ProjectTime `json:"projects"`
+}
+
+type ProjectTime struct {
+	Project string    `json:"project"`
+	Minutes int       `json:"minutes"`
+	Days    []DayTime `json:"days"`
+}
+
+// DayTime is the time logged on a project on Day, as YYYY-MM-DD.
+type DayTime struct {
+	Day     string         `json:"day"`
+	Minutes int            `json:"minutes"`
+	Entries []WorklogEntry `json:"entries"`
+}
+
+// worklogContent renders the block for work on text that ran from started
+// to ended.
+func worklogContent(text, project string, started, ended time.Time) string {
+	prefix := started.Format("2006-01-02 15:04") + "-" + ended.Format("15:04") + " "
+	if project != "" {
+		prefix += project + ": "
+	}
+	return prefix + text + " #" + WorklogTag
+}
+
+// worklogText returns the text of an entry without the prefix and tag
+// log-work adds.
+func worklogText(content string) string {
+	text := worklogPrefixPattern.ReplaceAllString(NewBlock(content).FirstLine(), "")
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(text), "#"+WorklogTag))
+}
+
+// parseWorkDuration reads a duration such as "25m" or "1h30m", or a bare
+// number of minutes.
+func parseWorkDuration(value string) (time.Duration, error) {
+	if minutes, err := strconv.Atoi(value); err == nil {
+		value = strconv.Itoa(minutes) + "m"
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a duration (try 25m or 1h30m)", value)
+	}
+	if duration < time.Minute {
+		return 0, fmt.Errorf("duration must be at least a minute")
+	}
+	return duration.Round(time.Minute), nil
+}
+
+// LogWork stores a worklog entry for work on text that ended now and took
+// duration.
+func LogWork(reconciler *Reconciler, text, project string, duration time.Duration, now time.Time) (*Block, error) {
+	started := now.Add(-duration)
+	block := NewBlock(worklogContent(text, project, started, now))
+	if _, err := reconciler.AddBlocks([]*Block{block}); err != nil {
+		return nil, err
+	}
+
+	meta := map[string]string{
+		MetaWorklogProject: project,
+		MetaWorklogMinutes: strconv.Itoa(int(duration.Minutes())),
+		MetaWorklogStarted: started.Format(time.RFC3339),
+	}
+	for _, key := range sortedKeys(meta) {
+		if err := reconciler.db.SetBlockMeta(block.ContentHash, key, meta[key]); err != nil {
+			return nil, err
+		}
+	}
+	return block, nil
+}
+
+// GetWorklogEntries returns the worklog entries started within timeRange,
+// oldest first. Blocks tagged #worklog by hand count once they have a
+// minutes value, and are taken to have ended when they were created.
+func GetWorklogEntries(db *Database, timeRange TimeRange) ([]WorklogEntry, error) {
+	var entries []WorklogEntry
+	err := db.IterateBlocks(func(block *Block) error {
+		if !block.HasTag(WorklogTag) {
+			return nil
+		}
+		meta, err := db.GetBlockMeta(block.ContentHash)
+		if err != nil {
+			return err
+		}
+		minutes, err := strconv.Atoi(meta[MetaWorklogMinutes])
+		if err != nil || minutes <= 0 {
+			return nil
+		}
+		started, err := time.Parse(time.RFC3339, meta[MetaWorklogStarted])
+		if err != nil {
+			started = block.CreatedAt.Add(-time.Duration(minutes) * time.Minute)
+		}
+		if !timeRange.Contains(started) {
+			return nil
+		}
+		entries = append(entries, WorklogEntry{
+			ID:      block.ID,
+			Hash:    block.ContentHash,
+			Project: meta[MetaWorklogProject],
+			Started: started,
+			Minutes: minutes,
+			Text:    worklogText(block.Content),
+		})
+		return nil
+	})
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Started.Before(entries[j].Started) })
+	return entries, err
+}
+
+// BuildTimesheet totals entries per project, most time first, and per day
+// within each project.
+func BuildTimesheet(entries []WorklogEntry, timeRange TimeRange) *Timesheet {
+	sheet := &Timesheet{Since: timeRange.Since, Until: timeRange.Until, Projects: []ProjectTime{}}
+	byProject := make(map[string]*ProjectTime)
+	var order []string
+	for _, entry := range entries {
+		name := entry.Project
+		if name == "" {
+			name = noProject
+		}
+		project := byProject[name]
+		if project == nil {
+			project = &ProjectTime{Project: name}
+			byProject[name] = project
+			order = append(order, name)
+		}
+
+		day := entry.Started.Local().Format("2006-01-02")
+		if len(project.Days) == 0 || project.Days[len(project.Days)-1].Day != day {
+			project.Days = append(project.Days, DayTime{Day: day})
+		}
+		last := &project.Days[len(project.Days)-1]
+		last.Minutes += entry.Minutes
+		last.Entries = append(last.Entries, entry)
+		project.Minutes += entry.Minutes
+		sheet.Minutes += entry.Minutes
+	}
+
+	for _, name := range order {
+		sheet.Projects = append(sheet.Projects, *byProject[name])
+	}
+	sort.SliceStable(sheet.Projects, func(i, j int) bool { return sheet.Projects[i].Minutes > sheet.Projects[j].Minutes })
+	return sheet
+}
+
+// formatMinutes writes minutes as hours and minutes, e.g. "1h40m".
+func formatMinutes(minutes int) string {
+	switch {
+	case minutes < 60:
+		return fmt.Sprintf("%dm", minutes)
+	case minutes%60 == 0:
+		return fmt.Sprintf("%dh", minutes/60)
+	default:
+		return fmt.Sprintf("%dh%02dm", minutes/60, minutes%60)
+	}
+}
+
+// printTimesheet writes sheet as a markdown report.
+func printTimesheet(sheet *Timesheet, now time.Time) {
+	until := sheet.Until
+	if until.IsZero() {
+		until = now
+	}
+	heading := "# Timesheet until " + until.Add(-time.Second).Local().Format("2006-01-02")
+	if !sheet.Since.IsZero() {
+		heading = "# Timesheet " + sheet.Since.Local().Format("2006-01-02") + " to " + until.Add(-time.Second).Local().Format("2006-01-02")
+	}
+	fmt.Println(heading)
+	if len(sheet.Projects) == 0 {
+		fmt.Println("\nNo work logged.")
+		return
+	}
+
+	for _, project := range sheet.Projects {
+		fmt.Printf("\n## %s (%s)\n\n", project.Project, formatMinutes(project.Minutes))
+		for _, day := range project.Days {
+			date, _ := time.ParseInLocation("2006-01-02", day.Day, time.Local)
+			texts := make([]string, len(day.Entries))
+			for i, entry := range day.Entries {
+				texts[i] = entry.Text
+			}
+			fmt.Printf("- %s %-6s %s\n", date.Format("Mon 01-02"), formatMinutes(day.Minutes), strings.Join(texts, "; "))
+		}
+	}
+	fmt.Printf("\nTotal: %s\n", formatMinutes(sheet.Minutes))
+}
+
+func handleLogWork() {
+	fs := flag.NewFlagSet("log-work", flag.ExitOnError)
+	project := fs.String("project", "", "project the work was for")
+	durationFlag := fs.String("duration", DefaultWorkDuration.String(), "how long the work took, ending now, e.g. 50m or 1h30m")
+	text := strings.TrimSpace(strings.Join(parseArgs(fs, os.Args[2:]), " "))
+
+	if text == "" {
+		fmt.Println("Error: log-work command requires a description of the work")
+		fmt.Println("Usage: notes log-work [--project atlas] [--duration 25m] <text>")
+		os.Exit(1)
+	}
+	duration, err := parseWorkDuration(*durationFlag)
+	if err != nil {
+		fmt.Printf("Error: --duration: %v\n", err)
+		os.Exit(1)
+	}
+	*project = strings.TrimSpace(*project)
+	if strings.ContainsAny(*project, " \t:") {
+		fmt.Println("Error: --project must be a single word without a colon")
+		os.Exit(1)
+	}
+	if remote != nil {
+		fmt.Println("Error: log-work stores metadata, which the remote server doesn't accept; run it on the server's repository")
+		os.Exit(1)
+	}
+
+	block, err := LogWork(newMainReconciler(), text, *project, duration, time.Now())
+	if err != nil {
+		log.Fatalf("Failed to log work: %v", err)
+	}
+	fmt.Printf("Logged %s: %s\n", formatMinutes(int(duration.Minutes())), block.FirstLine())
+}
+
+func handleTimesheet() {
+	fs := flag.NewFlagSet("timesheet", flag.ExitOnError)
+	week := fs.Bool("week", false, "cover this week, from Monday (the default without --since)")
+	project := fs.String("project", "", "only show this project")
+	jsonOutput := fs.Bool("json", false, "print the timesheet as JSON")
+	parseTimeRange := timeRangeFlags(fs)
+	parseArgs(fs, os.Args[2:])
+
+	now := time.Now()
+	timeRange, err := parseTimeRange(now)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *week && !timeRange.IsZero() {
+		fmt.Println("Error: --week can't be combined with --since or --until")
+		os.Exit(1)
+	}
+	if timeRange.Since.IsZero() && (*week || timeRange.Until.IsZero()) {
+		timeRange.Since = startOfWeek(now)
+		timeRange.Until = timeRange.Since.AddDate(0, 0, 7)
+	}
+
+	entries, err := GetWorklogEntries(db, timeRange)
+	if err != nil {
+		log.Fatalf("Failed to get worklog entries: %v", err)
+	}
+	if *project != "" {
+		var matching []WorklogEntry
+		for _, entry := range entries {
+			if strings.EqualFold(entry.Project, *project) {
+				matching = append(matching, entry)
+			}
+		}
+		entries = matching
+	}
+
+	sheet := BuildTimesheet(entries, timeRange)
+	if *jsonOutput {
+		printJSON(sheet)
+		return
+	}
+	printTimesheet(sheet, now)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// workspaceHeadingPrefix starts the heading of a workspace section, as in
+// "# @work".
+const workspaceHeadingPrefix = "# @"
+
+func (l *Layout) hasWorkspaces() bool {
+	return l != nil && len(l.Workspaces) > 0
+}
+
+func (l *Layout) validateWorkspaces() error {
+	for i, tag := range l.Workspaces {
+		if !isValidTag(tag) {
+			return fmt.Errorf("workspaces: %q is not a valid tag", tag)
+		}
+		for _, other := range l.Workspaces[:i] {
+			if other == tag || strings.HasPrefix(tag, other+"/") || strings.HasPrefix(other, tag+"/") {
+				return fmt.Errorf("workspaces: %q and %q overlap", other, tag)
+			}
+		}
+	}
+	return nil
+}
+
+// workspaceOf returns the first workspace whose tag, or a tag nested under
+// it, block carries, or "" for none.
+func (l *Layout) workspaceOf(block *Block) string {
+	if !l.hasWorkspaces() {
+		return ""
+	}
+	for _, tag := range l.Workspaces {
+		if hasTagOrChild(block, tag) {
+			return tag
+		}
+	}
+	return ""
+}
+
+// workspaceGroup is a run of blocks written under one workspace heading, or
+// under none for the blocks before the first.
+type workspaceGroup struct {
+	workspace string
+	blocks    []*Block
+}
+
+// groupByWorkspace splits ordered blocks into the blocks without a
+// workspace, followed by one group for each workspace in the configured
+// order, empty or not, so every heading is there to write under.
+func (l *Layout) groupByWorkspace(blocks []*Block) []workspaceGroup {
+	if !l.hasWorkspaces() {
+		return []workspaceGroup{{blocks: blocks}}
+	}
+
+	groups := []workspaceGroup{{}}
+	index := map[string]int{"": 0}
+	for _, tag := range l.Workspaces {
+		index[tag] = len(groups)
+		groups = append(groups, workspaceGroup{workspace: tag})
+	}
+	for _, block := range blocks {
+		i := index[l.workspaceOf(block)]
+		groups[i].blocks = append(groups[i].blocks, block)
+	}
+	return groups
+}
+
+// workspaceHeading returns the workspace a heading line opens, if it is one
+// of the layout's workspace headings.
+func (l *Layout) workspaceHeading(line string) (string, bool) {
+	if !l.hasWorkspaces() {
+		return "", false
+	}
+	tag, ok := strings.CutPrefix(strings.TrimSpace(line), workspaceHeadingPrefix)
+	return tag, ok && slices.Contains(l.Workspaces, tag)
+}
+
+// sectionBlocks drops the workspace headings from blocks parsed from a
+// file. With assign, blocks under a heading are moved into its workspace:
+// the tags of other workspaces are renamed to its tag, which is added if
+// missing. Blocks before the first heading are left alone.
+func (l *Layout) sectionBlocks(blocks []*Block, assign bool) []*Block {
+	if !l.hasWorkspaces() {
+		return blocks
+	}
+
+	var result []*Block
+	workspace := ""
+	for _, block := range blocks {
+		// A heading without a blank line after it starts the block below
+		if tag, ok := l.workspaceHeading(block.FirstLine()); ok {
+			workspace = tag
+			_, rest, _ := strings.Cut(block.Content, "\n")
+			if block = NewBlock(rest); block.IsEmpty() {
+				continue
+			}
+		}
+
+		if assign && workspace != "" && l.workspaceOf(block) != workspace {
+			content := block.Content
+			for _, other := range l.Workspaces {
+				if other != workspace {
+					content = renameTag(content, other, workspace)
+				}
+			}
+			if !hasTagOrChild(&Block{Content: content}, workspace) {
+				content += "\n#" + workspace
+			}
+			block = NewBlock(content)
+		}
+		result = append(result, block)
+	}
+	return result
+}